@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/timskillet/go-share/internal/file"
+	"github.com/timskillet/go-share/internal/tracker"
+)
+
+var (
+	announceOnly    bool
+	announceAddress string
+	announcePort    int
+)
+
+// unannounceCmd represents the unannounce command
+var unannounceCmd = &cobra.Command{
+	Use:   "unannounce [file|manifest|file-hash]",
+	Short: "Remove a peer's registration for a file from the tracker",
+	Long: `Tell the tracker that the peer at --address and --port no longer serves a file.
+This undoes "upload --announce-only", for example when externally hosted content
+is taken down.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := withOptionalTimeout(context.Background(), timeout)
+		defer cancel()
+
+		req, err := announceRequestFor(args[0])
+		if err != nil {
+			return err
+		}
+		client := tracker.NewTrackerClient(trackerURL, trackerTimeout)
+		if err := client.Unannounce(ctx, req); err != nil {
+			return fmt.Errorf("error unannouncing file: %v", describeTimeout(err, "unannouncing the file"))
+		}
+
+		fmt.Printf("Unannounced %s at %s:%d\n", req.FileHash, req.Address, req.Port)
+		return nil
+	},
+}
+
+// runAnnounceOnly registers the peer at --address and --port as serving the file
+// named by arg, without creating a manifest or starting a file server.
+func runAnnounceOnly(ctx context.Context, arg string) error {
+	req, err := announceRequestFor(arg)
+	if err != nil {
+		return err
+	}
+	client := tracker.NewTrackerClient(trackerURL, trackerTimeout)
+	if err := client.Announce(ctx, req); err != nil {
+		return fmt.Errorf("error announcing file: %v", describeTimeout(err, "announcing the file"))
+	}
+
+	fmt.Printf("Announced %s at %s:%d\n", req.FileHash, req.Address, req.Port)
+	fmt.Println("Remove the registration with: go-share unannounce", req.FileHash)
+	return nil
+}
+
+// announceRequestFor builds the tracker registration for the file named by arg
+// at --address and --port.
+func announceRequestFor(arg string) (tracker.AnnounceRequest, error) {
+	if announcePort < 1 || announcePort > 65535 {
+		return tracker.AnnounceRequest{}, fmt.Errorf("invalid --port %d", announcePort)
+	}
+	fileHash, err := resolveFileHash(arg)
+	if err != nil {
+		return tracker.AnnounceRequest{}, err
+	}
+	return tracker.AnnounceRequest{
+		FileHash: fileHash,
+		Address:  announceAddress,
+		Port:     announcePort,
+	}, nil
+}
+
+// resolveFileHash returns the file hash named by arg, which may be a manifest,
+// a file to hash, or a file hash.
+func resolveFileHash(arg string) (string, error) {
+	if _, err := os.Stat(arg); err != nil && isFileHash(arg) {
+		return arg, nil
+	}
+
+	if strings.HasSuffix(arg, ".manifest") || strings.HasSuffix(arg, ".manifest.gz") {
+		manifest, err := file.LoadManifestLimit(arg, maxManifestSize)
+		if err != nil {
+			return "", fmt.Errorf("error loading manifest: %v", err)
+		}
+		return manifest.FileHash, nil
+	}
+
+	f, err := os.Open(arg)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("error hashing file: %v", err)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+func init() {
+	uploadCmd.Flags().BoolVar(&announceOnly, "announce-only", false, "Only register --address and --port with the tracker and exit, without serving the file (the argument may also be a manifest or file hash)")
+	uploadCmd.Flags().StringVar(&announceAddress, "address", "localhost", "Address to register with the tracker (with --announce-only)")
+	uploadCmd.Flags().IntVar(&announcePort, "port", 9000, "Port to register with the tracker (with --announce-only)")
+	unannounceCmd.Flags().StringVar(&announceAddress, "address", "localhost", "Address of the peer to remove")
+	unannounceCmd.Flags().IntVar(&announcePort, "port", 9000, "Port of the peer to remove")
+	unannounceCmd.Flags().DurationVar(&timeout, "timeout", 0, "Abort if unannouncing takes longer than this (0 means no timeout)")
+
+	rootCmd.AddCommand(unannounceCmd)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/timskillet/go-share/pkg/goshare"
+)
+
+// compressCmd represents the compress command
+var compressCmd = &cobra.Command{
+	Use:   "compress [file]",
+	Short: "Gzip-compress a file to seed it compressed on disk",
+	Long: `Compress a file into a .gz file next to it, which upload --gzipped then seeds
+while it stays compressed on disk, serving downloaders the original content.
+Each chunk of --chunk-size bytes is compressed as its own gzip member, so that
+the seeder can decompress any chunk on its own; upload it with the same
+--chunk-size. The result is an ordinary gzip file, and the original can be
+deleted once it has been uploaded.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		gzPath, err := goshare.CompressGzip(context.Background(), args[0], chunkSize)
+		if err != nil {
+			if errors.Is(err, goshare.ErrFileExists) {
+				return fmt.Errorf("error compressing file: %v\nUpload it with --gzipped, or remove it to compress the file again", err)
+			}
+			return fmt.Errorf("error compressing file: %v", err)
+		}
+		fmt.Printf("Compressed %s to %s\n", args[0], gzPath)
+		fmt.Printf("Seed it with: go-share upload --gzipped --chunk-size %d %s\n", chunkSize, gzPath)
+		return nil
+	},
+}
+
+func init() {
+	compressCmd.Flags().Var((*byteSize)(&chunkSize), "chunk-size", "Chunk size in bytes the file will be shared with, optionally with a K, M, or G suffix")
+
+	rootCmd.AddCommand(compressCmd)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/timskillet/go-share/internal/file"
+)
+
+var diffJSON bool
+
+// diffCmd represents the diff command
+var diffCmd = &cobra.Command{
+	Use:   "diff [old-manifest] [new-manifest]",
+	Short: "Show how many chunks changed between two manifests",
+	Long: `Compare two manifests of a file and report how many chunks of the new version
+are identical to chunks of the old one and how many changed. This shows how much
+"go-share update" would have to download to turn the old file into the new one.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		older, err := file.LoadManifestLimit(args[0], maxManifestSize)
+		if err != nil {
+			return fmt.Errorf("error loading manifest: %v", err)
+		}
+		newer, err := file.LoadManifestLimit(args[1], maxManifestSize)
+		if err != nil {
+			return fmt.Errorf("error loading manifest: %v", err)
+		}
+		if older.Chunking != newer.Chunking || older.ChunkSize != newer.ChunkSize {
+			fmt.Fprintln(os.Stderr, "Warning: the manifests use different chunking, so few chunks can match")
+		}
+
+		diff := file.DiffManifests(older, newer)
+		if diffJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(diff)
+		}
+
+		fmt.Printf("Chunks:    %d -> %d\n", diff.OldChunks, diff.NewChunks)
+		fmt.Printf("Unchanged: %d (%.1f%%), %d at the same position\n", diff.Reused, diff.ReusedPercent(), diff.SamePosition)
+		fmt.Printf("Changed:   %d (%.1f%%)\n", diff.Changed, 100-diff.ReusedPercent())
+		fmt.Printf("Bytes:     %s reused, %s to download\n", formatBytes(diff.ReusedBytes), formatBytes(diff.ChangedBytes))
+		fmt.Printf("Size:      %d -> %d bytes (%+d)\n", older.FileSize, newer.FileSize, diff.SizeDelta)
+		return nil
+	},
+}
+
+func init() {
+	diffCmd.Flags().BoolVar(&diffJSON, "json", false, "Print the comparison as JSON")
+
+	rootCmd.AddCommand(diffCmd)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/timskillet/go-share/internal/file"
+	"github.com/timskillet/go-share/internal/tracker"
+	"github.com/timskillet/go-share/pkg/goshare"
+)
+
+var doctorProbes []string
+
+// checkStatus is the outcome of one doctor check.
+type checkStatus string
+
+const (
+	checkPass checkStatus = "PASS"
+	checkFail checkStatus = "FAIL"
+	checkSkip checkStatus = "SKIP"
+)
+
+// checkResult is the outcome of one doctor check, with a hint on how to fix
+// it if it failed.
+type checkResult struct {
+	name   string
+	status checkStatus
+	detail string
+	hint   string
+}
+
+// doctorCmd represents the doctor command
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check that this machine can share and download files",
+	Long: `Run a few self-tests that catch the usual reasons sharing or downloading fails,
+and print what passed, what failed, and how to fix it:
+
+  - the tracker (--tracker) answers its health check
+  - the seeder port is free for upload to listen on
+  - outgoing TCP connections get through, to each --probe address or else the
+    tracker's host if it isn't on this machine
+  - the downloads directory (--output, or the download default) is writable
+
+Passing doesn't prove peers elsewhere can connect to this machine: a router or
+firewall may still need the seeder port opened. The command fails if any check
+does.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		if dialTimeout == 0 {
+			// TCPTransport takes a negative timeout to mean no limit
+			dialTimeout = -1
+		}
+		transport := goshare.TCPTransport{DialTimeout: dialTimeout}
+		probes := doctorProbes
+		if len(probes) == 0 {
+			probes = trackerProbe(trackerURL)
+		}
+		downloadsDir := outputDir
+		if downloadsDir == "" {
+			downloadsDir = defaultDownloadsDir()
+		}
+
+		results := []checkResult{
+			checkTracker(ctx, trackerURL, trackerTimeout),
+			checkSeederPort(transport, goshare.DefaultSeederPort),
+			checkOutbound(ctx, transport, probes),
+			checkDownloadsDir(downloadsDir),
+		}
+
+		failed := 0
+		for _, r := range results {
+			fmt.Printf("[%s] %s: %s\n", r.status, r.name, r.detail)
+			if r.hint != "" {
+				fmt.Printf("       %s\n", r.hint)
+			}
+			if r.status == checkFail {
+				failed++
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d checks failed", failed, len(results))
+		}
+		fmt.Println("All checks passed")
+		return nil
+	},
+}
+
+// checkTracker checks that the tracker at trackerURL answers its health
+// check within timeout.
+func checkTracker(ctx context.Context, trackerURL string, timeout time.Duration) checkResult {
+	r := checkResult{name: "Tracker"}
+	if trackerURL == "" {
+		r.status = checkSkip
+		r.detail = `no tracker is used with --tracker ""`
+		r.hint = "Peers must then be found with --lan or given with download --peer"
+		return r
+	}
+	u, err := url.Parse(trackerURL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		r.status = checkFail
+		r.detail = fmt.Sprintf("%q is not a tracker URL", trackerURL)
+		r.hint = "Pass the tracker as --tracker http://HOST:PORT"
+		return r
+	}
+
+	health, err := tracker.NewTrackerClient(trackerURL, timeout).Health(ctx)
+	if err == nil {
+		r.status = checkPass
+		r.detail = fmt.Sprintf("%s is up, tracking %d files from %d peers", trackerURL, health.Files, health.Peers)
+		return r
+	}
+	r.status = checkFail
+	r.detail = fmt.Sprintf("%s: %v", trackerURL, err)
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		r.hint = fmt.Sprintf("The host name %s can't be resolved; check the --tracker URL and your DNS settings", u.Hostname())
+	case errors.Is(err, syscall.ECONNREFUSED):
+		r.hint = fmt.Sprintf("Nothing is listening at %s; start the tracker there, or pass the right --tracker URL", u.Host)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		r.hint = "The tracker didn't answer within --tracker-timeout; a firewall may be dropping traffic to its port"
+	case errors.As(err, &netErr):
+		r.hint = "The tracker couldn't be reached; check the --tracker URL and your network connection"
+	default:
+		r.hint = "A server answered, but not as a go-share tracker; check the --tracker URL and that the tracker is up to date"
+	}
+	return r
+}
+
+// checkSeederPort checks that upload could listen on port, by briefly
+// listening on it.
+func checkSeederPort(t goshare.Transport, port int) checkResult {
+	r := checkResult{name: "Seeder port"}
+	ln, err := t.Listen(":" + strconv.Itoa(port))
+	if err == nil {
+		ln.Close()
+		r.status = checkPass
+		r.detail = fmt.Sprintf("port %d is free for upload to listen on", port)
+		r.hint = "Peers on other networks may still need the port forwarded or opened in a firewall"
+		return r
+	}
+	r.status = checkFail
+	r.detail = fmt.Sprintf("can't listen on port %d: %v", port, err)
+	switch {
+	case errors.Is(err, syscall.EADDRINUSE):
+		r.hint = "Another program is using the port, perhaps a go-share upload or resume-seed already running; stop it before seeding"
+	case errors.Is(err, os.ErrPermission):
+		r.hint = "This user isn't allowed to listen on the port; check your firewall or security policy"
+	default:
+		r.hint = "Seeding will fail until the port can be listened on"
+	}
+	return r
+}
+
+// trackerProbe returns the tracker's host and port as the address to test
+// outgoing connections with, or nothing if the tracker is on this machine,
+// which wouldn't show whether connections leave it.
+func trackerProbe(trackerURL string) []string {
+	u, err := url.Parse(trackerURL)
+	if err != nil || u.Hostname() == "" {
+		return nil
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return []string{net.JoinHostPort(host, port)}
+}
+
+// checkOutbound checks that TCP connections can be opened to each of addrs.
+func checkOutbound(ctx context.Context, t goshare.Transport, addrs []string) checkResult {
+	r := checkResult{name: "Outbound connections"}
+	if len(addrs) == 0 {
+		r.status = checkSkip
+		r.detail = "no remote address to test, as the tracker is on this machine or not used"
+		r.hint = "Pass --probe HOST:PORT, e.g. a peer's address, to test one"
+		return r
+	}
+
+	for _, addr := range addrs {
+		conn, err := t.Dial(ctx, addr)
+		if err != nil {
+			r.status = checkFail
+			r.detail = fmt.Sprintf("can't connect to %s: %v", addr, err)
+			var dnsErr *net.DNSError
+			var netErr net.Error
+			switch {
+			case errors.As(err, &dnsErr):
+				r.hint = "The host name can't be resolved; check your DNS settings and network connection"
+			case errors.Is(err, syscall.ECONNREFUSED):
+				r.hint = "The host was reached, but nothing is listening on that port"
+			case errors.As(err, &netErr) && netErr.Timeout():
+				r.hint = "Connections time out; a firewall or proxy may be blocking outgoing TCP connections"
+			default:
+				r.hint = "Check your network connection and any firewall blocking outgoing TCP connections"
+			}
+			return r
+		}
+		conn.Close()
+	}
+	r.status = checkPass
+	r.detail = fmt.Sprintf("connected to %s", strings.Join(addrs, ", "))
+	return r
+}
+
+// checkDownloadsDir checks that downloads can be saved in dir, creating it as
+// download does and writing a scratch file to it.
+func checkDownloadsDir(dir string) checkResult {
+	r := checkResult{name: "Downloads directory"}
+	r.status = checkFail
+	r.hint = "Fix the directory's permissions, or save downloads elsewhere with download --output DIR"
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		r.detail = fmt.Sprintf("can't create %s: %v", dir, err)
+		return r
+	}
+	f, err := os.CreateTemp(dir, ".go-share-doctor-*")
+	if err != nil {
+		r.detail = fmt.Sprintf("can't write to %s: %v", dir, err)
+		return r
+	}
+	_, err = f.Write([]byte("go-share doctor\n"))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	os.Remove(f.Name())
+	if err != nil {
+		r.detail = fmt.Sprintf("can't write to %s: %v", dir, err)
+		return r
+	}
+
+	r.status = checkPass
+	r.hint = ""
+	r.detail = fmt.Sprintf("%s is writable", dir)
+	if abs, err := filepath.Abs(dir); err == nil {
+		r.detail = fmt.Sprintf("%s is writable", abs)
+	}
+	if free, err := file.FreeSpace(dir); err == nil {
+		r.detail += fmt.Sprintf(", %s free", formatBytes(free))
+	}
+	return r
+}
+
+func init() {
+	doctorCmd.Flags().StringVarP(&outputDir, "output", "o", "", "Downloads directory to check (default: as for download)")
+	doctorCmd.Flags().StringArrayVar(&doctorProbes, "probe", nil, "Test outgoing connections to this HOST:PORT, e.g. a peer (repeatable; default: the tracker's host unless it is on this machine)")
+	doctorCmd.Flags().DurationVar(&dialTimeout, "dial-timeout", goshare.DefaultDialTimeout, "Give up connecting to a --probe address after this long (0 waits as long as the operating system does)")
+
+	rootCmd.AddCommand(doctorCmd)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/timskillet/go-share/internal/tracker"
+	"github.com/timskillet/go-share/pkg/goshare"
+)
+
+// closedAddr returns the address of a TCP port nothing listens on.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// listening returns the address of a TCP listener open until the test ends.
+func listening(t *testing.T) (net.Listener, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return ln, ln.Addr().String()
+}
+
+func TestCheckTracker(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(tracker.NewTracker().Handler())
+	t.Cleanup(srv.Close)
+	notTracker := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(notTracker.Close)
+
+	for _, tc := range []struct {
+		name   string
+		url    string
+		status checkStatus
+		hint   string
+	}{
+		{"up", srv.URL, checkPass, ""},
+		{"not used", "", checkSkip, "--lan"},
+		{"not a URL", "localhost:8080", checkFail, "--tracker http://HOST:PORT"},
+		{"refused", "http://" + closedAddr(t), checkFail, "Nothing is listening"},
+		{"not a tracker", notTracker.URL, checkFail, "not as a go-share tracker"},
+	} {
+		r := checkTracker(ctx, tc.url, time.Second)
+		if r.status != tc.status || !strings.Contains(r.hint, tc.hint) {
+			t.Errorf("%s: %s, %q, want %s with a hint about %q", tc.name, r.status, r.hint, tc.status, tc.hint)
+		}
+	}
+
+	// A tracker that never answers times out
+	r := checkTracker(ctx, hungTracker(t), 100*time.Millisecond)
+	if r.status != checkFail || !strings.Contains(r.hint, "--tracker-timeout") {
+		t.Errorf("hung tracker: %s, %q, want a failure blaming the timeout", r.status, r.hint)
+	}
+}
+
+func TestCheckSeederPort(t *testing.T) {
+	ln, _ := listening(t)
+	port := ln.Addr().(*net.TCPAddr).Port
+	r := checkSeederPort(goshare.TCPTransport{}, port)
+	if r.status != checkFail || !strings.Contains(r.hint, "Another program is using the port") {
+		t.Fatalf("busy port: %s, %q, want a failure", r.status, r.hint)
+	}
+	ln.Close()
+	if r := checkSeederPort(goshare.TCPTransport{}, port); r.status != checkPass {
+		t.Fatalf("free port: %s, %s", r.status, r.detail)
+	}
+}
+
+func TestTrackerProbe(t *testing.T) {
+	for _, tc := range []struct {
+		url  string
+		want []string
+	}{
+		{"http://tracker.example:8080", []string{"tracker.example:8080"}},
+		{"http://tracker.example", []string{"tracker.example:80"}},
+		{"https://tracker.example", []string{"tracker.example:443"}},
+		{"http://[2001:db8::1]:8080", []string{"[2001:db8::1]:8080"}},
+		{"http://localhost:8080", nil},
+		{"http://127.0.0.1:8080", nil},
+		{"http://[::1]:8080", nil},
+		{"", nil},
+	} {
+		if got := trackerProbe(tc.url); !slices.Equal(got, tc.want) {
+			t.Errorf("trackerProbe(%q) = %v, want %v", tc.url, got, tc.want)
+		}
+	}
+}
+
+func TestCheckOutbound(t *testing.T) {
+	ctx := context.Background()
+	tr := goshare.TCPTransport{DialTimeout: time.Second}
+	_, open := listening(t)
+
+	if r := checkOutbound(ctx, tr, nil); r.status != checkSkip {
+		t.Errorf("no address: %s, want %s", r.status, checkSkip)
+	}
+	if r := checkOutbound(ctx, tr, []string{open}); r.status != checkPass {
+		t.Errorf("listening address: %s, %s", r.status, r.detail)
+	}
+	r := checkOutbound(ctx, tr, []string{open, closedAddr(t)})
+	if r.status != checkFail || !strings.Contains(r.hint, "nothing is listening") {
+		t.Errorf("closed address: %s, %q, want a failure", r.status, r.hint)
+	}
+}
+
+func TestCheckDownloadsDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "new", "downloads")
+	r := checkDownloadsDir(dir)
+	if r.status != checkPass || !strings.Contains(r.detail, "free") {
+		t.Fatalf("new directory: %s, %s", r.status, r.detail)
+	}
+	// The scratch file is removed again
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Fatalf("check left %v, %v in the directory", entries, err)
+	}
+
+	// A directory can't be created inside a file
+	notDir := writeFile(t, "file", "not a directory")
+	r = checkDownloadsDir(filepath.Join(notDir, "downloads"))
+	if r.status != checkFail || !strings.Contains(r.hint, "--output") {
+		t.Fatalf("directory inside a file: %s, %q, want a failure", r.status, r.hint)
+	}
+}
+
+func TestDoctorCommand(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	srv := httptest.NewServer(tracker.NewTracker().Handler())
+	t.Cleanup(srv.Close)
+	_, probe := listening(t)
+
+	if err := runCLI(t, "doctor", "--tracker", srv.URL, "--probe", probe, "--output", t.TempDir()); err != nil {
+		t.Fatalf("doctor failed with every check passing: %v", err)
+	}
+	resetFlags()
+
+	// Nothing listens at the tracker's address, and the seeder port is busy
+	ln, err := net.Listen("tcp", ":"+strconv.Itoa(goshare.DefaultSeederPort))
+	if err != nil {
+		t.Skipf("seeder port unavailable: %v", err)
+	}
+	defer ln.Close()
+	err = runCLI(t, "doctor", "--tracker", "http://"+closedAddr(t), "--output", t.TempDir())
+	if err == nil || !strings.Contains(err.Error(), "2 of 4 checks failed") {
+		t.Fatalf("doctor returned %v, want 2 of 4 checks failed", err)
+	}
+}
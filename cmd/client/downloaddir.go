@@ -0,0 +1,22 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// defaultDownloadsDir returns where downloads are saved unless --output says
+// otherwise: a go-share directory inside the user's download directory, which
+// is $XDG_DOWNLOAD_DIR if it is set to an absolute path (relative values are
+// ignored, as the XDG spec requires) and ~/Downloads otherwise. Without a
+// known home directory it falls back to downloads in the current directory.
+func defaultDownloadsDir() string {
+	if dir := os.Getenv("XDG_DOWNLOAD_DIR"); filepath.IsAbs(dir) {
+		return filepath.Join(dir, "go-share")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "downloads"
+	}
+	return filepath.Join(home, "Downloads", "go-share")
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/timskillet/go-share/pkg/goshare"
+)
+
+func TestDefaultDownloadsDir(t *testing.T) {
+	home := t.TempDir()
+	xdg := t.TempDir()
+	for _, tc := range []struct {
+		xdg  string
+		want string
+	}{
+		{xdg, filepath.Join(xdg, "go-share")},
+		{"", filepath.Join(home, "Downloads", "go-share")},
+		{"relative/dir", filepath.Join(home, "Downloads", "go-share")}, // Ignored, as the spec requires
+	} {
+		t.Setenv("HOME", home)
+		t.Setenv("XDG_DOWNLOAD_DIR", tc.xdg)
+		if got := defaultDownloadsDir(); got != tc.want {
+			t.Errorf("with XDG_DOWNLOAD_DIR %q, downloads go to %s, want %s", tc.xdg, got, tc.want)
+		}
+	}
+
+	t.Setenv("XDG_DOWNLOAD_DIR", "")
+	t.Setenv("HOME", "")
+	if got := defaultDownloadsDir(); got != "downloads" {
+		t.Errorf("without a home directory, downloads go to %s, want downloads", got)
+	}
+}
+
+func TestDownloadToDefaultDir(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	xdg := t.TempDir()
+	t.Setenv("XDG_DOWNLOAD_DIR", xdg)
+	content := strings.Repeat("saved where downloads go ", 200)
+	path := writeFile(t, "default.txt", content)
+	manifest, err := goshare.Upload(context.Background(), path, goshare.UploadOptions{ChunkSize: 1 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeder := goshare.NewSeeder(path, manifest, goshare.SeederOptions{})
+	if err := seeder.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer seeder.Close()
+
+	peerAddr := "localhost:" + strconv.Itoa(goshare.DefaultSeederPort)
+	if err := runCLI(t, "download", goshare.ManifestPath(path, false), "--peer", peerAddr, "--tracker", hungTracker(t), "--timeout", "10s"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(filepath.Join(xdg, "go-share", "default.txt")); err != nil || string(got) != content {
+		t.Fatalf("download wasn't saved in the XDG download directory: %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/timskillet/go-share/pkg/goshare"
+)
+
+var (
+	estimateSample    int
+	estimateParallel  int
+	estimateBandwidth byteSize
+)
+
+// estimateCmd represents the estimate command
+var estimateCmd = &cobra.Command{
+	Use:   "estimate [manifest|file-hash]",
+	Short: "Estimate how long downloading a file would take",
+	Long: `Estimate how long downloading a file would take before committing to it. Every
+peer the tracker knows is pinged and timed while serving a random sample of
+--sample chunks, and the fastest of them are assumed to share the download as
+download --max-parallel would. --bandwidth caps the estimated rate, e.g. at the
+speed of your link.
+
+The estimate is rough: it is based on a few chunks per peer at one moment, and
+peers that get busier, or other traffic on your link, make the download slower.
+Peers serving chunks that don't match the manifest aren't counted on.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		ctx, cancel := withOptionalTimeout(ctx, timeout)
+		defer cancel()
+
+		manifest, err := loadManifestArg(ctx, args[0])
+		if err != nil {
+			return fmt.Errorf("error loading manifest: %v", err)
+		}
+		hashKey, err := loadHashKey(hashKeyName)
+		if err != nil {
+			return err
+		}
+		if manifest.IsKeyed() && hashKey == nil {
+			return fmt.Errorf("%s uses keyed hashing; pass its group key with --hash-key (fingerprint %s)", manifest.FileName, manifest.KeyFingerprint)
+		}
+		if len(manifest.Chunks) == 0 {
+			fmt.Println("The file is empty; there is nothing to download")
+			return nil
+		}
+		peers, err := lookupPeers(ctx, manifest)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Timing %d peers with up to %d chunks each...\n", len(peers), estimateSample)
+		estimate, speeds, err := goshare.EstimateDownload(ctx, manifest, peers, goshare.EstimateOptions{
+			Sample:      estimateSample,
+			MaxParallel: estimateParallel,
+			Bandwidth:   int64(estimateBandwidth),
+			HashKey:     hashKey,
+		})
+		for _, s := range speeds {
+			addr := fmt.Sprintf("%s:%d", s.Peer.Address, s.Peer.Port)
+			if s.Peer.URL != "" {
+				addr = s.Peer.URL
+			}
+			if s.Err != nil {
+				fmt.Printf("  %s: %v\n", addr, s.Err)
+				continue
+			}
+			fmt.Printf("  %s: %s ping, %s/s\n", addr, s.RTT.Round(time.Microsecond), formatBytes(int64(s.Throughput())))
+		}
+		if err != nil {
+			return fmt.Errorf("error estimating download: %v", err)
+		}
+
+		fmt.Printf("%s in %d chunks\n", formatBytes(manifest.FileSize), len(manifest.Chunks))
+		limit := ""
+		if estimate.Limited {
+			limit = ", limited by --bandwidth"
+		}
+		fmt.Printf("Estimated download time: %s at %s/s from %d peers%s\n",
+			roundDuration(estimate.Duration), formatBytes(int64(estimate.Rate)), estimate.Peers, limit)
+		fmt.Println("This is a rough estimate from a small sample; busier peers or a shared link will make it slower.")
+		return nil
+	},
+}
+
+// roundDuration rounds d for display: to the millisecond under a second, and
+// to a tenth of a second above.
+func roundDuration(d time.Duration) time.Duration {
+	if d < time.Second {
+		return d.Round(time.Millisecond)
+	}
+	return d.Round(time.Second / 10)
+}
+
+func init() {
+	estimateCmd.Flags().IntVar(&estimateSample, "sample", goshare.DefaultEstimateSample, "How many random chunks to time from each peer")
+	estimateCmd.Flags().IntVar(&estimateParallel, "max-parallel", 0, "Number of chunks the download would fetch concurrently (default: as for download)")
+	estimateCmd.Flags().Var(&estimateBandwidth, "bandwidth", "Cap the estimated rate at this many bytes per second, e.g. 10M (default: no cap)")
+	estimateCmd.Flags().StringVar(&hashKeyName, "hash-key", "", "Symmetric key (name in the key directory, or path) of a file shared with --hash-key")
+	estimateCmd.Flags().StringVar(&accessToken, "access-token", "", "Token of a file its seeders keep private (default: the one recorded in the manifest, if any)")
+	estimateCmd.Flags().DurationVar(&timeout, "timeout", 0, "Abort if estimating takes longer than this (0 means no timeout)")
+
+	rootCmd.AddCommand(estimateCmd)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/timskillet/go-share/pkg/goshare"
+)
+
+var eventsOut string
+
+// openEvents returns an event bus whose events are written as JSON Lines, one
+// object per event, to the destination given with --events: "fd:N" for an
+// inherited file descriptor, "-" for standard output, or else a file path,
+// which is appended to. It returns a nil bus if --events isn't set. The
+// returned function stops writing and closes the destination.
+func openEvents() (*goshare.EventBus, func(), error) {
+	if eventsOut == "" {
+		return nil, func() {}, nil
+	}
+	w, err := openEventsWriter(eventsOut)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening --events %s: %v", eventsOut, err)
+	}
+
+	bus := goshare.NewEventBus()
+	enc := json.NewEncoder(w)
+	failed := false
+	unsubscribe := bus.Subscribe(func(e goshare.Event) {
+		if err := enc.Encode(e); err != nil && !failed {
+			// Keep going without events rather than failing the transfer
+			failed = true
+			fmt.Fprintf(os.Stderr, "Warning: writing events failed: %v\n", err)
+		}
+	})
+	return bus, func() {
+		unsubscribe()
+		w.Close()
+	}, nil
+}
+
+// openEventsWriter opens the destination of --events.
+func openEventsWriter(spec string) (io.WriteCloser, error) {
+	if spec == "-" {
+		return nopCloser{os.Stdout}, nil
+	}
+	if fdStr, ok := strings.CutPrefix(spec, "fd:"); ok {
+		fd, err := strconv.Atoi(fdStr)
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("invalid file descriptor %q", fdStr)
+		}
+		f := os.NewFile(uintptr(fd), spec)
+		if f == nil {
+			return nil, fmt.Errorf("invalid file descriptor %d", fd)
+		}
+		return f, nil
+	}
+	return os.OpenFile(spec, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+}
+
+// nopCloser is a WriteCloser whose Close does nothing, for standard output.
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+func init() {
+	const usage = `Write a JSON Lines stream of events (peer_connected, chunk_served, chunk_downloaded, error, complete) to this file, "fd:N" for an open file descriptor, or "-" for stdout`
+	uploadCmd.Flags().StringVar(&eventsOut, "events", "", usage)
+	downloadCmd.Flags().StringVar(&eventsOut, "events", "", usage)
+}
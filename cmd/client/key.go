@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/timskillet/go-share/internal/keys"
+)
+
+var (
+	keyDir  string
+	keyType string
+)
+
+// keyCmd represents the key command
+var keyCmd = &cobra.Command{
+	Use:   "key",
+	Short: "Generate and inspect keys for signing and encrypting files",
+	Long: `Manage the keys used to sign manifests and encrypt chunks. Keys are stored as
+files readable only by their owner in the key directory (--key-dir), and are
+referred to by name, so raw key bytes never have to be pasted on the command line.`,
+}
+
+// keyGenerateCmd represents the key generate command
+var keyGenerateCmd = &cobra.Command{
+	Use:   "generate [name]",
+	Short: "Generate a new key",
+	Long: `Generate a new key and store it as <name>.key in the key directory.
+--type ed25519 creates a keypair for signing, and --type symmetric a 256-bit
+secret for encryption. Existing keys are never overwritten.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dir, err := resolveKeyDir()
+		if err != nil {
+			return err
+		}
+		path, err := keys.Generate(dir, args[0], keyType)
+		if err != nil {
+			return fmt.Errorf("error generating key: %v", err)
+		}
+		key, err := keys.Load(path)
+		if err != nil {
+			return fmt.Errorf("error loading key: %v", err)
+		}
+
+		fmt.Printf("Generated %s key %s\n", key.Kind, path)
+		printKey(key)
+		return nil
+	},
+}
+
+// keyShowCmd represents the key show command
+var keyShowCmd = &cobra.Command{
+	Use:   "show [name|path]",
+	Short: "Show a key's public key and fingerprint",
+	Long: `Print the public key and fingerprint of a key, given its name in the key
+directory or the path of a key file. The secret part of a key is never printed.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dir, err := resolveKeyDir()
+		if err != nil {
+			return err
+		}
+		path := keys.Resolve(dir, args[0])
+		key, err := keys.Load(path)
+		if err != nil {
+			return fmt.Errorf("error loading key: %v", err)
+		}
+
+		fmt.Printf("Key:         %s\n", path)
+		fmt.Printf("Type:        %s\n", key.Kind)
+		printKey(key)
+		return nil
+	},
+}
+
+// printKey prints the parts of key that are safe to share.
+func printKey(key *keys.Key) {
+	if public := key.PublicKey(); public != "" {
+		fmt.Printf("Public key:  %s\n", public)
+	}
+	fmt.Printf("Fingerprint: %s\n", key.Fingerprint())
+}
+
+// resolveKeyDir returns the key directory given with --key-dir, or the default one.
+func resolveKeyDir() (string, error) {
+	if keyDir != "" {
+		return keyDir, nil
+	}
+	dir, err := keys.DefaultDir()
+	if err != nil {
+		return "", fmt.Errorf("error finding key directory (use --key-dir): %v", err)
+	}
+	return dir, nil
+}
+
+// loadHashKey loads the symmetric key given with --hash-key, by name in the
+// key directory or by path. It returns nil if no key was given.
+func loadHashKey(nameOrPath string) ([]byte, error) {
+	if nameOrPath == "" {
+		return nil, nil
+	}
+	dir, err := resolveKeyDir()
+	if err != nil {
+		return nil, err
+	}
+	key, err := keys.Load(keys.Resolve(dir, nameOrPath))
+	if err != nil {
+		return nil, fmt.Errorf("error loading hash key: %v", err)
+	}
+	if key.Kind != keys.KindSymmetric {
+		return nil, fmt.Errorf("hash key %s is an %s key; generate one with: key generate --type %s NAME", nameOrPath, key.Kind, keys.KindSymmetric)
+	}
+	return key.Secret, nil
+}
+
+func init() {
+	keyCmd.PersistentFlags().StringVar(&keyDir, "key-dir", "", "Directory keys are stored in (default: go-share/keys in the user config directory)")
+	keyGenerateCmd.Flags().StringVar(&keyType, "type", keys.KindEd25519, "Type of key: ed25519 for signing, or symmetric for encryption")
+
+	keyCmd.AddCommand(keyGenerateCmd)
+	keyCmd.AddCommand(keyShowCmd)
+	rootCmd.AddCommand(keyCmd)
+}
@@ -3,20 +3,85 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/timskillet/go-share/internal/discovery"
 	"github.com/timskillet/go-share/internal/file"
 	"github.com/timskillet/go-share/internal/peer"
+	"github.com/timskillet/go-share/internal/tracker"
+	"github.com/timskillet/go-share/pkg/goshare"
 )
 
 var (
-	chunkSize int64
+	chunkSize    int64
+	chunking     string
+	peerSelector string
+	maxParallel  int
+	perPeer      int
+	prefetch     int
+
+	verifyAfter     bool
+	repairOnFailure bool
+	noVerifyChunks  bool
+	quiet           bool
+	blacklistAfter  int
+
+	timeout          time.Duration
+	trackerURL       string
+	trackerTimeout   time.Duration
+	announceInterval time.Duration
+	compressManifest bool
+	publishManifest  bool
+	force            bool
+	rehash           bool
+	seedTime         time.Duration
+	seedUploads      int
+	allowCIDRs       []string
+	denyCIDRs        []string
+	verbose          bool
+	lanDiscovery     bool
+	webSeeds         []string
+	resume           bool
+	fresh            bool
+	statsAddr        string
+	startJitter      time.Duration
+	randomOrder      bool
+	byteRange        string
+	minPeers         int
+	minPeersWait     time.Duration
+	unavailableWait  time.Duration
+	overwrite        bool
+	hashKeyName      string
+	accessToken      string
+	downloadLimit    int64
+	verifyOnStart    bool
+	verifySampleSize int
+	follow           bool
+	followInterval   time.Duration
+	excludes         []string
+	directPeers      []string
+	gzipped          bool
+	serveManifest    bool
+	zeroCopy         bool
+	maxManifestSize  int64
+	dialTimeout      time.Duration
+	outputDir        string
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -25,139 +90,806 @@ var rootCmd = &cobra.Command{
 	Short: "A peer-to-peer file sharing application",
 	Long: `go-share is a command-line tool for sharing files in a peer-to-peer network.
 It allows users to upload files to the network and download files from other peers.`,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		if verbose {
+			slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})))
+		} else {
+			// The mDNS library used by --lan logs routine events through the
+			// standard logger; only show them with --verbose
+			log.SetOutput(io.Discard)
+		}
+	},
 }
 
 // uploadCmd represents the upload command
 var uploadCmd = &cobra.Command{
-	Use:   "upload [file]",
+	Use:   "upload [file|directory]",
 	Short: "Upload a file to the network",
 	Long: `Upload a file to the peer-to-peer network. The file will be split into chunks
 and made available for other peers to download. A manifest file will be created
-with the same name as the original file plus a .manifest extension.`,
+with the same name as the original file plus a .manifest extension
+(.manifest.gz with --compress-manifest). If that manifest already exists and the
+file hasn't changed since it was created, it is reused instead of hashing the
+file again.
+
+A directory can be uploaded as well. Its files are shared as one stream, and
+downloads recreate them with their permissions and symlinks.
+
+With --gzipped, a .gz file is seeded while it stays compressed on disk: the
+manifest describes its decompressed content, which downloaders receive, and
+chunks are decompressed as they are requested. Compress files with the compress
+command for this, so that each chunk can be decompressed on its own.
+
+With --announce-only, the file is only registered with the tracker as being
+served at --address and --port, for content hosted by another server.`,
 	Args: cobra.ExactArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		filePath := args[0]
 
-		// Create manifest for the file
-		manifest, err := file.CreateManifest(filePath, file.DefaultChunkSize)
+		// Stop on interrupt; --timeout bounds the time spent before seeding starts
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		setupCtx, cancelSetup := withOptionalTimeout(ctx, timeout)
+		defer cancelSetup()
+
+		if announceOnly {
+			return runAnnounceOnly(setupCtx, filePath)
+		}
+
+		// Parse access control lists
+		allow, err := peer.ParseCIDRs(allowCIDRs)
 		if err != nil {
-			fmt.Printf("Error creating manifest: %v\n", err)
-			return
+			return fmt.Errorf("--allow: %v", err)
+		}
+		deny, err := peer.ParseCIDRs(denyCIDRs)
+		if err != nil {
+			return fmt.Errorf("--deny: %v", err)
 		}
 
-		// Save manifest
-		if err := file.SaveManifest(manifest, filePath); err != nil {
-			fmt.Printf("Error saving manifest: %v\n", err)
-			return
+		// Refuse to build an unreasonably large manifest unless forced
+		if err := checkChunkCount(filePath, chunkSize, force); err != nil {
+			return err
 		}
 
-		// Start file server in background
-		go func() {
-			if err := peer.StartFileServer(filePath); err != nil {
-				fmt.Printf("Error starting file server: %v\n", err)
-				return
-			}
-		}()
+		rangeStart, rangeEnd, err := parseRange(byteRange)
+		if err != nil {
+			return fmt.Errorf("--range: %v", err)
+		}
 
-		// Announce file to tracker
-		announceReq := struct {
-			FileHash string `json:"fileHash"`
-			Address  string `json:"address"`
-			Port     int    `json:"port"`
-		}{
-			FileHash: manifest.FileHash,
-			Address:  "localhost",
-			Port:     9000,
+		hashKey, err := loadHashKey(hashKeyName)
+		if err != nil {
+			return err
 		}
 
-		data, err := json.Marshal(announceReq)
+		events, closeEvents, err := openEvents()
 		if err != nil {
-			fmt.Printf("Error marshaling announce request: %v\n", err)
-			return
+			return err
 		}
+		defer closeEvents()
 
-		resp, err := http.Post("http://localhost:8080/announce", "application/json", bytes.NewBuffer(data))
+		// Create the manifest, reusing a saved one if the file hasn't changed
+		manifest, err := goshare.Upload(setupCtx, filePath, goshare.UploadOptions{
+			ChunkSize:        chunkSize,
+			Chunking:         chunking,
+			CompressManifest: compressManifest,
+			Rehash:           rehash,
+			Trackers:         manifestTrackers(),
+			RangeStart:       rangeStart,
+			RangeEnd:         rangeEnd,
+			HashKey:          hashKey,
+			AccessToken:      accessToken,
+			Exclude:          excludes,
+			Gzipped:          gzipped,
+		})
 		if err != nil {
-			fmt.Printf("Error announcing file: %v\n", err)
-			return
+			return fmt.Errorf("error creating manifest: %v", err)
+		}
+		manifestPath := goshare.ManifestPath(filePath, compressManifest)
+		if manifest.IsRange() {
+			manifestPath = goshare.RangeManifestPath(filePath, rangeStart, rangeEnd, compressManifest)
 		}
-		defer resp.Body.Close()
 
-		if resp.StatusCode != http.StatusOK {
-			fmt.Printf("Error announcing file: %s\n", resp.Status)
-			return
+		// Serve the file and announce it to the tracker, re-scanning it for
+		// appended data with --follow
+		var seedFollow time.Duration
+		if follow {
+			if followInterval <= 0 {
+				return fmt.Errorf("--follow-interval must be positive")
+			}
+			seedFollow = followInterval
+		}
+		gone := make(chan error, 1)
+		seeder := goshare.NewSeeder(filePath, manifest, goshare.SeederOptions{
+			Allow:            allow,
+			Deny:             deny,
+			TrackerURL:       trackerURL,
+			TrackerTimeout:   trackerTimeout,
+			AnnounceInterval: announceInterval,
+			PublishManifest:  publishManifest,
+			OnAnnounceError: func(err error) {
+				fmt.Printf("Error re-announcing file: %v\n", err)
+			},
+			MaxUploads: seedUploads,
+			Follow:     seedFollow,
+			OnFollowError: func(err error) {
+				fmt.Printf("Error re-scanning file: %v\n", err)
+			},
+			VerifyOnStart: verifyOnStart,
+			VerifySample:  verifySampleSize,
+			Gzipped:       gzipped,
+			ZeroCopy:      zeroCopy,
+			ServeManifest: serveManifest,
+			OnFileGone:    func(err error) { gone <- err },
+			Events:        events,
+		})
+		if err := seeder.Start(setupCtx); err != nil {
+			return fmt.Errorf("error starting to seed: %v", describeTimeout(err, "announcing the file"))
+		}
+		fmt.Printf("Peer server started, serving file: %s\n", manifest.FileName)
+		// resume-seed serves files as they are on disk, so gzip files are left out
+		if remember && !gzipped {
+			if err := recordSeed(filePath, manifestPath, manifest, "localhost", goshare.DefaultSeederPort); err != nil {
+				fmt.Printf("Warning: recording the file for resume-seed failed: %v\n", err)
+			}
+		}
+		if lanDiscovery {
+			lan, err := discovery.New()
+			if err != nil {
+				seeder.Close()
+				return fmt.Errorf("error starting LAN discovery: %v", err)
+			}
+			defer lan.Close()
+			if err := lan.Announce(manifest.FileHash, goshare.DefaultSeederPort); err != nil {
+				fmt.Printf("Warning: announcing on the LAN failed: %v\n", err)
+			}
+		}
+		if statsAddr != "" {
+			mux := http.NewServeMux()
+			mux.Handle("/stats", seeder.StatsHandler())
+			statsServer := &http.Server{Addr: statsAddr, Handler: mux}
+			go func() {
+				if err := statsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					fmt.Printf("Error serving stats: %v\n", err)
+				}
+			}()
+			defer statsServer.Close()
+			fmt.Printf("Serving stats at http://%s/stats\n", statsAddr)
+		}
+		if publishManifest {
+			if accessToken != "" {
+				fmt.Printf("Manifest published to tracker without the access token. Download with: go-share download %s --access-token TOKEN\n", manifest.FileHash)
+			} else {
+				fmt.Printf("Manifest published to tracker. Download with: go-share download %s\n", manifest.FileHash)
+			}
 		}
 
-		fmt.Printf("File uploaded successfully. Manifest saved as %s.manifest\n", filePath)
+		fmt.Printf("File uploaded successfully. Manifest saved as %s\n", manifestPath)
+		if manifest.ContentType != "" {
+			fmt.Printf("Content type: %s\n", manifest.ContentType)
+		}
 		fmt.Println("Keep this terminal open to serve the file to other peers.")
 
-		// Block to keep the server running
-		select {}
+		// Seed until interrupted or a --seed-time or --seed-uploads limit is
+		// reached, then unannounce
+		var seedTimeout <-chan time.Time
+		if seedTime > 0 {
+			timer := time.NewTimer(seedTime)
+			defer timer.Stop()
+			seedTimeout = timer.C
+		}
+		// A limit that was reached ends the session for resume-seed as well
+		limitReached := true
+		select {
+		case <-ctx.Done():
+			limitReached = false
+		case <-seedTimeout:
+			fmt.Printf("Seeded for %s, stopping\n", seedTime)
+		case <-seeder.Done():
+			fmt.Printf("Served %d complete copies, stopping\n", seeder.Uploads())
+		case err := <-gone:
+			fmt.Printf("Stopped seeding and unannounced the file: %v\n", err)
+		}
+		if limitReached && remember {
+			if err := forgetSeedFor(manifest.FileHash); err != nil {
+				fmt.Printf("Warning: removing the file from the seed state failed: %v\n", err)
+			}
+		}
+		if err := seeder.Close(); err != nil {
+			return fmt.Errorf("error unannouncing file: %v", err)
+		}
+		return nil
 	},
 }
 
 // downloadCmd represents the download command
 var downloadCmd = &cobra.Command{
-	Use:   "download [manifest]",
+	Use:   "download [manifest|file-hash]...",
 	Short: "Download a file using its manifest",
 	Long: `Download a file using its manifest file. The manifest contains information
 about the file's chunks and where to find them. The file will be downloaded
-from available peers and saved in the same directory as the manifest.`,
-	Args: cobra.ExactArgs(1),
+from available peers and saved in the downloads directory: go-share inside
+$XDG_DOWNLOAD_DIR if set, or ~/Downloads/go-share, unless --output names
+another directory.
+
+Instead of a manifest path, the file hash can be given to fetch the manifest
+from a tracker that stores manifests, or from the peers serving the file. Such
+a manifest isn't trusted: the finished file is always checked against the
+hash, even with --verify-after=false.
+
+Several manifests or hashes can be given, as in download *.manifest, to
+download their files at once. They share --max-parallel (default 8) chunk
+requests, --per-peer-parallelism requests to any one peer, and
+--download-limit, and one progress bar shows their combined progress. Each
+file succeeds or fails on its own: a summary lists both, and the command
+fails if any download did.`,
+	Args: cobra.MinimumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		manifestPath := args[0]
 
-		// Load manifest
-		manifest, err := file.LoadManifest(manifestPath)
+		if cmd.Flags().Changed("max-parallel") && maxParallel < 1 {
+			return fmt.Errorf("--max-parallel must be at least 1")
+		}
+		if perPeer < 0 {
+			return fmt.Errorf("--per-peer-parallelism must not be negative")
+		}
+		if follow && followInterval <= 0 {
+			return fmt.Errorf("--follow-interval must be positive")
+		}
+		if follow && len(args) > 1 {
+			return fmt.Errorf("--follow can only be used when downloading a single file")
+		}
+		if follow && noVerifyChunks {
+			return fmt.Errorf("--follow can't be combined with --no-verify-chunks, since appended data is only verified chunk by chunk")
+		}
+		if noVerifyChunks {
+			// Skipping chunk checks must not quietly turn off other safeguards
+			if cmd.Flags().Changed("verify-after") && !verifyAfter {
+				return fmt.Errorf("--no-verify-chunks requires --verify-after, which catches corrupt chunks at the end")
+			}
+			if cmd.Flags().Changed("blacklist-after") {
+				return fmt.Errorf("--blacklist-after has no effect with --no-verify-chunks, which can't detect corrupt peers")
+			}
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		ctx, cancel := withOptionalTimeout(ctx, timeout)
+		defer cancel()
+
+		if len(args) > 1 {
+			return downloadMany(ctx, cmd, args)
+		}
+
+		// Load manifest, fetching it from the tracker if given a file hash
+		manifest, err := loadManifestArg(ctx, manifestPath)
 		if err != nil {
 			return fmt.Errorf("error loading manifest: %v", err)
 		}
 
-		// Get list of peers from tracker
-		resp, err := http.Get(fmt.Sprintf("http://localhost:8080/peers?fileHash=%s", manifest.FileHash))
+		// Keyed manifests can only be verified with their group key
+		hashKey, err := loadHashKey(hashKeyName)
 		if err != nil {
-			return fmt.Errorf("error getting peers: %v", err)
+			return err
 		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			return fmt.Errorf("error getting peers: %s", resp.Status)
+		if manifest.IsKeyed() && hashKey == nil {
+			return fmt.Errorf("%s uses keyed hashing; pass its group key with --hash-key (fingerprint %s)", manifest.FileName, manifest.KeyFingerprint)
 		}
 
-		var peersResp struct {
-			Peers []struct {
-				Address string `json:"address"`
-				Port    int    `json:"port"`
-			} `json:"peers"`
-		}
-		if err := json.NewDecoder(resp.Body).Decode(&peersResp); err != nil {
-			return fmt.Errorf("error decoding peers response: %v", err)
+		events, closeEvents, err := openEvents()
+		if err != nil {
+			return err
 		}
+		defer closeEvents()
 
-		if len(peersResp.Peers) == 0 {
-			return fmt.Errorf("no peers found for this file")
+		peers, err := findDownloadPeers(ctx, manifest)
+		if err != nil {
+			return err
 		}
 
 		// Download file
-		downloadsDir := "downloads"
-		if err := os.MkdirAll(downloadsDir, 0755); err != nil {
-			return fmt.Errorf("error creating downloads directory: %v", err)
+		downloadsDir, err := prepareDownloadsDir()
+		if err != nil {
+			return err
 		}
 		outputPath := filepath.Join(downloadsDir, manifest.FileName)
-		if err := peer.DownloadFile(manifest, peersResp.Peers[0].Address, peersResp.Peers[0].Port, outputPath); err != nil {
-			return fmt.Errorf("error downloading file: %v", err)
+
+		// Warn early if the disk clearly can't hold the file
+		if free, err := file.FreeSpace(downloadsDir); err == nil && free < manifest.FileSize {
+			fmt.Printf("Warning: %s needs %d bytes but only %d bytes are free in %s\n",
+				manifest.FileName, manifest.FileSize, free, downloadsDir)
+		}
+
+		opts := downloadOptions(cmd, manifest, manifestPath, outputPath, peers, hashKey, events)
+
+		// Continue from a previous attempt's .part file unless asked to start over
+		partPath, resuming, err := preparePartFile(manifest, outputPath)
+		if err != nil {
+			return err
+		}
+
+		bar := newProgressBar(os.Stdout, quiet)
+		opts.Progress = bar.Update
+
+		// With --follow, keep appending new data until interrupted
+		following := false
+		if follow {
+			var lastSize int64
+			opts.Follow = followInterval
+			opts.OnFollow = func(size int64) {
+				if !following {
+					following = true
+					bar.Finish()
+					fmt.Printf("Downloaded %s to %s; following it for appended data until interrupted\n", formatBytes(size), outputPath)
+				} else {
+					fmt.Printf("%s grew by %s to %s\n", outputPath, formatBytes(size-lastSize), formatBytes(size))
+				}
+				lastSize = size
+			}
+		}
+
+		var result *goshare.DownloadResult
+		if resuming {
+			result, err = goshare.Resume(ctx, manifest, opts)
+		} else {
+			result, err = goshare.Download(ctx, manifest, opts)
+		}
+		bar.Finish()
+		if following && ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+			fmt.Printf("Stopped following %s\n", outputPath)
+			return nil
+		}
+		if err != nil {
+			return describeDownloadError(err, downloadsDir, partPath)
 		}
 
+		if resuming {
+			fmt.Printf("Resumed from %s: reused %d of %d chunks, downloaded %d\n",
+				partPath, result.Reused, len(manifest.Chunks), result.Chunks)
+		}
+		if verifyAfter || noVerifyChunks || opts.FileHash != "" {
+			fmt.Println("Verification passed: all chunks and the file hash match the manifest")
+		}
 		fmt.Printf("File downloaded successfully to %s\n", outputPath)
+		if manifest.ContentType != "" {
+			fmt.Printf("Content type: %s\n", manifest.ContentType)
+		}
+		printDownloadResult(result)
 		return nil
 	},
 }
 
+// printDownloadResult prints where the chunks of a download came from and
+// which peers failed, to help judge the health of the swarm.
+func printDownloadResult(result *goshare.DownloadResult) {
+	if seconds := result.Duration.Seconds(); result.Chunks > 0 && seconds > 0 {
+		fmt.Printf("Fetched %s in %s (%s/s)\n", formatBytes(result.Bytes), result.Duration.Round(time.Millisecond), formatBytes(int64(float64(result.Bytes)/seconds)))
+	}
+	addrs := make([]string, 0, len(result.PeerChunks))
+	for addr := range result.PeerChunks {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		fmt.Printf("  %s: %d chunks\n", addr, result.PeerChunks[addr])
+	}
+	if result.Retries > 0 {
+		fmt.Printf("Retried %d chunk requests; failed peers: %s\n", result.Retries, strings.Join(result.FailedPeers, ", "))
+	}
+}
+
+// findDownloadPeers returns the peers to download the manifest's file from:
+// those given with --peer, or else those the tracker or LAN knows, plus any
+// --web-seed servers.
+func findDownloadPeers(ctx context.Context, manifest *goshare.Manifest) ([]goshare.Peer, error) {
+	// Parse web seeds: plain HTTP servers holding the file
+	var seeds []goshare.Peer
+	for _, rawURL := range webSeeds {
+		seed, err := goshare.WebSeed(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		seeds = append(seeds, seed)
+	}
+
+	// Peers given with --peer are used as they are, without a tracker
+	var peers []goshare.Peer
+	for _, addr := range directPeers {
+		p, err := goshare.ParsePeer(addr)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, p)
+	}
+
+	// Otherwise get the list of peers from the tracker. Empty files have no
+	// chunks to fetch, so they can be created without any peers.
+	if len(manifest.Chunks) > 0 && len(directPeers) == 0 {
+		var err error
+		if minPeers > 1 {
+			peers, err = waitForPeers(ctx, manifest)
+		} else {
+			peers, err = lookupPeers(ctx, manifest)
+		}
+		if err != nil {
+			if len(seeds) == 0 {
+				return nil, err
+			}
+			fmt.Printf("Warning: %v; downloading from web seeds only\n", err)
+		}
+	}
+	// Plain HTTP servers holding the file serve as extra peers
+	return append(peers, seeds...), nil
+}
+
+// prepareDownloadsDir returns the directory downloads are saved in, --output
+// or the default, creating it if needed.
+func prepareDownloadsDir() (string, error) {
+	downloadsDir := outputDir
+	if downloadsDir == "" {
+		downloadsDir = defaultDownloadsDir()
+	}
+	if err := os.MkdirAll(downloadsDir, 0755); err != nil {
+		return "", fmt.Errorf("error creating downloads directory: %v", err)
+	}
+	return downloadsDir, nil
+}
+
+// downloadOptions returns the options for downloading the manifest's file,
+// named by the command argument arg, to outputPath, as set by the download
+// command's flags.
+func downloadOptions(cmd *cobra.Command, manifest *goshare.Manifest, arg, outputPath string, peers []goshare.Peer, hashKey []byte, events *goshare.EventBus) goshare.DownloadOptions {
+	opts := goshare.DownloadOptions{
+		OutputPath:      outputPath,
+		Peers:           peers,
+		PeerSelection:   peerSelector,
+		VerifyAfter:     verifyAfter,
+		RepairOnFailure: repairOnFailure,
+		SkipChunkVerify: noVerifyChunks,
+		Prefetch:        prefetch,
+		PerPeerParallel: perPeer,
+		StartJitter:     startJitter,
+		RandomOrder:     randomOrder,
+		Overwrite:       overwrite,
+		HashKey:         hashKey,
+		RateLimit:       downloadLimit,
+		UnavailableWait: unavailableWait,
+		Events:          events,
+	}
+	// Peers that go away mid-download are replaced by those the tracker
+	// knows by then
+	if len(directPeers) == 0 && (len(trackersFor(manifest)) > 0 || lanDiscovery) {
+		opts.RefreshPeers = func(ctx context.Context) ([]goshare.Peer, error) {
+			return lookupPeers(ctx, manifest)
+		}
+	}
+	if cmd.Flags().Changed("max-parallel") {
+		opts.MaxParallel = maxParallel
+	}
+	if isHashArg(arg) {
+		// The manifest came from the tracker or a peer, and only the
+		// whole file can prove it genuine
+		opts.FileHash = arg
+	}
+	// TCPTransport takes a negative timeout to mean no limit
+	dial := dialTimeout
+	if dial == 0 {
+		dial = -1
+	}
+	opts.Transport = goshare.TCPTransport{DialTimeout: dial}
+	if !noVerifyChunks {
+		opts.BlacklistThreshold = blacklistAfter
+	}
+	return opts
+}
+
+// preparePartFile returns the .part file a download of the manifest's file to
+// outputPath is assembled in, and whether the download resumes from it. With
+// --fresh, a .part file left by an earlier attempt is removed instead.
+func preparePartFile(manifest *goshare.Manifest, outputPath string) (partPath string, resuming bool, err error) {
+	partPath = goshare.PartPathFor(manifest, outputPath)
+	_, statErr := os.Stat(partPath)
+	resuming = resume && !fresh && statErr == nil
+	if fresh && statErr == nil {
+		if err := os.Remove(partPath); err != nil {
+			return "", false, fmt.Errorf("error removing partial download: %v", err)
+		}
+		fmt.Printf("Discarded partial download %s\n", partPath)
+	}
+	return partPath, resuming, nil
+}
+
+// describeDownloadError returns the error of a failed download into
+// downloadsDir, with a hint on what to do about it where there is one.
+func describeDownloadError(err error, downloadsDir, partPath string) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("download timed out after %s; partial data is kept in %s", timeout, partPath)
+	}
+	if errors.Is(err, goshare.ErrFileExists) {
+		return fmt.Errorf("error downloading directory: %v\nPass --overwrite to replace existing files", err)
+	}
+	if errors.Is(err, goshare.ErrDiskFull) {
+		return fmt.Errorf("error downloading file: %v\nFree up space in %s and download again; any partial data is kept in %s",
+			err, downloadsDir, partPath)
+	}
+	if errors.Is(err, goshare.ErrAccessDenied) {
+		return fmt.Errorf("error downloading file: %v\nThe seeders keep this file private; pass the token they shared it with as --access-token", err)
+	}
+	if errors.Is(err, goshare.ErrChunkUnavailable) {
+		return fmt.Errorf("error downloading file: %v\nNo peer has these chunks yet; the rest is kept in %s, so download again once a peer has the whole file, or wait for one with --unavailable-wait",
+			err, partPath)
+	}
+	return fmt.Errorf("error downloading file: %v", err)
+}
+
+// loadManifestArg loads the manifest named by a command argument. If arg is not an
+// existing file but looks like a file hash, the manifest is fetched from the tracker,
+// or if it doesn't store it, from the peers serving the file. An --access-token
+// is set on the manifest, replacing any it records.
+func loadManifestArg(ctx context.Context, arg string) (*goshare.Manifest, error) {
+	manifest, err := fetchManifestArg(ctx, arg)
+	if err != nil {
+		return nil, err
+	}
+	if accessToken != "" {
+		manifest.AccessToken = accessToken
+	}
+	return manifest, nil
+}
+
+// fetchManifestArg implements loadManifestArg, without applying --access-token.
+func fetchManifestArg(ctx context.Context, arg string) (*goshare.Manifest, error) {
+	if isHashArg(arg) {
+		manifest, err := goshare.FetchManifest(ctx, trackerURL, trackerTimeout, arg)
+		if err == nil || ctx.Err() != nil {
+			return manifest, err
+		}
+		peers, peersErr := goshare.FindPeers(ctx, trackerURL, trackerTimeout, arg)
+		if peersErr != nil {
+			return nil, err
+		}
+		manifest, peersErr = goshare.FetchManifestFromPeers(ctx, peers, arg, accessToken, maxManifestSize)
+		if peersErr != nil {
+			return nil, fmt.Errorf("%v; no peer served it either: %v", err, peersErr)
+		}
+		return manifest, nil
+	}
+	return goshare.LoadManifestLimit(arg, maxManifestSize)
+}
+
+// isHashArg reports whether a command argument is the hash of a file whose
+// manifest is to be fetched, rather than the path of a manifest.
+func isHashArg(arg string) bool {
+	_, err := os.Stat(arg)
+	return err != nil && isFileHash(arg)
+}
+
+// isFileHash reports whether s looks like a hex-encoded SHA-256 file hash.
+func isFileHash(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// lookupPeers finds the peers serving the manifest's file. With --lan, peers on
+// the local network are asked first, and the tracker is only used if none answer.
+// It fails if no peers are found.
+func lookupPeers(ctx context.Context, manifest *goshare.Manifest) ([]goshare.Peer, error) {
+	trackers := trackersFor(manifest)
+	if lanDiscovery {
+		peers, err := lookupLANPeers(ctx, manifest.FileHash)
+		if err != nil {
+			fmt.Printf("Warning: LAN discovery failed: %v\n", err)
+		}
+		if len(peers) > 0 {
+			return peers, nil
+		}
+		if len(trackers) == 0 {
+			return nil, fmt.Errorf("no peers found for this file on the local network")
+		}
+	}
+
+	peers, err := goshare.FindPeersAny(ctx, trackers, trackerTimeout, manifest.FileHash)
+	if errors.Is(err, goshare.ErrNoPeers) {
+		return nil, fmt.Errorf("no peers found for this file")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting peers: %v", describeTimeout(err, "getting peers"))
+	}
+	return peers, nil
+}
+
+// waitForPeers waits until the trackers know --min-peers peers of the
+// manifest's file. Once --min-peers-wait has passed it goes ahead with the
+// peers found so far, if any; --timeout and interrupts end the wait with an error.
+func waitForPeers(ctx context.Context, manifest *goshare.Manifest) ([]goshare.Peer, error) {
+	fmt.Printf("Waiting for at least %d peers...\n", minPeers)
+	waitCtx, cancel := withOptionalTimeout(ctx, minPeersWait)
+	defer cancel()
+
+	peers, err := goshare.WaitForPeers(waitCtx, trackersFor(manifest), trackerTimeout, manifest.FileHash, minPeers)
+	if err == nil {
+		return peers, nil
+	}
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("error waiting for peers: %v", describeTimeout(err, "waiting for peers"))
+	}
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("no peers found for this file after waiting %s", minPeersWait)
+	}
+	fmt.Printf("Warning: only %d of %d peers found after waiting %s; downloading anyway\n", len(peers), minPeers, minPeersWait)
+	return peers, nil
+}
+
+// trackersFor returns the trackers to ask for the manifest's peers: the one
+// given with --tracker, or else those listed in the manifest, or else the
+// default tracker.
+func trackersFor(manifest *goshare.Manifest) []string {
+	if !rootCmd.PersistentFlags().Changed("tracker") && len(manifest.Trackers) > 0 {
+		return manifest.Trackers
+	}
+	return manifestTrackers()
+}
+
+// manifestTrackers returns the trackers to record in new manifests: the
+// configured tracker, unless tracking is disabled with --tracker "".
+func manifestTrackers() []string {
+	if trackerURL == "" {
+		return nil
+	}
+	return []string{trackerURL}
+}
+
+// lookupLANPeers asks peers on the local network who serves fileHash.
+func lookupLANPeers(ctx context.Context, fileHash string) ([]goshare.Peer, error) {
+	lan, err := discovery.New()
+	if err != nil {
+		return nil, err
+	}
+	defer lan.Close()
+
+	found, err := lan.Lookup(ctx, fileHash, discovery.DefaultLookupWait)
+	peers := make([]goshare.Peer, len(found))
+	for i, p := range found {
+		peers[i] = goshare.Peer{Address: p.Address, Port: p.Port}
+	}
+	return peers, err
+}
+
+// withOptionalTimeout returns a context that expires after timeout, or a plain
+// cancelable context if timeout is zero (no timeout).
+func withOptionalTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// describeTimeout replaces a deadline error with a message naming the --timeout
+// that expired during the given step.
+func describeTimeout(err error, step string) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after %s while %s", timeout, step)
+	}
+	return err
+}
+
 func init() {
+	rootCmd.PersistentFlags().StringVar(&trackerURL, "tracker", tracker.DefaultTrackerURL, "URL of the tracker server")
+	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Log debug details, such as each chunk served and how long it took")
+	rootCmd.PersistentFlags().BoolVar(&lanDiscovery, "lan", false, "Announce and find peers on the local network via mDNS, falling back to the tracker (use --tracker \"\" to skip it)")
+	rootCmd.PersistentFlags().DurationVar(&trackerTimeout, "tracker-timeout", tracker.DefaultRequestTimeout, "Timeout for each request to the tracker")
+	maxManifestSize = goshare.DefaultMaxManifestSize
+	rootCmd.PersistentFlags().Var((*byteSize)(&maxManifestSize), "max-manifest-size", "Refuse to load manifest files larger than this, optionally with a K, M, or G suffix, as a guard against hostile manifests")
+
+	chunkSize = file.DefaultChunkSize
+	uploadCmd.Flags().Var((*byteSize)(&chunkSize), "chunk-size", "Chunk size in bytes, optionally with a K, M, or G suffix (target average size with --chunking cdc)")
+	uploadCmd.Flags().StringVar(&chunking, "chunking", file.ChunkingFixed, "Chunking strategy: fixed, or cdc for content-defined chunks that survive insertions")
+	uploadCmd.Flags().DurationVar(&timeout, "timeout", 0, "Abort if preparing and announcing the file takes longer than this (0 means no timeout)")
+	uploadCmd.Flags().BoolVar(&compressManifest, "compress-manifest", false, "Save the manifest gzip-compressed as .manifest.gz")
+	uploadCmd.Flags().BoolVar(&publishManifest, "publish-manifest", false, "Upload the manifest to the tracker so it can be downloaded by file hash")
+	uploadCmd.Flags().StringArrayVar(&allowCIDRs, "allow", nil, "Only serve clients in this CIDR or IP address (repeatable; default: allow all)")
+	uploadCmd.Flags().StringArrayVar(&denyCIDRs, "deny", nil, "Never serve clients in this CIDR or IP address (repeatable; takes precedence over --allow)")
+	uploadCmd.Flags().StringArrayVar(&excludes, "exclude", nil, "When sharing a directory, leave out entries matching this .gitignore-style pattern, e.g. .git/ or '*.tmp' (repeatable; added to the directory's "+goshare.IgnoreFile+")")
+	uploadCmd.Flags().BoolVar(&gzipped, "gzipped", false, "Seed the decompressed content of a .gz file, which stays compressed on disk (see the compress command)")
+	uploadCmd.Flags().BoolVar(&rehash, "rehash", false, "Always hash the file again instead of reusing an up-to-date saved manifest")
+	uploadCmd.Flags().BoolVar(&force, "force", false, "Upload even if the file would be split into an unusually large number of chunks")
+	uploadCmd.Flags().StringVar(&hashKeyName, "hash-key", "", "Hash the file with HMAC-SHA256 under this symmetric key (name in the key directory, or path), so only holders of the key recognize it")
+	uploadCmd.Flags().StringVar(&accessToken, "access-token", "", "Keep the file private: only serve it to downloaders presenting this token, which is saved in the manifest but never published")
+	uploadCmd.Flags().StringVar(&byteRange, "range", "", "Share only the bytes from START up to END of the file, given as START:END, e.g. :1048576 to preview the first megabyte")
+	uploadCmd.Flags().StringVar(&statsAddr, "stats-addr", "", "Serve a JSON snapshot of what has been served at http://ADDR/stats, e.g. localhost:9090")
+	uploadCmd.Flags().DurationVar(&seedTime, "seed-time", 0, "Stop seeding and unannounce the file after this long (0 means until interrupted)")
+	uploadCmd.Flags().IntVar(&seedUploads, "seed-uploads", 0, "Stop seeding and unannounce the file once this many complete copies have been served (0 means no limit)")
+	uploadCmd.Flags().BoolVar(&follow, "follow", false, "Keep sharing data appended to the file, such as a growing log, re-scanning it every --follow-interval")
+	uploadCmd.Flags().DurationVar(&followInterval, "follow-interval", 2*time.Second, "With --follow, how often to re-scan the file for appended data")
+	uploadCmd.Flags().BoolVar(&serveManifest, "serve-manifest", true, "Hand the manifest to peers that only know the file hash")
+	uploadCmd.Flags().BoolVar(&zeroCopy, "zero-copy", false, "Send chunks straight from the file to peers with sendfile, skipping the check of each chunk before it is sent (pair with --verify-on-start)")
+	uploadCmd.Flags().BoolVar(&verifyOnStart, "verify-on-start", false, "Check the file against its manifest before serving it, and refuse to seed it if any chunk is corrupt")
+	uploadCmd.Flags().IntVar(&verifySampleSize, "verify-sample", 0, "With --verify-on-start, check only this many randomly chosen chunks, for large files (0 checks every chunk)")
+	uploadCmd.Flags().DurationVar(&announceInterval, "announce-interval", 0, "How often to re-announce the file to the tracker while seeding (default: a third of the tracker's peer TTL, or 5m if peers never expire; never over half the TTL)")
+
+	downloadCmd.Flags().DurationVar(&timeout, "timeout", 0, "Abort the download if it takes longer than this (0 means no timeout)")
+	downloadCmd.Flags().DurationVar(&dialTimeout, "dial-timeout", goshare.DefaultDialTimeout, "Give up connecting to a peer after this long and move on to others (0 waits as long as the operating system does)")
+	downloadCmd.Flags().IntVar(&maxParallel, "max-parallel", 0, "Maximum number of chunks to download concurrently (default: based on peer count, at most 8; 1 downloads sequentially)")
+	downloadCmd.Flags().IntVar(&perPeer, "per-peer-parallelism", 4, "Maximum number of chunks requested from any single peer at once (0 for no limit)")
+	downloadCmd.Flags().IntVar(&prefetch, "prefetch", 4, "With --max-parallel 1, fetch this many chunks ahead while the current one is verified and written")
+	downloadCmd.Flags().StringVar(&hashKeyName, "hash-key", "", "Symmetric key (name in the key directory, or path) of a file shared with --hash-key")
+	downloadCmd.Flags().StringVar(&accessToken, "access-token", "", "Token of a file its seeders keep private (default: the one recorded in the manifest, if any)")
+	downloadCmd.Flags().StringVarP(&outputDir, "output", "o", "", "Directory to save the download in (default: go-share in $XDG_DOWNLOAD_DIR or ~/Downloads)")
+	downloadCmd.Flags().BoolVar(&overwrite, "overwrite", false, "When downloading a directory, replace files that already exist in the downloads directory")
+	downloadCmd.Flags().IntVar(&minPeers, "min-peers", 1, "Wait until the tracker knows at least this many peers before downloading")
+	downloadCmd.Flags().DurationVar(&unavailableWait, "unavailable-wait", 0, "Wait this long for a peer to have chunks that no peer has yet, asking the tracker for new peers meanwhile (0 fails at once)")
+	downloadCmd.Flags().DurationVar(&minPeersWait, "min-peers-wait", 0, "With --min-peers, go ahead with the peers found so far after waiting this long (0 waits until --timeout)")
+	downloadCmd.Flags().DurationVar(&startJitter, "start-jitter", 0, "Wait a random time up to this long before the first chunk request, to spread out downloads started together")
+	downloadCmd.Flags().BoolVar(&randomOrder, "random-order", true, "Request chunks in random order when downloading several at once, spreading load over peers and chunks")
+	downloadCmd.Flags().BoolVar(&follow, "follow", false, "Keep downloading data appended to the file after it completes, like tail -f, until interrupted")
+	downloadCmd.Flags().DurationVar(&followInterval, "follow-interval", 2*time.Second, "With --follow, how often to ask peers for appended data")
+	downloadCmd.Flags().BoolVarP(&quiet, "quiet", "q", false, "Don't draw a progress bar; print periodic progress lines instead")
+	downloadCmd.Flags().BoolVar(&verifyAfter, "verify-after", true, "Re-read the downloaded file and verify every chunk and the file hash")
+	downloadCmd.Flags().BoolVar(&repairOnFailure, "repair", true, "Re-download chunks that fail --verify-after instead of leaving the .part file")
+	downloadCmd.Flags().BoolVar(&noVerifyChunks, "no-verify-chunks", false, "Don't hash chunks as they arrive; only verify the finished file. Faster on trusted LANs, but corrupt data is only found at the end and bad peers aren't blacklisted")
+	downloadCmd.Flags().IntVar(&blacklistAfter, "blacklist-after", peer.DefaultBlacklistThreshold, "Stop using a peer after it serves this many chunks that fail verification")
+	downloadCmd.Flags().BoolVar(&resume, "resume", true, "Continue from the .part file of an earlier attempt, keeping chunks that match the manifest")
+	downloadCmd.Flags().BoolVar(&fresh, "fresh", false, "Delete any .part file of an earlier attempt and download from scratch")
+	downloadCmd.Flags().StringArrayVar(&directPeers, "peer", nil, "Download straight from the peer at this host:port instead of asking the tracker (repeatable)")
+	downloadCmd.Flags().StringArrayVar(&webSeeds, "web-seed", nil, "Also fetch chunks with HTTP Range requests from this URL of the whole file, e.g. a mirror or CDN (repeatable)")
+	downloadCmd.Flags().Var((*byteSize)(&downloadLimit), "download-limit", "Cap the combined download rate from all peers to this many bytes per second, optionally with a K, M, or G suffix, e.g. 1M (0 means no limit)")
+	downloadCmd.Flags().StringVar(&peerSelector, "peer-selection", "first", "Peer selection strategy: first, round-robin, or lowest-latency")
+
 	rootCmd.AddCommand(uploadCmd)
 	rootCmd.AddCommand(downloadCmd)
 }
 
+// parseRange parses a --range value of the form START:END, in bytes, where an
+// empty START means 0. An empty value means the whole file, returned as 0, 0.
+func parseRange(s string) (int64, int64, error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	startStr, endStr, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, 0, fmt.Errorf("expected START:END, got %q", s)
+	}
+	var start int64
+	if startStr != "" {
+		var err error
+		if start, err = strconv.ParseInt(startStr, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid start %q", startStr)
+		}
+	}
+	end, err := strconv.ParseInt(endStr, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid end %q", endStr)
+	}
+	if start < 0 || end <= start {
+		return 0, 0, fmt.Errorf("range %q is empty", s)
+	}
+	return start, end, nil
+}
+
+// checkChunkCount warns when splitting filePath into chunks of chunkSize bytes
+// would produce more than file.ChunkCountWarning chunks, suggesting a larger
+// chunk size. Without force it returns an error instead of just warning.
+func checkChunkCount(filePath string, chunkSize int64, force bool) error {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+
+	n := file.EstimateChunks(info.Size(), chunkSize)
+	if n <= file.ChunkCountWarning {
+		return nil
+	}
+	msg := fmt.Sprintf("%s would be split into about %d chunks; consider --chunk-size %d",
+		filePath, n, file.SuggestChunkSize(info.Size()))
+	if !force {
+		return fmt.Errorf("%s (or pass --force to continue anyway)", msg)
+	}
+	fmt.Printf("Warning: %s\n", msg)
+	return nil
+}
+
 func main() {
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
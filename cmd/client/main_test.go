@@ -0,0 +1,698 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/timskillet/go-share/internal/file"
+	"github.com/timskillet/go-share/internal/peer"
+	"github.com/timskillet/go-share/internal/seedstate"
+	"github.com/timskillet/go-share/internal/tracker"
+	"github.com/timskillet/go-share/pkg/goshare"
+)
+
+// runCLI runs the command line args as main does, and returns the error that
+// makes main exit with a non-zero status. Flags set by args are put back to
+// their defaults when the test ends.
+func runCLI(t *testing.T, args ...string) error {
+	t.Helper()
+	t.Cleanup(resetFlags)
+	rootCmd.SetArgs(args)
+	return rootCmd.Execute()
+}
+
+// resetFlags puts the flags tests set back to their defaults, and forgets that
+// --tracker and --max-parallel were given.
+func resetFlags() {
+	timeout, announceOnly, trackerURL = 0, false, "http://localhost:8080"
+	announceAddress, announcePort = "localhost", 9000
+	outputDir, seedTime = "", 0
+	directPeers, fresh, doctorProbes, maxParallel = nil, false, nil, 0
+	chunkSize, chunking, compressManifest, rehash = file.DefaultChunkSize, file.ChunkingFixed, false, false
+	rootCmd.PersistentFlags().Lookup("tracker").Changed = false
+	downloadCmd.Flags().Lookup("max-parallel").Changed = false
+}
+
+// hungTracker starts a tracker that never answers until the test ends.
+func hungTracker(t *testing.T) string {
+	t.Helper()
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+	return srv.URL
+}
+
+// writeFile writes content to a file named name in a temporary directory and
+// returns its path.
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTimeoutFailsCommands(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	tracker := hungTracker(t)
+	path := writeFile(t, "shared.txt", "some content to share")
+
+	for _, tc := range []struct {
+		name string
+		args []string
+	}{
+		{"upload", []string{"upload", path}},
+		{"upload --announce-only", []string{"upload", path, "--announce-only"}},
+		{"download", []string{"download", strings.Repeat("ab", 32), "--output", t.TempDir()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			start := time.Now()
+			err := runCLI(t, append(tc.args, "--tracker", tracker, "--timeout", "200ms")...)
+			if err == nil {
+				t.Fatal("command succeeded after its --timeout expired")
+			}
+			if !strings.Contains(err.Error(), "timed out") && !strings.Contains(err.Error(), "deadline exceeded") {
+				t.Errorf("error %q doesn't say the command timed out", err)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("command took %v despite --timeout 200ms", elapsed)
+			}
+		})
+	}
+}
+
+func TestCheckChunkCount(t *testing.T) {
+	path := writeFile(t, "big.bin", "")
+	if err := os.Truncate(path, file.ChunkCountWarning+1); err != nil {
+		t.Fatal(err)
+	}
+
+	err := checkChunkCount(path, 1, false)
+	if err == nil || !strings.Contains(err.Error(), "--force") {
+		t.Fatalf("checkChunkCount over the threshold returned %v, want an error suggesting --force", err)
+	}
+	if !strings.Contains(err.Error(), "--chunk-size") {
+		t.Errorf("error %q doesn't suggest a larger chunk size", err)
+	}
+	if err := checkChunkCount(path, 1, true); err != nil {
+		t.Fatalf("checkChunkCount with force returned %v, want just a warning", err)
+	}
+	if err := checkChunkCount(path, 2, false); err != nil {
+		t.Fatalf("checkChunkCount under the threshold returned %v", err)
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	for _, tc := range []struct {
+		in         string
+		start, end int64
+		ok         bool
+	}{
+		{"", 0, 0, true},
+		{"100:200", 100, 200, true},
+		{":4096", 0, 4096, true},
+		{"100", 0, 0, false},
+		{"200:100", 0, 0, false},
+		{"100:100", 0, 0, false},
+		{"-1:10", 0, 0, false},
+		{"a:10", 0, 0, false},
+		{"10:", 0, 0, false},
+	} {
+		start, end, err := parseRange(tc.in)
+		if (err == nil) != tc.ok || start != tc.start || end != tc.end {
+			t.Errorf("parseRange(%q) = %d, %d, %v", tc.in, start, end, err)
+		}
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	for in, want := range map[string]int64{"4096": 4096, "512K": 512 << 10, "4M": 4 << 20, "4mb": 4 << 20, "1GiB": 1 << 30, " 2k ": 2 << 10} {
+		if n, err := parseByteSize(in); err != nil || n != want {
+			t.Errorf("parseByteSize(%q) = %d, %v; want %d", in, n, err, want)
+		}
+	}
+	for _, in := range []string{"", "M", "-1K", "4T", "1.5M", "99999999999G"} {
+		if n, err := parseByteSize(in); err == nil {
+			t.Errorf("parseByteSize(%q) = %d, want an error", in, n)
+		}
+	}
+}
+
+func TestRechunkCommand(t *testing.T) {
+	path := writeFile(t, "shared.txt", strings.Repeat("rechunk me ", 400))
+	original, err := goshare.Upload(context.Background(), path, goshare.UploadOptions{ChunkSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runCLI(t, "rechunk", path, "--chunk-size", "1K"); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := goshare.LoadManifest(goshare.ManifestPath(path, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.ChunkSize != 1<<10 || manifest.FileHash != original.FileHash || len(manifest.Chunks) != 5 {
+		t.Fatalf("rechunked manifest has %d chunks of %d bytes and file hash %s", len(manifest.Chunks), manifest.ChunkSize, manifest.FileHash)
+	}
+	report, err := file.VerifyFile(manifest, path)
+	if err != nil || !report.OK() {
+		t.Fatalf("rechunked manifest doesn't verify against the file: %+v, %v", report, err)
+	}
+
+	if err := runCLI(t, "rechunk", path, "--chunk-size", "1K"); err == nil || !strings.Contains(err.Error(), "already uses") {
+		t.Fatalf("rechunking to the same chunk size returned %v", err)
+	}
+}
+
+func TestManifestCommand(t *testing.T) {
+	content := strings.Repeat("release tarball ", 500)
+	path := writeFile(t, "rel.tar", content)
+
+	// The manifest is written next to the file, without seeding it or asking
+	// a tracker; one that never answers is only recorded
+	tracker := hungTracker(t)
+	if err := runCLI(t, "manifest", path, "--chunk-size", "1K", "--tracker", tracker); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if !slices.Equal(names, []string{"rel.tar", "rel.tar.manifest"}) {
+		t.Fatalf("manifest command left %v, want only the file and its manifest", names)
+	}
+	manifest, err := goshare.LoadManifest(goshare.ManifestPath(path, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("%x", sha256.Sum256([]byte(content))); manifest.FileHash != want || manifest.ChunkSize != 1<<10 {
+		t.Fatalf("manifest records hash %s in %d-byte chunks, want %s in 1K chunks", manifest.FileHash, manifest.ChunkSize, want)
+	}
+	if !slices.Equal(manifest.Trackers, []string{tracker}) {
+		t.Fatalf("manifest records trackers %v, want the one given", manifest.Trackers)
+	}
+
+	// Without --tracker none is recorded, and the manifest works as a
+	// checksum file
+	resetFlags()
+	if err := runCLI(t, "manifest", path, "--chunk-size", "1K", "--rehash", "--compress-manifest"); err != nil {
+		t.Fatal(err)
+	}
+	compressed := goshare.ManifestPath(path, true)
+	if manifest, err = goshare.LoadManifest(compressed); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Trackers) != 0 {
+		t.Fatalf("manifest records trackers %v without --tracker", manifest.Trackers)
+	}
+	if err := runCLI(t, "verify", compressed, path); err != nil {
+		t.Fatalf("verify of the file against its manifest: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(strings.ToUpper(content)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := runCLI(t, "verify", compressed, path); err == nil {
+		t.Fatal("verify accepted a changed file")
+	}
+
+	if err := runCLI(t, "manifest", filepath.Join(t.TempDir(), "missing.tar")); err == nil {
+		t.Fatal("manifest of a missing file succeeded")
+	}
+}
+
+func TestAnnounceOnlyRegistersWithoutServing(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	srv := httptest.NewServer(tracker.NewTracker().Handler())
+	t.Cleanup(srv.Close)
+	path := writeFile(t, "hosted.txt", "content hosted elsewhere")
+	fileHash := fmt.Sprintf("%x", sha256.Sum256([]byte("content hosted elsewhere")))
+
+	// Pick a free port, so that a server bound to it would be noticed
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	if err := runCLI(t, "upload", path, "--announce-only", "--tracker", srv.URL, "--address", "127.0.0.1", "--port", strconv.Itoa(port)); err != nil {
+		t.Fatal(err)
+	}
+	client := tracker.NewTrackerClient(srv.URL, 0)
+	peers, err := client.GetPeers(context.Background(), fileHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (tracker.Peer{Address: "127.0.0.1", Port: port}); len(peers) != 1 || peers[0] != want {
+		t.Fatalf("tracker lists %v, want only %v", peers, want)
+	}
+	if conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); err == nil {
+		conn.Close()
+		t.Fatal("announce-only left a server listening on the announced port")
+	}
+
+	// unannounce takes the file hash too, and removes the registration
+	if err := runCLI(t, "unannounce", fileHash, "--tracker", srv.URL, "--address", "127.0.0.1", "--port", strconv.Itoa(port)); err != nil {
+		t.Fatal(err)
+	}
+	if peers, err := client.GetPeers(context.Background(), fileHash); err != nil || len(peers) != 0 {
+		t.Fatalf("tracker lists %v, %v after unannounce, want no peers", peers, err)
+	}
+}
+
+func TestTrackersFor(t *testing.T) {
+	resetFlags()
+	t.Cleanup(resetFlags)
+	listed := &goshare.Manifest{Trackers: []string{"http://tracker-a:8080", "http://tracker-b:8080"}}
+
+	// Without --tracker, the manifest's trackers are asked, or else the default
+	if got := trackersFor(listed); !slices.Equal(got, listed.Trackers) {
+		t.Fatalf("trackersFor returned %v, want the manifest's %v", got, listed.Trackers)
+	}
+	if got := trackersFor(&goshare.Manifest{}); !slices.Equal(got, []string{"http://localhost:8080"}) {
+		t.Fatalf("trackersFor a manifest without trackers returned %v, want the default tracker", got)
+	}
+
+	// --tracker overrides the manifest, and --tracker "" disables trackers
+	if err := rootCmd.PersistentFlags().Set("tracker", "http://override:8080"); err != nil {
+		t.Fatal(err)
+	}
+	if got := trackersFor(listed); !slices.Equal(got, []string{"http://override:8080"}) {
+		t.Fatalf("trackersFor with --tracker returned %v, want only the flag's tracker", got)
+	}
+	if err := rootCmd.PersistentFlags().Set("tracker", ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := trackersFor(listed); len(got) != 0 {
+		t.Fatalf("trackersFor with --tracker \"\" returned %v, want none", got)
+	}
+}
+
+func TestSeedTimeStopsAndUnannounces(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	srv := httptest.NewServer(tracker.NewTracker().Handler())
+	t.Cleanup(srv.Close)
+	path := writeFile(t, "timed.txt", "content seeded for a while")
+	fileHash := fmt.Sprintf("%x", sha256.Sum256([]byte("content seeded for a while")))
+	client := tracker.NewTrackerClient(srv.URL, 0)
+
+	const seedFor = 500 * time.Millisecond
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- runCLI(t, "upload", path, "--tracker", srv.URL, "--seed-time", seedFor.String()) }()
+
+	// While seeding, the file is announced and served
+	var peers []tracker.Peer
+	for len(peers) == 0 && time.Since(start) < seedFor {
+		time.Sleep(10 * time.Millisecond)
+		peers, _ = client.GetPeers(context.Background(), fileHash)
+	}
+	if len(peers) != 1 || peers[0].Port != goshare.DefaultSeederPort {
+		t.Fatalf("tracker lists %v while seeding, want the seeder", peers)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * seedFor):
+		t.Fatal("upload still running long after --seed-time")
+	}
+	if elapsed := time.Since(start); elapsed < seedFor {
+		t.Fatalf("upload returned after %v, before --seed-time %v", elapsed, seedFor)
+	}
+	if peers, err := client.GetPeers(context.Background(), fileHash); err != nil || len(peers) != 0 {
+		t.Fatalf("tracker lists %v, %v after seeding stopped, want no peers", peers, err)
+	}
+	if conn, err := net.Dial("tcp", net.JoinHostPort("localhost", strconv.Itoa(goshare.DefaultSeederPort))); err == nil {
+		conn.Close()
+		t.Fatal("seeder still accepts connections after --seed-time")
+	}
+}
+
+func TestDownloadResumesPartFile(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	content := make([]byte, 8<<10)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	path := filepath.Join(t.TempDir(), "resumable.bin")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := goshare.Upload(context.Background(), path, goshare.UploadOptions{ChunkSize: 1 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeder := goshare.NewSeeder(path, manifest, goshare.SeederOptions{})
+	if err := seeder.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer seeder.Close()
+
+	// A .part file from an earlier attempt missing chunks 2 and 5
+	outDir := t.TempDir()
+	outputPath := filepath.Join(outDir, "resumable.bin")
+	writePart := func() {
+		t.Helper()
+		part := slices.Clone(content)
+		clear(part[2<<10 : 3<<10])
+		clear(part[5<<10 : 6<<10])
+		if err := os.WriteFile(goshare.PartPath(outputPath), part, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// download runs the download command with args and returns the chunks the
+	// seeder served for it, waiting for at least want to be counted: chunks
+	// are counted once sent, so the last may be counted after the download.
+	download := func(want int64, args ...string) int64 {
+		t.Helper()
+		before := seeder.Stats().ChunksServed
+		args = append([]string{"download", goshare.ManifestPath(path, false), "--peer", "localhost:" + strconv.Itoa(goshare.DefaultSeederPort), "--output", outDir}, args...)
+		if err := runCLI(t, args...); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := os.ReadFile(outputPath); err != nil || !slices.Equal(got, content) {
+			t.Fatalf("downloaded file doesn't match the original: %v", err)
+		}
+		if _, err := os.Stat(goshare.PartPath(outputPath)); !os.IsNotExist(err) {
+			t.Fatalf(".part file left behind: %v", err)
+		}
+		deadline := time.Now().Add(time.Second)
+		for seeder.Stats().ChunksServed-before < want && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		return seeder.Stats().ChunksServed - before
+	}
+
+	// By default only the missing chunks are fetched
+	writePart()
+	if served := download(2); served != 2 {
+		t.Fatalf("resuming fetched %d chunks, want the 2 missing", served)
+	}
+
+	// --fresh discards the .part file and fetches everything
+	writePart()
+	if served := download(int64(len(manifest.Chunks)), "--fresh"); served != int64(len(manifest.Chunks)) {
+		t.Fatalf("--fresh fetched %d chunks, want all %d", served, len(manifest.Chunks))
+	}
+}
+
+func TestResumeSeedsAnnouncesEachFile(t *testing.T) {
+	srv := httptest.NewServer(tracker.NewTracker().Handler())
+	t.Cleanup(srv.Close)
+	client := tracker.NewTrackerClient(srv.URL, 0)
+	ctx := context.Background()
+
+	var entries []seedstate.Entry
+	contents := make(map[string]string)
+	for i, content := range []string{strings.Repeat("first file ", 100), strings.Repeat("second file ", 100)} {
+		path := writeFile(t, fmt.Sprintf("file%d.txt", i), content)
+		manifest, err := goshare.Upload(ctx, path, goshare.UploadOptions{ChunkSize: 256})
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[manifest.FileHash] = content
+		entries = append(entries, seedstate.Entry{
+			FileHash:     manifest.FileHash,
+			FilePath:     path,
+			ManifestPath: goshare.ManifestPath(path, false),
+			Trackers:     []string{srv.URL},
+			Address:      "localhost",
+			Port:         9100 + i,
+		})
+	}
+	// A file whose manifest is gone is skipped, not fatal
+	moved := seedstate.Entry{FileHash: "moved", FilePath: "/nonexistent", ManifestPath: "/nonexistent.manifest", Trackers: []string{srv.URL}, Port: 9100}
+
+	tr := peer.NewMemoryTransport()
+	seeds, err := resumeSeeds(ctx, append(entries, moved), tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seeds.entries) != len(entries) {
+		t.Fatalf("resumed %d sessions, want %d", len(seeds.entries), len(entries))
+	}
+	for _, e := range entries {
+		peers, err := client.GetPeers(ctx, e.FileHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(peers) != 1 || peers[0] != (tracker.Peer{Address: "localhost", Port: e.Port}) {
+			t.Fatalf("tracker lists %v for %s, want the resumed seeder on port %d", peers, e.FilePath, e.Port)
+		}
+		// Each file is served again on its recorded port
+		manifest, err := file.LoadManifest(e.ManifestPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputPath := filepath.Join(t.TempDir(), "out.txt")
+		seeder := []peer.Peer{{Address: "localhost", Port: e.Port}}
+		if _, err := peer.DownloadFile(ctx, manifest, seeder, outputPath, peer.DownloadOptions{Transport: tr}); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := os.ReadFile(outputPath); err != nil || string(got) != contents[e.FileHash] {
+			t.Fatalf("downloaded %q, %v from the resumed seeder of %s", got, err, e.FilePath)
+		}
+	}
+
+	// Closing unannounces every file
+	seeds.close()
+	for _, e := range entries {
+		if peers, err := client.GetPeers(ctx, e.FileHash); err != nil || len(peers) != 0 {
+			t.Fatalf("tracker lists %v, %v for %s after resume-seed stopped", peers, err, e.FilePath)
+		}
+	}
+}
+
+func TestResumeSeedsWithdrawsGoneFile(t *testing.T) {
+	srv := httptest.NewServer(tracker.NewTracker().Handler())
+	t.Cleanup(srv.Close)
+	client := tracker.NewTrackerClient(srv.URL, 0)
+	ctx := context.Background()
+
+	var entries []seedstate.Entry
+	var manifests []*file.Manifest
+	for i, content := range []string{strings.Repeat("kept file ", 100), strings.Repeat("truncated file ", 100)} {
+		path := writeFile(t, fmt.Sprintf("file%d.txt", i), content)
+		manifest, err := goshare.Upload(ctx, path, goshare.UploadOptions{ChunkSize: 256})
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifests = append(manifests, manifest)
+		entries = append(entries, seedstate.Entry{
+			FileHash:     manifest.FileHash,
+			FilePath:     path,
+			ManifestPath: goshare.ManifestPath(path, false),
+			Trackers:     []string{srv.URL},
+			Address:      "localhost",
+			Port:         9110 + i,
+		})
+	}
+	tr := peer.NewMemoryTransport()
+	seeds, err := resumeSeeds(ctx, entries, tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seeds.close()
+
+	// A download finds the second file cut short, which withdraws just that one
+	if err := os.Truncate(entries[1].FilePath, 100); err != nil {
+		t.Fatal(err)
+	}
+	download := func(i int) error {
+		seeder := []peer.Peer{{Address: "localhost", Port: entries[i].Port}}
+		_, err := peer.DownloadFile(ctx, manifests[i], seeder, filepath.Join(t.TempDir(), "out.txt"), peer.DownloadOptions{Transport: tr})
+		return err
+	}
+	if err := download(1); err == nil {
+		t.Fatal("download of a truncated file succeeded")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		peers, err := client.GetPeers(ctx, entries[1].FileHash)
+		if err == nil && len(peers) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("tracker still lists %v, %v for the truncated file", peers, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The other file is still served and announced
+	if err := download(0); err != nil {
+		t.Fatal(err)
+	}
+	if peers, err := client.GetPeers(ctx, entries[0].FileHash); err != nil || len(peers) != 1 {
+		t.Fatalf("tracker lists %v, %v for the intact file, want its seeder", peers, err)
+	}
+}
+
+func TestOpenEventsWritesJSONLines(t *testing.T) {
+	t.Cleanup(func() { eventsOut = "" })
+	eventsOut = filepath.Join(t.TempDir(), "events.jsonl")
+	bus, closeEvents, err := openEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus.Publish(goshare.Event{Type: goshare.EventPeerConnected, Peer: "localhost:9000"})
+	bus.Publish(goshare.Event{Type: goshare.EventComplete, Size: 42})
+	closeEvents()
+	// Events published after closing aren't written
+	bus.Publish(goshare.Event{Type: goshare.EventError, Error: "late"})
+
+	data, err := os.ReadFile(eventsOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("events file has %d lines, want 2:\n%s", len(lines), data)
+	}
+	var last goshare.Event
+	if err := json.Unmarshal([]byte(lines[1]), &last); err != nil {
+		t.Fatal(err)
+	}
+	if last.Type != goshare.EventComplete || last.Size != 42 || last.Time.IsZero() {
+		t.Fatalf("second event decoded as %+v", last)
+	}
+
+	for _, spec := range []string{"fd:x", "fd:-1"} {
+		eventsOut = spec
+		if _, _, err := openEvents(); err == nil {
+			t.Errorf("--events %s opened without an error", spec)
+		}
+	}
+}
+
+func TestDownloadFromDirectPeer(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	content := strings.Repeat("direct from the seeder ", 200)
+	path := writeFile(t, "direct.txt", content)
+	manifest, err := goshare.Upload(context.Background(), path, goshare.UploadOptions{ChunkSize: 1 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeder := goshare.NewSeeder(path, manifest, goshare.SeederOptions{})
+	if err := seeder.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer seeder.Close()
+
+	// The tracker never answers, so the download only finishes in time if it
+	// isn't asked
+	outDir := t.TempDir()
+	peerAddr := "localhost:" + strconv.Itoa(goshare.DefaultSeederPort)
+	err = runCLI(t, "download", goshare.ManifestPath(path, false), "--peer", peerAddr, "--tracker", hungTracker(t), "--timeout", "10s", "--output", outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(filepath.Join(outDir, "direct.txt")); err != nil || string(got) != content {
+		t.Fatalf("downloaded file doesn't match the original: %v", err)
+	}
+
+	if err := runCLI(t, "download", goshare.ManifestPath(path, false), "--peer", "localhost", "--output", t.TempDir()); err == nil {
+		t.Fatal("download from a peer without a port succeeded")
+	}
+}
+
+func TestProgressBarLogsSteps(t *testing.T) {
+	// Output that isn't a terminal gets plain lines, not a bar
+	logFile, err := os.Create(filepath.Join(t.TempDir(), "download.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logFile.Close()
+	if newProgressBar(logFile, false).inPlace {
+		t.Fatal("progress bar drawn in place in a log file")
+	}
+
+	var out bytes.Buffer
+	p := &progressBar{out: &out, lastLogged: -1}
+	for _, done := range []int64{0, 50, 150, 160, 1000} {
+		p.Update(done, 1000)
+	}
+	p.Finish()
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	want := []string{"Downloaded 0%", "Downloaded 10%", "Downloaded 100%"}
+	if len(lines) != len(want) || strings.Contains(out.String(), "\r") {
+		t.Fatalf("logged %q, want one line per step reached", out.String())
+	}
+	for i, line := range lines {
+		if !strings.HasPrefix(line, want[i]) {
+			t.Errorf("line %d is %q, want it to start with %q", i, line, want[i])
+		}
+	}
+}
+
+func TestProgressBarDrawsInPlace(t *testing.T) {
+	var out bytes.Buffer
+	p := &progressBar{out: &out, inPlace: true, lastLogged: -1}
+	p.Update(500, 1000)
+	if got := out.String(); !strings.HasPrefix(got, "\r\033[K[") || !strings.Contains(got, " 50%") {
+		t.Fatalf("drew %q, want the bar at 50%% redrawn over the line", got)
+	}
+
+	// Updates closer together than progressRedraw are skipped, except the last
+	out.Reset()
+	p.Update(600, 1000)
+	if out.Len() != 0 {
+		t.Fatalf("redrew %q right after the previous update", out.String())
+	}
+	p.Update(1000, 1000)
+	if got := out.String(); !strings.Contains(got, "100%") || strings.Contains(got, ">") {
+		t.Fatalf("drew %q, want a full bar at 100%%", got)
+	}
+
+	// Finishing clears the line once
+	out.Reset()
+	p.Finish()
+	p.Finish()
+	if out.String() != "\r\033[K" {
+		t.Fatalf("finishing wrote %q, want the line cleared once", out.String())
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for _, tc := range []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1536, "1.5 KiB"},
+		{5 << 20, "5.0 MiB"},
+		{3 << 40, "3.0 TiB"},
+	} {
+		if got := formatBytes(tc.n); got != tc.want {
+			t.Errorf("formatBytes(%d) = %q, want %q", tc.n, got, tc.want)
+		}
+	}
+}
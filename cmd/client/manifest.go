@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"github.com/timskillet/go-share/pkg/goshare"
+)
+
+// manifestCmd represents the manifest command
+var manifestCmd = &cobra.Command{
+	Use:   "manifest [file|directory]",
+	Short: "Create a file's manifest without sharing it",
+	Long: `Create and save the manifest of a file or directory, as upload does, then exit
+without serving the file or contacting a tracker. The manifest records the
+file's SHA-256 hash and those of its chunks, so it can be distributed as a
+checksum file, e.g. for releases: verify checks a copy of the file against it.
+The same manifest can be seeded later with upload, which reuses it as long as
+the file hasn't changed.
+
+No tracker is recorded in the manifest unless --tracker is given explicitly.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		filePath := args[0]
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		if err := checkChunkCount(filePath, chunkSize, force); err != nil {
+			return err
+		}
+		hashKey, err := loadHashKey(hashKeyName)
+		if err != nil {
+			return err
+		}
+		var trackers []string
+		if cmd.Flags().Changed("tracker") {
+			trackers = manifestTrackers()
+		}
+
+		manifest, err := goshare.Upload(ctx, filePath, goshare.UploadOptions{
+			ChunkSize:        chunkSize,
+			Chunking:         chunking,
+			CompressManifest: compressManifest,
+			Rehash:           rehash,
+			Trackers:         trackers,
+			HashKey:          hashKey,
+			Exclude:          excludes,
+		})
+		if err != nil {
+			return fmt.Errorf("error creating manifest: %v", err)
+		}
+
+		fmt.Printf("Manifest saved as %s\n", goshare.ManifestPath(filePath, compressManifest))
+		fmt.Printf("File hash: %s\n", manifest.FileHash)
+		fmt.Printf("%s in %d chunks\n", formatBytes(manifest.FileSize), len(manifest.Chunks))
+		return nil
+	},
+}
+
+func init() {
+	manifestCmd.Flags().Var((*byteSize)(&chunkSize), "chunk-size", "Chunk size in bytes, optionally with a K, M, or G suffix (target average size with --chunking cdc)")
+	manifestCmd.Flags().StringVar(&chunking, "chunking", goshare.ChunkingFixed, "Chunking strategy: fixed, or cdc for content-defined chunks that survive insertions")
+	manifestCmd.Flags().BoolVar(&compressManifest, "compress-manifest", false, "Save the manifest gzip-compressed as .manifest.gz")
+	manifestCmd.Flags().BoolVar(&rehash, "rehash", false, "Always hash the file again instead of reusing an up-to-date saved manifest")
+	manifestCmd.Flags().BoolVar(&force, "force", false, "Create the manifest even if the file would be split into an unusually large number of chunks")
+	manifestCmd.Flags().StringVar(&hashKeyName, "hash-key", "", "Hash the file with HMAC-SHA256 under this symmetric key (name in the key directory, or path)")
+	manifestCmd.Flags().StringArrayVar(&excludes, "exclude", nil, "For a directory, leave out entries matching this .gitignore-style pattern (repeatable; added to the directory's "+goshare.IgnoreFile+")")
+
+	rootCmd.AddCommand(manifestCmd)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/spf13/cobra"
+	"github.com/timskillet/go-share/internal/file"
+	"github.com/timskillet/go-share/pkg/goshare"
+)
+
+// defaultDownloadBudget is how many chunks downloads of several files fetch at
+// once in total without --max-parallel: as many as a single download fetches
+// at most by default.
+const defaultDownloadBudget = 8
+
+// fileDownload is one of the files downloaded by downloadMany.
+type fileDownload struct {
+	arg        string // Manifest path or file hash it was named by
+	manifest   *goshare.Manifest
+	outputPath string
+	err        error
+}
+
+// downloadMany implements the download command for several manifests: their
+// files are downloaded at once, sharing a budget of chunk requests and the
+// --download-limit, behind a single progress bar. A download that fails doesn't
+// stop the others; each one's outcome is reported at the end, and the command
+// fails if any did.
+func downloadMany(ctx context.Context, cmd *cobra.Command, args []string) error {
+	hashKey, err := loadHashKey(hashKeyName)
+	if err != nil {
+		return err
+	}
+	events, closeEvents, err := openEvents()
+	if err != nil {
+		return err
+	}
+	defer closeEvents()
+	downloadsDir, err := prepareDownloadsDir()
+	if err != nil {
+		return err
+	}
+
+	// Load every manifest first, so that the progress bar knows the total
+	downloads := make([]*fileDownload, len(args))
+	outputs := make(map[string]string) // Output paths taken, by argument
+	var total int64
+	for i, arg := range args {
+		d := &fileDownload{arg: arg}
+		downloads[i] = d
+		manifest, err := loadManifestArg(ctx, arg)
+		if err != nil {
+			d.err = fmt.Errorf("error loading manifest: %v", err)
+			continue
+		}
+		if manifest.IsKeyed() && hashKey == nil {
+			d.err = fmt.Errorf("%s uses keyed hashing; pass its group key with --hash-key (fingerprint %s)", manifest.FileName, manifest.KeyFingerprint)
+			continue
+		}
+		outputPath := filepath.Join(downloadsDir, manifest.FileName)
+		if other, taken := outputs[outputPath]; taken {
+			d.err = fmt.Errorf("%s would be saved as %s like %s; download it on its own", manifest.FileName, outputPath, other)
+			continue
+		}
+		outputs[outputPath] = arg
+		d.manifest = manifest
+		d.outputPath = outputPath
+		total += manifest.FileSize
+	}
+
+	// Warn early if the disk clearly can't hold the files
+	if free, err := file.FreeSpace(downloadsDir); err == nil && free < total {
+		fmt.Printf("Warning: the files need %d bytes but only %d bytes are free in %s\n", total, free, downloadsDir)
+	}
+
+	budgetSize := defaultDownloadBudget
+	if cmd.Flags().Changed("max-parallel") {
+		budgetSize = maxParallel
+	}
+	budget := goshare.NewBudget(budgetSize, perPeer, downloadLimit)
+
+	if len(outputs) > 0 {
+		fmt.Printf("Downloading %d files (%s)...\n", len(outputs), formatBytes(total))
+	}
+	bar := newProgressBar(os.Stdout, quiet)
+	progress := newCombinedProgress(len(downloads), total, bar.Update)
+	var wg sync.WaitGroup
+	for i, d := range downloads {
+		if d.err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, d *fileDownload) {
+			defer wg.Done()
+			d.err = downloadOne(ctx, cmd, d, hashKey, events, budget, progress.forFile(i), downloadsDir)
+		}(i, d)
+	}
+	wg.Wait()
+	bar.Finish()
+
+	// Report each file's outcome
+	failed := 0
+	for _, d := range downloads {
+		if d.err != nil {
+			failed++
+			fmt.Printf("FAILED %s: %v\n", d.arg, d.err)
+			continue
+		}
+		fmt.Printf("OK     %s: %s saved to %s\n", d.arg, formatBytes(d.manifest.FileSize), d.outputPath)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d downloads failed", failed, len(downloads))
+	}
+	fmt.Printf("All %d files downloaded successfully\n", len(downloads))
+	return nil
+}
+
+// downloadOne downloads one of downloadMany's files within budget, resuming
+// from its .part file as a single download would.
+func downloadOne(ctx context.Context, cmd *cobra.Command, d *fileDownload, hashKey []byte, events *goshare.EventBus, budget *goshare.Budget, progress func(done, total int64), downloadsDir string) error {
+	peers, err := findDownloadPeers(ctx, d.manifest)
+	if err != nil {
+		return err
+	}
+	opts := downloadOptions(cmd, d.manifest, d.arg, d.outputPath, peers, hashKey, events)
+	// The budget caps the rate of all the downloads together
+	opts.RateLimit = 0
+	opts.Budget = budget
+	opts.Progress = progress
+
+	partPath, resuming, err := preparePartFile(d.manifest, d.outputPath)
+	if err != nil {
+		return err
+	}
+	if resuming {
+		_, err = goshare.Resume(ctx, d.manifest, opts)
+	} else {
+		_, err = goshare.Download(ctx, d.manifest, opts)
+	}
+	if err != nil {
+		return describeDownloadError(err, downloadsDir, partPath)
+	}
+	return nil
+}
+
+// combinedProgress adds up the progress of several downloads, so that one
+// progress bar shows them all.
+type combinedProgress struct {
+	mu     sync.Mutex
+	done   []int64 // Bytes downloaded so far, by file
+	sum    int64   // Total of done
+	total  int64
+	update func(done, total int64)
+}
+
+// newCombinedProgress creates a combinedProgress for n files totalling total
+// bytes, reporting their combined progress to update.
+func newCombinedProgress(n int, total int64, update func(done, total int64)) *combinedProgress {
+	return &combinedProgress{done: make([]int64, n), total: total, update: update}
+}
+
+// forFile returns the DownloadOptions.Progress callback of the i-th file.
+func (p *combinedProgress) forFile(i int) func(done, total int64) {
+	return func(done, _ int64) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.sum += done - p.done[i]
+		p.done[i] = done
+		p.update(p.sum, p.total)
+	}
+}
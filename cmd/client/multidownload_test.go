@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/timskillet/go-share/internal/peer"
+	"github.com/timskillet/go-share/pkg/goshare"
+)
+
+func TestCombinedProgress(t *testing.T) {
+	var done, total int64
+	p := newCombinedProgress(2, 300, func(d, tot int64) { done, total = d, tot })
+	first, second := p.forFile(0), p.forFile(1)
+
+	// Each file reports its own running total, which the bar adds up
+	for _, step := range []struct {
+		update func(done, total int64)
+		done   int64
+		want   int64
+	}{
+		{first, 50, 50},
+		{second, 20, 70},
+		{first, 100, 120},
+		{second, 200, 300},
+	} {
+		step.update(step.done, 0)
+		if done != step.want || total != 300 {
+			t.Fatalf("combined progress %d of %d, want %d of 300", done, total, step.want)
+		}
+	}
+}
+
+func TestDownloadSeveralManifests(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	ctx := context.Background()
+	store := peer.NewFileStore()
+	defer store.Close()
+	contents := map[string]string{
+		"first.txt":  strings.Repeat("first of several ", 300),
+		"second.txt": strings.Repeat("second of several ", 250),
+	}
+	var manifests []string
+	for name, content := range contents {
+		path := writeFile(t, name, content)
+		manifest, err := goshare.Upload(ctx, path, goshare.UploadOptions{ChunkSize: 1 << 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Add(path, manifest); err != nil {
+			t.Fatal(err)
+		}
+		manifests = append(manifests, goshare.ManifestPath(path, false))
+	}
+	// One seeder serves both files
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- peer.ServeStore(ln, store, peer.ServerOptions{}) }()
+	defer func() {
+		ln.Close()
+		<-served
+	}()
+	peerAddr := "127.0.0.1:" + strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+	outDir := t.TempDir()
+	args := append([]string{"download"}, manifests...)
+	args = append(args, "--peer", peerAddr, "--tracker", hungTracker(t), "--timeout", "10s", "--max-parallel", "2", "--output", outDir)
+	if err := runCLI(t, args...); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range contents {
+		if got, err := os.ReadFile(filepath.Join(outDir, name)); err != nil || string(got) != content {
+			t.Fatalf("%s doesn't match the original: %v", name, err)
+		}
+	}
+	resetFlags()
+
+	// A manifest that can't be loaded fails on its own, without stopping the others
+	outDir = t.TempDir()
+	args = append([]string{"download", filepath.Join(t.TempDir(), "missing.manifest")}, manifests...)
+	args = append(args, "--peer", peerAddr, "--tracker", hungTracker(t), "--timeout", "10s", "--output", outDir)
+	if err := runCLI(t, args...); err == nil || !strings.Contains(err.Error(), "1 of 3 downloads failed") {
+		t.Fatalf("download returned %v, want 1 of 3 downloads failed", err)
+	}
+	for name := range contents {
+		if _, err := os.Stat(filepath.Join(outDir, name)); err != nil {
+			t.Fatalf("%s wasn't downloaded alongside the missing manifest: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	progressBarWidth   = 30                     // Width of the bar in characters
+	progressRateWindow = 5 * time.Second        // Window used to compute the transfer rate
+	progressRedraw     = 100 * time.Millisecond // Minimum time between redraws of the bar
+	progressLogStep    = 10                     // Percentage step between log lines
+)
+
+// progressSample is a point-in-time byte count used to compute the transfer rate.
+type progressSample struct {
+	at    time.Time
+	bytes int64
+}
+
+// progressBar renders download progress. On a terminal it draws a bar that updates
+// in place; otherwise (or when quiet) it prints a plain line every progressLogStep
+// percent, which is friendlier to log files.
+type progressBar struct {
+	mu         sync.Mutex
+	out        io.Writer
+	inPlace    bool             // Whether to redraw a bar in place
+	samples    []progressSample // Samples within progressRateWindow, oldest first
+	lastDraw   time.Time        // When the bar was last drawn
+	lastLogged int              // Last percentage printed in log mode
+	drawn      bool             // Whether anything is on the current line
+}
+
+// newProgressBar creates a progress bar writing to out. The bar is drawn in place
+// only when out is a terminal and quiet is false.
+func newProgressBar(out *os.File, quiet bool) *progressBar {
+	return &progressBar{
+		out:        out,
+		inPlace:    !quiet && isTerminal(out),
+		lastLogged: -1,
+	}
+}
+
+// isTerminal reports whether f is a character device such as a TTY.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Update records that done of total bytes have been transferred and redraws.
+// It has the signature of peer.DownloadOptions.Progress.
+func (p *progressBar) Update(done, total int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	p.samples = append(p.samples, progressSample{at: now, bytes: done})
+	for len(p.samples) > 2 && now.Sub(p.samples[0].at) > progressRateWindow {
+		p.samples = p.samples[1:]
+	}
+
+	percent := 100
+	if total > 0 {
+		percent = int(done * 100 / total)
+	}
+
+	if !p.inPlace {
+		if step := percent / progressLogStep * progressLogStep; step > p.lastLogged {
+			p.lastLogged = step
+			fmt.Fprintf(p.out, "Downloaded %d%% (%s of %s, %s/s)\n",
+				step, formatBytes(done), formatBytes(total), formatBytes(int64(p.rate())))
+		}
+		return
+	}
+
+	if done < total && now.Sub(p.lastDraw) < progressRedraw {
+		return
+	}
+	p.lastDraw = now
+
+	filled := progressBarWidth * percent / 100
+	bar := strings.Repeat("=", filled)
+	if filled < progressBarWidth {
+		bar += ">" + strings.Repeat(" ", progressBarWidth-filled-1)
+	}
+
+	eta := "--"
+	if rate := p.rate(); rate > 0 {
+		eta = time.Duration(float64(total-done) / rate * float64(time.Second)).Round(time.Second).String()
+	}
+
+	fmt.Fprintf(p.out, "\r\033[K[%s] %3d%%  %s/s  ETA %s", bar, percent, formatBytes(int64(p.rate())), eta)
+	p.drawn = true
+}
+
+// Finish clears the bar so that subsequent output starts on a clean line.
+// It is safe to call on both success and error.
+func (p *progressBar) Finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.inPlace && p.drawn {
+		fmt.Fprint(p.out, "\r\033[K")
+		p.drawn = false
+	}
+}
+
+// rate returns the transfer rate in bytes per second over the sample window.
+func (p *progressBar) rate() float64 {
+	if len(p.samples) < 2 {
+		return 0
+	}
+	first, last := p.samples[0], p.samples[len(p.samples)-1]
+	elapsed := last.at.Sub(first.at).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(last.bytes-first.bytes) / elapsed
+}
+
+// formatBytes formats n as a human-readable size using binary units.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/timskillet/go-share/pkg/goshare"
+)
+
+var rechunkManifest string
+
+// rechunkCmd represents the rechunk command
+var rechunkCmd = &cobra.Command{
+	Use:   "rechunk [file|directory] --chunk-size SIZE",
+	Short: "Regenerate a file's manifest with a different chunk size",
+	Long: `Create a new manifest for a file that has already been uploaded, using a
+different chunk size or chunking strategy, e.g. to share it in a swarm that uses
+4M chunks. The file is hashed again, and must still match the file hash in its
+existing manifest, so the new manifest identifies the same file. Its trackers,
+keyed hashing, and byte range are carried over.
+
+The existing manifest is read from --manifest, or the .manifest (or .manifest.gz)
+next to the file. The new manifest replaces it, so a later upload with the same
+--chunk-size reuses it.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := args[0]
+
+		manifestPath := rechunkManifest
+		if manifestPath == "" {
+			manifestPath = goshare.ManifestPath(path, false)
+			if _, err := os.Stat(manifestPath); errors.Is(err, os.ErrNotExist) {
+				if _, err := os.Stat(goshare.ManifestPath(path, true)); err == nil {
+					manifestPath = goshare.ManifestPath(path, true)
+				}
+			}
+		}
+		manifest, err := goshare.LoadManifestLimit(manifestPath, maxManifestSize)
+		if err != nil {
+			return fmt.Errorf("error loading manifest: %v", err)
+		}
+		sameChunking := manifest.Chunking == chunking || (manifest.Chunking == "" && chunking == goshare.ChunkingFixed)
+		if manifest.ChunkSize == chunkSize && sameChunking {
+			return fmt.Errorf("%s already uses %d-byte %s chunks", manifestPath, chunkSize, chunking)
+		}
+
+		hashKey, err := loadHashKey(hashKeyName)
+		if err != nil {
+			return err
+		}
+		if manifest.IsKeyed() && hashKey == nil {
+			return fmt.Errorf("%s uses keyed hashing; pass its group key with --hash-key (fingerprint %s)", manifestPath, manifest.KeyFingerprint)
+		}
+
+		rechunked, err := goshare.Rechunk(context.Background(), path, manifest, goshare.UploadOptions{
+			ChunkSize:        chunkSize,
+			Chunking:         chunking,
+			CompressManifest: compressManifest,
+			HashKey:          hashKey,
+		})
+		if err != nil {
+			if errors.Is(err, goshare.ErrContentChanged) {
+				return fmt.Errorf("error rechunking: %v\nThe file was modified; upload it again to create a new manifest", err)
+			}
+			return fmt.Errorf("error rechunking: %v", err)
+		}
+
+		fmt.Printf("Rechunked %s: %d chunks of %s -> %d chunks of %s\n", rechunked.FileName,
+			len(manifest.Chunks), formatBytes(manifest.ChunkSize), len(rechunked.Chunks), formatBytes(rechunked.ChunkSize))
+		fmt.Printf("File hash unchanged: %s\n", rechunked.FileHash)
+		return nil
+	},
+}
+
+func init() {
+	rechunkCmd.Flags().Var((*byteSize)(&chunkSize), "chunk-size", "New chunk size in bytes, optionally with a K, M, or G suffix (target average size with --chunking cdc)")
+	rechunkCmd.Flags().StringVar(&chunking, "chunking", goshare.ChunkingFixed, "New chunking strategy: fixed, or cdc for content-defined chunks")
+	rechunkCmd.Flags().StringVar(&rechunkManifest, "manifest", "", "Existing manifest of the file (default: the .manifest next to it)")
+	rechunkCmd.Flags().BoolVar(&compressManifest, "compress-manifest", false, "Save the new manifest gzip-compressed as .manifest.gz")
+	rechunkCmd.Flags().StringVar(&hashKeyName, "hash-key", "", "Symmetric key (name in the key directory, or path) of a file shared with --hash-key")
+	rechunkCmd.MarkFlagRequired("chunk-size")
+
+	rootCmd.AddCommand(rechunkCmd)
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"github.com/timskillet/go-share/internal/file"
+	"github.com/timskillet/go-share/internal/peer"
+	"github.com/timskillet/go-share/internal/seedstate"
+	"github.com/timskillet/go-share/internal/tracker"
+)
+
+var (
+	seedStatePath string
+	remember      bool
+	listSeeds     bool
+	forgetSeed    string
+)
+
+// resumeSeedCmd represents the resume-seed command
+var resumeSeedCmd = &cobra.Command{
+	Use:   "resume-seed",
+	Short: "Resume seeding every file recorded by earlier uploads",
+	Long: `Serve and re-announce every file that upload was seeding, as recorded in the
+seed state file (--seed-state), for example after a reboot. Files that have
+been moved or changed since are skipped with a warning; the rest are served
+until interrupted and then unannounced.
+
+Upload records each file it seeds unless --remember=false is given, and removes
+it again once a --seed-time or --seed-uploads limit is reached. Use --list to
+show the recorded files and --forget to stop resuming one of them.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, err := resolveSeedState()
+		if err != nil {
+			return err
+		}
+		if forgetSeed != "" {
+			forgotten, err := seedstate.Forget(path, forgetSeed)
+			if err != nil {
+				return fmt.Errorf("error updating seed state: %v", err)
+			}
+			if !forgotten {
+				return fmt.Errorf("no seeding session recorded for %s", forgetSeed)
+			}
+			fmt.Printf("Forgot %s\n", forgetSeed)
+			return nil
+		}
+
+		state, err := seedstate.Load(path)
+		if err != nil {
+			return fmt.Errorf("error loading seed state: %v", err)
+		}
+		if listSeeds {
+			for _, e := range state.Seeds {
+				fmt.Printf("%s  %s (port %d)\n", e.FileHash, e.FilePath, e.Port)
+			}
+			return nil
+		}
+		if len(state.Seeds) == 0 {
+			fmt.Printf("No seeding sessions recorded in %s\n", path)
+			return nil
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		seeds, err := resumeSeeds(ctx, state.Seeds, peer.TCPTransport{})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Resumed seeding %d of %d recorded files. Keep this terminal open to serve them.\n", len(seeds.entries), len(state.Seeds))
+
+		<-ctx.Done()
+		seeds.close()
+		return nil
+	},
+}
+
+// resumedSeeds is a set of recorded seeding sessions re-established by
+// resumeSeeds: one server per port, and a re-announce loop per file and tracker.
+type resumedSeeds struct {
+	entries   []seedstate.Entry       // Sessions that could be resumed
+	stores    map[int]*peer.FileStore // Files served on each port
+	tokens    map[string]string       // Access tokens of private files, by file hash
+	listeners []net.Listener
+	served    sync.WaitGroup
+	stop      context.CancelFunc // Stops the re-announce loops
+	announced sync.WaitGroup
+
+	mu         sync.Mutex                    // Guards unannounce
+	unannounce map[string]context.CancelFunc // Stops the re-announce loops of each file, by file hash
+}
+
+// resumeSeeds serves the files of entries over t and announces each of them to
+// its trackers. Entries whose file or manifest can't be loaded are skipped
+// with a warning. A tracker that can't be reached is retried at the next
+// --announce-interval rather than failing the others.
+func resumeSeeds(ctx context.Context, entries []seedstate.Entry, t peer.Transport) (*resumedSeeds, error) {
+	r := &resumedSeeds{
+		stores:     make(map[int]*peer.FileStore),
+		tokens:     make(map[string]string),
+		stop:       func() {},
+		unannounce: make(map[string]context.CancelFunc),
+	}
+
+	// Share each recorded file from the store for its port
+	for _, e := range entries {
+		if err := r.add(e); err != nil {
+			fmt.Printf("Warning: skipping %s: %v\n", e.FilePath, err)
+			continue
+		}
+		r.entries = append(r.entries, e)
+	}
+	if len(r.entries) == 0 {
+		r.close()
+		return nil, errors.New("none of the recorded files can be seeded")
+	}
+
+	for port, store := range r.stores {
+		ln, err := t.Listen(":" + strconv.Itoa(port))
+		if err != nil {
+			r.close()
+			return nil, fmt.Errorf("error listening on port %d: %v", port, err)
+		}
+		r.listeners = append(r.listeners, ln)
+		r.served.Add(1)
+		go func(ln net.Listener, store *peer.FileStore) {
+			defer r.served.Done()
+			peer.ServeStore(ln, store, peer.ServerOptions{ServeManifest: serveManifest, AccessTokens: r.tokens, OnFileGone: r.fileGone})
+		}(ln, store)
+	}
+
+	// Announce every file and keep the registrations fresh until close
+	loopCtx, stop := context.WithCancel(context.Background())
+	r.stop = stop
+	for _, e := range r.entries {
+		e := e
+		fmt.Printf("Seeding %s (%s)\n", e.FilePath, e.FileHash)
+		fileCtx, unannounce := context.WithCancel(loopCtx)
+		r.mu.Lock()
+		r.unannounce[e.FileHash] = unannounce
+		r.mu.Unlock()
+		for _, url := range e.Trackers {
+			url := url
+			client := tracker.NewTrackerClient(url, trackerTimeout)
+			req := tracker.AnnounceRequest{FileHash: e.FileHash, Address: e.Address, Port: e.Port}
+			if err := client.Announce(ctx, req); err != nil {
+				fmt.Printf("Error announcing %s to %s: %v\n", e.FilePath, url, err)
+			}
+			onError := func(err error) {
+				fmt.Printf("Error re-announcing %s to %s: %v\n", e.FilePath, url, err)
+			}
+			r.announced.Add(1)
+			go func() {
+				defer r.announced.Done()
+				if err := client.KeepAnnounced(fileCtx, req, announceInterval, onError); err != nil {
+					fmt.Printf("Error unannouncing %s from %s: %v\n", e.FilePath, url, err)
+				}
+			}()
+		}
+	}
+	return r, nil
+}
+
+// fileGone unannounces a file found truncated or deleted while it was served,
+// which its server no longer serves.
+func (r *resumedSeeds) fileGone(fileHash string, err error) {
+	r.mu.Lock()
+	unannounce, ok := r.unannounce[fileHash]
+	r.mu.Unlock()
+	if ok {
+		unannounce()
+	}
+	fmt.Printf("Stopped seeding %s and unannounced it: %v\n", fileHash, err)
+}
+
+// add loads the manifest of e and shares its file from the store for e's port.
+func (r *resumedSeeds) add(e seedstate.Entry) error {
+	manifest, err := file.LoadManifest(e.ManifestPath)
+	if err != nil {
+		return fmt.Errorf("error loading manifest: %v", err)
+	}
+	if manifest.FileHash != e.FileHash {
+		return fmt.Errorf("manifest %s now describes %s, not %s; upload the file again", e.ManifestPath, manifest.FileHash, e.FileHash)
+	}
+	// Files uploaded with --access-token stay private
+	if manifest.AccessToken != "" {
+		r.tokens[manifest.FileHash] = manifest.AccessToken
+	}
+	if manifest.IsKeyed() {
+		hashKey, err := loadHashKey(e.HashKey)
+		if err != nil {
+			return err
+		}
+		if err := manifest.SetHashKey(hashKey); err != nil {
+			return err
+		}
+	}
+
+	store, ok := r.stores[e.Port]
+	if !ok {
+		store = peer.NewFileStore()
+		r.stores[e.Port] = store
+	}
+	if manifest.IsDir() {
+		dir, err := file.OpenDir(e.FilePath, manifest)
+		if err != nil {
+			return err
+		}
+		if err := store.AddReader(dir, dir.Size(), manifest); err != nil {
+			dir.Close()
+			return err
+		}
+		return nil
+	}
+	return store.Add(e.FilePath, manifest)
+}
+
+// close unannounces every file and stops serving them.
+func (r *resumedSeeds) close() {
+	r.stop()
+	r.announced.Wait()
+	for _, ln := range r.listeners {
+		ln.Close()
+	}
+	r.served.Wait()
+	for _, store := range r.stores {
+		store.Close()
+	}
+}
+
+// recordSeed remembers that the file at filePath, described by the manifest
+// saved at manifestPath, is being seeded, so that resume-seed can seed it again.
+func recordSeed(filePath, manifestPath string, manifest *file.Manifest, address string, port int) error {
+	path, err := resolveSeedState()
+	if err != nil {
+		return err
+	}
+	if filePath, err = filepath.Abs(filePath); err != nil {
+		return err
+	}
+	if manifestPath, err = filepath.Abs(manifestPath); err != nil {
+		return err
+	}
+	// A key given by path must still be found from another directory
+	hashKey := hashKeyName
+	if _, err := os.Stat(hashKey); hashKey != "" && err == nil {
+		if hashKey, err = filepath.Abs(hashKey); err != nil {
+			return err
+		}
+	}
+	return seedstate.Record(path, seedstate.Entry{
+		FileHash:     manifest.FileHash,
+		FilePath:     filePath,
+		ManifestPath: manifestPath,
+		Trackers:     manifestTrackers(),
+		Address:      address,
+		Port:         port,
+		HashKey:      hashKey,
+	})
+}
+
+// forgetSeedFor removes the recorded seeding session of fileHash, if any.
+func forgetSeedFor(fileHash string) error {
+	path, err := resolveSeedState()
+	if err != nil {
+		return err
+	}
+	_, err = seedstate.Forget(path, fileHash)
+	return err
+}
+
+// resolveSeedState returns the seed state file given with --seed-state, or the default one.
+func resolveSeedState() (string, error) {
+	if seedStatePath != "" {
+		return seedStatePath, nil
+	}
+	path, err := seedstate.DefaultPath()
+	if err != nil {
+		return "", fmt.Errorf("error finding seed state file (use --seed-state): %v", err)
+	}
+	return path, nil
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&seedStatePath, "seed-state", "", "File recording what upload is seeding, for resume-seed (default: go-share/seeds.json in the user config directory)")
+	uploadCmd.Flags().BoolVar(&remember, "remember", true, "Record the file in the seed state so resume-seed can seed it again after a restart")
+
+	resumeSeedCmd.Flags().BoolVar(&listSeeds, "list", false, "List the recorded seeding sessions instead of resuming them")
+	resumeSeedCmd.Flags().StringVar(&forgetSeed, "forget", "", "Remove the recorded seeding session of this file hash")
+	resumeSeedCmd.Flags().DurationVar(&announceInterval, "announce-interval", 0, "How often to re-announce the files to their trackers (default: a third of each tracker's peer TTL, or 5m if peers never expire; never over half the TTL)")
+	resumeSeedCmd.Flags().BoolVar(&serveManifest, "serve-manifest", true, "Hand the files' manifests to peers that only know a file hash")
+	rootCmd.AddCommand(resumeSeedCmd)
+}
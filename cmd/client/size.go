@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// byteSize is an int64 flag value holding a number of bytes. Besides plain
+// numbers it accepts binary unit suffixes, such as 512K or 4M.
+type byteSize int64
+
+func (s *byteSize) String() string {
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *byteSize) Set(value string) error {
+	n, err := parseByteSize(value)
+	if err != nil {
+		return err
+	}
+	*s = byteSize(n)
+	return nil
+}
+
+func (s *byteSize) Type() string {
+	return "size"
+}
+
+// parseByteSize parses a number of bytes with an optional K, M, or G suffix
+// (powers of 1024, optionally followed by "B" or "iB", in any case).
+func parseByteSize(value string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "IB"), "B")
+
+	multiplier := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		}
+		if multiplier > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q: use a number of bytes, optionally with a K, M, or G suffix", value)
+	}
+	if n > (1<<63-1)/multiplier {
+		return 0, fmt.Errorf("size %q is too large", value)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"github.com/timskillet/go-share/internal/file"
+	"github.com/timskillet/go-share/internal/torrent"
+	"github.com/timskillet/go-share/pkg/goshare"
+)
+
+var (
+	torrentOutput   string
+	torrentAnnounce []string
+)
+
+// exportTorrentCmd represents the export-torrent command
+var exportTorrentCmd = &cobra.Command{
+	Use:   "export-torrent [manifest|file-hash] [file]",
+	Short: "Convert a manifest into a BitTorrent v2 .torrent file",
+	Long: `Create a BitTorrent v2 .torrent file for a shared file, so that it can also be
+seeded and downloaded with standard BitTorrent clients. Each chunk becomes a
+piece, so the file must use fixed-size chunks whose size is a power of two of
+at least 16K (such as the default 1M); use rechunk otherwise.
+
+BitTorrent v2 hashes pieces as SHA-256 Merkle trees, so the file is read to
+compute them, and must still match the manifest. It is found next to the
+manifest unless given. go-share trackers don't speak the BitTorrent tracker
+protocol; pass BitTorrent trackers with --announce, or let clients find peers
+through DHT.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		manifest, err := loadManifestArg(context.Background(), args[0])
+		if err != nil {
+			return fmt.Errorf("error loading manifest: %v", err)
+		}
+
+		var filePath string
+		switch {
+		case len(args) > 1:
+			filePath = args[1]
+		case isFileHash(args[0]):
+			return fmt.Errorf("specify the file to export, since the manifest was fetched by file hash")
+		default:
+			filePath = filepath.Join(filepath.Dir(args[0]), manifest.FileName)
+		}
+		f, err := os.Open(filePath)
+		if err != nil {
+			return fmt.Errorf("error opening file: %v", err)
+		}
+		defer f.Close()
+
+		t, err := torrent.Export(manifest, f, torrent.ExportOptions{Announce: torrentAnnounce})
+		if err != nil {
+			if errors.Is(err, file.ErrContentChanged) {
+				return fmt.Errorf("error exporting torrent: %v\nThe file was modified; upload it again to create a new manifest", err)
+			}
+			return fmt.Errorf("error exporting torrent: %v", err)
+		}
+
+		outPath := torrentOutput
+		if outPath == "" {
+			outPath = manifest.FileName + ".torrent"
+		}
+		if err := os.WriteFile(outPath, t.Data, 0644); err != nil {
+			return fmt.Errorf("error saving torrent: %v", err)
+		}
+		fmt.Printf("Torrent saved as %s\n", outPath)
+		fmt.Printf("Info hash (v2): %x\n", t.InfoHash)
+		return nil
+	},
+}
+
+// importTorrentCmd represents the import-torrent command
+var importTorrentCmd = &cobra.Command{
+	Use:   "import-torrent [file.torrent] [file]",
+	Short: "Convert a BitTorrent v2 .torrent file into a manifest",
+	Long: `Create a manifest for the file of a single-file BitTorrent v2 torrent, with
+one chunk per piece. Chunks are verified against the torrent's piece hashes, so
+the file can be downloaded from go-share peers seeding it under this manifest.
+
+If a local copy of the file is given, it is checked against the torrent and the
+manifest is saved next to it, where upload --chunk-size <piece length> reuses it
+to seed the file. Otherwise the manifest is saved in the current directory.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		data, err := os.ReadFile(args[0])
+		if err != nil {
+			return fmt.Errorf("error reading torrent: %v", err)
+		}
+		manifest, err := torrent.Import(data)
+		if err != nil {
+			return fmt.Errorf("error importing torrent: %v", err)
+		}
+
+		// The manifest is saved next to the local copy, or else where the file
+		// would be downloaded to the current directory
+		base := manifest.FileName
+		if len(args) > 1 {
+			base = args[1]
+			report, err := file.VerifyFile(manifest, base)
+			if err != nil {
+				return fmt.Errorf("error verifying file: %v", err)
+			}
+			if !report.OK() {
+				return fmt.Errorf("%s doesn't match the torrent: %d of %d pieces are bad", base, len(report.BadChunks), len(manifest.Chunks))
+			}
+			info, err := os.Stat(base)
+			if err != nil {
+				return fmt.Errorf("error verifying file: %v", err)
+			}
+			if info.Name() != manifest.FileName {
+				return fmt.Errorf("%s is named %s in the torrent; rename it so that upload finds its manifest", base, manifest.FileName)
+			}
+			// Let upload reuse the manifest until the file changes
+			manifest.SourceModTime = info.ModTime().UnixNano()
+		}
+		if err := file.SaveManifest(manifest, base); err != nil {
+			return fmt.Errorf("error saving manifest: %v", err)
+		}
+		manifestPath := goshare.ManifestPath(base, false)
+
+		fmt.Printf("Manifest saved as %s: %s, %d pieces of %s\n", manifestPath, formatBytes(manifest.FileSize), len(manifest.Chunks), formatBytes(manifest.ChunkSize))
+		fmt.Printf("File hash (pieces root): %s\n", manifest.FileHash)
+		return nil
+	},
+}
+
+func init() {
+	exportTorrentCmd.Flags().StringVarP(&torrentOutput, "output", "o", "", "Where to save the torrent (default: the file's name with .torrent appended, in the current directory)")
+	exportTorrentCmd.Flags().StringArrayVar(&torrentAnnounce, "announce", nil, "URL of a BitTorrent tracker to record in the torrent (repeatable; the first is the main tracker)")
+
+	rootCmd.AddCommand(exportTorrentCmd)
+	rootCmd.AddCommand(importTorrentCmd)
+}
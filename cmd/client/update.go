@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"github.com/timskillet/go-share/internal/peer"
+)
+
+var updateOutput string
+
+// updateCmd represents the update command
+var updateCmd = &cobra.Command{
+	Use:   "update [oldfile] [newmanifest]",
+	Short: "Update a local file to a new version, downloading only changed chunks",
+	Long: `Update an old copy of a file to the version described by a new manifest.
+Chunks of the new version that already exist in the old file are copied locally,
+and only the chunks that changed are downloaded from peers. By default the old
+file is replaced once the new version has been assembled and verified.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		oldPath, manifestPath := args[0], args[1]
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		manifest, err := loadManifestArg(ctx, manifestPath)
+		if err != nil {
+			return fmt.Errorf("error loading manifest: %v", err)
+		}
+
+		// Peers are only needed if some chunks changed, so a missing swarm is
+		// reported by the update itself rather than up front
+		peers, err := lookupPeers(ctx, manifest)
+		if err != nil {
+			fmt.Printf("Warning: %v\n", err)
+		}
+
+		outputPath := updateOutput
+		if outputPath == "" {
+			outputPath = oldPath
+		}
+
+		opts := peer.DownloadOptions{
+			VerifyAfter: true,
+			MaxParallel: peer.DefaultMaxParallel(len(peers)),
+		}
+		reused, err := peer.UpdateFile(ctx, oldPath, manifest, peers, outputPath, opts)
+		if err != nil {
+			return fmt.Errorf("error updating file: %v", err)
+		}
+
+		fmt.Printf("Reused %d of %d chunks, downloaded %d\n", reused, len(manifest.Chunks), len(manifest.Chunks)-reused)
+		fmt.Printf("File updated successfully at %s\n", outputPath)
+		return nil
+	},
+}
+
+func init() {
+	updateCmd.Flags().StringVarP(&updateOutput, "output", "o", "", "Where to write the new version (default: replace the old file)")
+
+	rootCmd.AddCommand(updateCmd)
+}
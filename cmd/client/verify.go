@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"github.com/timskillet/go-share/internal/file"
+	"github.com/timskillet/go-share/pkg/goshare"
+)
+
+var (
+	verifyRemote bool
+	verifySample int
+)
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify [manifest|file-hash] [file]",
+	Short: "Check a file, or the peers serving it, against its manifest",
+	Long: `Check a local copy of a file against its manifest, reporting any chunks whose
+data doesn't match.
+
+With --remote, check the peers serving the file instead: a random sample of
+--sample chunks is fetched from each peer the tracker knows and checked against
+the manifest's hashes, without downloading the whole file. Peers serving bad
+data, such as poisoned seeders, are reported, and the command fails if there
+are any. Peers that can't be reached are listed but don't count as bad.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		ctx, cancel := withOptionalTimeout(ctx, timeout)
+		defer cancel()
+
+		manifest, err := loadManifestArg(ctx, args[0])
+		if err != nil {
+			return fmt.Errorf("error loading manifest: %v", err)
+		}
+		hashKey, err := loadHashKey(hashKeyName)
+		if err != nil {
+			return err
+		}
+		if manifest.IsKeyed() {
+			if hashKey == nil {
+				return fmt.Errorf("%s uses keyed hashing; pass its group key with --hash-key (fingerprint %s)", manifest.FileName, manifest.KeyFingerprint)
+			}
+			if err := manifest.SetHashKey(hashKey); err != nil {
+				return err
+			}
+		}
+
+		if verifyRemote {
+			if len(args) > 1 {
+				return fmt.Errorf("--remote checks peers, not a local file")
+			}
+			return verifyPeers(ctx, manifest)
+		}
+		if len(args) < 2 {
+			return fmt.Errorf("specify the file to check, or use --remote to check the peers serving it")
+		}
+		return verifyLocal(manifest, args[1])
+	},
+}
+
+// verifyLocal checks the file at path against manifest.
+func verifyLocal(manifest *goshare.Manifest, path string) error {
+	if manifest.IsDir() {
+		return fmt.Errorf("%s is a directory manifest; only single files can be checked locally", manifest.FileName)
+	}
+	report, err := file.VerifyFile(manifest, path)
+	if err != nil {
+		return fmt.Errorf("error verifying file: %v", err)
+	}
+	if !report.OK() {
+		return fmt.Errorf("%s doesn't match the manifest: %d of %d chunks are bad (%s)",
+			path, len(report.BadChunks), len(manifest.Chunks), formatChunks(report.BadChunks))
+	}
+	fmt.Printf("%s matches the manifest: all %d chunks and the file hash are correct\n", path, len(manifest.Chunks))
+	return nil
+}
+
+// verifyPeers checks a sample of chunks from every peer serving the manifest's
+// file and reports which serve good and bad data.
+func verifyPeers(ctx context.Context, manifest *goshare.Manifest) error {
+	if len(manifest.Chunks) == 0 {
+		fmt.Println("The file is empty; there is nothing to check")
+		return nil
+	}
+	peers, err := lookupPeers(ctx, manifest)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Checking %d peers with up to %d chunks each...\n", len(peers), verifySample)
+	reports, err := goshare.VerifyPeers(ctx, manifest, peers, goshare.VerifyPeersOptions{Sample: verifySample})
+	if err != nil {
+		return fmt.Errorf("error verifying peers: %v", err)
+	}
+
+	var good, bad int
+	for _, r := range reports {
+		addr := fmt.Sprintf("%s:%d", r.Peer.Address, r.Peer.Port)
+		switch {
+		case r.OK():
+			good++
+			fmt.Printf("  good         %s: %d chunks match\n", addr, len(r.Good))
+		case r.Unreachable():
+			fmt.Printf("  unreachable  %s: %v\n", addr, r.Err)
+		case len(r.BadChunks) > 0:
+			bad++
+			fmt.Printf("  BAD          %s: chunks %s don't match the manifest\n", addr, formatChunks(r.BadChunks))
+		default:
+			bad++
+			fmt.Printf("  BAD          %s: %v\n", addr, r.Err)
+		}
+	}
+
+	fmt.Printf("%d good, %d bad, %d unreachable\n", good, bad, len(reports)-good-bad)
+	if bad > 0 {
+		return fmt.Errorf("%d of %d peers serve data that doesn't match the manifest", bad, len(reports))
+	}
+	return nil
+}
+
+// formatChunks lists chunk indices for a message, e.g. "3, 7, 12".
+func formatChunks(indices []int) string {
+	s := make([]string, len(indices))
+	for i, index := range indices {
+		s[i] = fmt.Sprint(index)
+	}
+	return strings.Join(s, ", ")
+}
+
+func init() {
+	verifyCmd.Flags().BoolVar(&verifyRemote, "remote", false, "Check the peers serving the file instead of a local copy")
+	verifyCmd.Flags().IntVar(&verifySample, "sample", goshare.DefaultVerifySample, "With --remote, how many random chunks to fetch from each peer")
+	verifyCmd.Flags().StringVar(&hashKeyName, "hash-key", "", "Symmetric key (name in the key directory, or path) of a file shared with --hash-key")
+	verifyCmd.Flags().DurationVar(&timeout, "timeout", 0, "Abort if checking takes longer than this (0 means no timeout)")
+
+	rootCmd.AddCommand(verifyCmd)
+}
@@ -1,18 +1,40 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
-	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
-	"github.com/timskillet/go-share/internal/tracker"
+	"github.com/timskillet/go-share/pkg/goshare"
 )
 
 func main() {
-	t := tracker.NewTracker()
+	storeManifests := flag.Bool("store-manifests", false, "Accept and serve manifests on /manifest")
+	adminToken := flag.String("admin-token", "", "Bearer token required by admin endpoints such as DELETE /peer (disabled if empty)")
+	peerTTL := flag.Duration("peer-ttl", goshare.DefaultPeerTTL, "Drop peers that haven't re-announced a file for this long (0 keeps them until they unannounce)")
+	basePath := flag.String("base-path", "", "Serve the endpoints under this path prefix, e.g. /goshare behind a reverse proxy (clients then use the tracker URL with the prefix)")
+	flag.Parse()
 
-	http.HandleFunc("/announce", t.Announce)
-	http.HandleFunc("/peers", t.GetPeers)
+	t := goshare.NewTracker(goshare.TrackerOptions{
+		StoreManifests: *storeManifests,
+		AdminToken:     *adminToken,
+		PeerTTL:        *peerTTL,
+		BasePath:       *basePath,
+	})
 
-	log.Println("Tracker running on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *basePath != "" {
+		log.Printf("Tracker running on :8080 under %s\n", *basePath)
+	} else {
+		log.Println("Tracker running on :8080")
+	}
+	if err := t.ListenAndServe(ctx, ":8080"); err != nil && !errors.Is(err, context.Canceled) {
+		log.Fatal(err)
+	}
 }
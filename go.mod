@@ -2,9 +2,17 @@ module github.com/timskillet/go-share
 
 go 1.21
 
-require github.com/spf13/cobra v1.9.1
+require (
+	github.com/hashicorp/mdns v1.0.5
+	github.com/spf13/cobra v1.9.1
+)
 
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
+	github.com/miekg/dns v1.1.58 // indirect
 	github.com/spf13/pflag v1.0.6 // indirect
+	golang.org/x/mod v0.14.0 // indirect
+	golang.org/x/net v0.20.0 // indirect
+	golang.org/x/sys v0.16.0 // indirect
+	golang.org/x/tools v0.17.0 // indirect
 )
@@ -0,0 +1,206 @@
+// Package discovery finds peers on the local network without a tracker.
+// Seeders publish a DNS-SD service over mDNS for each file hash they serve, so
+// seeders and downloaders on the same LAN can find each other with no
+// configuration, and standard tools such as avahi-browse or dns-sd see them.
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/mdns"
+)
+
+// ServiceType is the DNS-SD service type seeders publish under.
+const ServiceType = "_goshare._tcp"
+
+// DefaultLookupWait is how long Lookup waits for answers by default.
+const DefaultLookupWait = time.Second
+
+// hashKey is the TXT record key holding the hash of the file a seeder serves.
+const hashKey = "hash="
+
+// maxLabelSize is the longest a DNS label, and so an instance name, can be.
+const maxLabelSize = 63
+
+// Peer is a seeder found on the local network.
+type Peer struct {
+	Address string `json:"address"` // IP address the seeder advertised
+	Port    int    `json:"port"`    // Port the seeder serves the file on
+}
+
+// Service announces the files this peer serves and looks up files served by
+// others on the local network. It is safe for concurrent use.
+type Service struct {
+	host string // Host name advertised in SRV records, ending in "."
+
+	mu      sync.Mutex
+	servers map[string]*mdns.Server // Responders for announced files, by file hash
+	closed  bool
+}
+
+// New returns a Service that has announced nothing yet. Call Close to stop
+// answering queries for the files it announces.
+func New() (*Service, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	host = strings.ReplaceAll(strings.TrimSuffix(host, "."), ".", "-")
+	return &Service{
+		host:    host + ".local.",
+		servers: make(map[string]*mdns.Server),
+	}, nil
+}
+
+// Announce publishes a service instance for fileHash on port and answers mDNS
+// queries for it, replacing any earlier announcement of the same hash.
+func (s *Service) Announce(fileHash string, port int) error {
+	if fileHash == "" {
+		return errors.New("discovery: empty file hash")
+	}
+	ips, err := localIPs()
+	if err != nil {
+		return err
+	}
+	instance := instanceName(fileHash, s.host, port)
+	zone, err := mdns.NewMDNSService(instance, ServiceType, "", s.host, port, ips, []string{hashKey + fileHash})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return net.ErrClosed
+	}
+	server, err := mdns.NewServer(&mdns.Config{Zone: zone})
+	if err != nil {
+		return err
+	}
+	if old, ok := s.servers[fileHash]; ok {
+		old.Shutdown()
+	}
+	s.servers[fileHash] = server
+	return nil
+}
+
+// Withdraw stops answering queries for fileHash.
+func (s *Service) Withdraw(fileHash string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if server, ok := s.servers[fileHash]; ok {
+		server.Shutdown()
+		delete(s.servers, fileHash)
+	}
+}
+
+// Lookup browses the local network for seeders of fileHash and collects answers
+// for wait (DefaultLookupWait if zero), or until ctx is done. It returns the
+// peers found, without duplicates; an empty result means no peer answered.
+func (s *Service) Lookup(ctx context.Context, fileHash string, wait time.Duration) ([]Peer, error) {
+	if wait <= 0 {
+		wait = DefaultLookupWait
+	}
+
+	entries := make(chan *mdns.ServiceEntry, 32)
+	queried := make(chan error, 1)
+	go func() {
+		queried <- mdns.Query(&mdns.QueryParam{
+			Service:             ServiceType,
+			Timeout:             wait,
+			Entries:             entries,
+			WantUnicastResponse: true,
+			DisableIPv6:         true,
+		})
+	}()
+
+	var peers []Peer
+	seen := make(map[Peer]bool)
+	for {
+		select {
+		case entry := <-entries:
+			p, ok := peerFor(entry, fileHash)
+			if ok && !seen[p] {
+				seen[p] = true
+				peers = append(peers, p)
+			}
+		case err := <-queried:
+			// Query stops sending once it returns, but entries it sent
+			// before may still be buffered
+			for len(entries) > 0 {
+				if p, ok := peerFor(<-entries, fileHash); ok && !seen[p] {
+					seen[p] = true
+					peers = append(peers, p)
+				}
+			}
+			return peers, err
+		case <-ctx.Done():
+			return peers, ctx.Err()
+		}
+	}
+}
+
+// Close withdraws every announced file.
+func (s *Service) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, server := range s.servers {
+		server.Shutdown()
+		delete(s.servers, hash)
+	}
+	s.closed = true
+	return nil
+}
+
+// peerFor returns the seeder described by entry if it serves fileHash.
+func peerFor(entry *mdns.ServiceEntry, fileHash string) (Peer, bool) {
+	if entry.AddrV4 == nil || entry.Port <= 0 || entry.Port > 65535 {
+		return Peer{}, false
+	}
+	for _, field := range entry.InfoFields {
+		if field == hashKey+fileHash {
+			return Peer{Address: entry.AddrV4.String(), Port: entry.Port}, true
+		}
+	}
+	return Peer{}, false
+}
+
+// instanceName names the service instance for fileHash served from host on
+// port. Browsers key answers by instance name, so it includes the host and port
+// to keep seeders of the same file apart, and is cut to fit in a DNS label.
+func instanceName(fileHash, host string, port int) string {
+	host = strings.TrimSuffix(host, ".local.")
+	name := fmt.Sprintf("%.16s-%d-%s", fileHash, port, host)
+	if len(name) > maxLabelSize {
+		name = name[:maxLabelSize]
+	}
+	return name
+}
+
+// localIPs returns the IPv4 addresses to advertise for this host: those of its
+// interfaces other than loopback, or the loopback address if there are none.
+func localIPs() ([]net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.To4() == nil {
+			continue
+		}
+		ips = append(ips, ipnet.IP)
+	}
+	if len(ips) == 0 {
+		ips = []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+	return ips, nil
+}
@@ -0,0 +1,90 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lookupWait is long enough for answers to arrive over loopback multicast.
+const lookupWait = 500 * time.Millisecond
+
+func newService(t *testing.T) *Service {
+	t.Helper()
+	s, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// testHash returns a file hash no other test run announces.
+func testHash(name string) string {
+	return strings.Repeat("0", 40) + name + time.Now().Format("150405.000000")
+}
+
+func TestInstancesFindEachOther(t *testing.T) {
+	seeder := newService(t)
+	downloader := newService(t)
+	hash := testHash("found")
+	other := testHash("other")
+
+	if err := seeder.Announce(hash, 9123); err != nil {
+		t.Skipf("multicast unavailable: %v", err)
+	}
+	if err := seeder.Announce(other, 9124); err != nil {
+		t.Fatal(err)
+	}
+
+	peers, err := downloader.Lookup(context.Background(), hash, lookupWait)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].Port != 9123 || peers[0].Address == "" {
+		t.Fatalf("Lookup found %+v, want the one seeder on port 9123", peers)
+	}
+	ips, _ := localIPs()
+	if !slices.ContainsFunc(ips, func(ip net.IP) bool { return ip.String() == peers[0].Address }) {
+		t.Errorf("found address %s, want one of this host's %v", peers[0].Address, ips)
+	}
+
+	// A withdrawn file is no longer found
+	seeder.Withdraw(hash)
+	peers, err = downloader.Lookup(context.Background(), hash, lookupWait)
+	if err != nil || len(peers) != 0 {
+		t.Fatalf("Lookup after Withdraw returned %+v, %v", peers, err)
+	}
+	peers, err = downloader.Lookup(context.Background(), other, lookupWait)
+	if err != nil || len(peers) != 1 || peers[0].Port != 9124 {
+		t.Fatalf("Lookup of the file still announced returned %+v, %v", peers, err)
+	}
+}
+
+func TestLookupStopsWithContext(t *testing.T) {
+	s := newService(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := s.Lookup(ctx, testHash("missing"), 5*time.Second); err != context.DeadlineExceeded {
+		t.Fatalf("Lookup returned %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Lookup took %v after its context expired", elapsed)
+	}
+}
+
+func TestInstanceNameFitsLabel(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	name := instanceName(hash, strings.Repeat("h", 80)+".local.", 9000)
+	if len(name) > maxLabelSize || !strings.HasPrefix(name, hash[:16]+"-9000-") {
+		t.Fatalf("instanceName returned %q", name)
+	}
+	if a, b := instanceName(hash, "a.local.", 9000), instanceName(hash, "b.local.", 9000); a == b {
+		t.Fatalf("seeders on different hosts share the instance name %q", a)
+	}
+}
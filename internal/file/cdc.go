@@ -0,0 +1,156 @@
+// Package file implements file handling functionality for the peer-to-peer file sharing system.
+// It provides utilities for creating file manifests, handling chunks, and managing file operations.
+package file
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Chunking strategies recorded in Manifest.Chunking.
+const (
+	ChunkingFixed = "fixed" // Every chunk but the last is exactly ChunkSize bytes
+	ChunkingCDC   = "cdc"   // Content-defined boundaries averaging ChunkSize bytes
+)
+
+// gearTable maps each byte value to a pseudo-random 64-bit value for the gear
+// rolling hash. It is generated from a fixed seed so that every peer computes the
+// same chunk boundaries for the same content.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	seed := uint64(0x9e3779b97f4a7c15)
+	for i := range table {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// cdcParams holds the boundary rules derived from a target average chunk size.
+type cdcParams struct {
+	min  int64  // No boundary is placed before this many bytes
+	max  int64  // A boundary is forced at this many bytes
+	mask uint64 // A boundary is placed where hash&mask == 0
+}
+
+// newCDCParams derives chunking parameters for the given average chunk size.
+// Chunks are between a quarter and four times the average.
+func newCDCParams(avg int64) cdcParams {
+	bits := uint(0)
+	for int64(1)<<bits < avg {
+		bits++
+	}
+	min := avg / 4
+	if min < 1 {
+		min = 1
+	}
+	return cdcParams{
+		min:  min,
+		max:  avg * 4,
+		mask: uint64(1)<<bits - 1,
+	}
+}
+
+// CreateManifestCDC creates a manifest using content-defined chunking.
+// Chunk boundaries are chosen with a gear rolling hash over the file's content,
+// so inserting or removing bytes only changes the chunks around the edit instead
+// of shifting every later chunk. avgChunkSize is the target average chunk size
+// and is recorded as the manifest's ChunkSize.
+func CreateManifestCDC(filePath string, avgChunkSize int64) (*Manifest, error) {
+	if avgChunkSize <= 0 {
+		return nil, fmt.Errorf("invalid chunk size %d", avgChunkSize)
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkChunkCount(EstimateChunks(fileInfo.Size(), avgChunkSize), fileInfo.Size(), avgChunkSize); err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{
+		FileName:      fileInfo.Name(),
+		FileSize:      fileInfo.Size(),
+		ChunkSize:     avgChunkSize,
+		Chunking:      ChunkingCDC,
+		Chunks:        []Chunk{},
+		SourceModTime: fileInfo.ModTime().UnixNano(),
+	}
+
+	// Hash the whole file and each chunk in a single pass, sampling each chunk's
+	// start to judge whether the content is compressible, and keeping the
+	// file's start to detect its content type
+	fileHash := sha256.New()
+	params := newCDCParams(avgChunkSize)
+	var sampler entropySampler
+	var sniffer contentSniffer
+	offset := int64(0)
+	err = splitCDC(bufio.NewReader(io.TeeReader(file, io.MultiWriter(fileHash, &sniffer))), params, func(data []byte) {
+		sampler.startChunk()
+		sampler.Write(data)
+		manifest.Chunks = append(manifest.Chunks, Chunk{
+			Hash:   fmt.Sprintf("%x", sha256.Sum256(data)),
+			Size:   int64(len(data)),
+			Offset: offset,
+		})
+		offset += int64(len(data))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := checkChunkCount(int64(len(manifest.Chunks)), fileInfo.Size(), avgChunkSize); err != nil {
+		return nil, err
+	}
+	manifest.FileHash = fmt.Sprintf("%x", fileHash.Sum(nil))
+	manifest.Compressible = sampler.compressible()
+	manifest.ContentType = sniffer.contentType()
+
+	return manifest, nil
+}
+
+// splitCDC reads r to the end, calling emit with the data of each
+// content-defined chunk in order. The slice passed to emit is reused afterwards.
+func splitCDC(r io.ByteReader, params cdcParams, emit func(data []byte)) error {
+	buf := make([]byte, 0, params.max)
+	var h uint64
+
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		buf = append(buf, b)
+		h = h<<1 + gearTable[b]
+
+		size := int64(len(buf))
+		if (size >= params.min && h&params.mask == 0) || size >= params.max {
+			emit(buf)
+			buf = buf[:0]
+			h = 0
+		}
+	}
+
+	// Emit the final partial chunk
+	if len(buf) > 0 {
+		emit(buf)
+	}
+	return nil
+}
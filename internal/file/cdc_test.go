@@ -0,0 +1,92 @@
+package file
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// changedChunks counts the chunks of b whose hash isn't among the chunks of a.
+func changedChunks(a, b *Manifest) int {
+	have := make(map[string]bool, len(a.Chunks))
+	for _, c := range a.Chunks {
+		have[c.Hash] = true
+	}
+	n := 0
+	for _, c := range b.Chunks {
+		if !have[c.Hash] {
+			n++
+		}
+	}
+	return n
+}
+
+func TestCDCInsertChangesFewChunks(t *testing.T) {
+	path, data := writeTestFile(t, "old.bin", 64*testChunkSize)
+	old, err := CreateManifestCDC(path, testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Insert one byte near the start of the file
+	edited := append(append(append([]byte{}, data[:1000]...), 'x'), data[1000:]...)
+	editedPath := filepath.Join(t.TempDir(), "new.bin")
+	if err := os.WriteFile(editedPath, edited, 0644); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := CreateManifestCDC(editedPath, testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := changedChunks(old, updated); n > 2 {
+		t.Errorf("inserting a byte changed %d of %d chunks, want at most 2", n, len(updated.Chunks))
+	}
+
+	// Fixed-size chunks all shift instead
+	oldFixed, err := CreateManifest(path, testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newFixed, err := CreateManifest(editedPath, testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := changedChunks(oldFixed, newFixed); n < len(newFixed.Chunks)-1 {
+		t.Errorf("fixed-size chunking changed only %d of %d chunks", n, len(newFixed.Chunks))
+	}
+}
+
+func TestCDCManifestLayout(t *testing.T) {
+	path, _ := writeTestFile(t, "data.bin", 32*testChunkSize+123)
+	manifest, err := CreateManifestCDC(path, testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Chunking != ChunkingCDC || manifest.ChunkSize != testChunkSize {
+		t.Fatalf("manifest records chunking %q with chunk size %d", manifest.Chunking, manifest.ChunkSize)
+	}
+
+	// Chunks are contiguous, within the size bounds, and verify against the file
+	report, err := VerifyFile(manifest, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("file doesn't verify against its CDC manifest: %+v", report)
+	}
+	params := newCDCParams(testChunkSize)
+	offset := int64(0)
+	for i, c := range manifest.Chunks {
+		if c.Offset != offset {
+			t.Fatalf("chunk %d at offset %d, want %d", i, c.Offset, offset)
+		}
+		if c.Size > params.max || (c.Size < params.min && i != len(manifest.Chunks)-1) {
+			t.Errorf("chunk %d is %d bytes, outside [%d, %d]", i, c.Size, params.min, params.max)
+		}
+		offset += c.Size
+	}
+	if offset != manifest.FileSize {
+		t.Fatalf("chunks cover %d bytes of a %d byte file", offset, manifest.FileSize)
+	}
+}
@@ -4,46 +4,80 @@ package file
 
 import (
 	"crypto/sha256"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"math/rand"
 	"os"
+	"sort"
 )
 
+// ErrHashMismatch is returned when chunk data doesn't match its hash in the manifest.
+var ErrHashMismatch = errors.New("chunk hash verification failed")
+
 // GetChunk retrieves a specific chunk from a file.
 // It reads the chunk data from the file and returns it as a byte slice.
-// The chunk is identified by its index in the manifest's chunks array.
+// The chunk is identified by its index in the manifest's chunks array, and is
+// read at the offset the manifest records for it and verified against its
+// hash, as by GetChunkAt. The file must have the size the manifest was
+// created from.
 func GetChunk(filePath string, manifest *Manifest, chunkIndex int) ([]byte, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
-
-	// Calculate the offset for this chunk
-	offset := int64(0)
-	for i := 0; i < len(manifest.Chunks); i++ {
-		if i == chunkIndex {
-			break
-		}
-		offset += manifest.Chunks[i].Size
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
 	}
 
-	// Seek to the chunk's position
-	if _, err := file.Seek(offset, 0); err != nil {
+	// Range manifests only describe part of the file
+	section, err := manifest.Section(file, info.Size())
+	if err != nil {
 		return nil, err
 	}
+	return GetChunkAt(section, manifest, chunkIndex)
+}
+
+// GetChunkAt retrieves a specific chunk from src, which holds the content
+// described by manifest. The chunk is read at its offset and verified against
+// its hash in the manifest before it is returned. Both come from the
+// manifest's record of the chunk, so the last chunk of a file whose size isn't
+// a multiple of the chunk size is returned with exactly its recorded size. If
+// src ends before the chunk does, the error wraps io.ErrUnexpectedEOF.
+func GetChunkAt(src io.ReaderAt, manifest *Manifest, chunkIndex int) ([]byte, error) {
+	return ReadChunkAt(src, manifest, chunkIndex, nil)
+}
 
-	// Read the chunk data
+// ReadChunkAt is like GetChunkAt, but reads the chunk into buf if it has room
+// for it, so that callers serving many chunks can reuse their buffers. The
+// returned slice shares buf's memory in that case.
+func ReadChunkAt(src io.ReaderAt, manifest *Manifest, chunkIndex int, buf []byte) ([]byte, error) {
+	if chunkIndex < 0 || chunkIndex >= len(manifest.Chunks) {
+		return nil, fmt.Errorf("chunk index %d out of range for %d chunks", chunkIndex, len(manifest.Chunks))
+	}
+
+	// Read the chunk data at its recorded offset
 	chunk := manifest.Chunks[chunkIndex]
-	data := make([]byte, chunk.Size)
-	if _, err := io.ReadFull(file, data); err != nil {
-		return nil, err
+	var data []byte
+	if int64(cap(buf)) >= chunk.Size {
+		data = buf[:chunk.Size]
+	} else {
+		data = make([]byte, chunk.Size)
+	}
+	// ReadAt may report io.EOF alongside a full read of the last chunk
+	if n, err := src.ReadAt(data, chunk.Offset); n < len(data) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("chunk %d: read %d of %d bytes at offset %d: %w", chunkIndex, n, len(data), chunk.Offset, err)
 	}
 
 	// Verify the chunk hash
-	hash := sha256.Sum256(data)
-	if fmt.Sprintf("%x", hash) != chunk.Hash {
-		return nil, fmt.Errorf("chunk hash verification failed")
+	if !manifest.VerifyChunk(chunk, data) {
+		return nil, ErrHashMismatch
 	}
 
 	return data, nil
@@ -55,7 +89,7 @@ func WriteChunk(file *os.File, chunk Chunk, data []byte) error {
 	// Verify the chunk hash
 	hash := sha256.Sum256(data)
 	if fmt.Sprintf("%x", hash) != chunk.Hash {
-		return fmt.Errorf("chunk hash verification failed")
+		return ErrHashMismatch
 	}
 
 	// Write the chunk data
@@ -66,9 +100,149 @@ func WriteChunk(file *os.File, chunk Chunk, data []byte) error {
 	return nil
 }
 
-// VerifyChunk verifies that a chunk's data matches its hash.
-// It returns true if the hash matches, false otherwise.
+// WriteChunkAt writes data as the chunk of manifest at chunkIndex, at the
+// chunk's offset in file. Unlike WriteChunk it does not depend on the file's
+// current position, so chunks can be written in any order. The chunk's hash is
+// verified before writing.
+func WriteChunkAt(file *os.File, manifest *Manifest, chunkIndex int, data []byte) error {
+	// Verify the chunk hash
+	chunk := manifest.Chunks[chunkIndex]
+	if !manifest.VerifyChunk(chunk, data) {
+		return ErrHashMismatch
+	}
+
+	// Write the chunk data at its offset
+	if _, err := file.WriteAt(data, chunk.Offset); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// VerifyChunk verifies that a chunk's data matches its SHA-256 hash.
+// It returns true if the hash matches, false otherwise. Chunks of keyed
+// manifests must be checked with Manifest.VerifyChunk instead.
 func VerifyChunk(chunk Chunk, data []byte) bool {
 	hash := sha256.Sum256(data)
 	return fmt.Sprintf("%x", hash) == chunk.Hash
 }
+
+// VerifyReport describes the result of checking a file against its manifest.
+type VerifyReport struct {
+	BadChunks  []int // Indices of chunks whose data doesn't match the manifest
+	FileHashOK bool  // Whether the whole file matches the manifest's FileHash
+}
+
+// OK reports whether every chunk and the whole-file hash matched.
+func (r *VerifyReport) OK() bool {
+	return len(r.BadChunks) == 0 && r.FileHashOK
+}
+
+// VerifyFile checks a file against its manifest in a single sequential pass,
+// verifying each chunk's hash as well as the hash of the whole file.
+// Chunks that can't be read in full (e.g. because the file is short) count as bad.
+func VerifyFile(manifest *Manifest, filePath string) (*VerifyReport, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if err := manifest.CheckHashKey(); err != nil {
+		return nil, err
+	}
+
+	report := &VerifyReport{}
+	fileHash := manifest.newHash()
+	for i, chunk := range manifest.Chunks {
+		data := make([]byte, chunk.Size)
+		n, err := io.ReadFull(file, data)
+		fileHash.Write(data[:n])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			report.BadChunks = append(report.BadChunks, i)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !manifest.VerifyChunk(chunk, data) {
+			report.BadChunks = append(report.BadChunks, i)
+		}
+	}
+
+	// Include any trailing bytes beyond the last chunk in the file hash
+	if _, err := io.Copy(fileHash, file); err != nil {
+		return nil, err
+	}
+	report.FileHashOK = fmt.Sprintf("%x", fileHash.Sum(nil)) == manifest.FileHash
+
+	return report, nil
+}
+
+// FileHasher computes the whole-file hash of a manifest's content from its
+// chunks as they are produced in file order, such as by a sequential
+// download, so that the file doesn't have to be read again to check it.
+type FileHasher struct {
+	manifest *Manifest
+	hash     hash.Hash // nil once a chunk arrived out of order
+	next     int       // Index of the next chunk in file order
+}
+
+// NewFileHasher returns a FileHasher for m's content.
+func (m *Manifest) NewFileHasher() *FileHasher {
+	return &FileHasher{manifest: m, hash: m.newHash()}
+}
+
+// WriteChunk adds the data of the chunk at index to the hash. If index isn't
+// the next chunk in file order, the hasher gives up and reports false; the
+// file then has to be verified by reading it.
+func (h *FileHasher) WriteChunk(index int, data []byte) bool {
+	if h.hash == nil || index != h.next {
+		h.hash = nil
+		return false
+	}
+	h.hash.Write(data)
+	h.next++
+	return true
+}
+
+// Verify reports whether every chunk was written in order and together they
+// match the manifest's file hash.
+func (h *FileHasher) Verify() bool {
+	return h.hash != nil && h.next == len(h.manifest.Chunks) &&
+		fmt.Sprintf("%x", h.hash.Sum(nil)) == h.manifest.FileHash
+}
+
+// VerifySample checks chunks of src, which should hold the content described
+// by manifest, against their hashes and returns the indices of those that
+// don't match, in ascending order. If sample is positive and less than the
+// number of chunks, only that many chunks chosen at random are read, which
+// bounds the time spent on large files at the cost of possibly missing some
+// bad chunks; otherwise every chunk is checked. Chunks that can't be read in
+// full count as bad.
+func VerifySample(src io.ReaderAt, manifest *Manifest, sample int) ([]int, error) {
+	if err := manifest.CheckHashKey(); err != nil {
+		return nil, err
+	}
+
+	indices := rand.Perm(len(manifest.Chunks))
+	if sample > 0 && sample < len(indices) {
+		indices = indices[:sample]
+	}
+	sort.Ints(indices)
+
+	var bad []int
+	var buf []byte
+	for _, i := range indices {
+		data, err := ReadChunkAt(src, manifest, i, buf)
+		if errors.Is(err, ErrHashMismatch) || errors.Is(err, io.ErrUnexpectedEOF) {
+			bad = append(bad, i)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		buf = data
+	}
+	return bad, nil
+}
@@ -0,0 +1,201 @@
+package file
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestVerifyFileReportsBadChunks(t *testing.T) {
+	path, data, manifest := testManifest(t, 3*testChunkSize+50)
+
+	report, err := VerifyFile(manifest, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("intact file reported %+v", report)
+	}
+
+	data[manifest.Chunks[2].Offset+1] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	report, err = VerifyFile(manifest, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(report.BadChunks, []int{2}) || report.FileHashOK {
+		t.Fatalf("corrupted file reported %+v, want chunk 2 bad and the file hash wrong", report)
+	}
+
+	// A short file fails the chunks it doesn't hold in full
+	if err := os.Truncate(path, manifest.Chunks[3].Offset+10); err != nil {
+		t.Fatal(err)
+	}
+	report, err = VerifyFile(manifest, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(report.BadChunks, []int{2, 3}) {
+		t.Fatalf("truncated file reported bad chunks %v, want [2 3]", report.BadChunks)
+	}
+}
+
+func TestWriteChunkAtAnyOrder(t *testing.T) {
+	_, data, manifest := testManifest(t, 3*testChunkSize+50)
+	out, err := os.Create(filepath.Join(t.TempDir(), "out.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	for _, i := range []int{3, 0, 2, 1} {
+		chunk := manifest.Chunks[i]
+		if err := WriteChunkAt(out, manifest, i, data[chunk.Offset:chunk.Offset+chunk.Size]); err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+	}
+	got, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("chunks written out of order don't reassemble the file")
+	}
+
+	if err := WriteChunkAt(out, manifest, 0, make([]byte, manifest.Chunks[0].Size)); !errors.Is(err, ErrHashMismatch) {
+		t.Fatalf("writing the wrong data returned %v, want ErrHashMismatch", err)
+	}
+}
+
+func TestGetChunkAtShortSource(t *testing.T) {
+	_, data, manifest := testManifest(t, 2*testChunkSize+123)
+	last := len(manifest.Chunks) - 1
+	got, err := GetChunkAt(bytes.NewReader(data), manifest, last)
+	if err != nil || int64(len(got)) != manifest.Chunks[last].Size {
+		t.Fatalf("GetChunkAt of the last chunk returned %d bytes, %v; want %d", len(got), err, manifest.Chunks[last].Size)
+	}
+
+	if _, err := GetChunkAt(bytes.NewReader(data[:len(data)-1]), manifest, last); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("GetChunkAt past the end of the source returned %v, want io.ErrUnexpectedEOF", err)
+	}
+	for _, i := range []int{-1, last + 1} {
+		if _, err := GetChunkAt(bytes.NewReader(data), manifest, i); err == nil {
+			t.Errorf("GetChunkAt accepted chunk index %d of %d", i, len(manifest.Chunks))
+		}
+	}
+}
+
+func TestVerifySample(t *testing.T) {
+	_, data, manifest := testManifest(t, 6*testChunkSize+50)
+	corrupt := slices.Clone(data)
+	corrupt[2*testChunkSize+1] ^= 0xff
+
+	if bad, err := VerifySample(bytes.NewReader(data), manifest, 0); err != nil || len(bad) != 0 {
+		t.Fatalf("intact file: bad chunks %v, %v", bad, err)
+	}
+	if bad, err := VerifySample(bytes.NewReader(corrupt), manifest, 0); err != nil || !slices.Equal(bad, []int{2}) {
+		t.Fatalf("checking every chunk found bad chunks %v, %v; want [2]", bad, err)
+	}
+	// A truncated file is missing part of its last chunk
+	if bad, err := VerifySample(bytes.NewReader(data[:len(data)-10]), manifest, 0); err != nil || !slices.Equal(bad, []int{6}) {
+		t.Fatalf("truncated file: bad chunks %v, %v; want [6]", bad, err)
+	}
+
+	// A sample checks only that many chunks, so it finds the bad one only
+	// when it picks it; every chunk is bad here, so each one picked is
+	bad, err := VerifySample(bytes.NewReader(make([]byte, len(data))), manifest, 3)
+	if err != nil || len(bad) != 3 || !slices.IsSorted(bad) {
+		t.Fatalf("sample of 3 chunks of a zeroed file found bad chunks %v, %v", bad, err)
+	}
+}
+
+func TestGetChunkAtManifestOffsets(t *testing.T) {
+	// The last chunk is shorter than the others
+	path, data, manifest := testManifest(t, 4*testChunkSize+777)
+	last := len(manifest.Chunks) - 1
+	if manifest.Chunks[last].Size != 777 {
+		t.Fatalf("last chunk is %d bytes, want 777", manifest.Chunks[last].Size)
+	}
+
+	buf := make([]byte, testChunkSize)
+	for _, i := range []int{0, 2, last} {
+		want := data[int64(i)*testChunkSize : min(int64(i+1)*testChunkSize, int64(len(data)))]
+		got, err := GetChunk(path, manifest, i)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("GetChunk(%d) returned %d bytes, %v; want the %d bytes at offset %d", i, len(got), err, len(want), i*testChunkSize)
+		}
+		got, err = ReadChunkAt(bytes.NewReader(data), manifest, i, buf)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("ReadChunkAt(%d) returned %d bytes, %v", i, len(got), err)
+		}
+		if &got[0] != &buf[0] {
+			t.Fatalf("ReadChunkAt(%d) didn't read into the buffer it was given", i)
+		}
+	}
+
+	for _, i := range []int{-1, last + 1} {
+		if _, err := GetChunk(path, manifest, i); err == nil {
+			t.Errorf("GetChunk accepted chunk index %d of %d", i, len(manifest.Chunks))
+		}
+	}
+
+	// A chunk changed on disk no longer matches its hash
+	data[2*testChunkSize+5] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetChunk(path, manifest, 2); !errors.Is(err, ErrHashMismatch) {
+		t.Fatalf("GetChunk of a corrupted chunk returned %v, want ErrHashMismatch", err)
+	}
+	if _, err := GetChunk(path, manifest, 1); err != nil {
+		t.Fatalf("GetChunk of an intact chunk next to a corrupted one: %v", err)
+	}
+}
+
+func TestFileHasher(t *testing.T) {
+	_, data, manifest := testManifest(t, 3*testChunkSize+50)
+	chunk := func(i int) []byte {
+		c := manifest.Chunks[i]
+		return data[c.Offset : c.Offset+c.Size]
+	}
+
+	h := manifest.NewFileHasher()
+	for i := range manifest.Chunks {
+		if !h.WriteChunk(i, chunk(i)) {
+			t.Fatalf("hasher refused chunk %d written in order", i)
+		}
+		if i < len(manifest.Chunks)-1 && h.Verify() {
+			t.Fatalf("hasher verified the file after %d of %d chunks", i+1, len(manifest.Chunks))
+		}
+	}
+	if !h.Verify() {
+		t.Fatal("hasher didn't verify chunks written in order")
+	}
+
+	// Once a chunk arrives out of order the hash can't be completed
+	h = manifest.NewFileHasher()
+	h.WriteChunk(0, chunk(0))
+	if h.WriteChunk(2, chunk(2)) {
+		t.Fatal("hasher accepted chunk 2 after chunk 0")
+	}
+	for i := 1; i < len(manifest.Chunks); i++ {
+		h.WriteChunk(i, chunk(i))
+	}
+	if h.Verify() {
+		t.Fatal("hasher verified chunks written out of order")
+	}
+
+	h = manifest.NewFileHasher()
+	for i := range manifest.Chunks {
+		h.WriteChunk(i, make([]byte, manifest.Chunks[i].Size))
+	}
+	if h.Verify() {
+		t.Fatal("hasher verified the wrong content")
+	}
+}
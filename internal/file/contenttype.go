@@ -0,0 +1,38 @@
+// Package file implements file handling functionality for the peer-to-peer file sharing system.
+// It provides utilities for creating file manifests, handling chunks, and managing file operations.
+package file
+
+import "net/http"
+
+// sniffLen is how many bytes at the start of a file are used to detect its
+// content type, as many as http.DetectContentType considers.
+const sniffLen = 512
+
+// DetectContentType returns the MIME type of content starting with data, as
+// detected by http.DetectContentType, such as "video/mp4" or "text/plain;
+// charset=utf-8". Content that isn't recognized is "application/octet-stream".
+// It returns "" for empty data, whose type can't be told.
+func DetectContentType(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	return http.DetectContentType(data)
+}
+
+// contentSniffer keeps the first sniffLen bytes written to it, so that the
+// content type can be detected while the content is hashed.
+type contentSniffer struct {
+	head []byte
+}
+
+func (s *contentSniffer) Write(p []byte) (int, error) {
+	if n := sniffLen - len(s.head); n > 0 {
+		s.head = append(s.head, p[:min(n, len(p))]...)
+	}
+	return len(p), nil
+}
+
+// contentType returns the content type detected from the bytes written so far.
+func (s *contentSniffer) contentType() string {
+	return DetectContentType(s.head)
+}
@@ -0,0 +1,63 @@
+package file
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestManifestContentType(t *testing.T) {
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 3*testChunkSize)...)
+	for _, tc := range []struct {
+		name    string
+		content []byte
+		want    string
+	}{
+		{"image.png", png, "image/png"},
+		{"notes.txt", bytes.Repeat([]byte("plain text "), 1000), "text/plain; charset=utf-8"},
+		{"page.html", []byte("<!DOCTYPE html><html><body>hi</body></html>"), "text/html; charset=utf-8"},
+		{"blob.bin", []byte{0x00, 0x01, 0xfe, 0xff, 0x00}, "application/octet-stream"},
+		{"empty", nil, ""},
+	} {
+		path := filepath.Join(t.TempDir(), tc.name)
+		if err := os.WriteFile(path, tc.content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		fixed, err := CreateManifest(path, testChunkSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cdc, err := CreateManifestCDC(path, testChunkSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fixed.ContentType != tc.want || cdc.ContentType != tc.want {
+			t.Errorf("%s: content types %q (fixed) and %q (CDC), want %q", tc.name, fixed.ContentType, cdc.ContentType, tc.want)
+		}
+	}
+}
+
+func TestContentSnifferKeepsFileStart(t *testing.T) {
+	var s contentSniffer
+	// The type is told from the first bytes, however they are split up
+	s.Write([]byte("%PDF"))
+	s.Write([]byte("-1.7\n"))
+	s.Write(bytes.Repeat([]byte{0}, 2*sniffLen))
+	if len(s.head) != sniffLen {
+		t.Fatalf("sniffer kept %d bytes, want %d", len(s.head), sniffLen)
+	}
+	if got := s.contentType(); got != "application/pdf" {
+		t.Fatalf("content type %q, want application/pdf", got)
+	}
+}
+
+func TestDirManifestHasNoContentType(t *testing.T) {
+	manifest, err := CreateDirManifest(writeTestDir(t), testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.ContentType != "" {
+		t.Fatalf("directory manifest has content type %q", manifest.ContentType)
+	}
+}
@@ -0,0 +1,59 @@
+package file
+
+// ManifestDiff summarizes how much of a new manifest's content is already
+// present in an old one. It quantifies how much an update would have to download.
+type ManifestDiff struct {
+	OldChunks int `json:"oldChunks"` // Number of chunks in the old manifest
+	NewChunks int `json:"newChunks"` // Number of chunks in the new manifest
+
+	// SamePosition counts chunks with the same hash at the same index in both
+	// manifests. This is what matters for fixed-size chunking.
+	SamePosition int `json:"samePosition"`
+	// Reused counts new chunks whose hash appears anywhere in the old manifest.
+	// Content-defined chunks shift position after insertions, so this is the
+	// relevant measure for CDC manifests.
+	Reused int `json:"reused"`
+	// Changed counts new chunks whose content isn't in the old manifest.
+	Changed int `json:"changed"`
+
+	ReusedBytes  int64 `json:"reusedBytes"`  // Total size of the reused chunks
+	ChangedBytes int64 `json:"changedBytes"` // Total size of the changed chunks
+	SizeDelta    int64 `json:"sizeDelta"`    // New file size minus old file size
+}
+
+// DiffManifests compares the chunks of newer against those of older.
+func DiffManifests(older, newer *Manifest) ManifestDiff {
+	diff := ManifestDiff{
+		OldChunks: len(older.Chunks),
+		NewChunks: len(newer.Chunks),
+		SizeDelta: newer.FileSize - older.FileSize,
+	}
+
+	oldHashes := make(map[string]bool, len(older.Chunks))
+	for _, chunk := range older.Chunks {
+		oldHashes[chunk.Hash] = true
+	}
+
+	for i, chunk := range newer.Chunks {
+		if i < len(older.Chunks) && older.Chunks[i].Hash == chunk.Hash {
+			diff.SamePosition++
+		}
+		if oldHashes[chunk.Hash] {
+			diff.Reused++
+			diff.ReusedBytes += chunk.Size
+		} else {
+			diff.Changed++
+			diff.ChangedBytes += chunk.Size
+		}
+	}
+	return diff
+}
+
+// ReusedPercent returns the percentage of the new manifest's chunks that are
+// reused from the old one. A manifest without chunks counts as fully reused.
+func (d ManifestDiff) ReusedPercent() float64 {
+	if d.NewChunks == 0 {
+		return 100
+	}
+	return 100 * float64(d.Reused) / float64(d.NewChunks)
+}
@@ -0,0 +1,85 @@
+package file
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// manifestOf writes data to a file named name and creates its manifest with
+// testChunkSize chunks, using content-defined chunking if cdc is set.
+func manifestOf(t *testing.T, name string, data []byte, cdc bool) *Manifest {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	create := CreateManifest
+	if cdc {
+		create = CreateManifestCDC
+	}
+	manifest, err := create(path, testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manifest
+}
+
+func TestDiffManifestsChangedChunks(t *testing.T) {
+	_, data := writeTestFile(t, "old.bin", 8*testChunkSize)
+	older := manifestOf(t, "old.bin", data, false)
+
+	// Change chunks 1 and 5, and append a short chunk
+	edited := append([]byte{}, data...)
+	edited[1*testChunkSize+10]++
+	edited[5*testChunkSize]++
+	edited = append(edited, make([]byte, 100)...)
+	newer := manifestOf(t, "new.bin", edited, false)
+
+	got := DiffManifests(older, newer)
+	want := ManifestDiff{
+		OldChunks:    8,
+		NewChunks:    9,
+		SamePosition: 6,
+		Reused:       6,
+		Changed:      3,
+		ReusedBytes:  6 * testChunkSize,
+		ChangedBytes: 2*testChunkSize + 100,
+		SizeDelta:    100,
+	}
+	if got != want {
+		t.Fatalf("DiffManifests = %+v, want %+v", got, want)
+	}
+	if p := got.ReusedPercent(); p < 66.6 || p > 66.7 {
+		t.Fatalf("ReusedPercent = %.2f, want 66.67", p)
+	}
+	if p := DiffManifests(older, older).ReusedPercent(); p != 100 {
+		t.Fatalf("identical manifests reuse %.1f%% of chunks", p)
+	}
+}
+
+func TestDiffManifestsInsertion(t *testing.T) {
+	_, data := writeTestFile(t, "old.bin", 32*testChunkSize)
+	older := manifestOf(t, "old.bin", data, true)
+
+	// Content-defined chunks resynchronize after an insertion
+	edited := append([]byte("inserted"), data...)
+	newer := manifestOf(t, "new.bin", edited, true)
+
+	diff := DiffManifests(older, newer)
+	if diff.Changed > 2 || diff.Reused < diff.NewChunks-2 {
+		t.Errorf("insertion changed %d of %d CDC chunks, want at most 2", diff.Changed, diff.NewChunks)
+	}
+	if diff.SamePosition > diff.Reused {
+		t.Errorf("%d chunks match by position but only %d by content", diff.SamePosition, diff.Reused)
+	}
+	if diff.SizeDelta != int64(len("inserted")) {
+		t.Errorf("SizeDelta = %d, want %d", diff.SizeDelta, len("inserted"))
+	}
+
+	// Fixed-size chunks all shift, so none can be reused
+	fixed := DiffManifests(manifestOf(t, "old.bin", data, false), manifestOf(t, "new.bin", edited, false))
+	if fixed.Reused != 0 || fixed.Changed != fixed.NewChunks {
+		t.Errorf("insertion left %d of %d fixed-size chunks unchanged, want none", fixed.Reused, fixed.NewChunks)
+	}
+}
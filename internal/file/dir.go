@@ -0,0 +1,484 @@
+// Package file implements file handling functionality for the peer-to-peer file sharing system.
+// It provides utilities for creating file manifests, handling chunks, and managing file operations.
+package file
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FileEntry describes one entry of a shared directory. The content of a
+// directory manifest is the content of its regular files concatenated in the
+// order of Manifest.Files, so chunks may span file boundaries.
+type FileEntry struct {
+	Path    string      `json:"path"`              // Slash-separated path relative to the directory
+	Size    int64       `json:"size"`              // Size in bytes; 0 for directories and symlinks
+	Mode    os.FileMode `json:"mode"`              // Type and permission bits
+	Symlink string      `json:"symlink,omitempty"` // Target of a symlink, relative to the link's directory
+}
+
+// ErrUnsafePath is returned when a directory manifest names a path or symlink
+// target that would end up outside the directory it is extracted to.
+var ErrUnsafePath = errors.New("path escapes the output directory")
+
+// ErrPathCollision is returned when two entries of a directory would end up at
+// the same path, such as names differing only in case on a case-insensitive
+// filesystem.
+var ErrPathCollision = errors.New("paths collide")
+
+// ErrFileExists is returned when extracting a directory would overwrite
+// existing files.
+var ErrFileExists = errors.New("file already exists")
+
+// IsDir reports whether m describes a directory rather than a single file.
+func (m *Manifest) IsDir() bool {
+	return len(m.Files) > 0
+}
+
+// CreateDirManifest creates a manifest for the directory at dirPath, with
+// fixed-size chunks over the concatenated content of its regular files. Files
+// are listed in lexical order, with their permission bits; symlinks are recorded
+// with their targets rather than followed. Other file types are skipped.
+// Directories with paths that differ only in case are refused with
+// ErrPathCollision, since they can't be extracted on case-insensitive filesystems.
+// Entries matching the patterns of the directory's IgnoreFile are left out.
+func CreateDirManifest(dirPath string, chunkSize int64) (*Manifest, error) {
+	return createDirManifest(dirPath, chunkSize, nil, nil)
+}
+
+// CreateDirManifestExcluding is like CreateDirManifest, but also leaves out
+// the entries matching the exclude patterns, which take precedence over those
+// of the IgnoreFile. See Excluder for the syntax of patterns.
+func CreateDirManifestExcluding(dirPath string, chunkSize int64, exclude []string) (*Manifest, error) {
+	return createDirManifest(dirPath, chunkSize, nil, exclude)
+}
+
+// createDirManifest implements CreateDirManifest, hashing with HMAC-SHA256
+// under key if key isn't nil, and leaving out entries matching exclude.
+func createDirManifest(dirPath string, chunkSize int64, key []byte, exclude []string) (*Manifest, error) {
+	info, err := os.Stat(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dirPath)
+	}
+	excluder, err := LoadExcluder(dirPath, exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	// List the directory's entries; WalkDir visits them in lexical order
+	var entries []FileEntry
+	var size int64
+	err = filepath.WalkDir(dirPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dirPath {
+			return nil
+		}
+		rel, err := filepath.Rel(dirPath, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if excluder.Excluded(rel, d.IsDir()) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		entry := FileEntry{Path: rel, Mode: info.Mode()}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			if entry.Symlink, err = os.Readlink(path); err != nil {
+				return err
+			}
+		case info.IsDir():
+		case info.Mode().IsRegular():
+			entry.Size = info.Size()
+			size += entry.Size
+		default:
+			// Devices, sockets, and pipes can't be shared
+			return nil
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%s has no files to share", dirPath)
+	}
+	// Names that only differ in case would overwrite each other when extracted
+	// on Windows or macOS
+	if err := checkCollisions(entries); err != nil {
+		return nil, err
+	}
+
+	manifest, err := createManifest(&dirReader{dir: dirPath, entries: entries}, info.Name(), size, chunkSize, key)
+	if err != nil {
+		return nil, err
+	}
+	// The start of the first file says nothing about the directory as a whole
+	manifest.ContentType = ""
+	manifest.Files = entries
+	return manifest, nil
+}
+
+// dirReader reads the concatenated content of the regular files among entries,
+// opening one file at a time. It fails if a file's size differs from its entry.
+type dirReader struct {
+	dir     string
+	entries []FileEntry
+	next    int       // Index of the next entry to open
+	cur     io.Reader // Remaining content of the open file
+	close   func() error
+	read    int64 // Bytes read from the open file
+	size    int64 // Expected size of the open file
+	path    string
+}
+
+func (r *dirReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur != nil {
+			n, err := r.cur.Read(p)
+			r.read += int64(n)
+			if err != io.EOF {
+				return n, err
+			}
+			r.close()
+			r.cur = nil
+			if r.read != r.size {
+				return n, fmt.Errorf("%w: %s changed size while being read", ErrSizeMismatch, r.path)
+			}
+			if n > 0 {
+				return n, nil
+			}
+		}
+
+		// Open the next regular file
+		for r.next < len(r.entries) && !r.entries[r.next].Mode.IsRegular() {
+			r.next++
+		}
+		if r.next == len(r.entries) {
+			return 0, io.EOF
+		}
+		entry := r.entries[r.next]
+		r.next++
+		r.path = filepath.Join(r.dir, filepath.FromSlash(entry.Path))
+		f, err := os.Open(r.path)
+		if err != nil {
+			return 0, err
+		}
+		// Read one byte past the recorded size to detect growth
+		r.cur, r.close, r.read, r.size = io.LimitReader(f, entry.Size+1), f.Close, 0, entry.Size
+	}
+}
+
+// DirReader reads the concatenated content of a shared directory at arbitrary
+// offsets, so that it can be served like a single file. Files are opened for
+// each read, so it is safe for concurrent use and holds no open files.
+type DirReader struct {
+	dir     string
+	files   []FileEntry // Regular files, in manifest order
+	offsets []int64     // Offset of each file in the concatenated content
+	size    int64
+}
+
+// OpenDir prepares the directory at dirPath, described by manifest, to be read
+// as one concatenated stream. It fails if any file's size differs from the manifest.
+func OpenDir(dirPath string, manifest *Manifest) (*DirReader, error) {
+	r := &DirReader{dir: dirPath}
+	for _, entry := range manifest.Files {
+		if !entry.Mode.IsRegular() {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(dirPath, filepath.FromSlash(entry.Path)))
+		if err != nil {
+			return nil, err
+		}
+		if info.Size() != entry.Size {
+			return nil, fmt.Errorf("%s has %d bytes but the manifest describes %d", entry.Path, info.Size(), entry.Size)
+		}
+		r.files = append(r.files, entry)
+		r.offsets = append(r.offsets, r.size)
+		r.size += entry.Size
+	}
+	if r.size != manifest.FileSize {
+		return nil, fmt.Errorf("%s has %d bytes but the manifest describes %d", dirPath, r.size, manifest.FileSize)
+	}
+	return r, nil
+}
+
+// Size returns the length of the concatenated content.
+func (r *DirReader) Size() int64 {
+	return r.size
+}
+
+// ReadAt reads len(p) bytes of the concatenated content starting at off,
+// reading across file boundaries as needed.
+func (r *DirReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+
+	// Find the last file starting at or before off
+	i := sort.Search(len(r.offsets), func(i int) bool { return r.offsets[i] > off }) - 1
+	n := 0
+	for ; i < len(r.files) && n < len(p); i++ {
+		if i < 0 {
+			continue
+		}
+		entry := r.files[i]
+		start := off + int64(n) - r.offsets[i]
+		if start >= entry.Size {
+			continue
+		}
+		want := p[n:]
+		if rest := entry.Size - start; int64(len(want)) > rest {
+			want = want[:rest]
+		}
+		m, err := readFileAt(filepath.Join(r.dir, filepath.FromSlash(entry.Path)), want, start)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Close releases the reader. DirReader holds no open files, so it does nothing.
+func (r *DirReader) Close() error {
+	return nil
+}
+
+// readFileAt reads len(p) bytes at off from the file at path.
+func readFileAt(path string, p []byte, off int64) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	n, err := f.ReadAt(p, off)
+	if n == len(p) {
+		return n, nil
+	}
+	return n, err
+}
+
+// ExtractDir recreates the directory described by manifest at outputDir from
+// dataPath, which holds the concatenated content of its regular files. File
+// permissions are restored and symlinks recreated. Paths and symlink targets
+// that would point outside outputDir are rejected with ErrUnsafePath, and
+// paths that collide with ErrPathCollision, before anything is written.
+// Unless overwrite is set, existing files in outputDir are never replaced:
+// ExtractDir fails with ErrFileExists before writing anything instead.
+func ExtractDir(dataPath string, manifest *Manifest, outputDir string, overwrite bool) error {
+	// Refuse manifests that would write or link outside outputDir
+	if err := checkEntries(manifest.Files); err != nil {
+		return err
+	}
+	if !overwrite {
+		if err := CheckDirTarget(manifest, outputDir); err != nil {
+			return err
+		}
+	}
+
+	data, err := os.Open(dataPath)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return err
+	}
+
+	// Write regular files first, and create symlinks only afterwards so that no
+	// file can be written through a symlink
+	for _, entry := range manifest.Files {
+		path := filepath.Join(outputDir, filepath.FromSlash(entry.Path))
+		switch {
+		case entry.Mode.IsDir():
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+		case entry.Mode.IsRegular():
+			if err := extractFile(data, path, entry); err != nil {
+				return err
+			}
+		}
+	}
+	for _, entry := range manifest.Files {
+		if entry.Mode&os.ModeSymlink == 0 {
+			continue
+		}
+		path := filepath.Join(outputDir, filepath.FromSlash(entry.Path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		os.Remove(path)
+		if err := os.Symlink(entry.Symlink, path); err != nil {
+			return err
+		}
+	}
+
+	// Restore directory permissions last, in case they forbid writing
+	for _, entry := range manifest.Files {
+		if entry.Mode.IsDir() {
+			path := filepath.Join(outputDir, filepath.FromSlash(entry.Path))
+			if err := os.Chmod(path, entry.Mode.Perm()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CheckDirTarget returns an error wrapping ErrFileExists if extracting the
+// directory described by manifest at outputDir would replace any existing file,
+// symlink, or directory. Directories that the manifest also lists as
+// directories may already exist.
+func CheckDirTarget(manifest *Manifest, outputDir string) error {
+	var existing []string
+	for _, entry := range manifest.Files {
+		info, err := os.Lstat(filepath.Join(outputDir, filepath.FromSlash(entry.Path)))
+		if err != nil {
+			continue
+		}
+		if entry.Mode.IsDir() && info.IsDir() {
+			continue
+		}
+		existing = append(existing, entry.Path)
+	}
+
+	switch len(existing) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("%w: %s", ErrFileExists, filepath.Join(outputDir, existing[0]))
+	default:
+		return fmt.Errorf("%w: %s and %d more in %s", ErrFileExists, existing[0], len(existing)-1, outputDir)
+	}
+}
+
+// extractFile copies the next entry.Size bytes of data to a new file at path
+// with the entry's permissions. Anything already at path is replaced rather
+// than written through, in case it is a symlink.
+func extractFile(data io.Reader, path string, entry FileEntry) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, entry.Mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(out, data, entry.Size); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to extract %s: %v", entry.Path, err)
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	// The umask may have stripped bits from the mode given to OpenFile
+	return os.Chmod(path, entry.Mode.Perm())
+}
+
+// checkEntries makes sure every entry's path, and every symlink's target, stays
+// inside the directory the entries are extracted to, and that no two entries
+// collide. Paths are resolved
+// lexically, so neither may pass through another symlink in the manifest,
+// whose target could be at a different depth.
+func checkEntries(entries []FileEntry) error {
+	if err := checkCollisions(entries); err != nil {
+		return err
+	}
+
+	symlinks := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.Mode&os.ModeSymlink != 0 {
+			symlinks[path.Clean(entry.Path)] = true
+		}
+	}
+
+	for _, entry := range entries {
+		if !filepath.IsLocal(filepath.FromSlash(entry.Path)) {
+			return fmt.Errorf("%w: %q", ErrUnsafePath, entry.Path)
+		}
+		parts := strings.Split(path.Clean(entry.Path), "/")
+		for i := 1; i < len(parts); i++ {
+			if symlinks[strings.Join(parts[:i], "/")] {
+				return fmt.Errorf("%w: %q is inside symlink %q", ErrUnsafePath, entry.Path, strings.Join(parts[:i], "/"))
+			}
+		}
+		if entry.Mode&os.ModeSymlink == 0 {
+			continue
+		}
+
+		// Walk the target from the link's directory
+		target := filepath.ToSlash(entry.Symlink)
+		if path.IsAbs(target) || filepath.IsAbs(entry.Symlink) {
+			return fmt.Errorf("%w: symlink %q points to absolute path %q", ErrUnsafePath, entry.Path, entry.Symlink)
+		}
+		dir := parts[:len(parts)-1]
+		steps := strings.Split(target, "/")
+		for i, step := range steps {
+			switch step {
+			case "", ".":
+				continue
+			case "..":
+				if len(dir) == 0 {
+					return fmt.Errorf("%w: symlink %q points to %q", ErrUnsafePath, entry.Path, entry.Symlink)
+				}
+				dir = dir[:len(dir)-1]
+				continue
+			}
+			dir = append(dir, step)
+			if i < len(steps)-1 && symlinks[strings.Join(dir, "/")] {
+				return fmt.Errorf("%w: symlink %q points through symlink %q", ErrUnsafePath, entry.Path, strings.Join(dir, "/"))
+			}
+		}
+	}
+	return nil
+}
+
+// checkCollisions returns an error wrapping ErrPathCollision if two entries
+// have the same path, or paths that differ only in case.
+func checkCollisions(entries []FileEntry) error {
+	seen := make(map[string]string, len(entries)) // Folded path to the entry's path
+	for _, entry := range entries {
+		p := path.Clean(entry.Path)
+		key := strings.ToLower(p)
+		other, ok := seen[key]
+		switch {
+		case !ok:
+			seen[key] = p
+		case other == p:
+			return fmt.Errorf("%w: %q is listed twice", ErrPathCollision, p)
+		default:
+			return fmt.Errorf("%w: %q and %q differ only in case, so they would be the same file on case-insensitive filesystems", ErrPathCollision, other, p)
+		}
+	}
+	return nil
+}
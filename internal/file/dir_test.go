@@ -0,0 +1,207 @@
+package file
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestDir creates a directory holding an executable script, a text file,
+// and a relative symlink to the script, and returns its path.
+func writeTestDir(t testing.TB) string {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "project")
+	for _, f := range []struct {
+		path    string
+		content string
+		mode    os.FileMode
+	}{
+		{"bin/run.sh", "#!/bin/sh\necho running\n", 0755},
+		{"docs/readme.txt", "Read me first.\n", 0640},
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(f.path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(f.content), f.mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, f.mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("../bin/run.sh", filepath.Join(dir, "docs", "run")); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// dirData returns the concatenated content of the directory described by
+// manifest, as downloaded before extraction, written to a file.
+func dirData(t testing.TB, dir string, manifest *Manifest) string {
+	t.Helper()
+	r, err := OpenDir(dir, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	path := filepath.Join(t.TempDir(), "dir.data")
+	out, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, io.NewSectionReader(r, 0, r.Size())); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDirManifestModesAndSymlinks(t *testing.T) {
+	dir := writeTestDir(t)
+	manifest, err := CreateDirManifest(dir, testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := make(map[string]FileEntry)
+	for _, e := range manifest.Files {
+		entries[e.Path] = e
+	}
+	if e := entries["bin/run.sh"]; e.Mode.Perm() != 0755 || !e.Mode.IsRegular() {
+		t.Errorf("script recorded with mode %v, want an executable regular file", e.Mode)
+	}
+	if e := entries["docs/run"]; e.Mode&os.ModeSymlink == 0 || e.Symlink != "../bin/run.sh" {
+		t.Errorf("symlink recorded as %+v, want a link to ../bin/run.sh", e)
+	}
+
+	out := filepath.Join(t.TempDir(), "out")
+	if err := ExtractDir(dirData(t, dir, manifest), manifest, out, false); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]os.FileMode{"bin/run.sh": 0755, "docs/readme.txt": 0640} {
+		info, err := os.Stat(filepath.Join(out, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != want {
+			t.Errorf("%s extracted with mode %v, want %v", path, info.Mode().Perm(), want)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(out, "docs", "run")); err != nil || target != "../bin/run.sh" {
+		t.Fatalf("extracted symlink points to %q, %v", target, err)
+	}
+	if got, err := os.ReadFile(filepath.Join(out, "docs", "run")); err != nil || string(got) != "#!/bin/sh\necho running\n" {
+		t.Fatalf("reading through the extracted symlink returned %q, %v", got, err)
+	}
+
+	// Extracting again would replace the files
+	if err := ExtractDir(dirData(t, dir, manifest), manifest, out, false); !errors.Is(err, ErrFileExists) {
+		t.Fatalf("extracting over existing files returned %v, want ErrFileExists", err)
+	}
+}
+
+func TestExtractDirRejectsEscapingSymlinks(t *testing.T) {
+	dir := writeTestDir(t)
+	manifest, err := CreateDirManifest(dir, testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := dirData(t, dir, manifest)
+
+	for _, tc := range []struct {
+		name  string
+		entry FileEntry
+	}{
+		{"parent of the output directory", FileEntry{Path: "docs/up", Symlink: "../../secret"}},
+		{"absolute target", FileEntry{Path: "docs/abs", Symlink: "/etc/passwd"}},
+		{"through another symlink", FileEntry{Path: "docs/via", Symlink: "run/../../x"}},
+		{"path outside the directory", FileEntry{Path: "../evil", Symlink: "bin/run.sh"}},
+	} {
+		tc.entry.Mode = os.ModeSymlink | 0777
+		bad := *manifest
+		bad.Files = append(append([]FileEntry(nil), manifest.Files...), tc.entry)
+		out := filepath.Join(t.TempDir(), "out")
+		if err := ExtractDir(data, &bad, out, false); !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("%s: ExtractDir returned %v, want ErrUnsafePath", tc.name, err)
+		}
+		if _, err := os.Stat(out); !os.IsNotExist(err) {
+			t.Errorf("%s: output directory created despite the unsafe entry", tc.name)
+		}
+	}
+}
+
+func TestDirCaseCollision(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "shared")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"README.txt", "readme.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 2 {
+		t.Skip("filesystem is case-insensitive")
+	}
+	if _, err := CreateDirManifest(dir, testChunkSize); !errors.Is(err, ErrPathCollision) {
+		t.Fatalf("CreateDirManifest of names differing in case returned %v, want ErrPathCollision", err)
+	}
+
+	// A manifest listing such a pair, which would overwrite one file with the
+	// other on a case-insensitive target, is refused before anything is written
+	src := writeTestDir(t)
+	manifest, err := CreateDirManifest(src, testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := dirData(t, src, manifest)
+	for _, path := range []string{"DOCS/readme.txt", "docs/readme.txt", "docs/./readme.txt"} {
+		bad := *manifest
+		bad.Files = append(append([]FileEntry(nil), manifest.Files...), FileEntry{Path: path, Mode: 0644})
+		out := filepath.Join(t.TempDir(), "out")
+		if err := ExtractDir(data, &bad, out, false); !errors.Is(err, ErrPathCollision) {
+			t.Errorf("extracting a second %s returned %v, want ErrPathCollision", path, err)
+		}
+		if _, err := os.Stat(out); !os.IsNotExist(err) {
+			t.Errorf("output directory created despite the collision with %s", path)
+		}
+	}
+}
+
+func TestExtractDirOverwrite(t *testing.T) {
+	dir := writeTestDir(t)
+	manifest, err := CreateDirManifest(dir, testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "out")
+	if err := os.MkdirAll(filepath.Join(out, "docs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// An existing symlink where a file goes is replaced, not written through
+	victim := filepath.Join(t.TempDir(), "victim.txt")
+	if err := os.WriteFile(victim, []byte("untouched"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(victim, filepath.Join(out, "docs", "readme.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Directories listed in the manifest may exist, but files may not
+	err = CheckDirTarget(manifest, out)
+	if !errors.Is(err, ErrFileExists) || !strings.Contains(err.Error(), "readme.txt") {
+		t.Fatalf("CheckDirTarget returned %v, want ErrFileExists naming readme.txt", err)
+	}
+	if err := ExtractDir(dirData(t, dir, manifest), manifest, out, true); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(filepath.Join(out, "docs", "readme.txt")); err != nil || string(got) != "Read me first.\n" {
+		t.Fatalf("overwritten file holds %q, %v", got, err)
+	}
+	if got, err := os.ReadFile(victim); err != nil || string(got) != "untouched" {
+		t.Fatalf("file behind the replaced symlink holds %q, %v", got, err)
+	}
+}
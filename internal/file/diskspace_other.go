@@ -0,0 +1,11 @@
+//go:build !linux
+
+package file
+
+import "errors"
+
+// FreeSpace returns the number of bytes available on the filesystem containing dir.
+// It is not implemented on this platform.
+func FreeSpace(dir string) (int64, error) {
+	return 0, errors.New("free space check not supported on this platform")
+}
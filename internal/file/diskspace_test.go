@@ -0,0 +1,19 @@
+package file
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestFreeSpace(t *testing.T) {
+	free, err := FreeSpace(t.TempDir())
+	if err != nil {
+		t.Skip("free space unknown on this platform:", err)
+	}
+	if free <= 0 {
+		t.Fatalf("FreeSpace = %d, want a positive number of bytes", free)
+	}
+	if _, err := FreeSpace(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatal("FreeSpace of a missing directory succeeded")
+	}
+}
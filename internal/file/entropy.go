@@ -0,0 +1,78 @@
+// Package file implements file handling functionality for the peer-to-peer file sharing system.
+// It provides utilities for creating file manifests, handling chunks, and managing file operations.
+package file
+
+import "math"
+
+// CompressibleEntropy is the Shannon entropy, in bits per byte, below which data
+// is considered worth compressing. Already-compressed formats such as zip, jpg,
+// and mp4 measure close to the maximum of 8.
+const CompressibleEntropy = 7.5
+
+// sampleBytesPerChunk is how many bytes at the start of each chunk are sampled
+// to estimate whether a file is compressible.
+const sampleBytesPerChunk = 4 << 10
+
+// Entropy returns the Shannon entropy of data's byte distribution in bits per
+// byte, from 0 for a single repeated byte to 8 for uniformly random data.
+func Entropy(data []byte) float64 {
+	var counts [256]int64
+	for _, b := range data {
+		counts[b]++
+	}
+	return entropyOf(&counts, int64(len(data)))
+}
+
+// IsCompressible reports whether data looks worth compressing, judged by a
+// cheap entropy estimate rather than by compressing it.
+func IsCompressible(data []byte) bool {
+	return len(data) > 0 && Entropy(data) < CompressibleEntropy
+}
+
+// entropyOf computes the entropy of a byte histogram holding total bytes.
+func entropyOf(counts *[256]int64, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	var h float64
+	for _, c := range counts {
+		if c == 0 {
+			continue
+		}
+		p := float64(c) / float64(total)
+		h -= p * math.Log2(p)
+	}
+	return h
+}
+
+// entropySampler estimates a file's entropy from the first sampleBytesPerChunk
+// bytes of each of its chunks, as they are written to it during hashing.
+type entropySampler struct {
+	counts [256]int64
+	total  int64
+	left   int64 // Bytes still to sample from the current chunk
+}
+
+// startChunk begins sampling a new chunk.
+func (s *entropySampler) startChunk() {
+	s.left = sampleBytesPerChunk
+}
+
+// Write samples the start of p, up to what is left of the current chunk's budget.
+func (s *entropySampler) Write(p []byte) (int, error) {
+	sample := p
+	if int64(len(sample)) > s.left {
+		sample = sample[:s.left]
+	}
+	for _, b := range sample {
+		s.counts[b]++
+	}
+	s.total += int64(len(sample))
+	s.left -= int64(len(sample))
+	return len(p), nil
+}
+
+// compressible reports whether the sampled data looks worth compressing.
+func (s *entropySampler) compressible() bool {
+	return s.total > 0 && entropyOf(&s.counts, s.total) < CompressibleEntropy
+}
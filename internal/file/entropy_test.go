@@ -0,0 +1,67 @@
+package file
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEntropy(t *testing.T) {
+	uniform := make([]byte, 256*16)
+	for i := range uniform {
+		uniform[i] = byte(i)
+	}
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want float64
+	}{
+		{"empty", nil, 0},
+		{"one byte repeated", bytes.Repeat([]byte{'a'}, 100), 0},
+		{"two bytes alternating", bytes.Repeat([]byte("ab"), 100), 1},
+		{"every byte equally often", uniform, 8},
+	} {
+		if got := Entropy(tc.data); math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("%s: entropy %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestManifestCompressibleHint(t *testing.T) {
+	// Random bytes stand in for already-compressed formats
+	random, data := writeTestFile(t, "random.bin", 8*testChunkSize)
+	if IsCompressible(data) {
+		t.Fatalf("random data has entropy %.2f, yet is compressible", Entropy(data))
+	}
+	text := filepath.Join(t.TempDir(), "text.txt")
+	content := strings.Repeat("The quick brown fox jumps over the lazy dog. ", 1000)
+	if err := os.WriteFile(text, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, create := range []struct {
+		name string
+		fn   func(string, int64) (*Manifest, error)
+	}{
+		{"fixed", CreateManifest},
+		{"cdc", CreateManifestCDC},
+	} {
+		m, err := create.fn(random, testChunkSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Compressible {
+			t.Errorf("%s: random file flagged compressible", create.name)
+		}
+		m, err = create.fn(text, testChunkSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !m.Compressible {
+			t.Errorf("%s: text file not flagged compressible", create.name)
+		}
+	}
+}
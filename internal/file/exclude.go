@@ -0,0 +1,152 @@
+// Package file implements file handling functionality for the peer-to-peer file sharing system.
+// It provides utilities for creating file manifests, handling chunks, and managing file operations.
+package file
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// IgnoreFile is the name of the file in a shared directory's root listing
+// patterns of entries to leave out of its manifest, one per line, as in a
+// .gitignore file.
+const IgnoreFile = ".goshareignore"
+
+// excludeRule is one parsed exclude pattern.
+type excludeRule struct {
+	segments []string // Slash-separated parts of the pattern; "**" matches any number of parts
+	negate   bool     // The pattern started with "!", re-including what earlier rules excluded
+	dirOnly  bool     // The pattern ended with "/", so only matches directories
+}
+
+// Excluder decides which entries of a shared directory are left out of its
+// manifest. Patterns follow .gitignore syntax: "*", "?", and "[...]" match
+// within a path component and "**" across components; a pattern without a
+// slash matches an entry's name at any depth, while one with a slash is
+// relative to the directory's root; a trailing "/" only matches directories;
+// and a leading "!" includes again what an earlier pattern excluded. The last
+// matching pattern decides. Blank lines and lines starting with "#" are
+// ignored. A directory that is left out is left out with everything in it.
+type Excluder struct {
+	rules []excludeRule
+}
+
+// NewExcluder parses patterns into an Excluder. It fails if a pattern is malformed.
+func NewExcluder(patterns []string) (*Excluder, error) {
+	e := &Excluder{}
+	for _, pattern := range patterns {
+		if err := e.add(pattern); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// LoadExcluder returns an Excluder for the directory at dirPath, with the
+// patterns of its IgnoreFile, if it has one, followed by patterns, which
+// therefore take precedence.
+func LoadExcluder(dirPath string, patterns []string) (*Excluder, error) {
+	var all []string
+	f, err := os.Open(filepath.Join(dirPath, IgnoreFile))
+	switch {
+	case err == nil:
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			all = append(all, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", IgnoreFile, err)
+		}
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+	return NewExcluder(append(all, patterns...))
+}
+
+// add parses pattern and adds it as the last rule.
+func (e *Excluder) add(pattern string) error {
+	p := strings.TrimRight(pattern, " \t\r")
+	if p == "" || strings.HasPrefix(p, "#") {
+		return nil
+	}
+
+	var rule excludeRule
+	if rest, ok := strings.CutPrefix(p, "!"); ok {
+		rule.negate = true
+		p = rest
+	}
+	if strings.HasPrefix(p, `\#`) || strings.HasPrefix(p, `\!`) {
+		// An escaped "#" or "!" stands for the character itself
+		p = p[1:]
+	}
+	if rest, ok := strings.CutSuffix(p, "/"); ok {
+		rule.dirOnly = true
+		p = rest
+	}
+	// Without a slash, the pattern matches names at any depth
+	if !strings.Contains(p, "/") {
+		p = "**/" + p
+	}
+	p = strings.TrimPrefix(p, "/")
+	if p == "" || p == "**/" {
+		return fmt.Errorf("invalid exclude pattern %q", pattern)
+	}
+
+	rule.segments = strings.Split(p, "/")
+	for _, seg := range rule.segments {
+		if _, err := path.Match(seg, ""); err != nil {
+			return fmt.Errorf("invalid exclude pattern %q: %w", pattern, err)
+		}
+	}
+	e.rules = append(e.rules, rule)
+	return nil
+}
+
+// Excluded reports whether the entry at the slash-separated path rel, relative
+// to the directory's root, is left out. isDir tells whether it is a directory.
+// A nil Excluder excludes nothing.
+func (e *Excluder) Excluded(rel string, isDir bool) bool {
+	if e == nil {
+		return false
+	}
+	parts := strings.Split(rel, "/")
+	excluded := false
+	for _, rule := range e.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if matchSegments(rule.segments, parts) {
+			excluded = !rule.negate
+		}
+	}
+	return excluded
+}
+
+// matchSegments reports whether the path components parts match the pattern
+// components pattern, where "**" matches zero or more components.
+func matchSegments(pattern, parts []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// Try every number of components for "**" to stand for
+			for skip := 0; skip <= len(parts); skip++ {
+				if matchSegments(pattern[1:], parts[skip:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], parts[0]); !ok {
+			return false
+		}
+		pattern, parts = pattern[1:], parts[1:]
+	}
+	return len(parts) == 0
+}
@@ -0,0 +1,106 @@
+package file
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestExcluder(t *testing.T) {
+	e, err := NewExcluder([]string{
+		"# build output",
+		"*.log",
+		"!keep.log",
+		"build/",
+		"/todo.txt",
+		"docs/**/*.tmp",
+		`\#notes`,
+		"",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"app.log", false, true},
+		{"logs/deep/app.log", false, true},
+		{"keep.log", false, false},
+		{"logs/keep.log", false, false},
+		{"build", true, true},
+		{"src/build", true, true},
+		{"build", false, false}, // A file named like an excluded directory stays
+		{"todo.txt", false, true},
+		{"src/todo.txt", false, false}, // Rooted patterns only match at the root
+		{"docs/a.tmp", false, true},
+		{"docs/a/b/c.tmp", false, true},
+		{"src/a.tmp", false, false},
+		{"#notes", false, true},
+		{"main.go", false, false},
+	} {
+		if got := e.Excluded(tc.path, tc.isDir); got != tc.want {
+			t.Errorf("Excluded(%q, dir %v) = %v, want %v", tc.path, tc.isDir, got, tc.want)
+		}
+	}
+
+	var none *Excluder
+	if none.Excluded("app.log", false) {
+		t.Error("nil Excluder excluded an entry")
+	}
+	for _, bad := range []string{"/", "[", "a/[b"} {
+		if _, err := NewExcluder([]string{bad}); err == nil {
+			t.Errorf("NewExcluder accepted the malformed pattern %q", bad)
+		}
+	}
+}
+
+func TestCreateDirManifestExcluding(t *testing.T) {
+	dir := writeTestDir(t)
+	for name, content := range map[string]string{
+		"debug.log":       "noise\n",
+		"cache/blob.bin":  "cached\n",
+		"docs/keep.log":   "kept\n",
+		IgnoreFile:        "*.log\ncache/\n",
+		"docs/draft.txt":  "unfinished\n",
+		"docs/final.txt":  "finished\n",
+		"bin/scratch.tmp": "scratch\n",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Patterns given on top of the ignore file come after it, so they can
+	// include again what it leaves out
+	manifest, err := CreateDirManifestExcluding(dir, testChunkSize, []string{"draft.txt", "*.tmp", "!docs/keep.log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, entry := range manifest.Files {
+		paths = append(paths, entry.Path)
+	}
+	for _, excluded := range []string{"debug.log", "cache", "cache/blob.bin", "docs/draft.txt", "bin/scratch.tmp"} {
+		if slices.Contains(paths, excluded) {
+			t.Errorf("manifest lists excluded entry %s", excluded)
+		}
+	}
+	for _, kept := range []string{IgnoreFile, "bin/run.sh", "docs/final.txt", "docs/keep.log", "docs/readme.txt"} {
+		if !slices.Contains(paths, kept) {
+			t.Errorf("manifest doesn't list %s", kept)
+		}
+	}
+
+	// The manifest only covers the content of the entries it lists
+	report, err := VerifyFile(manifest, dirData(t, dir, manifest))
+	if err != nil || !report.OK() {
+		t.Fatalf("directory content doesn't match the manifest without excluded entries: %+v, %v", report, err)
+	}
+}
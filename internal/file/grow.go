@@ -0,0 +1,120 @@
+// Package file implements file handling functionality for the peer-to-peer file sharing system.
+// It provides utilities for creating file manifests, handling chunks, and managing file operations.
+package file
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrNotGrowable is returned when a manifest can't follow a file that is being
+// appended to.
+var ErrNotGrowable = errors.New("manifest can't describe a growing file")
+
+// CheckGrowable returns an error wrapping ErrNotGrowable unless m can be
+// extended as its file grows: only whole files split into fixed-size chunks
+// can, since appending never moves their chunk boundaries.
+func (m *Manifest) CheckGrowable() error {
+	switch {
+	case m.IsDir():
+		return fmt.Errorf("%w: %s is a directory", ErrNotGrowable, m.FileName)
+	case m.IsRange():
+		return fmt.Errorf("%w: %s is a range of a file", ErrNotGrowable, m.FileName)
+	case m.Chunking != "" && m.Chunking != ChunkingFixed:
+		return fmt.Errorf("%w: %s uses %s chunking", ErrNotGrowable, m.FileName, m.Chunking)
+	case m.Hashing == HashingMerkle:
+		return fmt.Errorf("%w: %s was imported from a torrent", ErrNotGrowable, m.FileName)
+	}
+	return nil
+}
+
+// SealedChunks returns the number of m's chunks that stay the same as its file
+// is appended to: all of them, unless the last one is shorter than ChunkSize
+// and will grow with the file.
+func (m *Manifest) SealedChunks() int {
+	n := len(m.Chunks)
+	if n > 0 && m.Chunks[n-1].Size < m.ChunkSize {
+		n--
+	}
+	return n
+}
+
+// Grow returns a copy of m describing src, m's file after size-m.FileSize bytes
+// were appended to it. The sealed chunks are kept as they are and the rest of
+// src is hashed into new chunks, so only the appended data is read. The copy
+// keeps m's FileHash, which goes on identifying the file to peers and trackers
+// but no longer is the hash of its whole content.
+func (m *Manifest) Grow(src io.ReaderAt, size int64) (*Manifest, error) {
+	if err := m.CheckGrowable(); err != nil {
+		return nil, err
+	}
+	if err := m.CheckHashKey(); err != nil {
+		return nil, err
+	}
+	if size < m.FileSize {
+		return nil, fmt.Errorf("%s shrank from %d to %d bytes; only appended data can be followed", m.FileName, m.FileSize, size)
+	}
+	if err := checkChunkCount(EstimateChunks(size, m.ChunkSize), size, m.ChunkSize); err != nil {
+		return nil, err
+	}
+
+	grown := *m
+	sealed := m.SealedChunks()
+	grown.Chunks = append([]Chunk{}, m.Chunks[:sealed]...)
+	grown.FileSize = m.ChunkOffset(sealed)
+	grown.SourceModTime = 0
+
+	// Hash everything from the first chunk that may have changed
+	r := io.NewSectionReader(src, grown.FileSize, size-grown.FileSize)
+	for grown.FileSize < size {
+		chunkHash := m.newHash()
+		n, err := io.CopyN(chunkHash, r, m.ChunkSize)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("%w: read %d bytes, expected %d", ErrSizeMismatch, grown.FileSize, size)
+		}
+		grown.Chunks = append(grown.Chunks, Chunk{
+			Hash:   fmt.Sprintf("%x", chunkHash.Sum(nil)),
+			Size:   n,
+			Offset: grown.FileSize,
+		})
+		grown.FileSize += n
+	}
+	return &grown, nil
+}
+
+// Extend returns a copy of m whose chunks from index from on are replaced by
+// chunks, as reported by a seeder whose copy of the file has grown. from must
+// not be below SealedChunks, since sealed chunks never change, and the result
+// must describe at least as much of the file as m does.
+func (m *Manifest) Extend(from int, chunks []Chunk) (*Manifest, error) {
+	if err := m.CheckGrowable(); err != nil {
+		return nil, err
+	}
+	if from < m.SealedChunks() || from > len(m.Chunks) {
+		return nil, fmt.Errorf("%w: can't replace chunks from %d of %d", ErrInvalidManifest, from, len(m.Chunks))
+	}
+
+	grown := *m
+	grown.Chunks = append(append([]Chunk{}, m.Chunks[:from]...), chunks...)
+	grown.FileSize = 0
+	for _, chunk := range grown.Chunks {
+		grown.FileSize += chunk.Size
+	}
+	// Every chunk but the last must be full, as if the file had been chunked anew
+	for i, chunk := range grown.Chunks {
+		if chunk.Size > m.ChunkSize || (i < len(grown.Chunks)-1 && chunk.Size != m.ChunkSize) {
+			return nil, fmt.Errorf("%w: chunk %d has size %d, expected %d", ErrInvalidManifest, i, chunk.Size, m.ChunkSize)
+		}
+	}
+	if err := grown.Validate(); err != nil {
+		return nil, err
+	}
+	if grown.FileSize < m.FileSize {
+		return nil, fmt.Errorf("%w: %d bytes is less than the %d already known", ErrInvalidManifest, grown.FileSize, m.FileSize)
+	}
+	return &grown, nil
+}
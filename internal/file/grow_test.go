@@ -0,0 +1,89 @@
+package file
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestManifestGrow(t *testing.T) {
+	path, data, manifest := testManifest(t, 2*testChunkSize+100)
+	if manifest.SealedChunks() != 2 {
+		t.Fatalf("%d sealed chunks, want the 2 full ones", manifest.SealedChunks())
+	}
+
+	// Append enough to fill the short chunk and add two more
+	_, more := writeTestFile(t, "more.bin", 2*testChunkSize)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(more); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	data = append(data, more...)
+
+	src, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	grown, err := manifest.Grow(src, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	whole, err := CreateManifest(path, testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(grown.Chunks, whole.Chunks) || grown.FileSize != whole.FileSize {
+		t.Fatal("grown manifest's chunks differ from those of the whole file")
+	}
+	if grown.FileHash != manifest.FileHash || len(manifest.Chunks) != 3 {
+		t.Fatal("Grow changed the file hash or the original manifest")
+	}
+
+	// Another peer learns of the new chunks from the first unsealed one on
+	extended, err := manifest.Extend(manifest.SealedChunks(), grown.Chunks[manifest.SealedChunks():])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(extended.Chunks, grown.Chunks) {
+		t.Fatal("extended manifest differs from the grown one")
+	}
+
+	if _, err := grown.Grow(src, grown.FileSize-1); err == nil {
+		t.Fatal("Grow accepted a file that shrank")
+	}
+	if _, err := manifest.Extend(1, grown.Chunks[1:]); !errors.Is(err, ErrInvalidManifest) {
+		t.Fatalf("replacing a sealed chunk returned %v, want ErrInvalidManifest", err)
+	}
+	short := append([]Chunk{}, grown.Chunks[2:]...)
+	short[0].Size--
+	if _, err := manifest.Extend(2, short); !errors.Is(err, ErrInvalidManifest) {
+		t.Fatalf("extending with a short chunk before the last returned %v, want ErrInvalidManifest", err)
+	}
+}
+
+func TestCheckGrowable(t *testing.T) {
+	path, _, _ := testManifest(t, 3*testChunkSize)
+	cdc, err := CreateManifestCDC(path, testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranged, err := CreateRangeManifest(path, testChunkSize, 10, 2*testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := CreateDirManifest(writeTestDir(t), testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []*Manifest{cdc, ranged, dir} {
+		if err := m.CheckGrowable(); !errors.Is(err, ErrNotGrowable) {
+			t.Errorf("CheckGrowable of %s returned %v, want ErrNotGrowable", m.FileName, err)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+// Package file implements file handling functionality for the peer-to-peer file sharing system.
+// It provides utilities for creating file manifests, handling chunks, and managing file operations.
+package file
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// GzipExt is the extension of files stored gzip-compressed, which is dropped
+// from the name of their decompressed content.
+const GzipExt = ".gz"
+
+// GzipReader reads the decompressed content of a gzip file at any offset, so
+// that a seeder can keep a file compressed on disk while serving the chunks of
+// its decompressed content. Gzip can only be decompressed from the start of a
+// member, so each read decompresses from the last member starting at or before
+// its offset. Files written by CompressGzip start a member at every chunk and
+// are read quickly; a file compressed as a single member, as by the gzip tool,
+// is decompressed from its start for every chunk. GzipReader is safe for
+// concurrent use.
+type GzipReader struct {
+	f       *os.File
+	members []gzipMember // In file order
+	size    int64        // Size of the decompressed content
+}
+
+// gzipMember locates one member of a gzip file.
+type gzipMember struct {
+	offset int64 // Offset of the member in the compressed file
+	start  int64 // Offset of its content in the decompressed content
+}
+
+// OpenGzip opens the gzip file at path for reading its decompressed content
+// with ReadAt. The whole file is decompressed once to find its members and
+// size, which also checks that it isn't corrupt.
+func OpenGzip(path string) (*GzipReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	members, size, err := scanGzip(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &GzipReader{f: f, members: members, size: size}, nil
+}
+
+// scanGzip decompresses r, returning where each of its members starts and the
+// size of the decompressed content.
+func scanGzip(r io.Reader) ([]gzipMember, int64, error) {
+	// Count the compressed bytes consumed by each member. countingReader is an
+	// io.ByteReader, so gzip reads no further ahead than a member's end.
+	cr := &countingReader{r: bufio.NewReader(r)}
+	zr, err := gzip.NewReader(cr)
+	if err != nil {
+		return nil, 0, err
+	}
+	var members []gzipMember
+	var size, offset int64
+	for {
+		zr.Multistream(false)
+		members = append(members, gzipMember{offset: offset, start: size})
+		n, err := io.Copy(io.Discard, zr)
+		if err != nil {
+			return nil, 0, err
+		}
+		size += n
+		offset = cr.n
+		if err := zr.Reset(cr); err == io.EOF {
+			return members, size, nil
+		} else if err != nil {
+			return nil, 0, err
+		}
+	}
+}
+
+// Size returns the size of the decompressed content.
+func (r *GzipReader) Size() int64 {
+	return r.size
+}
+
+// ReadAt reads len(p) bytes of the decompressed content starting at off.
+func (r *GzipReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	// Decompress from the last member starting at or before off, skipping
+	// to off; later members are read as needed
+	i := sort.Search(len(r.members), func(i int) bool { return r.members[i].start > off }) - 1
+	member := r.members[i]
+	zr, err := gzip.NewReader(bufio.NewReader(io.NewSectionReader(r.f, member.offset, 1<<63-1-member.offset)))
+	if err != nil {
+		return 0, err
+	}
+	if _, err := io.CopyN(io.Discard, zr, off-member.start); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(zr, p)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Close closes the gzip file.
+func (r *GzipReader) Close() error {
+	return r.f.Close()
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// CompressGzip gzip-compresses src into dst, starting a new gzip member every
+// memberSize bytes, so that GzipReader can read any chunk of a file shared
+// with chunks of that size without decompressing what comes before it. The
+// result is an ordinary gzip file, which any gzip tool decompresses.
+func CompressGzip(dst io.Writer, src io.Reader, memberSize int64) error {
+	if memberSize <= 0 {
+		return fmt.Errorf("invalid member size %d", memberSize)
+	}
+	br := bufio.NewReader(src)
+	zw := gzip.NewWriter(dst)
+	for {
+		if _, err := io.CopyN(zw, br, memberSize); err != nil && err != io.EOF {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		// Start another member only if there is content left for it
+		if _, err := br.Peek(1); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		zw.Reset(dst)
+	}
+}
+
+// GzipFileName returns the name of the decompressed content of the gzip file
+// called name: name without GzipExt.
+func GzipFileName(name string) string {
+	return strings.TrimSuffix(name, GzipExt)
+}
+
+// CreateGzipManifest creates a manifest for the decompressed content of the
+// gzip file at path, split into fixed chunks of chunkSize, so that the file
+// can be seeded while it stays compressed on disk; see GzipReader. The
+// manifest is named after the content, path's name without GzipExt, and
+// downloaders get the decompressed content. Its SourceModTime is that of the
+// compressed file; see IsCurrentGzip.
+func CreateGzipManifest(path string, chunkSize int64) (*Manifest, error) {
+	if name := filepath.Base(path); !strings.HasSuffix(name, GzipExt) || GzipFileName(name) == "" {
+		return nil, fmt.Errorf("%s doesn't have the %s extension of a gzip file", path, GzipExt)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// Decompress the content in one pass; its size is only known at the end
+	zr, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	manifest, err := createManifest(zr, GzipFileName(info.Name()), -1, chunkSize, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	manifest.SourceModTime = info.ModTime().UnixNano()
+	return manifest, nil
+}
+
+// IsCurrentGzip is like IsCurrent for manifests created by CreateGzipManifest
+// from the gzip file described by info, judged by its name and modification
+// time.
+func (m *Manifest) IsCurrentGzip(info os.FileInfo) bool {
+	return m.SourceModTime != 0 &&
+		m.SourceModTime == info.ModTime().UnixNano() &&
+		strings.HasSuffix(info.Name(), GzipExt) &&
+		m.FileName == GzipFileName(info.Name())
+}
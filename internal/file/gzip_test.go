@@ -0,0 +1,127 @@
+package file
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeGzip compresses data into a file named name in a temporary directory,
+// with a member every memberSize bytes, or as a single member as by the gzip
+// tool if memberSize is 0, and returns its path.
+func writeGzip(t *testing.T, name string, data []byte, memberSize int64) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if memberSize > 0 {
+		if err := CompressGzip(&buf, bytes.NewReader(data), memberSize); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		zw := gzip.NewWriter(&buf)
+		zw.Write(data)
+		zw.Close()
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGzipReader(t *testing.T) {
+	_, data := writeTestFile(t, "data.bin", 5*testChunkSize+123)
+	for _, memberSize := range []int64{testChunkSize, 0} {
+		path := writeGzip(t, "data.bin.gz", data, memberSize)
+		r, err := OpenGzip(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		wantMembers := 1
+		if memberSize > 0 {
+			wantMembers = 6
+		}
+		if r.Size() != int64(len(data)) || len(r.members) != wantMembers {
+			t.Fatalf("member size %d: size %d in %d members, want %d in %d", memberSize, r.Size(), len(r.members), len(data), wantMembers)
+		}
+
+		// Reads within a member, across members, and up to the end
+		for _, rng := range [][2]int{{0, 10}, {testChunkSize - 5, testChunkSize + 5}, {3 * testChunkSize, 4 * testChunkSize}, {len(data) - 7, len(data)}} {
+			p := make([]byte, rng[1]-rng[0])
+			if n, err := r.ReadAt(p, int64(rng[0])); err != nil || n != len(p) || !bytes.Equal(p, data[rng[0]:rng[1]]) {
+				t.Fatalf("member size %d: ReadAt of %d-%d returned %d bytes, %v", memberSize, rng[0], rng[1], n, err)
+			}
+		}
+		p := make([]byte, 20)
+		if n, err := r.ReadAt(p, int64(len(data)-10)); n != 10 || err != io.EOF {
+			t.Fatalf("member size %d: ReadAt past the end returned %d, %v; want 10, EOF", memberSize, n, err)
+		}
+		if _, err := r.ReadAt(p, int64(len(data))); err != io.EOF {
+			t.Fatalf("member size %d: ReadAt at the end returned %v, want EOF", memberSize, err)
+		}
+	}
+}
+
+func TestCompressGzipIsOrdinaryGzip(t *testing.T) {
+	_, data := writeTestFile(t, "data.bin", 3*testChunkSize)
+	var buf bytes.Buffer
+	if err := CompressGzip(&buf, bytes.NewReader(data), testChunkSize); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(zr)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("standard gzip reader got %d bytes, %v", len(got), err)
+	}
+	if err := CompressGzip(io.Discard, bytes.NewReader(data), 0); err == nil {
+		t.Fatal("CompressGzip accepted a member size of 0")
+	}
+}
+
+func TestCreateGzipManifest(t *testing.T) {
+	_, data := writeTestFile(t, "data.bin", 4*testChunkSize+9)
+	path := writeGzip(t, "data.bin.gz", data, testChunkSize)
+	manifest, err := CreateGzipManifest(path, testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := CreateManifestFromReader(bytes.NewReader(data), "data.bin", int64(len(data)), testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The manifest describes the decompressed content, named without .gz
+	if manifest.FileName != "data.bin" || manifest.FileHash != plain.FileHash || !reflect.DeepEqual(manifest.Chunks, plain.Chunks) {
+		t.Fatalf("manifest of %s doesn't describe its decompressed content", filepath.Base(path))
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !manifest.IsCurrentGzip(info) {
+		t.Fatal("manifest of an unchanged gzip file isn't current")
+	}
+
+	plainPath, _ := writeTestFile(t, "data.bin", 100)
+	if _, err := CreateGzipManifest(plainPath, testChunkSize); err == nil {
+		t.Fatal("CreateGzipManifest accepted a file without the .gz extension")
+	}
+	notGzip := filepath.Join(t.TempDir(), "fake.gz")
+	if err := os.WriteFile(notGzip, []byte("not compressed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateGzipManifest(notGzip, testChunkSize); !errors.Is(err, gzip.ErrHeader) {
+		t.Fatalf("CreateGzipManifest of a file that isn't gzip returned %v, want gzip.ErrHeader", err)
+	}
+	if _, err := OpenGzip(notGzip); !errors.Is(err, gzip.ErrHeader) {
+		t.Fatalf("OpenGzip of a file that isn't gzip returned %v, want gzip.ErrHeader", err)
+	}
+}
@@ -0,0 +1,37 @@
+package file
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testChunkSize keeps test files small while still splitting them into
+// several chunks.
+const testChunkSize = 4 << 10
+
+// writeTestFile writes size bytes of random data to a file named name in a
+// temporary directory, and returns its path and content.
+func writeTestFile(t testing.TB, name string, size int) (string, []byte) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+// testManifest writes a file of size random bytes, as writeTestFile does, and
+// creates its manifest with testChunkSize chunks.
+func testManifest(t testing.TB, size int) (string, []byte, *Manifest) {
+	t.Helper()
+	path, data := writeTestFile(t, "data.bin", size)
+	manifest, err := CreateManifest(path, testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, data, manifest
+}
@@ -0,0 +1,134 @@
+// Package file implements file handling functionality for the peer-to-peer file sharing system.
+// It provides utilities for creating file manifests, handling chunks, and managing file operations.
+package file
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+)
+
+// HashingHMAC is the Manifest.Hashing of manifests created by
+// CreateKeyedManifest: chunks and the whole file are hashed with HMAC-SHA256
+// under a group key instead of plain SHA-256.
+const HashingHMAC = "hmac-sha256"
+
+// ErrHashKey is returned when a keyed manifest is used without its hash key,
+// or with a different key than it was created with.
+var ErrHashKey = errors.New("wrong or missing hash key")
+
+// KeyFingerprint identifies a hash key without revealing it: the SHA-256 hash
+// of the key, truncated to 16 bytes. It matches keys.Key.Fingerprint for
+// symmetric keys.
+func KeyFingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return "SHA256:" + hex.EncodeToString(sum[:16])
+}
+
+// newHasher returns a function creating the hash used with key: HMAC-SHA256
+// under key, or plain SHA-256 if key is nil.
+func newHasher(key []byte) func() hash.Hash {
+	if key == nil {
+		return sha256.New
+	}
+	return func() hash.Hash { return hmac.New(sha256.New, key) }
+}
+
+// CreateKeyedManifest is like CreateManifest, or CreateDirManifest for a
+// directory, but hashes chunks and the whole content with HMAC-SHA256 under
+// key. The resulting hashes don't reveal the content to anyone without the
+// key, so a private group can share files whose plain SHA-256 is well known.
+// The manifest records that keyed hashing was used and the key's fingerprint,
+// and key is set as its hash key.
+func CreateKeyedManifest(path string, chunkSize int64, key []byte) (*Manifest, error) {
+	return createKeyedManifest(path, chunkSize, key, nil)
+}
+
+// CreateKeyedDirManifest is like CreateKeyedManifest for the directory at
+// dirPath, but also leaves out the entries matching the exclude patterns, as
+// CreateDirManifestExcluding does.
+func CreateKeyedDirManifest(dirPath string, chunkSize int64, key []byte, exclude []string) (*Manifest, error) {
+	return createKeyedManifest(dirPath, chunkSize, key, exclude)
+}
+
+// createKeyedManifest implements CreateKeyedManifest, leaving out the entries
+// of a directory that match exclude.
+func createKeyedManifest(path string, chunkSize int64, key []byte, exclude []string) (*Manifest, error) {
+	if len(key) == 0 {
+		return nil, fmt.Errorf("%w: empty key", ErrHashKey)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest *Manifest
+	if info.IsDir() {
+		manifest, err = createDirManifest(path, chunkSize, key, exclude)
+	} else {
+		manifest, err = createFileManifest(path, chunkSize, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	manifest.Hashing = HashingHMAC
+	manifest.KeyFingerprint = KeyFingerprint(key)
+	manifest.hashKey = key
+	return manifest, nil
+}
+
+// IsKeyed reports whether m's hashes are keyed, so that it can only be used
+// with its hash key.
+func (m *Manifest) IsKeyed() bool {
+	return m.Hashing == HashingHMAC
+}
+
+// SetHashKey sets the key used to verify the hashes of a keyed manifest. It
+// returns an error wrapping ErrHashKey if key isn't the one m was created with.
+func (m *Manifest) SetHashKey(key []byte) error {
+	if !m.IsKeyed() {
+		return fmt.Errorf("manifest for %s does not use keyed hashing", m.FileName)
+	}
+	if fp := KeyFingerprint(key); fp != m.KeyFingerprint {
+		return fmt.Errorf("%w: manifest for %s was hashed with key %s, not %s", ErrHashKey, m.FileName, m.KeyFingerprint, fp)
+	}
+	m.hashKey = key
+	return nil
+}
+
+// CheckHashKey returns an error wrapping ErrHashKey if m is keyed but has no
+// hash key set, in which case none of its chunks could be verified.
+func (m *Manifest) CheckHashKey() error {
+	if m.IsKeyed() && m.hashKey == nil {
+		return fmt.Errorf("%w: manifest for %s is hashed with key %s", ErrHashKey, m.FileName, m.KeyFingerprint)
+	}
+	return nil
+}
+
+// newHash returns the hash used for m's whole-file hash and, unless m uses
+// HashingMerkle, for its chunks.
+func (m *Manifest) newHash() hash.Hash {
+	if m.Hashing == HashingMerkle {
+		return &merkleHash{}
+	}
+	return newHasher(m.hashKey)()
+}
+
+// VerifyChunk reports whether data matches chunk, one of m's chunks, using
+// m's keyed or Merkle hash if it has one. Chunks of keyed manifests without a
+// hash key never match.
+func (m *Manifest) VerifyChunk(chunk Chunk, data []byte) bool {
+	if m.CheckHashKey() != nil {
+		return false
+	}
+	if m.Hashing == HashingMerkle {
+		return fmt.Sprintf("%x", m.merkleChunkHash(data)) == chunk.Hash
+	}
+	h := m.newHash()
+	h.Write(data)
+	return fmt.Sprintf("%x", h.Sum(nil)) == chunk.Hash
+}
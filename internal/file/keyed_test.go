@@ -0,0 +1,89 @@
+package file
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestKeyedManifestHashes(t *testing.T) {
+	path, _, plain := testManifest(t, 3*testChunkSize+9)
+	alice, err := CreateKeyedManifest(path, testChunkSize, []byte("alice's group"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := CreateKeyedManifest(path, testChunkSize, []byte("bob's group"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := CreateKeyedManifest(path, testChunkSize, []byte("alice's group"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same content under different keys, or none, shares no hash
+	if alice.FileHash == bob.FileHash || alice.FileHash == plain.FileHash || bob.FileHash == plain.FileHash {
+		t.Fatal("file hashes under different keys are equal")
+	}
+	for i := range plain.Chunks {
+		if alice.Chunks[i].Hash == bob.Chunks[i].Hash || alice.Chunks[i].Hash == plain.Chunks[i].Hash {
+			t.Fatalf("chunk %d hashes under different keys are equal", i)
+		}
+		if alice.Chunks[i].Size != plain.Chunks[i].Size || alice.Chunks[i].Offset != plain.Chunks[i].Offset {
+			t.Fatalf("chunk %d has another layout under a key", i)
+		}
+	}
+	if again.FileHash != alice.FileHash {
+		t.Fatal("the same key hashed the file differently")
+	}
+	if !alice.IsKeyed() || alice.Hashing != HashingHMAC || alice.KeyFingerprint != KeyFingerprint([]byte("alice's group")) {
+		t.Fatalf("keyed manifest records hashing %q with key %q", alice.Hashing, alice.KeyFingerprint)
+	}
+	if alice.KeyFingerprint == bob.KeyFingerprint || plain.IsKeyed() {
+		t.Fatal("fingerprints don't tell the keys apart")
+	}
+
+	if _, err := CreateKeyedManifest(path, testChunkSize, nil); !errors.Is(err, ErrHashKey) {
+		t.Fatalf("CreateKeyedManifest without a key returned %v, want ErrHashKey", err)
+	}
+}
+
+func TestKeyedManifestNeedsKey(t *testing.T) {
+	path, data := writeTestFile(t, "data.bin", 2*testChunkSize+1)
+	key := []byte("group key")
+	created, err := CreateKeyedManifest(path, testChunkSize, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report, err := VerifyFile(created, path); err != nil || !report.OK() {
+		t.Fatalf("VerifyFile with the creating key: %+v, %v", report, err)
+	}
+	if err := SaveManifest(created, path); err != nil {
+		t.Fatal(err)
+	}
+
+	// The key is never saved, so a loaded manifest can't verify anything
+	// until it is given the key again
+	manifest, err := LoadManifest(path + ".manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := manifest.Chunks[0]
+	if manifest.VerifyChunk(chunk, data[:chunk.Size]) {
+		t.Fatal("chunk verified without the hash key")
+	}
+	if _, err := VerifyFile(manifest, path); !errors.Is(err, ErrHashKey) {
+		t.Fatalf("VerifyFile without the hash key returned %v, want ErrHashKey", err)
+	}
+	if err := manifest.SetHashKey([]byte("other key")); !errors.Is(err, ErrHashKey) {
+		t.Fatalf("SetHashKey with the wrong key returned %v, want ErrHashKey", err)
+	}
+	if err := manifest.SetHashKey(key); err != nil {
+		t.Fatal(err)
+	}
+	if !manifest.VerifyChunk(chunk, data[:chunk.Size]) || VerifyChunk(chunk, data[:chunk.Size]) {
+		t.Fatal("chunk doesn't verify with its key, or verifies as plain SHA-256")
+	}
+	if report, err := VerifyFile(manifest, path); err != nil || !report.OK() {
+		t.Fatalf("VerifyFile with the hash key: %+v, %v", report, err)
+	}
+}
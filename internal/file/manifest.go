@@ -3,17 +3,23 @@
 package file
 
 import (
-	"crypto/sha256"
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
 )
 
 // Chunk represents a portion of a file that can be shared independently.
-// Each chunk has a unique hash and a specific size within the file.
+// Each chunk has a unique hash and a specific size and offset within the file.
 type Chunk struct {
-	Hash string `json:"hash"` // SHA-256 hash of the chunk data
-	Size int64  `json:"size"` // Size of the chunk in bytes
+	Hash   string `json:"hash"`   // SHA-256 hash of the chunk data
+	Size   int64  `json:"size"`   // Size of the chunk in bytes
+	Offset int64  `json:"offset"` // Byte offset of the chunk within the file
 }
 
 // Manifest represents the metadata for a shared file.
@@ -21,18 +27,133 @@ type Chunk struct {
 type Manifest struct {
 	FileName  string  `json:"fileName"`  // Original name of the file
 	FileSize  int64   `json:"fileSize"`  // Total size of the file in bytes
-	ChunkSize int64   `json:"chunkSize"` // Size of each chunk in bytes
+	ChunkSize int64   `json:"chunkSize"` // Size of each chunk in bytes (average size for CDC)
 	Chunks    []Chunk `json:"chunks"`    // List of chunks that make up the file
 	FileHash  string  `json:"fileHash"`  // SHA-256 hash of the entire file
+
+	Chunking string `json:"chunking,omitempty"` // Chunking strategy; empty means ChunkingFixed
+
+	// SourceModTime is the modification time of the file the manifest was created
+	// from, in Unix nanoseconds. Together with FileSize it lets a seeder detect
+	// whether a saved manifest still describes the file.
+	SourceModTime int64 `json:"sourceModTime,omitempty"`
+
+	// Trackers lists the URLs of trackers that know the file's peers, so that a
+	// manifest is enough to start a download without configuring a tracker.
+	Trackers []string `json:"trackers,omitempty"`
+
+	// AccessToken, if set, is the secret a seeder requires before serving
+	// the file, so that anyone holding the manifest can download it and
+	// anyone with only its hash can't. It is stripped from manifests sent
+	// to trackers and peers; see WithoutAccessToken.
+	AccessToken string `json:"accessToken,omitempty"`
+
+	// Compressible hints whether the file's content is worth compressing on the
+	// wire. It is estimated from the entropy of a sample of each chunk, so that
+	// already-compressed formats such as zip, jpg, and mp4 are sent as is.
+	Compressible bool `json:"compressible,omitempty"`
+
+	// ContentType is the MIME type of the file, such as "video/mp4" or
+	// "application/zip", detected from its first bytes as by
+	// DetectContentType, so that downloaders can tell what it is before
+	// fetching it. It is "application/octet-stream" for unrecognized content,
+	// and empty for empty files, directories, and manifests created before it
+	// was recorded.
+	ContentType string `json:"contentType,omitempty"`
+
+	// Files lists the entries of a shared directory, whose content is the
+	// concatenation of its regular files. It is empty for a single file.
+	Files []FileEntry `json:"files,omitempty"`
+
+	// RangeStart and SourceSize are set for manifests created by
+	// CreateRangeManifest, which cover only part of a file: the offset of the
+	// range in the source file, and the size of the whole source file.
+	RangeStart int64 `json:"rangeStart,omitempty"`
+	SourceSize int64 `json:"sourceSize,omitempty"`
+
+	// Hashing is empty when chunks and the file are hashed with SHA-256,
+	// HashingHMAC when they are hashed under a group key, which KeyFingerprint
+	// then identifies (see CreateKeyedManifest), or HashingMerkle for
+	// manifests imported from BitTorrent v2 torrents.
+	Hashing        string `json:"hashing,omitempty"`
+	KeyFingerprint string `json:"keyFingerprint,omitempty"`
+
+	hashKey []byte // Key for keyed hashing, set by SetHashKey; never saved
+}
+
+// ErrInvalidTracker is returned when a manifest lists a tracker URL that isn't
+// an absolute http or https URL.
+var ErrInvalidTracker = errors.New("invalid tracker URL")
+
+// ValidateTrackerURL checks that rawURL is an absolute http or https URL with a host.
+func ValidateTrackerURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("%w %q: %v", ErrInvalidTracker, rawURL, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w %q: must be an http or https URL", ErrInvalidTracker, rawURL)
+	}
+	return nil
 }
 
 // DefaultChunkSize is the default size for file chunks (1MB).
 const DefaultChunkSize = 1024 * 1024
 
+const (
+	// ChunkCountWarning is the chunk count above which a manifest is considered
+	// unreasonably large, and a larger chunk size should be used.
+	ChunkCountWarning = 100_000
+	// MaxChunks is the hard limit on the number of chunks in a manifest.
+	MaxChunks = 1_000_000
+)
+
+// ErrTooManyChunks is returned when a file would be split into more than MaxChunks chunks.
+var ErrTooManyChunks = errors.New("too many chunks")
+
+// EstimateChunks returns the number of chunks a file of fileSize bytes is split
+// into with the given chunk size. For content-defined chunking, where chunkSize
+// is the average, this is an estimate.
+func EstimateChunks(fileSize, chunkSize int64) int64 {
+	if chunkSize <= 0 {
+		return 0
+	}
+	return (fileSize + chunkSize - 1) / chunkSize
+}
+
+// SuggestChunkSize returns the smallest power-of-two chunk size, starting at
+// DefaultChunkSize, that splits a file of fileSize bytes into no more than
+// ChunkCountWarning chunks.
+func SuggestChunkSize(fileSize int64) int64 {
+	size := int64(DefaultChunkSize)
+	for EstimateChunks(fileSize, size) > ChunkCountWarning {
+		size *= 2
+	}
+	return size
+}
+
+// checkChunkCount returns ErrTooManyChunks if n exceeds MaxChunks.
+func checkChunkCount(n, fileSize, chunkSize int64) error {
+	if n > MaxChunks {
+		return fmt.Errorf("%w: %d chunks of %d bytes exceeds the limit of %d, try a chunk size of %d",
+			ErrTooManyChunks, n, chunkSize, MaxChunks, SuggestChunkSize(fileSize))
+	}
+	return nil
+}
+
 // CreateManifest creates a new manifest for a file.
 // It splits the file into chunks and calculates their hashes.
 // The chunkSize parameter determines how large each chunk should be.
+// Empty files produce a valid manifest with no chunks and the SHA-256 of empty input
+// as their file hash. Files that would need more than MaxChunks chunks are rejected
+// with ErrTooManyChunks before any data is read.
 func CreateManifest(filePath string, chunkSize int64) (*Manifest, error) {
+	return createFileManifest(filePath, chunkSize, nil)
+}
+
+// createFileManifest implements CreateManifest, hashing with HMAC-SHA256
+// under key if key isn't nil.
+func createFileManifest(filePath string, chunkSize int64, key []byte) (*Manifest, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return nil, err
@@ -44,76 +165,360 @@ func CreateManifest(filePath string, chunkSize int64) (*Manifest, error) {
 		return nil, err
 	}
 
-	manifest := &Manifest{
-		FileName:  fileInfo.Name(),
-		FileSize:  fileInfo.Size(),
-		ChunkSize: chunkSize,
+	manifest, err := createManifest(file, fileInfo.Name(), fileInfo.Size(), chunkSize, key)
+	if err != nil {
+		return nil, err
 	}
+	manifest.SourceModTime = fileInfo.ModTime().UnixNano()
+	return manifest, nil
+}
 
-	// Calculate file hash
-	fileHash := sha256.New()
-	if _, err := file.Seek(0, 0); err != nil {
-		return nil, err
+// ErrSizeMismatch is returned by CreateManifestFromReader when the reader
+// doesn't hold exactly the declared number of bytes.
+var ErrSizeMismatch = errors.New("content size differs from declared size")
+
+// CreateManifestFromReader creates a manifest for content read sequentially from
+// r, such as a pipe or network stream, without seeking. Each chunk and the whole
+// content are hashed in a single pass. name becomes the manifest's file name.
+// If size is not negative, it is the declared content length: r must hold exactly
+// that many bytes, or ErrSizeMismatch is returned. A negative size means the
+// length is unknown and r is read to EOF.
+func CreateManifestFromReader(r io.Reader, name string, size int64, chunkSize int64) (*Manifest, error) {
+	return createManifest(r, name, size, chunkSize, nil)
+}
+
+// createManifest implements CreateManifestFromReader, hashing with
+// HMAC-SHA256 under key if key isn't nil.
+func createManifest(r io.Reader, name string, size int64, chunkSize int64, key []byte) (*Manifest, error) {
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("invalid chunk size %d", chunkSize)
 	}
-	if _, err := file.WriteTo(fileHash); err != nil {
-		return nil, err
+	if size >= 0 {
+		if err := checkChunkCount(EstimateChunks(size, chunkSize), size, chunkSize); err != nil {
+			return nil, err
+		}
+		// Read one byte past the declared size to detect longer content
+		r = io.LimitReader(r, size+1)
 	}
-	manifest.FileHash = fmt.Sprintf("%x", fileHash.Sum(nil))
 
-	// Create chunks
-	numChunks := (fileInfo.Size() + chunkSize - 1) / chunkSize
-	manifest.Chunks = make([]Chunk, numChunks)
+	manifest := &Manifest{
+		FileName:  name,
+		ChunkSize: chunkSize,
+		Chunks:    []Chunk{},
+	}
 
-	for i := int64(0); i < numChunks; i++ {
-		chunkSize := chunkSize
-		if i == numChunks-1 {
-			chunkSize = fileInfo.Size() - (i * chunkSize)
+	// Hash each chunk while feeding every byte into the file hash, sample
+	// each chunk's start to judge whether the content is compressible, and
+	// keep the file's start to detect its content type
+	newHash := newHasher(key)
+	fileHash := newHash()
+	var sniffer contentSniffer
+	tee := io.TeeReader(r, io.MultiWriter(fileHash, &sniffer))
+	var sampler entropySampler
+	for {
+		chunkHash := newHash()
+		sampler.startChunk()
+		n, err := io.CopyN(io.MultiWriter(chunkHash, &sampler), tee, chunkSize)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if n > 0 {
+			manifest.Chunks = append(manifest.Chunks, Chunk{
+				Hash:   fmt.Sprintf("%x", chunkHash.Sum(nil)),
+				Size:   n,
+				Offset: manifest.FileSize,
+			})
+			manifest.FileSize += n
+		}
+		if err == io.EOF {
+			break
+		}
+		if len(manifest.Chunks) > MaxChunks {
+			return nil, checkChunkCount(int64(len(manifest.Chunks)), manifest.FileSize, chunkSize)
 		}
+	}
+	manifest.FileHash = fmt.Sprintf("%x", fileHash.Sum(nil))
+	manifest.Compressible = sampler.compressible()
+	manifest.ContentType = sniffer.contentType()
 
-		chunk := Chunk{
-			Size: chunkSize,
+	if size >= 0 && manifest.FileSize != size {
+		if manifest.FileSize > size {
+			return nil, fmt.Errorf("%w: more than the declared %d bytes", ErrSizeMismatch, size)
 		}
+		return nil, fmt.Errorf("%w: read %d bytes, expected %d", ErrSizeMismatch, manifest.FileSize, size)
+	}
+	return manifest, nil
+}
+
+// IsCurrent reports whether m was created from the file described by info in
+// its current state, judged by its name, size, and modification time. Manifests
+// without a recorded modification time are never considered current.
+func (m *Manifest) IsCurrent(info os.FileInfo) bool {
+	return m.SourceModTime != 0 &&
+		m.SourceModTime == info.ModTime().UnixNano() &&
+		m.FileSize == info.Size() &&
+		m.FileName == info.Name()
+}
+
+// WithoutAccessToken returns m without its access token, for sending to
+// trackers and peers: a copy if m has one, m itself otherwise.
+func (m *Manifest) WithoutAccessToken() *Manifest {
+	if m.AccessToken == "" {
+		return m
+	}
+	public := *m
+	public.AccessToken = ""
+	return &public
+}
 
-		// Calculate chunk hash
-		chunkHash := sha256.New()
-		if _, err := file.Seek(i*chunkSize, 0); err != nil {
+// CreateManifestLike creates a manifest for filePath using the same chunking
+// strategy, chunk size, and hash key as layout, so that identical content
+// produces identical chunk hashes in both manifests.
+func CreateManifestLike(filePath string, layout *Manifest) (*Manifest, error) {
+	if layout.Hashing == HashingMerkle {
+		return nil, fmt.Errorf("manifests imported from torrents can't be created from a file")
+	}
+	if layout.IsKeyed() {
+		if err := layout.CheckHashKey(); err != nil {
 			return nil, err
 		}
-		if _, err := file.WriteTo(chunkHash); err != nil {
-			return nil, err
+		if layout.Chunking != "" && layout.Chunking != ChunkingFixed {
+			return nil, fmt.Errorf("keyed hashing is only supported with %s chunking", ChunkingFixed)
 		}
-		chunk.Hash = fmt.Sprintf("%x", chunkHash.Sum(nil))
+		return CreateKeyedManifest(filePath, layout.ChunkSize, layout.hashKey)
+	}
+	switch layout.Chunking {
+	case "", ChunkingFixed:
+		return CreateManifest(filePath, layout.ChunkSize)
+	case ChunkingCDC:
+		return CreateManifestCDC(filePath, layout.ChunkSize)
+	default:
+		return nil, fmt.Errorf("unknown chunking strategy %q", layout.Chunking)
+	}
+}
 
-		manifest.Chunks[i] = chunk
+// ChunkOffset returns the byte offset of the chunk at index within the file,
+// or the file size for an index past the last chunk.
+func (m *Manifest) ChunkOffset(index int) int64 {
+	if index < 0 {
+		return 0
+	}
+	if index >= len(m.Chunks) {
+		return m.FileSize
 	}
+	return m.Chunks[index].Offset
+}
 
-	return manifest, nil
+// ErrInvalidManifest is returned when a manifest's chunks don't describe its file.
+var ErrInvalidManifest = errors.New("invalid manifest")
+
+// Validate checks that m's chunks are non-empty, follow each other without
+// gaps or overlaps, and together cover exactly FileSize bytes. Manifests saved
+// before chunk offsets were recorded have every offset at 0; their offsets are
+// first filled in from the chunk sizes.
+func (m *Manifest) Validate() error {
+	m.fillOffsets()
+
+	offset := int64(0)
+	for i, chunk := range m.Chunks {
+		if chunk.Size <= 0 {
+			return fmt.Errorf("%w: chunk %d has size %d", ErrInvalidManifest, i, chunk.Size)
+		}
+		if chunk.Offset != offset {
+			return fmt.Errorf("%w: chunk %d is at offset %d, expected %d", ErrInvalidManifest, i, chunk.Offset, offset)
+		}
+		offset += chunk.Size
+	}
+	if offset != m.FileSize {
+		return fmt.Errorf("%w: chunks cover %d bytes of a %d-byte file", ErrInvalidManifest, offset, m.FileSize)
+	}
+	if m.Hashing != "" && m.Hashing != HashingHMAC && m.Hashing != HashingMerkle {
+		return fmt.Errorf("%w: unknown hashing %q", ErrInvalidManifest, m.Hashing)
+	}
+	return nil
+}
+
+// fillOffsets computes chunk offsets from the chunk sizes if none are recorded.
+func (m *Manifest) fillOffsets() {
+	for _, chunk := range m.Chunks {
+		if chunk.Offset != 0 {
+			return
+		}
+	}
+	offset := int64(0)
+	for i := range m.Chunks {
+		m.Chunks[i].Offset = offset
+		offset += m.Chunks[i].Size
+	}
 }
 
 // SaveManifest saves a manifest to a file.
 // The manifest is saved in JSON format with the same name as the original file
 // plus a .manifest extension.
+// Manifests that LoadManifest would reject as too large are refused with
+// ErrManifestTooLarge.
 func SaveManifest(manifest *Manifest, filePath string) error {
 	manifestPath := filePath + ".manifest"
 	data, err := json.MarshalIndent(manifest, "", "  ")
 	if err != nil {
 		return err
 	}
+	if err := checkManifestSize(data); err != nil {
+		return err
+	}
 	return os.WriteFile(manifestPath, data, 0644)
 }
 
+// SaveManifestCompressed saves a gzip-compressed manifest to a file.
+// The manifest is saved as compact JSON with the same name as the original file
+// plus a .manifest.gz extension. This is much smaller for files with many chunks.
+func SaveManifestCompressed(manifest *Manifest, filePath string) error {
+	data, err := EncodeManifest(manifest)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filePath+".manifest.gz", data, 0644)
+}
+
+// EncodeManifest returns manifest as gzip-compressed compact JSON, as saved
+// by SaveManifestCompressed and read by ReadManifest.
+func EncodeManifest(manifest *Manifest) ([]byte, error) {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkManifestSize(data); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// maxChunkJSONSize bounds the JSON of one chunk in a saved manifest: an
+// indented object with a 64-digit hash and a 19-digit size and offset.
+const maxChunkJSONSize = 168
+
+// DefaultMaxManifestSize is the largest manifest LoadManifest accepts, in
+// bytes of JSON after decompression. It fits a manifest of MaxChunks chunks
+// with room for the rest of it, so that every manifest the tool creates can
+// be loaded again; SaveManifest refuses to write larger ones.
+const DefaultMaxManifestSize = MaxChunks*maxChunkJSONSize + 16<<20
+
+// ErrManifestTooLarge is returned when a manifest exceeds the size limit it
+// is loaded with.
+var ErrManifestTooLarge = errors.New("manifest too large")
+
+// checkManifestSize returns ErrManifestTooLarge if data, the JSON of a
+// manifest about to be saved, is larger than LoadManifest accepts.
+func checkManifestSize(data []byte) error {
+	if len(data) > DefaultMaxManifestSize {
+		return fmt.Errorf("%w: %d bytes of JSON exceeds the limit of %d", ErrManifestTooLarge, len(data), DefaultMaxManifestSize)
+	}
+	return nil
+}
+
+// ErrManifestMismatch is returned when a manifest fetched by file hash, from a
+// tracker or a peer, describes a different file than the one asked for.
+var ErrManifestMismatch = errors.New("manifest describes a different file")
+
 // LoadManifest loads a manifest from a file.
-// It reads and parses the JSON data into a Manifest struct.
+// It reads and parses the JSON data into a Manifest struct. Gzip-compressed
+// manifests are detected by their magic bytes and decompressed transparently.
+// Manifests whose chunks fail Validate are rejected, and so are manifests
+// larger than DefaultMaxManifestSize, with ErrManifestTooLarge.
 func LoadManifest(manifestPath string) (*Manifest, error) {
-	data, err := os.ReadFile(manifestPath)
+	return LoadManifestLimit(manifestPath, DefaultMaxManifestSize)
+}
+
+// LoadManifestLimit is like LoadManifest, but accepts manifests of up to
+// maxSize bytes (DefaultMaxManifestSize if maxSize isn't positive).
+func LoadManifestLimit(manifestPath string, maxSize int64) (*Manifest, error) {
+	f, err := os.Open(manifestPath)
 	if err != nil {
 		return nil, err
 	}
+	defer f.Close()
+	return ReadManifest(f, maxSize)
+}
+
+// ReadManifest reads a manifest from r as LoadManifestLimit does, so that
+// manifests from untrusted sources are rejected before they are held in
+// memory: reading stops with ErrManifestTooLarge after maxSize bytes
+// (DefaultMaxManifestSize if maxSize isn't positive) of JSON, however little
+// compressed data they came from.
+func ReadManifest(r io.Reader, maxSize int64) (*Manifest, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxManifestSize
+	}
+	br := bufio.NewReader(r)
+
+	// Decompress gzip-compressed manifests
+	var data io.Reader = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		data = zr
+	}
 
+	// Decode as the JSON streams in, stopping at the limit
 	var manifest Manifest
-	if err := json.Unmarshal(data, &manifest); err != nil {
+	dec := json.NewDecoder(&sizeLimitReader{r: data, max: maxSize})
+	if err := dec.Decode(&manifest); err != nil {
 		return nil, err
 	}
+	if _, err := dec.Token(); err != io.EOF {
+		if errors.Is(err, ErrManifestTooLarge) {
+			return nil, err
+		}
+		return nil, errors.New("invalid manifest: unexpected data after the JSON object")
+	}
+
+	// Reject chunk layouts that don't describe the file
+	if err := manifest.Validate(); err != nil {
+		return nil, err
+	}
+
+	// Reject tracker URLs that a download would fail to use
+	for _, tracker := range manifest.Trackers {
+		if err := ValidateTrackerURL(tracker); err != nil {
+			return nil, err
+		}
+	}
 
 	return &manifest, nil
 }
+
+// sizeLimitReader reads from r until max bytes have been read, then fails
+// with ErrManifestTooLarge if there is more.
+type sizeLimitReader struct {
+	r    io.Reader
+	max  int64
+	read int64
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	if l.read >= l.max {
+		var b [1]byte
+		if n, err := l.r.Read(b[:]); n == 0 {
+			return 0, err
+		}
+		return 0, fmt.Errorf("%w: more than %d bytes", ErrManifestTooLarge, l.max)
+	}
+	if int64(len(p)) > l.max-l.read {
+		p = p[:l.max-l.read]
+	}
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	return n, err
+}
@@ -0,0 +1,373 @@
+package file
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompressedManifestRoundTrip(t *testing.T) {
+	path, _, manifest := testManifest(t, 200*testChunkSize+5)
+	if err := SaveManifest(manifest, path); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveManifestCompressed(manifest, path); err != nil {
+		t.Fatal(err)
+	}
+
+	plain, err := LoadManifest(path + ".manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := LoadManifest(path + ".manifest.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(compressed, manifest) || !reflect.DeepEqual(plain, manifest) {
+		t.Fatal("loaded manifests differ from the saved one")
+	}
+
+	plainInfo, err := os.Stat(path + ".manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gzInfo, err := os.Stat(path + ".manifest.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gzInfo.Size()*2 > plainInfo.Size() {
+		t.Errorf("compressed manifest has %d bytes, plain %d; want under half", gzInfo.Size(), plainInfo.Size())
+	}
+}
+
+func TestEmptyFileManifest(t *testing.T) {
+	path, _ := writeTestFile(t, "empty", 0)
+	manifest, err := CreateManifest(path, testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Chunks) != 0 || manifest.FileSize != 0 {
+		t.Fatalf("empty file has %d chunks and size %d", len(manifest.Chunks), manifest.FileSize)
+	}
+	if want := fmt.Sprintf("%x", sha256.Sum256(nil)); manifest.FileHash != want {
+		t.Fatalf("file hash %s, want the SHA-256 of empty input %s", manifest.FileHash, want)
+	}
+	if err := manifest.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := VerifyFile(manifest, path)
+	if err != nil || !report.OK() {
+		t.Fatalf("VerifyFile of the empty file: %+v, %v", report, err)
+	}
+}
+
+func TestManifestLastChunkSize(t *testing.T) {
+	for _, size := range []int{3*testChunkSize + 100, 3 * testChunkSize, 1} {
+		path, data, manifest := testManifest(t, size)
+		want := (size + testChunkSize - 1) / testChunkSize
+		if len(manifest.Chunks) != want {
+			t.Fatalf("%d bytes: %d chunks, want %d", size, len(manifest.Chunks), want)
+		}
+		last := manifest.Chunks[len(manifest.Chunks)-1]
+		if wantSize := int64(size - (want-1)*testChunkSize); last.Offset+last.Size != int64(size) || last.Size != wantSize {
+			t.Fatalf("%d bytes: last chunk at %d has size %d, want %d ending at the file size", size, last.Offset, last.Size, wantSize)
+		}
+		if !manifest.VerifyChunk(last, data[last.Offset:]) {
+			t.Fatalf("%d bytes: last chunk hash doesn't cover the file's tail", size)
+		}
+		got, err := GetChunk(path, manifest, len(manifest.Chunks)-1)
+		if err != nil || !bytes.Equal(got, data[last.Offset:]) {
+			t.Fatalf("%d bytes: GetChunk of the last chunk returned %d bytes, %v", size, len(got), err)
+		}
+	}
+}
+
+func TestLoadManifestValidatesTrackers(t *testing.T) {
+	path, _, manifest := testManifest(t, testChunkSize)
+	manifest.Trackers = []string{"http://tracker.example:8080", "https://tracker.example/base"}
+	if err := SaveManifest(manifest, path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadManifest(path + ".manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.Trackers, manifest.Trackers) {
+		t.Fatalf("loaded trackers %v, want %v", loaded.Trackers, manifest.Trackers)
+	}
+
+	manifest.Trackers = append(manifest.Trackers, "tracker.example:8080")
+	if err := SaveManifest(manifest, path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadManifest(path + ".manifest"); !errors.Is(err, ErrInvalidTracker) {
+		t.Fatalf("loading a manifest with a bare host:port tracker returned %v, want ErrInvalidTracker", err)
+	}
+}
+
+func TestSuggestChunkSize(t *testing.T) {
+	if n := EstimateChunks(10*DefaultChunkSize+1, DefaultChunkSize); n != 11 {
+		t.Fatalf("EstimateChunks counted %d chunks, want 11", n)
+	}
+	for _, size := range []int64{0, DefaultChunkSize, ChunkCountWarning * DefaultChunkSize, 1 << 40} {
+		suggested := SuggestChunkSize(size)
+		if suggested < DefaultChunkSize || EstimateChunks(size, suggested) > ChunkCountWarning {
+			t.Errorf("SuggestChunkSize(%d) = %d, giving %d chunks", size, suggested, EstimateChunks(size, suggested))
+		}
+		if suggested > DefaultChunkSize && EstimateChunks(size, suggested/2) <= ChunkCountWarning {
+			t.Errorf("SuggestChunkSize(%d) = %d, but half that is small enough", size, suggested)
+		}
+	}
+}
+
+func TestCreateManifestRejectsTooManyChunks(t *testing.T) {
+	// A sparse file that would need one more chunk than allowed
+	path := filepath.Join(t.TempDir(), "huge.bin")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, MaxChunks+1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateManifest(path, 1); !errors.Is(err, ErrTooManyChunks) {
+		t.Fatalf("CreateManifest returned %v, want ErrTooManyChunks", err)
+	}
+	if _, err := CreateManifestCDC(path, 1); !errors.Is(err, ErrTooManyChunks) {
+		t.Fatalf("CreateManifestCDC returned %v, want ErrTooManyChunks", err)
+	}
+}
+
+func TestManifestIsCurrent(t *testing.T) {
+	path, _, manifest := testManifest(t, testChunkSize)
+	stat := func() os.FileInfo {
+		t.Helper()
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+	if !manifest.IsCurrent(stat()) {
+		t.Fatal("manifest of an unchanged file isn't current")
+	}
+
+	legacy := *manifest
+	legacy.SourceModTime = 0
+	if legacy.IsCurrent(stat()) {
+		t.Fatal("manifest without a modification time is current")
+	}
+
+	later := time.Unix(manifest.SourceModTime/1e9+60, 0)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.IsCurrent(stat()) {
+		t.Fatal("manifest is current after the file was modified")
+	}
+}
+
+// readerOnly hides every method of its Reader but Read, such as Seek and
+// ReadAt, as for a pipe or network stream.
+type readerOnly struct {
+	io.Reader
+}
+
+func TestCreateManifestFromReader(t *testing.T) {
+	_, data, want := testManifest(t, 3*testChunkSize+77)
+
+	for _, size := range []int64{int64(len(data)), -1} {
+		got, err := CreateManifestFromReader(readerOnly{bytes.NewReader(data)}, "data.bin", size, testChunkSize)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if got.FileHash != want.FileHash || got.FileSize != want.FileSize || !reflect.DeepEqual(got.Chunks, want.Chunks) {
+			t.Fatalf("size %d: manifest from a reader differs from the file's", size)
+		}
+	}
+
+	// Content from a pipe, written while it is read
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write(data)
+		pw.Close()
+	}()
+	got, err := CreateManifestFromReader(pr, "data.bin", int64(len(data)), testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.FileHash != want.FileHash {
+		t.Fatal("manifest from a pipe has the wrong file hash")
+	}
+}
+
+func TestCreateManifestFromReaderSizeMismatch(t *testing.T) {
+	data := make([]byte, 2*testChunkSize)
+	for _, declared := range []int64{int64(len(data)) - 1, int64(len(data)) + 1} {
+		_, err := CreateManifestFromReader(readerOnly{bytes.NewReader(data)}, "data.bin", declared, testChunkSize)
+		if !errors.Is(err, ErrSizeMismatch) {
+			t.Errorf("declaring %d of %d bytes returned %v, want ErrSizeMismatch", declared, len(data), err)
+		}
+	}
+}
+
+func TestChunkOffsets(t *testing.T) {
+	path, data := writeTestFile(t, "data.bin", 20*testChunkSize+31)
+	fixed, err := CreateManifest(path, testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cdc, err := CreateManifestCDC(path, testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, manifest := range []*Manifest{fixed, cdc} {
+		if err := manifest.Validate(); err != nil {
+			t.Fatalf("%s manifest: %v", manifest.Chunking, err)
+		}
+		// Chunks are read from and written to their recorded offsets, in any
+		// order, whatever their sizes
+		out, err := os.Create(filepath.Join(t.TempDir(), "out.bin"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer out.Close()
+		for i := len(manifest.Chunks) - 1; i >= 0; i-- {
+			chunk := manifest.Chunks[i]
+			got, err := GetChunk(path, manifest, i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data[chunk.Offset:chunk.Offset+chunk.Size]) {
+				t.Fatalf("%s chunk %d doesn't hold the bytes at its offset %d", manifest.Chunking, i, chunk.Offset)
+			}
+			if err := WriteChunkAt(out, manifest, i, got); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := os.ReadFile(out.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%s chunks written at their offsets don't reassemble the file", manifest.Chunking)
+		}
+		if manifest.ChunkOffset(len(manifest.Chunks)) != manifest.FileSize {
+			t.Fatalf("%s offset past the last chunk is %d, want the file size", manifest.Chunking, manifest.ChunkOffset(len(manifest.Chunks)))
+		}
+	}
+}
+
+func TestValidateChunkLayout(t *testing.T) {
+	layout := func(sizes ...int64) *Manifest {
+		m := &Manifest{}
+		for _, size := range sizes {
+			m.Chunks = append(m.Chunks, Chunk{Size: size, Offset: m.FileSize})
+			m.FileSize += size
+		}
+		return m
+	}
+
+	// Manifests saved before offsets were recorded get them from the sizes
+	legacy := layout(10, 10, 5)
+	for i := range legacy.Chunks {
+		legacy.Chunks[i].Offset = 0
+	}
+	if err := legacy.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(legacy, layout(10, 10, 5)) {
+		t.Fatalf("legacy manifest validated to %+v", legacy.Chunks)
+	}
+
+	gap := layout(10, 10, 5)
+	gap.Chunks[2].Offset++
+	overlap := layout(10, 10, 5)
+	overlap.Chunks[1].Offset--
+	empty := layout(10, 0, 5)
+	short := layout(10, 10, 5)
+	short.FileSize++
+	for name, m := range map[string]*Manifest{"gap": gap, "overlap": overlap, "empty chunk": empty, "short": short} {
+		if err := m.Validate(); !errors.Is(err, ErrInvalidManifest) {
+			t.Errorf("%s: Validate returned %v, want ErrInvalidManifest", name, err)
+		}
+	}
+}
+
+func TestLoadManifestRejectsInvalidLayout(t *testing.T) {
+	path, _, manifest := testManifest(t, 3*testChunkSize)
+	manifest.Chunks[1].Offset += 7
+	if err := SaveManifest(manifest, path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadManifest(path + ".manifest"); !errors.Is(err, ErrInvalidManifest) {
+		t.Fatalf("LoadManifest of a manifest with a gap returned %v, want ErrInvalidManifest", err)
+	}
+}
+
+func TestDefaultMaxManifestSizeFitsMaxChunks(t *testing.T) {
+	// The largest chunk the JSON of a saved manifest can hold
+	worst := Chunk{Hash: strings.Repeat("f", 64), Size: math.MaxInt64, Offset: math.MaxInt64}
+	size := func(chunks int) int {
+		m := &Manifest{FileName: "data.bin", FileHash: worst.Hash, FileSize: math.MaxInt64, ChunkSize: math.MaxInt64}
+		for i := 0; i < chunks; i++ {
+			m.Chunks = append(m.Chunks, worst)
+		}
+		data, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(data)
+	}
+
+	perChunk := size(3) - size(2)
+	if perChunk > maxChunkJSONSize {
+		t.Fatalf("a chunk takes up to %d bytes of JSON, more than the %d allowed for", perChunk, maxChunkJSONSize)
+	}
+	if total := size(1) + (MaxChunks-1)*perChunk; total > DefaultMaxManifestSize {
+		t.Fatalf("a manifest of MaxChunks chunks takes up to %d bytes, more than the default limit of %d", total, DefaultMaxManifestSize)
+	}
+}
+
+func TestReadManifestLimit(t *testing.T) {
+	path, _, manifest := testManifest(t, 50*testChunkSize)
+	if err := SaveManifest(manifest, path); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveManifestCompressed(manifest, path); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path + ".manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{path + ".manifest", path + ".manifest.gz"} {
+		if _, err := LoadManifestLimit(name, info.Size()); err != nil {
+			t.Fatalf("%s: loading with a limit of its size: %v", filepath.Base(name), err)
+		}
+		// The limit applies to the JSON, however small it is compressed
+		if _, err := LoadManifestLimit(name, info.Size()/2); !errors.Is(err, ErrManifestTooLarge) {
+			t.Fatalf("%s: loading with half the size as the limit returned %v, want ErrManifestTooLarge", filepath.Base(name), err)
+		}
+	}
+
+	data, err := os.ReadFile(path + ".manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadManifest(bytes.NewReader(append(data, []byte(`{"fileName":"other"}`)...)), 0); err == nil {
+		t.Fatal("ReadManifest accepted data after the manifest")
+	}
+}
@@ -0,0 +1,133 @@
+// Package file implements file handling functionality for the peer-to-peer file sharing system.
+// It provides utilities for creating file manifests, handling chunks, and managing file operations.
+package file
+
+import "crypto/sha256"
+
+// MerkleBlockSize is the size of the blocks whose SHA-256 hashes are the
+// leaves of a Merkle tree, as in BitTorrent v2.
+const MerkleBlockSize = 16 << 10
+
+// MerkleLeaves returns the SHA-256 hash of each MerkleBlockSize block of data.
+// The last block may be shorter.
+func MerkleLeaves(data []byte) [][32]byte {
+	leaves := make([][32]byte, 0, (len(data)+MerkleBlockSize-1)/MerkleBlockSize)
+	for len(data) > 0 {
+		n := min(len(data), MerkleBlockSize)
+		leaves = append(leaves, sha256.Sum256(data[:n]))
+		data = data[n:]
+	}
+	return leaves
+}
+
+// MerkleRoot returns the root of the binary Merkle tree over leaves, padded
+// with all-zero hashes to width leaves, which must be a power of two no
+// smaller than len(leaves). Each inner node is the SHA-256 of its two
+// children's hashes.
+func MerkleRoot(leaves [][32]byte, width int) [32]byte {
+	return merkleRoot(leaves, width, [32]byte{})
+}
+
+// merkleRoot returns the root of the binary Merkle tree over nodes, padded to
+// width nodes with pad, the hash of a node that covers only padding.
+func merkleRoot(nodes [][32]byte, width int, pad [32]byte) [32]byte {
+	layer := make([][32]byte, len(nodes))
+	copy(layer, nodes)
+	for ; width > 1; width /= 2 {
+		next := make([][32]byte, 0, (len(layer)+1)/2)
+		for i := 0; i < len(layer); i += 2 {
+			right := pad // Hash of an all-padding subtree at the current layer
+			if i+1 < len(layer) {
+				right = layer[i+1]
+			}
+			next = append(next, hashPair(layer[i], right))
+		}
+		layer = next
+		pad = hashPair(pad, pad)
+	}
+	if len(layer) == 0 {
+		return pad
+	}
+	return layer[0]
+}
+
+// MerkleWidth returns the number of leaves of the smallest Merkle tree that
+// holds n leaves: the smallest power of two no smaller than n.
+func MerkleWidth(n int) int {
+	width := 1
+	for width < n {
+		width *= 2
+	}
+	return width
+}
+
+// hashPair returns the hash of an inner Merkle tree node with the given children.
+func hashPair(left, right [32]byte) [32]byte {
+	var buf [64]byte
+	copy(buf[:32], left[:])
+	copy(buf[32:], right[:])
+	return sha256.Sum256(buf[:])
+}
+
+// MerkleLayerRoot returns the root of the Merkle tree whose layer of piece
+// hashes is layer, each covering pieceWidth leaves. The layer is padded to a
+// power of two with the hashes of all-padding pieces.
+func MerkleLayerRoot(layer [][32]byte, pieceWidth int) [32]byte {
+	return merkleRoot(layer, MerkleWidth(len(layer)), MerkleRoot(nil, pieceWidth))
+}
+
+// HashingMerkle is the Manifest.Hashing of manifests imported from BitTorrent
+// v2 torrents. Each chunk's hash is the root of a Merkle tree over its
+// MerkleBlockSize blocks, padded to ChunkSize, or for a file of a single
+// chunk, to the smallest tree that holds it; the file hash is the root of the
+// tree over all of the file's blocks.
+const HashingMerkle = "sha256-merkle"
+
+// merkleChunkHash returns the hash of data as a chunk of m, which uses
+// HashingMerkle.
+func (m *Manifest) merkleChunkHash(data []byte) [32]byte {
+	leaves := MerkleLeaves(data)
+	width := MerkleWidth(len(leaves))
+	if len(m.Chunks) > 1 {
+		width = max(width, int(m.ChunkSize/MerkleBlockSize))
+	}
+	return MerkleRoot(leaves, width)
+}
+
+// merkleHash is a hash.Hash computing the Merkle root of everything written
+// to it, as the file hash of manifests using HashingMerkle.
+type merkleHash struct {
+	block  []byte // Start of the current, incomplete block
+	leaves [][32]byte
+}
+
+func (h *merkleHash) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		take := min(len(p), MerkleBlockSize-len(h.block))
+		h.block = append(h.block, p[:take]...)
+		p = p[take:]
+		if len(h.block) == MerkleBlockSize {
+			h.leaves = append(h.leaves, sha256.Sum256(h.block))
+			h.block = h.block[:0]
+		}
+	}
+	return n, nil
+}
+
+func (h *merkleHash) Sum(b []byte) []byte {
+	leaves := h.leaves
+	if len(h.block) > 0 {
+		leaves = append(leaves[:len(leaves):len(leaves)], sha256.Sum256(h.block))
+	}
+	root := MerkleRoot(leaves, MerkleWidth(len(leaves)))
+	return append(b, root[:]...)
+}
+
+func (h *merkleHash) Reset() {
+	h.block = h.block[:0]
+	h.leaves = nil
+}
+
+func (h *merkleHash) Size() int      { return sha256.Size }
+func (h *merkleHash) BlockSize() int { return sha256.BlockSize }
@@ -0,0 +1,97 @@
+package file
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+// pair is the hash of an inner Merkle tree node, written out for tests.
+func pair(left, right [32]byte) [32]byte {
+	return sha256.Sum256(append(left[:], right[:]...))
+}
+
+func TestMerkleRoot(t *testing.T) {
+	a, b, c := sha256.Sum256([]byte("a")), sha256.Sum256([]byte("b")), sha256.Sum256([]byte("c"))
+	var zero [32]byte
+	for _, tc := range []struct {
+		name   string
+		leaves [][32]byte
+		width  int
+		want   [32]byte
+	}{
+		{"single leaf", [][32]byte{a}, 1, a},
+		{"two leaves", [][32]byte{a, b}, 2, pair(a, b)},
+		{"padded leaf", [][32]byte{a}, 2, pair(a, zero)},
+		{"three leaves", [][32]byte{a, b, c}, 4, pair(pair(a, b), pair(c, zero))},
+		{"padded subtree", [][32]byte{a}, 4, pair(pair(a, zero), pair(zero, zero))},
+		{"no leaves", nil, 2, pair(zero, zero)},
+	} {
+		if got := MerkleRoot(tc.leaves, tc.width); got != tc.want {
+			t.Errorf("%s: root %x, want %x", tc.name, got, tc.want)
+		}
+	}
+
+	for n, want := range map[int]int{0: 1, 1: 1, 2: 2, 3: 4, 4: 4, 5: 8, 1000: 1024} {
+		if got := MerkleWidth(n); got != want {
+			t.Errorf("MerkleWidth(%d) = %d, want %d", n, got, want)
+		}
+	}
+}
+
+func TestMerkleLeaves(t *testing.T) {
+	data := bytes.Repeat([]byte{7}, 2*MerkleBlockSize+1)
+	leaves := MerkleLeaves(data)
+	if len(leaves) != 3 {
+		t.Fatalf("%d bytes make %d leaves, want 3", len(data), len(leaves))
+	}
+	if leaves[0] != sha256.Sum256(data[:MerkleBlockSize]) || leaves[2] != sha256.Sum256(data[2*MerkleBlockSize:]) {
+		t.Fatal("leaves aren't the hashes of the blocks, with a short last block")
+	}
+	if len(MerkleLeaves(nil)) != 0 {
+		t.Fatal("empty data has leaves")
+	}
+}
+
+func TestMerkleHash(t *testing.T) {
+	data := bytes.Repeat([]byte("merkle"), MerkleBlockSize) // 6 blocks
+	want := MerkleRoot(MerkleLeaves(data), 8)
+
+	// Written in pieces that don't line up with blocks, the hash is the root
+	// over every block
+	h := &merkleHash{}
+	for rest := data; len(rest) > 0; {
+		n := min(len(rest), 5000)
+		h.Write(rest[:n])
+		rest = rest[n:]
+	}
+	if got := h.Sum(nil); !bytes.Equal(got, want[:]) {
+		t.Fatalf("Merkle hash %x, want %x", got, want)
+	}
+	// Sum doesn't change the state, so more can be written
+	h.Write([]byte("x"))
+	more := MerkleRoot(MerkleLeaves(append(bytes.Clone(data), 'x')), 8)
+	if got := h.Sum(nil); !bytes.Equal(got, more[:]) {
+		t.Fatal("Merkle hash after Sum and another Write is wrong")
+	}
+	h.Reset()
+	if got, empty := h.Sum(nil), MerkleRoot(nil, 1); !bytes.Equal(got, empty[:]) {
+		t.Fatal("Merkle hash after Reset isn't that of empty content")
+	}
+}
+
+func TestMerkleLayerRoot(t *testing.T) {
+	// The root over a file's piece hashes is the root over its blocks, with
+	// the last piece padded like the rest of the tree
+	data := bytes.Repeat([]byte{3}, 5*MerkleBlockSize+7)
+	const pieceWidth = 2
+	var layer [][32]byte
+	for offset := 0; offset < len(data); offset += pieceWidth * MerkleBlockSize {
+		piece := data[offset:min(offset+pieceWidth*MerkleBlockSize, len(data))]
+		layer = append(layer, MerkleRoot(MerkleLeaves(piece), pieceWidth))
+	}
+	want := MerkleRoot(MerkleLeaves(data), 8)
+	if got := MerkleLayerRoot(layer, pieceWidth); got != want {
+		t.Fatalf("layer root %x, want the root over every block %x", got, want)
+	}
+}
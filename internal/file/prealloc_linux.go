@@ -0,0 +1,24 @@
+//go:build linux
+
+package file
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Preallocate reserves size bytes of disk space for f so that chunks can be
+// written at arbitrary offsets. On Linux it uses fallocate to reserve real
+// blocks, which fails fast with ENOSPC if the disk cannot hold the file.
+// Filesystems without fallocate support fall back to a sparse Truncate.
+func Preallocate(f *os.File, size int64) error {
+	if size == 0 {
+		return nil
+	}
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, size)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return f.Truncate(size)
+	}
+	return err
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package file
+
+import "os"
+
+// Preallocate sizes f to size bytes so that chunks can be written at arbitrary
+// offsets. On platforms without fallocate the file is extended sparsely.
+func Preallocate(f *os.File, size int64) error {
+	return f.Truncate(size)
+}
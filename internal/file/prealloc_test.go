@@ -0,0 +1,42 @@
+package file
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPreallocateSizesFile(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "out.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := Preallocate(f, 0); err != nil {
+		t.Fatal(err)
+	}
+	const size = 3*testChunkSize + 17
+	if err := Preallocate(f, size); err != nil {
+		t.Fatal(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != size {
+		t.Fatalf("preallocated file has %d bytes, want %d", info.Size(), size)
+	}
+
+	// The reserved space reads as zeros and can be written at any offset
+	if _, err := f.WriteAt([]byte("end"), size-3); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(data)) != size || string(data[size-3:]) != "end" || data[0] != 0 {
+		t.Fatalf("file holds %d bytes ending in %q", len(data), data[len(data)-3:])
+	}
+}
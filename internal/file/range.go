@@ -0,0 +1,71 @@
+// Package file implements file handling functionality for the peer-to-peer file sharing system.
+// It provides utilities for creating file manifests, handling chunks, and managing file operations.
+package file
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CreateRangeManifest creates a manifest covering only the bytes from startByte
+// up to (but not including) endByte of the file at filePath, split into fixed
+// chunks of chunkSize. The manifest describes the range as a file of its own,
+// so it can be downloaded like any other, and records where the range lies in
+// the source file so that seeders can serve it from the whole file. Its file
+// name marks the range, e.g. movie.0-1048576.mp4, so that the partial download
+// is never mistaken for the complete file.
+func CreateRangeManifest(filePath string, chunkSize, startByte, endByte int64) (*Manifest, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if startByte < 0 || endByte > info.Size() || startByte >= endByte {
+		return nil, fmt.Errorf("invalid range %d-%d of a %d-byte file", startByte, endByte, info.Size())
+	}
+
+	manifest, err := CreateManifestFromReader(io.NewSectionReader(f, startByte, endByte-startByte),
+		RangeFileName(info.Name(), startByte, endByte), endByte-startByte, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	manifest.RangeStart = startByte
+	manifest.SourceSize = info.Size()
+	manifest.SourceModTime = info.ModTime().UnixNano()
+	return manifest, nil
+}
+
+// RangeFileName returns the name of the bytes from startByte to endByte of the
+// file called name: the range inserted before the extension.
+func RangeFileName(name string, startByte, endByte int64) string {
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s.%d-%d%s", strings.TrimSuffix(name, ext), startByte, endByte, ext)
+}
+
+// IsRange reports whether m describes a byte range of a larger file rather
+// than a whole file.
+func (m *Manifest) IsRange() bool {
+	return m.SourceSize > 0
+}
+
+// Section returns the part of src, a source of srcSize bytes, that m describes:
+// the range for range manifests, or all of src otherwise. It fails if srcSize
+// isn't the size m was created from.
+func (m *Manifest) Section(src io.ReaderAt, srcSize int64) (*io.SectionReader, error) {
+	want := m.FileSize
+	if m.IsRange() {
+		want = m.SourceSize
+	}
+	if srcSize != want {
+		return nil, fmt.Errorf("source has %d bytes but the manifest describes %d", srcSize, want)
+	}
+	return io.NewSectionReader(src, m.RangeStart, m.FileSize), nil
+}
@@ -0,0 +1,74 @@
+package file
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCreateRangeManifest(t *testing.T) {
+	path, data := writeTestFile(t, "movie.mp4", 10*testChunkSize+123)
+	// A range starting and ending mid-chunk, so neither edge is aligned
+	const start, end = 2*testChunkSize + 100, 7*testChunkSize + 50
+	manifest, err := CreateRangeManifest(path, testChunkSize, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := manifest.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if !manifest.IsRange() || manifest.RangeStart != start || manifest.SourceSize != int64(len(data)) {
+		t.Fatalf("range manifest records start %d of %d bytes", manifest.RangeStart, manifest.SourceSize)
+	}
+	if manifest.FileSize != end-start || manifest.FileName != "movie.8292-28722.mp4" {
+		t.Fatalf("range manifest describes %s of %d bytes", manifest.FileName, manifest.FileSize)
+	}
+
+	// The range is hashed as a file of its own, with offsets from its start
+	whole, err := CreateManifestFromReader(bytes.NewReader(data[start:end]), manifest.FileName, end-start, testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.FileHash != whole.FileHash || len(manifest.Chunks) != len(whole.Chunks) {
+		t.Fatal("range manifest differs from a manifest of the range's bytes")
+	}
+	for i, chunk := range manifest.Chunks {
+		if chunk != whole.Chunks[i] {
+			t.Fatalf("chunk %d is %+v, want %+v", i, chunk, whole.Chunks[i])
+		}
+		// GetChunk reads each chunk from its place in the source file
+		got, err := GetChunk(path, manifest, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		from := start + chunk.Offset
+		if !bytes.Equal(got, data[from:from+chunk.Size]) {
+			t.Fatalf("chunk %d doesn't hold bytes %d-%d of the source", i, from, from+chunk.Size)
+		}
+	}
+
+	for _, r := range [][2]int64{{-1, 10}, {10, 10}, {20, 10}, {0, int64(len(data)) + 1}} {
+		if _, err := CreateRangeManifest(path, testChunkSize, r[0], r[1]); err == nil {
+			t.Errorf("CreateRangeManifest accepted range %d-%d of %d bytes", r[0], r[1], len(data))
+		}
+	}
+}
+
+func TestManifestSection(t *testing.T) {
+	path, data := writeTestFile(t, "movie.mp4", 3*testChunkSize)
+	manifest, err := CreateRangeManifest(path, testChunkSize, 10, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	section, err := manifest.Section(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, section.Size())
+	if _, err := section.ReadAt(got, 0); err != nil || !bytes.Equal(got, data[10:20]) {
+		t.Fatalf("section holds %q, %v", got, err)
+	}
+	// A source of another size isn't the file the range was taken from
+	if _, err := manifest.Section(bytes.NewReader(data[:20]), 20); err == nil {
+		t.Fatal("Section accepted a source of the wrong size")
+	}
+}
@@ -0,0 +1,82 @@
+// Package file implements file handling functionality for the peer-to-peer file sharing system.
+// It provides utilities for creating file manifests, handling chunks, and managing file operations.
+package file
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrContentChanged is returned by Rechunk when the content no longer has the
+// file hash recorded in its manifest.
+var ErrContentChanged = errors.New("content changed since the manifest was created")
+
+// Rechunk creates a manifest for the file or directory at path with a
+// different chunk size and chunking strategy than manifest, which describes
+// the same content. The content is read and hashed again in a single pass,
+// which also checks that it still has manifest's file hash; if not, an error
+// wrapping ErrContentChanged is returned. Everything that doesn't depend on the
+// layout is carried over: the trackers, keyed hashing and its hash key, which
+// must be set, and the byte range of a range manifest.
+func Rechunk(path string, manifest *Manifest, chunkSize int64, chunking string) (*Manifest, error) {
+	if err := manifest.CheckHashKey(); err != nil {
+		return nil, err
+	}
+	if chunking == "" {
+		chunking = ChunkingFixed
+	}
+	if chunking != ChunkingFixed && (manifest.IsDir() || manifest.IsRange() || manifest.IsKeyed()) {
+		return nil, fmt.Errorf("directories, ranges, and keyed manifests can only use %s chunking", ChunkingFixed)
+	}
+
+	var (
+		rechunked *Manifest
+		err       error
+	)
+	switch {
+	case manifest.IsRange():
+		rechunked, err = CreateRangeManifest(path, chunkSize, manifest.RangeStart, manifest.RangeStart+manifest.FileSize)
+	case manifest.IsDir():
+		rechunked, err = rechunkDir(path, manifest, chunkSize)
+	default:
+		layout := &Manifest{
+			ChunkSize:      chunkSize,
+			Chunking:       chunking,
+			Hashing:        manifest.Hashing,
+			KeyFingerprint: manifest.KeyFingerprint,
+			hashKey:        manifest.hashKey,
+		}
+		rechunked, err = CreateManifestLike(path, layout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if rechunked.FileHash != manifest.FileHash {
+		return nil, fmt.Errorf("%w: %s has file hash %s, the manifest records %s", ErrContentChanged, path, rechunked.FileHash, manifest.FileHash)
+	}
+	rechunked.Trackers = manifest.Trackers
+	rechunked.AccessToken = manifest.AccessToken
+	return rechunked, nil
+}
+
+// rechunkDir implements Rechunk for the directory at dirPath. The entries of
+// manifest are read rather than the directory walked again, so entries that
+// were excluded when the manifest was created stay excluded.
+func rechunkDir(dirPath string, manifest *Manifest, chunkSize int64) (*Manifest, error) {
+	rechunked, err := createManifest(&dirReader{dir: dirPath, entries: manifest.Files}, manifest.FileName, manifest.FileSize, chunkSize, manifest.hashKey)
+	if errors.Is(err, ErrSizeMismatch) {
+		return nil, fmt.Errorf("%w: %v", ErrContentChanged, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rechunked.ContentType = ""
+	rechunked.Files = manifest.Files
+	if manifest.IsKeyed() {
+		rechunked.Hashing = manifest.Hashing
+		rechunked.KeyFingerprint = manifest.KeyFingerprint
+		rechunked.hashKey = manifest.hashKey
+	}
+	return rechunked, nil
+}
@@ -0,0 +1,70 @@
+package file
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestRechunkVerifiesAgainstFile(t *testing.T) {
+	path, data, manifest := testManifest(t, 10*testChunkSize+77)
+	manifest.Trackers = []string{"http://tracker.example:8080"}
+
+	for _, chunking := range []string{ChunkingFixed, ChunkingCDC} {
+		rechunked, err := Rechunk(path, manifest, 4*testChunkSize, chunking)
+		if err != nil {
+			t.Fatalf("%s: %v", chunking, err)
+		}
+		if rechunked.FileHash != manifest.FileHash || rechunked.ChunkSize != 4*testChunkSize {
+			t.Fatalf("%s: rechunked manifest has file hash %s and chunk size %d", chunking, rechunked.FileHash, rechunked.ChunkSize)
+		}
+		if len(rechunked.Chunks) >= len(manifest.Chunks) {
+			t.Fatalf("%s: %d chunks after rechunking to 4 times the size, from %d", chunking, len(rechunked.Chunks), len(manifest.Chunks))
+		}
+		if !reflect.DeepEqual(rechunked.Trackers, manifest.Trackers) {
+			t.Fatalf("%s: trackers %v not carried over", chunking, rechunked.Trackers)
+		}
+		report, err := VerifyFile(rechunked, path)
+		if err != nil || !report.OK() {
+			t.Fatalf("%s: rechunked manifest doesn't verify against the file: %+v, %v", chunking, report, err)
+		}
+	}
+
+	// A file modified since is no longer the one the manifest describes
+	data[0] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Rechunk(path, manifest, 4*testChunkSize, ChunkingFixed); !errors.Is(err, ErrContentChanged) {
+		t.Fatalf("rechunking a modified file returned %v, want ErrContentChanged", err)
+	}
+}
+
+func TestRechunkDir(t *testing.T) {
+	dir := writeTestDir(t)
+	manifest, err := CreateDirManifest(dir, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rechunked, err := Rechunk(dir, manifest, 16, ChunkingFixed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rechunked.FileHash != manifest.FileHash || !reflect.DeepEqual(rechunked.Files, manifest.Files) {
+		t.Fatal("rechunked directory manifest describes other content")
+	}
+	src, err := OpenDir(dir, rechunked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	for i := range rechunked.Chunks {
+		if _, err := GetChunkAt(src, rechunked, i); err != nil {
+			t.Fatalf("chunk %d of the rechunked directory: %v", i, err)
+		}
+	}
+	if _, err := Rechunk(dir, manifest, 16, ChunkingCDC); err == nil {
+		t.Fatal("directory rechunked with content-defined chunks")
+	}
+}
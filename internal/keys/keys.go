@@ -0,0 +1,164 @@
+// Package keys creates, stores, and loads the keys used to sign and encrypt shared files.
+// Keys are stored as PEM files readable only by their owner, in a key directory.
+package keys
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Kinds of key that can be generated.
+const (
+	KindEd25519   = "ed25519"   // Keypair for signing manifests
+	KindSymmetric = "symmetric" // 256-bit secret for encrypting chunks
+)
+
+// SymmetricKeySize is the size in bytes of a symmetric key.
+const SymmetricKeySize = 32
+
+// Extension is the file extension of stored keys.
+const Extension = ".key"
+
+// symmetricBlockType is the PEM block type of symmetric keys. Ed25519 keys are
+// stored as PKCS #8 "PRIVATE KEY" blocks.
+const symmetricBlockType = "GO-SHARE SYMMETRIC KEY"
+
+// ErrKeyExists is returned by Generate when a key with the same name already exists.
+var ErrKeyExists = errors.New("key already exists")
+
+// Key is a loaded key. Exactly one of Private and Secret is set, depending on Kind.
+type Key struct {
+	Kind    string
+	Private ed25519.PrivateKey // Set for KindEd25519
+	Secret  []byte             // Set for KindSymmetric
+}
+
+// DefaultDir returns the default key directory, go-share/keys inside the user's
+// configuration directory (e.g. ~/.config/go-share/keys on Linux).
+func DefaultDir() (string, error) {
+	config, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(config, "go-share", "keys"), nil
+}
+
+// Generate creates a new key of the given kind and stores it as name in dir,
+// which is created if needed. The key file is only readable by its owner, and
+// an existing key is never overwritten. It returns the path of the key file.
+func Generate(dir, name, kind string) (string, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid key name %q", name)
+	}
+
+	var block *pem.Block
+	switch kind {
+	case KindEd25519:
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return "", err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(private)
+		if err != nil {
+			return "", err
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	case KindSymmetric:
+		secret := make([]byte, SymmetricKeySize)
+		if _, err := rand.Read(secret); err != nil {
+			return "", err
+		}
+		block = &pem.Block{Type: symmetricBlockType, Bytes: secret}
+	default:
+		return "", fmt.Errorf("unknown key type %q (want %s or %s)", kind, KindEd25519, KindSymmetric)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, name+Extension)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return "", fmt.Errorf("%w: %s", ErrKeyExists, path)
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := pem.Encode(f, block); err != nil {
+		f.Close()
+		os.Remove(path)
+		return "", err
+	}
+	return path, f.Close()
+}
+
+// Resolve returns the path of the key named by nameOrPath: the path itself if
+// such a file exists, or else the key with that name in dir.
+func Resolve(dir, nameOrPath string) string {
+	if _, err := os.Stat(nameOrPath); err == nil {
+		return nameOrPath
+	}
+	return filepath.Join(dir, strings.TrimSuffix(nameOrPath, Extension)+Extension)
+}
+
+// Load reads a key file written by Generate.
+func Load(path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM key file", path)
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+		private, ok := parsed.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s holds a %T, not an Ed25519 key", path, parsed)
+		}
+		return &Key{Kind: KindEd25519, Private: private}, nil
+	case symmetricBlockType:
+		if len(block.Bytes) != SymmetricKeySize {
+			return nil, fmt.Errorf("%s holds a %d-byte key, expected %d", path, len(block.Bytes), SymmetricKeySize)
+		}
+		return &Key{Kind: KindSymmetric, Secret: block.Bytes}, nil
+	default:
+		return nil, fmt.Errorf("%s holds an unsupported %q block", path, block.Type)
+	}
+}
+
+// PublicKey returns the base64-encoded public half of an Ed25519 key, or an
+// empty string for symmetric keys, which have none.
+func (k *Key) PublicKey() string {
+	if k.Kind != KindEd25519 {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(k.Private.Public().(ed25519.PublicKey))
+}
+
+// Fingerprint identifies a key without revealing it: the SHA-256 hash of the
+// public key, or of the secret for symmetric keys, truncated to 16 bytes.
+func (k *Key) Fingerprint() string {
+	material := k.Secret
+	if k.Kind == KindEd25519 {
+		material = k.Private.Public().(ed25519.PublicKey)
+	}
+	sum := sha256.Sum256(material)
+	return "SHA256:" + hex.EncodeToString(sum[:16])
+}
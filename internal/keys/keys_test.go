@@ -0,0 +1,106 @@
+package keys
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGenerateAndLoad(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "keys")
+	for _, kind := range []string{KindEd25519, KindSymmetric} {
+		path, err := Generate(dir, "my-"+kind, kind)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path != filepath.Join(dir, "my-"+kind+Extension) {
+			t.Errorf("%s key stored at %s", kind, path)
+		}
+		key, err := Load(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key.Kind != kind {
+			t.Fatalf("loaded a %s key, want %s", key.Kind, kind)
+		}
+		switch kind {
+		case KindEd25519:
+			public, err := base64.StdEncoding.DecodeString(key.PublicKey())
+			if err != nil || !ed25519.PublicKey(public).Equal(key.Private.Public()) {
+				t.Errorf("public key %q doesn't match the private key", key.PublicKey())
+			}
+		case KindSymmetric:
+			if len(key.Secret) != SymmetricKeySize || key.PublicKey() != "" {
+				t.Errorf("symmetric key has %d bytes and public key %q", len(key.Secret), key.PublicKey())
+			}
+		}
+		if fp := key.Fingerprint(); !strings.HasPrefix(fp, "SHA256:") || len(fp) != len("SHA256:")+32 {
+			t.Errorf("fingerprint %q, want SHA256: and 32 hex digits", fp)
+		}
+
+		// The same name is never overwritten
+		if _, err := Generate(dir, "my-"+kind, kind); !errors.Is(err, ErrKeyExists) {
+			t.Errorf("generating %s again returned %v, want ErrKeyExists", kind, err)
+		}
+		if again, err := Load(path); err != nil || again.Fingerprint() != key.Fingerprint() {
+			t.Errorf("key changed after a refused overwrite: %v", err)
+		}
+	}
+}
+
+func TestGenerateRestrictsPermissions(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "keys")
+	path, err := Generate(dir, "secret", KindSymmetric)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("key file has mode %v, want 0600", perm)
+	}
+	info, err = os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		t.Errorf("key directory has mode %v, want no access for group or others", perm)
+	}
+}
+
+func TestGenerateRejectsBadInput(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"", ".", "..", "../escape", `a\b`} {
+		if _, err := Generate(dir, name, KindEd25519); err == nil {
+			t.Errorf("Generate accepted the name %q", name)
+		}
+	}
+	if _, err := Generate(dir, "rsa", "rsa"); err == nil {
+		t.Error("Generate accepted an unknown key type")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("rejected keys left %d files behind", len(entries))
+	}
+}
+
+func TestResolve(t *testing.T) {
+	dir := t.TempDir()
+	path, err := Generate(dir, "signing", KindEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, arg := range []string{"signing", "signing.key", path} {
+		if got := Resolve(dir, arg); got != path {
+			t.Errorf("Resolve(%q) = %s, want %s", arg, got, path)
+		}
+	}
+	if _, err := Load(Resolve(dir, "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("loading a missing key returned %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+// Package peer implements the peer-to-peer file sharing functionality.
+// It provides both client and server capabilities for sharing files between peers.
+package peer
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ParseCIDRs parses a list of CIDR blocks such as "10.0.0.0/8" for use in
+// ServerOptions. A bare IP address is treated as a block containing only that address.
+func ParseCIDRs(values []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(values))
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address or CIDR %q", v)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %v", v, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// allowed reports whether a client connecting from remoteAddr (host:port) may
+// download. Deny entries take precedence over Allow entries, and an empty allow
+// list allows every address that isn't denied. If either list is set, clients
+// whose address can't be parsed are rejected.
+func (o ServerOptions) allowed(remoteAddr string) bool {
+	if len(o.Allow) == 0 && len(o.Deny) == 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range o.Deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(o.Allow) == 0 {
+		return true
+	}
+	for _, n := range o.Allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := ParseCIDRs([]string{"10.0.0.0/8", "192.168.1.7", "fd00::/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.0/8", "192.168.1.7/32", "fd00::/8", "::1/128"}
+	for i, n := range nets {
+		if n.String() != want[i] {
+			t.Errorf("entry %d parsed as %s, want %s", i, n, want[i])
+		}
+	}
+
+	for _, bad := range []string{"10.0.0.0/33", "not-an-ip", "10.0.0"} {
+		if _, err := ParseCIDRs([]string{bad}); err == nil {
+			t.Errorf("ParseCIDRs accepted %q", bad)
+		}
+	}
+}
+
+func TestServerOptionsAllowed(t *testing.T) {
+	mustParse := func(values ...string) []*net.IPNet {
+		nets, err := ParseCIDRs(values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nets
+	}
+	lan := ServerOptions{Allow: mustParse("10.0.0.0/8"), Deny: mustParse("10.0.0.13")}
+
+	for _, tc := range []struct {
+		opts   ServerOptions
+		remote string
+		want   bool
+	}{
+		{ServerOptions{}, "203.0.113.5:4000", true},
+		{ServerOptions{}, "pipe", true},
+		{lan, "10.1.2.3:4000", true},
+		{lan, "10.0.0.13:4000", false}, // Deny wins over Allow
+		{lan, "203.0.113.5:4000", false},
+		{lan, "pipe", false},
+		{ServerOptions{Deny: mustParse("203.0.113.0/24")}, "203.0.113.5:4000", false},
+		{ServerOptions{Deny: mustParse("203.0.113.0/24")}, "[2001:db8::1]:4000", true},
+	} {
+		if got := tc.opts.allowed(tc.remote); got != tc.want {
+			t.Errorf("allow %v deny %v: allowed(%q) = %v, want %v", tc.opts.Allow, tc.opts.Deny, tc.remote, got, tc.want)
+		}
+	}
+}
+
+func TestServerRejectsDisallowedClients(t *testing.T) {
+	path, _, manifest := testManifest(t, testChunkSize)
+	loopback, err := ParseCIDRs([]string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	others, err := ParseCIDRs([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		opts ServerOptions
+		want bool
+	}{
+		{"default", ServerOptions{}, true},
+		{"allowed", ServerOptions{Allow: loopback}, true},
+		{"not allowed", ServerOptions{Allow: others}, false},
+		{"denied", ServerOptions{Allow: loopback, Deny: loopback}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			store := NewFileStore()
+			if err := store.Add(path, manifest); err != nil {
+				t.Fatal(err)
+			}
+			done := make(chan error, 1)
+			go func() { done <- ServeStore(ln, store, tc.opts) }()
+			defer func() {
+				ln.Close()
+				<-done
+				store.Close()
+			}()
+
+			peer := Peer{Address: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port}
+			_, err = DownloadChunks(context.Background(), TCPTransport{}, peer, manifest, []int{0})
+			if tc.want && err != nil {
+				t.Fatalf("allowed client failed: %v", err)
+			}
+			if !tc.want && (err == nil || errors.Is(err, ErrPeerUnreachable)) {
+				t.Fatalf("disallowed client got %v, want the connection closed before any chunk", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package peer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+// lineTransport wraps a Transport to count the message lines written to the
+// connections it dials.
+type lineTransport struct {
+	Transport
+	lines atomic.Int64
+}
+
+func (t *lineTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := t.Transport.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return lineConn{Conn: conn, lines: &t.lines}, nil
+}
+
+// lineConn is a connection dialed by lineTransport.
+type lineConn struct {
+	net.Conn
+	lines *atomic.Int64
+}
+
+func (c lineConn) Write(p []byte) (int, error) {
+	c.lines.Add(int64(bytes.Count(p, []byte("\n"))))
+	return c.Conn.Write(p)
+}
+
+func TestDownloadChunksBatched(t *testing.T) {
+	mem := NewMemoryTransport()
+	path, data, manifest := testManifest(t, 150*testChunkSize+123)
+	var served atomic.Int64
+	peer := serveFile(t, mem, 9000, path, manifest, ServerOptions{
+		OnChunkServed: func(string, int, int64) { served.Add(1) },
+	})
+	tr := &lineTransport{Transport: mem}
+
+	indices := make([]int, len(manifest.Chunks))
+	for i := range indices {
+		indices[i] = len(indices) - 1 - i
+	}
+	chunks, err := DownloadChunks(context.Background(), tr, peer, manifest, indices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range manifest.Chunks {
+		if !bytes.Equal(chunks[i], data[c.Offset:c.Offset+c.Size]) {
+			t.Fatalf("chunk %d doesn't match the file", i)
+		}
+	}
+	// The handshake, then batches of 64, 64 and 23 chunks
+	if lines := tr.lines.Load(); lines != 4 {
+		t.Fatalf("%d chunks requested with %d messages, want 4", len(indices), lines)
+	}
+	// The seeder counts a chunk once it is sent, which may be after it arrived
+	deadline := time.Now().Add(5 * time.Second)
+	for served.Load() < int64(len(indices)) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := served.Load(); n != int64(len(indices)) {
+		t.Fatalf("seeder served %d chunks, want %d", n, len(indices))
+	}
+}
+
+// singleSeeder serves data, described by manifest, to one connection on port
+// of tr like a seeder predating batches: it serves only the ChunkIndex of each
+// request. It returns the number of chunk requests it read.
+func singleSeeder(t *testing.T, tr Transport, port int, manifest *file.Manifest, data []byte) *atomic.Int64 {
+	t.Helper()
+	ln, err := tr.Listen(":" + strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var requests atomic.Int64
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		var hello HelloRequest
+		if err := readMessage(r, &hello); err != nil {
+			return
+		}
+		writeMessage(conn, HelloAck{Type: TypeHelloAck, FileHash: manifest.FileHash, ChunkSize: manifest.ChunkSize})
+		for {
+			var req ChunkRequest
+			if err := readMessage(r, &req); err != nil {
+				return
+			}
+			requests.Add(1)
+			chunk := manifest.Chunks[req.ChunkIndex]
+			writeMessage(conn, ChunkResponse{
+				FileHash:   manifest.FileHash,
+				ChunkSize:  manifest.ChunkSize,
+				ChunkIndex: req.ChunkIndex,
+				Hash:       chunk.Hash,
+				Size:       chunk.Size,
+			})
+			conn.Write(data[chunk.Offset : chunk.Offset+chunk.Size])
+		}
+	}()
+	return &requests
+}
+
+func TestDownloadChunksFromSeederWithoutBatches(t *testing.T) {
+	tr := NewMemoryTransport()
+	_, data, manifest := testManifest(t, 10*testChunkSize)
+	requests := singleSeeder(t, tr, 9000, manifest, data)
+
+	indices := []int{7, 2, 9, 0, 5, 1}
+	chunks, err := DownloadChunks(context.Background(), tr, Peer{Address: "localhost", Port: 9000}, manifest, indices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range indices {
+		c := manifest.Chunks[i]
+		if !bytes.Equal(chunks[i], data[c.Offset:c.Offset+c.Size]) {
+			t.Errorf("chunk %d doesn't match the file", i)
+		}
+	}
+	// The first batch only got its first chunk; the rest went one at a time
+	if n := requests.Load(); n != int64(len(indices)) {
+		t.Fatalf("seeder read %d requests, want one per chunk", n)
+	}
+}
+
+func TestBatchTooLarge(t *testing.T) {
+	tr := NewMemoryTransport()
+	path, data, manifest := testManifest(t, (MaxBatchChunks+1)*testChunkSize)
+	seeder := serveFile(t, tr, 9000, path, manifest, ServerOptions{})
+
+	// batch sends a batch of the first n chunks after a handshake, and
+	// returns the seeder's first response
+	batch := func(n int) (ChunkResponse, *bufio.Reader) {
+		t.Helper()
+		conn, err := tr.Dial(context.Background(), seeder.addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		indices := make([]int, n)
+		for i := range indices {
+			indices[i] = i
+		}
+		if err := writeMessages(conn, helloFor(manifest), chunkBatch(manifest, indices)); err != nil {
+			t.Fatal(err)
+		}
+		r := bufio.NewReader(conn)
+		batched, err := readHelloAckBatch(r, manifest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !batched {
+			t.Fatal("seeder didn't announce batch support")
+		}
+		var resp ChunkResponse
+		if err := readMessage(r, &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp, r
+	}
+
+	// The largest batch allowed is served in the order requested
+	resp, r := batch(MaxBatchChunks)
+	for i := 0; i < MaxBatchChunks; i++ {
+		if i > 0 {
+			resp = ChunkResponse{}
+			if err := readMessage(r, &resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if resp.Error != "" || resp.ChunkIndex != i {
+			t.Fatalf("response %d of the batch is %+v", i, resp)
+		}
+		if got, err := readChunkData(r, resp.Size); err != nil || !bytes.Equal(got, data[i*testChunkSize:(i+1)*testChunkSize]) {
+			t.Fatalf("chunk %d of the batch: %d bytes, %v", i, len(got), err)
+		}
+	}
+
+	// One more is refused and the connection closed
+	resp, r = batch(MaxBatchChunks + 1)
+	if resp.Code != codeBatchTooLarge || resp.Size != 0 {
+		t.Fatalf("oversized batch answered %+v", resp)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("connection still open after an oversized batch: %v", err)
+	}
+	// A single chunk goes as a plain request older seeders understand
+	if req := chunkBatch(manifest, []int{3}); req.ChunkIndex != 3 || req.ChunkIndices != nil {
+		t.Fatalf("request for one chunk is %+v", req)
+	}
+}
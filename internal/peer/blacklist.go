@@ -0,0 +1,63 @@
+// Package peer implements the peer-to-peer file sharing functionality.
+// It provides both client and server capabilities for sharing files between peers.
+package peer
+
+import "sync"
+
+// DefaultBlacklistThreshold is the number of chunks failing verification after
+// which a peer is blacklisted for the rest of a download.
+const DefaultBlacklistThreshold = 3
+
+// blacklist tracks peers that served corrupt chunks during a download.
+// It is safe for concurrent use by download workers.
+type blacklist struct {
+	threshold int // Verification failures before a peer is blacklisted
+
+	mu       sync.Mutex
+	failures map[Peer]int  // Verification failures per peer
+	banned   map[Peer]bool // Peers that are no longer selected
+}
+
+// newBlacklist creates a blacklist that bans peers after threshold failures.
+func newBlacklist(threshold int) *blacklist {
+	return &blacklist{
+		threshold: threshold,
+		failures:  make(map[Peer]int),
+		banned:    make(map[Peer]bool),
+	}
+}
+
+// recordFailure notes that p served a chunk that failed verification.
+// It reports whether this failure caused p to be blacklisted.
+func (b *blacklist) recordFailure(p Peer) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures[p]++
+	if !b.banned[p] && b.failures[p] >= b.threshold {
+		b.banned[p] = true
+		return true
+	}
+	return false
+}
+
+// ban blacklists p immediately, regardless of its failure count.
+func (b *blacklist) ban(p Peer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.banned[p] = true
+}
+
+// candidates returns the peers that are neither blacklisted nor in skip.
+func (b *blacklist) candidates(peers []Peer, skip map[Peer]bool) []Peer {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var out []Peer
+	for _, p := range peers {
+		if !b.banned[p] && !skip[p] {
+			out = append(out, p)
+		}
+	}
+	return out
+}
@@ -0,0 +1,99 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestBlacklistThreshold(t *testing.T) {
+	good, bad := Peer{Address: "a", Port: 1}, Peer{Address: "b", Port: 2}
+	peers := []Peer{bad, good}
+	b := newBlacklist(2)
+
+	if b.recordFailure(bad) {
+		t.Fatal("peer blacklisted after its first failure")
+	}
+	if got := b.candidates(peers, nil); len(got) != 2 {
+		t.Fatalf("candidates %v, want both peers below the threshold", got)
+	}
+	if !b.recordFailure(bad) {
+		t.Fatal("peer not blacklisted on reaching the threshold")
+	}
+	if b.recordFailure(bad) {
+		t.Fatal("recordFailure reported blacklisting an already blacklisted peer")
+	}
+	if got := b.candidates(peers, nil); len(got) != 1 || got[0] != good {
+		t.Fatalf("candidates %v, want only %v", got, good)
+	}
+	if got := b.candidates(peers, map[Peer]bool{good: true}); len(got) != 0 {
+		t.Fatalf("candidates %v, want none once the good peer is skipped", got)
+	}
+}
+
+func TestDownloadBlacklistsCorruptPeer(t *testing.T) {
+	mem := NewMemoryTransport()
+	path, data, manifest := testManifest(t, 8*testChunkSize)
+	bad := serveFile(t, mem, 9001, path, manifest, ServerOptions{})
+	good := serveFile(t, mem, 9002, path, manifest, ServerOptions{})
+
+	// The corrupt peer comes first, so FirstAvailable tries it for every
+	// chunk until it is blacklisted
+	badDials := &countingTransport{Transport: corruptTransport{mem}}
+	tr := portTransport{base: mem, byPort: map[int]Transport{bad.Port: badDials}}
+
+	const threshold = 2
+	logs := captureLogs(t, slog.LevelWarn)
+	var mu sync.Mutex
+	failures := make(map[Peer]int)
+	out := filepath.Join(t.TempDir(), "out.bin")
+	result, err := DownloadFile(context.Background(), manifest, []Peer{bad, good}, out, DownloadOptions{
+		Transport:          tr,
+		BlacklistThreshold: threshold,
+		OnChunkError: func(index int, from Peer, err error) {
+			if !errors.Is(err, ErrHashMismatch) {
+				t.Errorf("chunk %d from %v failed with %v, want ErrHashMismatch", index, from, err)
+			}
+			mu.Lock()
+			failures[from]++
+			mu.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutput(t, out); !bytes.Equal(got, data) {
+		t.Fatal("downloaded file doesn't match the original")
+	}
+
+	if dials, _ := badDials.stats(); dials != threshold {
+		t.Errorf("corrupt peer was asked for %d chunks, want %d before it was blacklisted", dials, threshold)
+	}
+	if failures[bad] != threshold || failures[good] != 0 {
+		t.Errorf("chunk failures %v, want %d from the corrupt peer only", failures, threshold)
+	}
+	if result.PeerChunks[good.addr()] != len(manifest.Chunks) || result.Retries != threshold {
+		t.Errorf("result %+v, want every chunk from %s after %d retries", result, good.addr(), threshold)
+	}
+	// Blacklisting is logged once, rather than printed to the embedding program's stdout
+	if records := logs.records(t); len(records) != 1 || records[0]["msg"] != "blacklisted peer" || records[0]["peer"] != bad.addr() {
+		t.Errorf("logged %v, want %s blacklisted once", records, bad.addr())
+	}
+}
+
+func TestBlacklistThresholdWithSkipChunkVerify(t *testing.T) {
+	_, _, manifest := testManifest(t, testChunkSize)
+	_, err := DownloadFile(context.Background(), manifest, []Peer{{Address: "localhost", Port: 9000}},
+		filepath.Join(t.TempDir(), "out.bin"), DownloadOptions{
+			Transport:          NewMemoryTransport(),
+			SkipChunkVerify:    true,
+			BlacklistThreshold: 1,
+		})
+	if err == nil {
+		t.Fatal("DownloadFile accepted BlacklistThreshold with SkipChunkVerify")
+	}
+}
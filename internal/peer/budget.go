@@ -0,0 +1,48 @@
+// Package peer implements the peer-to-peer file sharing functionality.
+// It provides both client and server capabilities for sharing files between peers.
+package peer
+
+import "context"
+
+// Budget bounds several downloads running at once together, as
+// DownloadOptions.Budget: the chunk requests in flight across all of them,
+// those to any single peer, so that a seeder serving several of the files
+// isn't asked for more at once than by one download, and optionally their
+// combined rate. It is safe for concurrent use.
+type Budget struct {
+	slots chan struct{} // Holds a token per chunk request in flight
+	peers *peerLimit
+	rate  *RateLimiter
+}
+
+// NewBudget creates a Budget allowing maxParallel chunk requests in flight in
+// total (at least 1), and perPeer to any single peer (0 for no limit beyond
+// maxParallel). rate, if not nil, caps the downloads' combined rate.
+func NewBudget(maxParallel, perPeer int, rate *RateLimiter) *Budget {
+	return &Budget{
+		slots: make(chan struct{}, max(maxParallel, 1)),
+		peers: newPeerLimit(perPeer),
+		rate:  rate,
+	}
+}
+
+// acquire waits for a free request slot, or returns ctx's error once ctx is
+// done. A nil Budget never waits.
+func (b *Budget) acquire(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	select {
+	case b.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees the slot taken by acquire.
+func (b *Budget) release() {
+	if b != nil {
+		<-b.slots
+	}
+}
@@ -0,0 +1,151 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+// busyTransport wraps a Transport to track how many chunk requests are in
+// flight at once, from dialing, which takes delay, until the connection is
+// closed.
+type busyTransport struct {
+	Transport
+	delay time.Duration
+
+	mu   sync.Mutex
+	busy int
+	peak int
+}
+
+func (t *busyTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	t.mu.Lock()
+	t.busy++
+	t.peak = max(t.peak, t.busy)
+	t.mu.Unlock()
+	time.Sleep(t.delay)
+	conn, err := t.Transport.Dial(ctx, addr)
+	if err != nil {
+		t.done()
+		return nil, err
+	}
+	return &busyConn{Conn: conn, t: t}, nil
+}
+
+// done ends a request counted by Dial.
+func (t *busyTransport) done() {
+	t.mu.Lock()
+	t.busy--
+	t.mu.Unlock()
+}
+
+// busyConn is a connection dialed by busyTransport.
+type busyConn struct {
+	net.Conn
+	t    *busyTransport
+	once sync.Once
+}
+
+func (c *busyConn) Close() error {
+	c.once.Do(c.t.done)
+	return c.Conn.Close()
+}
+
+func TestBudget(t *testing.T) {
+	mem := NewMemoryTransport()
+	store := NewFileStore()
+	defer store.Close()
+	type shared struct {
+		data     []byte
+		manifest *file.Manifest
+	}
+	var files []shared
+	for _, size := range []int{8 * testChunkSize, 6*testChunkSize + 11} {
+		path, data, manifest := testManifest(t, size)
+		if err := store.Add(path, manifest); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, shared{data, manifest})
+	}
+	seeder := serveStore(t, mem, 9000, store, ServerOptions{})
+
+	// download fetches every file at once with opts, and returns the most
+	// chunk requests that were in flight together
+	download := func(opts DownloadOptions) int {
+		t.Helper()
+		tr := &busyTransport{Transport: mem, delay: 10 * time.Millisecond}
+		opts.Transport = tr
+		opts.MaxParallel = 4
+		var wg sync.WaitGroup
+		errs := make([]error, len(files))
+		outputs := make([]string, len(files))
+		for i := range files {
+			outputs[i] = filepath.Join(t.TempDir(), "out.bin")
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, errs[i] = DownloadFile(context.Background(), files[i].manifest, []Peer{seeder}, outputs[i], opts)
+			}(i)
+		}
+		wg.Wait()
+		for i, f := range files {
+			if errs[i] != nil {
+				t.Fatal(errs[i])
+			}
+			if !bytes.Equal(readOutput(t, outputs[i]), f.data) {
+				t.Fatalf("download of file %d doesn't match", i)
+			}
+		}
+		return tr.peak
+	}
+
+	if peak := download(DownloadOptions{}); peak <= 2 {
+		t.Fatalf("downloads without a budget had at most %d requests in flight, want more than 2", peak)
+	}
+	if peak := download(DownloadOptions{Budget: NewBudget(2, 0, nil)}); peak > 2 {
+		t.Fatalf("downloads sharing a budget of 2 had %d requests in flight", peak)
+	}
+	// The per-peer limit holds across downloads, replacing PerPeerParallel
+	if peak := download(DownloadOptions{Budget: NewBudget(8, 1, nil), PerPeerParallel: 4}); peak > 1 {
+		t.Fatalf("downloads sharing a budget of 1 request per peer had %d in flight to their one peer", peak)
+	}
+}
+
+func TestBudgetAcquire(t *testing.T) {
+	var none *Budget
+	if err := none.acquire(context.Background()); err != nil {
+		t.Fatalf("nil budget: %v", err)
+	}
+	none.release()
+
+	b := NewBudget(0, 0, nil) // At least one slot
+	if err := b.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := b.acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("acquire of a full budget returned %v, want context.DeadlineExceeded", err)
+	}
+	b.release()
+	if err := b.acquire(context.Background()); err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	}
+
+	// The budget's rate limit applies unless the download has its own
+	rate, own := NewRateLimiter(1<<10), NewRateLimiter(2<<10)
+	withRate := NewBudget(1, 0, rate)
+	if opts := (DownloadOptions{Budget: withRate}).withDefaults(); opts.RateLimit != rate {
+		t.Fatal("download sharing a budget doesn't use its rate limit")
+	}
+	if opts := (DownloadOptions{Budget: withRate, RateLimit: own}).withDefaults(); opts.RateLimit != own {
+		t.Fatal("download's own rate limit replaced by its budget's")
+	}
+}
@@ -0,0 +1,55 @@
+// Package peer implements the peer-to-peer file sharing functionality.
+// It provides both client and server capabilities for sharing files between peers.
+package peer
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+// DirDataPath returns where the concatenated content of a directory download to
+// outputDir is assembled before it is extracted.
+func DirDataPath(outputDir string) string {
+	return outputDir + ".data"
+}
+
+// DownloadDir downloads the directory described by manifest to outputDir. The
+// concatenated content of its files is downloaded like a single file to
+// DirDataPath(outputDir), then split into the directory's files, with their
+// permissions and symlinks restored. Symlinks that would point outside outputDir
+// are refused before anything is extracted. Unless opts.Overwrite is set, a
+// download that would replace existing files in outputDir fails with
+// file.ErrFileExists before anything is downloaded.
+func DownloadDir(ctx context.Context, manifest *file.Manifest, peers []Peer, outputDir string, opts DownloadOptions) (*DownloadResult, error) {
+	if !manifest.IsDir() {
+		return nil, fmt.Errorf("manifest for %s does not describe a directory", manifest.FileName)
+	}
+	if !opts.Overwrite {
+		if err := file.CheckDirTarget(manifest, outputDir); err != nil {
+			return nil, err
+		}
+	}
+	dataPath := DirDataPath(outputDir)
+	result, err := DownloadFile(ctx, manifest, peers, dataPath, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := ExtractDownloadedDir(manifest, outputDir, opts.Overwrite); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ExtractDownloadedDir extracts the content downloaded to DirDataPath(outputDir)
+// into outputDir, and removes it once extraction succeeds. Existing files are
+// only replaced with overwrite.
+func ExtractDownloadedDir(manifest *file.Manifest, outputDir string, overwrite bool) error {
+	dataPath := DirDataPath(outputDir)
+	if err := file.ExtractDir(dataPath, manifest, outputDir, overwrite); err != nil {
+		return fmt.Errorf("failed to extract directory: %w", err)
+	}
+	return os.Remove(dataPath)
+}
@@ -0,0 +1,63 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+func TestDownloadDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "shared")
+	if err := os.MkdirAll(filepath.Join(dir, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	_, data := writeTestFile(t, "unused", 3*testChunkSize+10)
+	if err := os.WriteFile(filepath.Join(dir, "bin", "tool"), data, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("bin/tool", filepath.Join(dir, "tool")); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := file.CreateDirManifest(dir, testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := file.OpenDir(dir, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewFileStore()
+	if err := store.AddReader(src, src.Size(), manifest); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close(); src.Close() })
+	tr := NewMemoryTransport()
+	peer := serveStore(t, tr, 9000, store, ServerOptions{})
+
+	out := filepath.Join(t.TempDir(), "out")
+	if _, err := DownloadDir(context.Background(), manifest, []Peer{peer}, out, DownloadOptions{Transport: tr}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(out, "bin", "tool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("tool downloaded with mode %v, want 0755", info.Mode().Perm())
+	}
+	if got, err := os.ReadFile(filepath.Join(out, "tool")); err != nil || string(got) != string(data) {
+		t.Fatalf("reading through the downloaded symlink returned %d bytes, %v", len(got), err)
+	}
+	if _, err := os.Stat(DirDataPath(out)); !os.IsNotExist(err) {
+		t.Fatalf("assembled data left behind: %v", err)
+	}
+
+	// A second download into the same directory would replace its files
+	if _, err := DownloadDir(context.Background(), manifest, []Peer{peer}, out, DownloadOptions{Transport: tr}); !errors.Is(err, file.ErrFileExists) {
+		t.Fatalf("downloading over existing files returned %v, want ErrFileExists", err)
+	}
+}
@@ -3,12 +3,21 @@
 package peer
 
 import (
-	"encoding/json"
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"math/rand"
 	"net"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/timskillet/go-share/internal/file"
 )
@@ -16,87 +25,1038 @@ import (
 type Peer struct {
 	Address string `json:"address"`
 	Port    int    `json:"port"`
+
+	// URL, if set, makes the peer a web seed: a plain HTTP server holding the
+	// whole file, which is fetched in chunks with Range requests. Address and
+	// Port are unused. See WebSeed.
+	URL string `json:"url,omitempty"`
+}
+
+// addr returns the peer's host:port dial address, or the URL of a web seed.
+func (p Peer) addr() string {
+	if p.URL != "" {
+		return p.URL
+	}
+	return net.JoinHostPort(p.Address, strconv.Itoa(p.Port))
 }
 
 // DownloadChunk downloads a specific chunk from a peer
-func DownloadChunk(peer Peer, chunkIndex int) ([]byte, error) {
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", peer.Address, peer.Port))
+func DownloadChunk(ctx context.Context, t Transport, peer Peer, chunkIndex int) ([]byte, error) {
+	if peer.URL != "" {
+		return nil, fmt.Errorf("chunks can only be fetched from web seed %s with a manifest", peer.URL)
+	}
+	conn, err := t.Dial(ctx, peer.addr())
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to peer: %v", err)
+		return nil, fmt.Errorf("%w: %w", ErrPeerUnreachable, err)
 	}
 	defer conn.Close()
+	defer context.AfterFunc(ctx, func() { conn.Close() })()
 
 	// Send chunk request
-	request := struct {
-		ChunkIndex int `json:"chunkIndex"`
-	}{
-		ChunkIndex: chunkIndex,
-	}
-
-	if err := json.NewEncoder(conn).Encode(request); err != nil {
+	request := ChunkRequest{Type: TypeChunk, ChunkIndex: chunkIndex}
+	if err := writeMessage(conn, request); err != nil {
 		return nil, fmt.Errorf("failed to send chunk request: %v", err)
 	}
 
-	// Read chunk data
-	data, err := io.ReadAll(conn)
+	// Read chunk header and data. Without a manifest the header's Size is the
+	// only record of the chunk's length, which is shorter for the last chunk,
+	// so it is only checked against MaxChunkSize before the buffer is made.
+	r := bufio.NewReader(conn)
+	resp, err := readChunkHeader(r)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read chunk data: %v", err)
+		return nil, err
+	}
+	if resp.ChunkIndex != chunkIndex {
+		return nil, fmt.Errorf("peer %s answered with chunk %d, expected %d", peer.addr(), resp.ChunkIndex, chunkIndex)
+	}
+	if resp.Size > MaxChunkSize {
+		return nil, fmt.Errorf("peer %s announced a chunk of %d bytes, more than the %d allowed", peer.addr(), resp.Size, MaxChunkSize)
+	}
+	return readChunkData(r, resp.Size)
+}
+
+// PeerRefreshInterval is the least time between two calls to
+// DownloadOptions.RefreshPeers during a download.
+const PeerRefreshInterval = 5 * time.Second
+
+// DownloadOptions configures how DownloadFile transfers a file.
+// The zero value downloads every chunk sequentially from the first peer over TCP.
+type DownloadOptions struct {
+	Transport Transport    // Network used to reach peers (default: TCPTransport)
+	Selector  PeerSelector // Strategy for choosing the peer for each chunk (default: FirstAvailable)
+
+	// VerifyAfter re-reads the assembled file and checks every chunk hash and the
+	// whole-file hash before moving it to its final path. When a download
+	// writes every chunk in file order, as a sequential one does, the
+	// whole-file hash is computed as they are written instead, and the file is
+	// only re-read if it doesn't match.
+	VerifyAfter bool
+	// RepairOnFailure re-downloads any chunks that fail VerifyAfter from the same
+	// peers. Without it a failed verification leaves the .part file for inspection.
+	RepairOnFailure bool
+
+	// SkipChunkVerify skips hashing each chunk as it arrives, saving CPU on fast,
+	// trusted links. The assembled file is then always verified as if VerifyAfter
+	// were set, so corruption is still caught, but only once the whole file has been
+	// transferred. Peers serving corrupt chunks can't be detected while downloading,
+	// so blacklisting is disabled and BlacklistThreshold must not be set.
+	// Only use it when every peer is trusted.
+	SkipChunkVerify bool
+
+	// VerifyFunc, if set, is called with each chunk after the built-in hash
+	// check, for checks of its own, such as a signature on the chunk. A non-nil
+	// error rejects the chunk as if it were corrupt: it is requested from the
+	// next peer, and the peer that served it counts towards BlacklistThreshold.
+	// Chunks a resumed download keeps from its .part file are passed to it
+	// too, and fetched again if rejected. It is called from the download's
+	// workers, so it must be safe for concurrent use.
+	VerifyFunc func(chunk file.Chunk, data []byte) error
+
+	// Progress, if set, is called after each chunk is written with the number of
+	// bytes downloaded so far and the total file size. Calls are serialized and
+	// done is non-decreasing.
+	Progress func(done, total int64)
+
+	// BlacklistThreshold is the number of chunks failing verification after which a
+	// peer is never selected again for the rest of the download
+	// (default: DefaultBlacklistThreshold). Blacklisting is logged with slog
+	// at warning level.
+	BlacklistThreshold int
+
+	// MaxParallel is the number of chunks downloaded concurrently (default: 1).
+	// A value of 1 downloads chunks one at a time in manifest order.
+	// Seeders still apply their own limits, so raising it cannot exceed the
+	// bandwidth a seeder is willing to upload.
+	MaxParallel int
+
+	// Prefetch is the number of chunks fetched ahead when downloading
+	// sequentially (MaxParallel 1), so that the next chunks arrive while the
+	// current one is verified and written. Values below 2 disable read-ahead.
+	Prefetch int
+
+	// StartJitter, if positive, delays the first request by a random duration
+	// of up to StartJitter, so that many downloads started at the same moment
+	// don't all reach the seeders at once.
+	StartJitter time.Duration
+	// RandomOrder requests chunks in a random order instead of manifest order,
+	// so that simultaneous downloads spread over different chunks and peers from
+	// the start. It only applies when MaxParallel is greater than 1.
+	RandomOrder bool
+
+	// PerPeerParallel caps the chunk requests in flight to any single peer, so
+	// that a high MaxParallel spreads over peers instead of overloading one
+	// seeder. Workers wait for a slot when every usable peer is at its cap.
+	// Zero means no cap beyond MaxParallel.
+	PerPeerParallel int
+
+	// Overwrite lets DownloadDir replace existing files in the output
+	// directory. Without it, such a download fails before it starts.
+	Overwrite bool
+
+	// OnChunk, if set, is called after each chunk is written with its index,
+	// the peer it came from, and its size. OnChunkError, if set, is called when
+	// fetching a chunk from a peer fails, before the next peer is tried. Both
+	// are called from the download's workers, so they must be safe for
+	// concurrent use.
+	OnChunk      func(index int, from Peer, size int64)
+	OnChunkError func(index int, from Peer, err error)
+
+	// RefreshPeers, if set, is asked for the peers currently serving the file
+	// when every peer has failed to provide a chunk, e.g. because the peers of
+	// a long-paused download have gone away. The peer list is replaced with
+	// its answer, keeping web seeds, and the download carries on with the new
+	// peers. It is called at most once every PeerRefreshInterval.
+	RefreshPeers func(ctx context.Context) ([]Peer, error)
+
+	// UnavailableWait is how long to wait for chunks that no reachable peer
+	// has, e.g. while every seeder's copy is still growing, counted from the
+	// first chunk found missing. Meanwhile the peers, and those RefreshPeers
+	// finds, are asked again every PeerRefreshInterval. The rest of the file
+	// is downloaded either way, and chunks still missing at the end fail the
+	// download with an UnavailableError. Zero gives up on such chunks at once.
+	UnavailableWait time.Duration
+
+	// RateLimit, if set, caps how fast chunk data is read from peers and web
+	// seeds. One limiter is shared by every connection, so it bounds the
+	// download as a whole; share it between downloads to bound them together.
+	RateLimit *RateLimiter
+
+	// Budget, if set, is shared with other downloads running at once to bound
+	// them together: each chunk request waits for one of its slots, its
+	// per-peer limit replaces PerPeerParallel, and its rate limit, if any,
+	// applies unless RateLimit is set. MaxParallel still caps this download.
+	Budget *Budget
+
+	// ReorderBuffer caps the bytes of chunks DownloadTo holds in memory, or is
+	// fetching, ahead of the next chunk it writes (default:
+	// DefaultReorderBuffer). Other downloads write chunks where they belong
+	// as they arrive, and ignore it.
+	ReorderBuffer int64
+}
+
+// withDefaults returns a copy of the options with unset fields filled in.
+func (o DownloadOptions) withDefaults() DownloadOptions {
+	if o.Transport == nil {
+		o.Transport = TCPTransport{}
+	}
+	if o.RateLimit == nil && o.Budget != nil {
+		o.RateLimit = o.Budget.rate
+	}
+	if _, limited := o.Transport.(limitedTransport); o.RateLimit != nil && !limited {
+		o.Transport = limitedTransport{Transport: o.Transport, limiter: o.RateLimit}
+	}
+	if o.Selector == nil {
+		o.Selector = FirstAvailable{}
+	}
+	if o.MaxParallel < 1 {
+		o.MaxParallel = 1
+	}
+	if o.BlacklistThreshold < 1 {
+		o.BlacklistThreshold = DefaultBlacklistThreshold
+	}
+	return o
+}
+
+// DefaultMaxParallel returns a sensible download concurrency for the given
+// number of peers: two chunks in flight per peer, bounded to [1, 8].
+func DefaultMaxParallel(numPeers int) int {
+	n := 2 * numPeers
+	if n < 1 {
+		n = 1
+	}
+	if n > 8 {
+		n = 8
 	}
+	return n
+}
+
+// PartPath returns the path a download is written to before it is complete.
+func PartPath(outputPath string) string {
+	return outputPath + ".part"
+}
 
-	return data, nil
+// DownloadFile downloads a file from a set of peers using its manifest.
+// For each chunk it asks the configured PeerSelector which peer to use, requests
+// the chunk, and writes it at its offset in the output file. Up to
+// opts.MaxParallel chunks are downloaded at once.
+// Data is written to PartPath(outputPath), flushed to disk, and only renamed to
+// outputPath once the download (and verification, if enabled) succeeds, so a
+// file at outputPath is always complete; on failure the .part file is
+// left in place, and ResumeFile can continue from it. Write failures caused by a full disk wrap ErrDiskFull.
+// Empty files have no chunks, so they are created without contacting any peer.
+// If ctx is cancelled or times out, the download stops, the .part file is kept,
+// and ctx's error is returned. With opts.SkipChunkVerify, chunks are only checked
+// once the whole file has been downloaded. On success it returns a summary of
+// where the chunks came from and which requests failed.
+func DownloadFile(ctx context.Context, manifest *file.Manifest, peers []Peer, outputPath string, opts DownloadOptions) (*DownloadResult, error) {
+	if len(peers) == 0 && len(manifest.Chunks) > 0 {
+		return nil, ErrNoPeers
+	}
+	return downloadFile(ctx, manifest, peers, outputPath, opts, false, nil)
 }
 
-// DownloadFile downloads a file from a peer using its manifest.
-// It connects to the specified peer, requests each chunk, and assembles them into the output file.
-// The outputPath parameter specifies where the downloaded file should be saved.
-func DownloadFile(manifest *file.Manifest, peerAddress string, peerPort int, outputPath string) error {
+// prefillFunc fills in chunks that are already available locally by writing them
+// into out, and returns the indices of the chunks that still need downloading.
+type prefillFunc func(out *os.File) ([]int, error)
+
+// downloadFile implements DownloadFile. If prefill is non-nil it is called after
+// the .part file is prepared, and only the chunks it returns are downloaded.
+// With keepPart, an existing .part file is opened without discarding its content,
+// so that prefill can keep the chunks already in it; the chunks it keeps are
+// counted as reused in the result.
+func downloadFile(ctx context.Context, manifest *file.Manifest, peers []Peer, outputPath string, opts DownloadOptions, keepPart bool, prefill prefillFunc) (*DownloadResult, error) {
+	start := time.Now()
+	if opts.SkipChunkVerify && opts.BlacklistThreshold > 0 {
+		return nil, errors.New("BlacklistThreshold can't be used with SkipChunkVerify, which disables blacklisting")
+	}
+	// Without its hash key no chunk of a keyed manifest could be verified
+	if err := manifest.CheckHashKey(); err != nil {
+		return nil, err
+	}
+	opts = opts.withDefaults()
+
 	// Create output directory if it doesn't exist
 	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
-		return fmt.Errorf("failed to create output directory: %v", err)
+		return nil, fmt.Errorf("failed to create output directory: %v", err)
 	}
 
 	// Create output file
-	outFile, err := os.Create(outputPath)
+	partPath := PartPath(outputPath)
+	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if keepPart {
+		flags &^= os.O_TRUNC
+	}
+	outFile, err := os.OpenFile(partPath, flags, 0666)
 	if err != nil {
-		return fmt.Errorf("failed to create output file: %v", err)
+		return nil, fmt.Errorf("failed to create output file: %v", err)
 	}
 	defer outFile.Close()
 
-	// Download each chunk
-	for i, chunk := range manifest.Chunks {
-		// Connect to peer
-		conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", peerAddress, peerPort))
+	// Reserve the full file size up front so chunks can be written at their
+	// offsets and a full disk is detected before any data is transferred.
+	// A kept .part file is first cut to size in case it is too long.
+	if keepPart {
+		if err := outFile.Truncate(manifest.FileSize); err != nil {
+			return nil, fmt.Errorf("failed to resize output file: %w", classifyWriteError(err))
+		}
+	}
+	if err := file.Preallocate(outFile, manifest.FileSize); err != nil {
+		outFile.Close()
+		if !keepPart {
+			os.Remove(partPath)
+		}
+		return nil, fmt.Errorf("failed to preallocate output file: %w", classifyWriteError(err))
+	}
+
+	// Work out which chunks still have to be fetched
+	pending := make([]int, len(manifest.Chunks))
+	for i := range pending {
+		pending[i] = i
+	}
+	if prefill != nil {
+		if pending, err = prefill(outFile); err != nil {
+			return nil, err
+		}
+	}
+
+	// Hash a fresh download as it is written, to verify it without reading it
+	// again if the chunks arrive in order
+	sink := NewFileSink(outFile, manifest)
+	var streamed *hashingSink
+	if (opts.VerifyAfter || opts.SkipChunkVerify) && len(pending) == len(manifest.Chunks) {
+		streamed = &hashingSink{ChunkSink: sink, hasher: manifest.NewFileHasher()}
+		sink = streamed
+	}
+	result, err := fetchInto(ctx, manifest, peers, sink, pending, opts)
+	if err != nil {
+		return nil, err
+	}
+	result.Reused = len(manifest.Chunks) - len(pending)
+	// Flush the data to disk first, so that a crash after the rename can't leave
+	// a truncated file at outputPath
+	if err := sink.Finalize(); err != nil {
+		return nil, err
+	}
+	if err := outFile.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close output file: %v", err)
+	}
+
+	// Without per-chunk checks the final verification is the only one. A
+	// file hash that matched as the chunks were written in order covers every
+	// chunk, so the file needn't be read again.
+	if (opts.VerifyAfter || opts.SkipChunkVerify) && (streamed == nil || !streamed.verified()) {
+		if err := verifyDownload(ctx, manifest, partPath, peers, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := moveIntoPlace(partPath, outputPath); err != nil {
+		return nil, fmt.Errorf("failed to move download into place: %v", err)
+	}
+	result.Duration = time.Since(start)
+	return result, nil
+}
+
+// fetchInto downloads the pending chunks of manifest from peers into sink,
+// spreading simultaneous downloads over time and over the file as configured,
+// and returns what was downloaded from where.
+func fetchInto(ctx context.Context, manifest *file.Manifest, peers []Peer, sink ChunkSink, pending []int, opts DownloadOptions) (*DownloadResult, error) {
+	if len(pending) == 0 {
+		return newDownloadStats().snapshot(), nil
+	}
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("%w to download %d missing chunks from", ErrNoPeers, len(pending))
+	}
+
+	// Spread simultaneous downloads over time and over the file
+	if opts.RandomOrder && opts.MaxParallel > 1 {
+		rand.Shuffle(len(pending), func(i, j int) { pending[i], pending[j] = pending[j], pending[i] })
+	}
+	if err := startDelay(ctx, opts.StartJitter); err != nil {
+		return nil, err
+	}
+
+	d := newDownloader(manifest, peers, sink, opts)
+	if err := d.run(ctx, pending); err != nil {
+		return nil, err
+	}
+	return d.stats.snapshot(), nil
+}
+
+// moveIntoPlace atomically replaces outputPath with the complete file at
+// partPath, so that readers of outputPath never see a partial file. If the two
+// are on different filesystems, as when outputPath is a bind mount, partPath is
+// first copied to a temporary file next to outputPath, which is then renamed.
+func moveIntoPlace(partPath, outputPath string) error {
+	err := os.Rename(partPath, outputPath)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	src, err := os.Open(partPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(outputPath), "."+filepath.Base(outputPath)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return classifyWriteError(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return classifyWriteError(err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	// Keep the .part file's permissions rather than CreateTemp's 0600
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), outputPath); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Remove(partPath)
+}
+
+// startDelay waits for a random duration of up to max, or until ctx is done.
+func startDelay(ctx context.Context, max time.Duration) error {
+	if max <= 0 {
+		return nil
+	}
+	return sleepContext(ctx, time.Duration(rand.Int63n(int64(max)+1)))
+}
+
+// sleepContext waits for d, or returns ctx's error if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// verifyDownload checks the assembled file at partPath against the manifest.
+// If verification fails and opts.RepairOnFailure is set, the bad chunks are
+// re-downloaded and the file is checked again.
+func verifyDownload(ctx context.Context, manifest *file.Manifest, partPath string, peers []Peer, opts DownloadOptions) error {
+	report, err := file.VerifyFile(manifest, partPath)
+	if err != nil {
+		return fmt.Errorf("failed to verify download: %v", err)
+	}
+	if report.OK() {
+		return nil
+	}
+
+	if opts.RepairOnFailure {
+		if _, err := Repair(ctx, opts.Transport, manifest, partPath, peers); err != nil {
+			return fmt.Errorf("%w and repair failed: %w (partial file left at %s)", ErrVerificationFailed, err, partPath)
+		}
+		if report, err = file.VerifyFile(manifest, partPath); err != nil {
+			return fmt.Errorf("failed to verify repaired download: %v", err)
+		}
+		if report.OK() {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %d bad chunks, file hash match: %t (partial file left at %s)",
+		ErrVerificationFailed, len(report.BadChunks), report.FileHashOK, partPath)
+}
+
+// downloader holds the state shared by the workers of a single download.
+type downloader struct {
+	opts     DownloadOptions
+	manifest *file.Manifest
+	out      ChunkSink  // Destination of the downloaded chunks
+	bad      *blacklist // Peers that served corrupt chunks
+	limit    *peerLimit // Requests in flight per peer
+	stats    *downloadStats
+
+	progressMu sync.Mutex // Serializes progress callbacks
+	done       int64      // Bytes written so far
+
+	peersMu     sync.Mutex // Guards peers, which RefreshPeers may replace
+	peers       []Peer
+	refreshMu   sync.Mutex // Serializes calls to RefreshPeers
+	lastRefresh time.Time
+
+	missingMu sync.Mutex // Guards missing and waitUntil
+	missing   []int      // Chunks no peer had, see ErrChunkUnavailable
+	waitUntil time.Time  // End of opts.UnavailableWait, once a chunk was found missing
+
+	reorder *reorderBuffer // out, if chunks must be admitted before they are fetched
+}
+
+// newDownloader prepares a download of manifest into out.
+func newDownloader(manifest *file.Manifest, peers []Peer, out ChunkSink, opts DownloadOptions) *downloader {
+	// A streaming download bounds its memory by pausing fetches
+	reorder, _ := out.(*reorderBuffer)
+	// Downloads sharing a budget share its per-peer limit
+	limit := newPeerLimit(opts.PerPeerParallel)
+	if opts.Budget != nil {
+		limit = opts.Budget.peers
+	}
+	return &downloader{
+		opts:     opts,
+		manifest: manifest,
+		peers:    peers,
+		out:      out,
+		bad:      newBlacklist(opts.BlacklistThreshold),
+		limit:    limit,
+		stats:    newDownloadStats(),
+		reorder:  reorder,
+	}
+}
+
+// run downloads the pending chunks using a pool of opts.MaxParallel workers.
+// Chunks are handed out in the given order; the first error or the cancellation of
+// ctx stops the download. Chunks that aren't pending are counted as already done.
+func (d *downloader) run(ctx context.Context, pending []int) error {
+	d.done = d.manifest.FileSize
+	for _, i := range pending {
+		d.done -= d.manifest.Chunks[i].Size
+	}
+	if d.opts.MaxParallel == 1 && d.opts.Prefetch > 1 {
+		return d.runPrefetch(ctx, pending)
+	}
+
+	jobs := make(chan int)
+	stop := make(chan struct{})
+	var (
+		wg       sync.WaitGroup
+		stopOnce sync.Once
+		firstErr error
+	)
+
+	for w := 0; w < d.opts.MaxParallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if err := d.downloadChunk(ctx, i); err != nil && !d.recordMissing(i, err) {
+					stopOnce.Do(func() {
+						firstErr = err
+						close(stop)
+					})
+					return
+				}
+			}
+		}()
+	}
+
+	// Hand out chunks in order until done or a worker fails
+feed:
+	for _, i := range pending {
+		if d.reorder != nil && d.reorder.reserve(ctx, stop, i) != nil {
+			break feed
+		}
+		select {
+		case jobs <- i:
+		case <-stop:
+			break feed
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	// Report cancellation rather than the connection errors it caused
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	return d.missingErr()
+}
+
+// recordMissing notes chunk i as missing if err says no peer has it, so that
+// the download carries on with the other chunks, and reports whether it did.
+// A stream can't go on past a missing chunk, so it never does for DownloadTo.
+func (d *downloader) recordMissing(i int, err error) bool {
+	if !errors.Is(err, ErrChunkUnavailable) || d.reorder != nil {
+		return false
+	}
+	d.missingMu.Lock()
+	defer d.missingMu.Unlock()
+	d.missing = append(d.missing, i)
+	return true
+}
+
+// unavailableDeadline returns when to stop waiting for peers to have missing
+// chunks. The wait is shared by all of them, starting with the first chunk
+// found missing, so that many missing chunks don't multiply it.
+func (d *downloader) unavailableDeadline() time.Time {
+	d.missingMu.Lock()
+	defer d.missingMu.Unlock()
+	if d.waitUntil.IsZero() {
+		d.waitUntil = time.Now().Add(d.opts.UnavailableWait)
+	}
+	return d.waitUntil
+}
+
+// missingErr returns an UnavailableError listing the chunks no peer had, or
+// nil if there were none.
+func (d *downloader) missingErr() error {
+	d.missingMu.Lock()
+	defer d.missingMu.Unlock()
+	if len(d.missing) == 0 {
+		return nil
+	}
+	missing := slices.Clone(d.missing)
+	slices.Sort(missing)
+	return &UnavailableError{Chunks: missing}
+}
+
+// runPrefetch downloads the pending chunks sequentially, writing them in order,
+// while up to opts.Prefetch chunks are fetched and verified ahead of the one
+// being written. This keeps the link busy during verification and disk writes
+// even when downloading from a single peer.
+func (d *downloader) runPrefetch(ctx context.Context, pending []int) error {
+	type result struct {
+		data []byte
+		from Peer
+		err  error
+	}
+
+	fetchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Start fetches in order, never holding more than Prefetch chunks at once
+	results := make([]chan result, len(pending))
+	for k := range results {
+		results[k] = make(chan result, 1)
+	}
+	slots := make(chan struct{}, d.opts.Prefetch)
+	go func() {
+		for k, i := range pending {
+			select {
+			case slots <- struct{}{}:
+			case <-fetchCtx.Done():
+				return
+			}
+			if d.reorder != nil && d.reorder.reserve(fetchCtx, nil, i) != nil {
+				return
+			}
+			go func(k, i int) {
+				data, from, err := d.fetchVerified(fetchCtx, i)
+				results[k] <- result{data, from, err}
+			}(k, i)
+		}
+	}()
+
+	// Write chunks in order as their fetches complete
+	for k, i := range pending {
+		var r result
+		select {
+		case r = <-results[k]:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		<-slots
+		if r.err != nil {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if d.recordMissing(i, r.err) {
+				continue
+			}
+			return r.err
+		}
+		if err := d.writeChunk(i, r.data, r.from); err != nil {
+			return err
+		}
+	}
+	return d.missingErr()
+}
+
+// downloadChunk fetches, verifies, and writes the chunk at index i.
+func (d *downloader) downloadChunk(ctx context.Context, i int) error {
+	data, from, err := d.fetchVerified(ctx, i)
+	if err != nil {
+		return err
+	}
+	return d.writeChunk(i, data, from)
+}
+
+// fetchVerified fetches the chunk at index i and verifies it, returning the
+// peer that served it.
+// If a peer can't be reached or serves corrupt data, or data opts.VerifyFunc
+// rejects, the chunk is requested from the remaining peers in turn. Peers
+// that repeatedly serve corrupt data are blacklisted and skipped for all
+// later chunks. Peers at opts.PerPeerParallel requests are skipped until one
+// of their requests finishes. If every peer
+// that answered doesn't have the chunk, they are asked again until
+// opts.UnavailableWait has passed, and then the error wraps
+// ErrChunkUnavailable.
+func (d *downloader) fetchVerified(ctx context.Context, i int) ([]byte, Peer, error) {
+	chunk := d.manifest.Chunks[i]
+
+	tried := make(map[Peer]bool)
+	lastErr := &ChunkError{Index: i, Err: ErrNoPeers}
+	refreshed := false
+	answered, lacking := 0, 0 // Peers that answered, and those without the chunk
+	for {
+		candidates := d.bad.candidates(d.currentPeers(), tried)
+		if len(candidates) == 0 {
+			// Every known peer failed; the tracker may know others by now
+			if !refreshed && d.refreshPeers(ctx, tried) {
+				refreshed = true
+				continue
+			}
+			if lacking == 0 || lacking < answered {
+				return nil, Peer{}, lastErr
+			}
+
+			// No peer has the chunk yet; wait for one that does
+			waitUntil := d.unavailableDeadline()
+			if !time.Now().Before(waitUntil) {
+				return nil, Peer{}, &ChunkError{Index: i, Err: ErrChunkUnavailable}
+			}
+			if err := sleepContext(ctx, min(PeerRefreshInterval, time.Until(waitUntil))); err != nil {
+				return nil, Peer{}, err
+			}
+			d.refreshPeers(ctx, nil)
+			clear(tried)
+			answered, lacking = 0, 0
+			continue
+		}
+
+		if err := d.opts.Budget.acquire(ctx); err != nil {
+			return nil, Peer{}, err
+		}
+		peer, err := d.limit.acquire(ctx, candidates, d.opts.Selector, i)
+		if err != nil {
+			d.opts.Budget.release()
+			return nil, Peer{}, err
+		}
+		tried[peer] = true
+
+		data, err := fetchChunk(ctx, d.opts.Transport, peer, d.manifest, i)
+		d.limit.release(peer)
+		d.opts.Budget.release()
 		if err != nil {
-			return fmt.Errorf("failed to connect to peer: %v", err)
+			if ctx.Err() != nil {
+				return nil, Peer{}, ctx.Err()
+			}
+			lastErr = &ChunkError{Index: i, Peer: &peer, Err: err}
+			d.chunkFailed(i, peer, err)
+			if !errors.Is(err, ErrPeerUnreachable) {
+				answered++
+			}
+			if errors.Is(err, ErrInvalidChunkIndex) {
+				lacking++
+			}
+			// A peer serving a different file, refusing us the file, or whose
+			// copy is gone can't provide any chunk
+			if errors.Is(err, ErrPeerMismatch) || errors.Is(err, ErrAccessDenied) || errors.Is(err, ErrFileGone) {
+				d.bad.ban(peer)
+			}
+			continue
 		}
-		defer conn.Close()
 
-		// Send chunk request
-		req := struct {
-			ChunkIndex int `json:"chunkIndex"`
-		}{
-			ChunkIndex: i,
+		// Verify chunk hash, then any checks of the caller's
+		err = nil
+		if !d.opts.SkipChunkVerify && !d.manifest.VerifyChunk(chunk, data) {
+			err = ErrHashMismatch
+		} else if d.opts.VerifyFunc != nil {
+			if hookErr := d.opts.VerifyFunc(chunk, data); hookErr != nil {
+				err = fmt.Errorf("%w: %w", ErrChunkRejected, hookErr)
+			}
 		}
-		if err := json.NewEncoder(conn).Encode(req); err != nil {
-			return fmt.Errorf("failed to send chunk request: %v", err)
+		if err != nil {
+			answered++
+			lastErr = &ChunkError{Index: i, Peer: &peer, Err: err}
+			d.chunkFailed(i, peer, err)
+			if d.bad.recordFailure(peer) {
+				slog.Warn("blacklisted peer", "peer", peer.addr(), "corrupt chunks", d.opts.BlacklistThreshold)
+			}
+			continue
 		}
+		return data, peer, nil
+	}
+}
+
+// currentPeers returns the peers to download from.
+func (d *downloader) currentPeers() []Peer {
+	d.peersMu.Lock()
+	defer d.peersMu.Unlock()
+	return d.peers
+}
+
+// refreshPeers replaces the peer list with the answer of opts.RefreshPeers,
+// keeping web seeds, unless the list was refreshed less than
+// PeerRefreshInterval ago; workers that run out of peers meanwhile share that
+// result. It reports whether the list now has a usable peer not in tried.
+func (d *downloader) refreshPeers(ctx context.Context, tried map[Peer]bool) bool {
+	if d.opts.RefreshPeers == nil {
+		return false
+	}
+	d.refreshMu.Lock()
+	defer d.refreshMu.Unlock()
 
-		// Read chunk data
-		chunkData := make([]byte, chunk.Size)
-		if _, err := io.ReadFull(conn, chunkData); err != nil {
-			return fmt.Errorf("failed to read chunk data: %v", err)
+	if time.Since(d.lastRefresh) >= PeerRefreshInterval {
+		fresh, err := d.opts.RefreshPeers(ctx)
+		d.lastRefresh = time.Now()
+		if err == nil && len(fresh) > 0 {
+			for _, p := range d.currentPeers() {
+				if p.URL != "" && !slices.Contains(fresh, p) {
+					fresh = append(fresh, p)
+				}
+			}
+			d.peersMu.Lock()
+			d.peers = fresh
+			d.peersMu.Unlock()
 		}
+	}
+	return len(d.bad.candidates(d.currentPeers(), tried)) > 0
+}
 
-		// Verify chunk hash
-		if !file.VerifyChunk(chunk, chunkData) {
-			return fmt.Errorf("chunk hash verification failed")
+// chunkFailed records that fetching chunk i from peer failed, and notifies
+// opts.OnChunkError.
+func (d *downloader) chunkFailed(i int, peer Peer, err error) {
+	d.stats.requestFailed(peer)
+	if d.opts.OnChunkError != nil {
+		d.opts.OnChunkError(i, peer, err)
+	}
+}
+
+// writeChunk hands the data of chunk i, served by from, to the sink.
+func (d *downloader) writeChunk(i int, data []byte, from Peer) error {
+	if err := d.out.WriteChunkAt(i, data); err != nil {
+		return err
+	}
+
+	d.stats.chunkDone(from, d.manifest.Chunks[i].Size)
+	if d.opts.OnChunk != nil {
+		d.opts.OnChunk(i, from, d.manifest.Chunks[i].Size)
+	}
+	d.reportProgress(d.manifest.Chunks[i].Size)
+	return nil
+}
+
+// reportProgress records n more bytes as downloaded and notifies opts.Progress.
+func (d *downloader) reportProgress(n int64) {
+	d.progressMu.Lock()
+	defer d.progressMu.Unlock()
+
+	d.done += n
+	if d.opts.Progress != nil {
+		d.opts.Progress(d.done, d.manifest.FileSize)
+	}
+}
+
+// fetchChunk requests a single chunk of manifest's file over a fresh connection.
+// It rejects peers whose response shows they are serving a different file or
+// chunk layout, and checks that exactly the expected number of bytes arrived.
+// The connection is closed before returning, or as soon as ctx is done.
+func fetchChunk(ctx context.Context, t Transport, peer Peer, manifest *file.Manifest, chunkIndex int) ([]byte, error) {
+	if peer.URL != "" {
+		return fetchWebSeedChunk(ctx, peer, manifest, chunkIndex, rateLimiterOf(t))
+	}
+
+	// Connect to peer
+	conn, err := t.Dial(ctx, peer.addr())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrPeerUnreachable, err)
+	}
+	defer conn.Close()
+	defer context.AfterFunc(ctx, func() { conn.Close() })()
+
+	// Send the handshake and chunk request together, so the handshake costs no
+	// extra round trip
+	req := ChunkRequest{Type: TypeChunk, FileHash: manifest.FileHash, ChunkIndex: chunkIndex}
+	if err := writeMessages(conn, helloFor(manifest), req); err != nil {
+		return nil, fmt.Errorf("failed to send chunk request: %v", err)
+	}
+
+	// Make sure the peer serves the manifest's chunk layout
+	r := bufio.NewReader(conn)
+	if err := readHelloAck(r, manifest); err != nil {
+		return nil, err
+	}
+
+	// Read chunk header
+	resp, err := readChunkHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ChunkIndex != chunkIndex {
+		return nil, fmt.Errorf("peer %s answered with chunk %d, expected %d", peer.addr(), resp.ChunkIndex, chunkIndex)
+	}
+	if err := checkChunkResponse(peer, manifest, resp); err != nil {
+		return nil, err
+	}
+
+	// Read chunk data
+	return readChunkData(r, resp.Size)
+}
+
+// DownloadChunks requests several chunks of manifest's file from a peer over a
+// single connection. All requests are sent up front without waiting for responses,
+// and each response is matched to its request by the chunk index in its header.
+// Chunks are requested in batches of up to MaxBatchChunks, each in a single
+// message, from seeders that serve them, and one at a time from older ones.
+// Every chunk is checked against the manifest before it is accepted. It returns
+// the chunk data keyed by chunk index.
+func DownloadChunks(ctx context.Context, t Transport, peer Peer, manifest *file.Manifest, indices []int) (map[int][]byte, error) {
+	if peer.URL != "" {
+		return downloadWebSeedChunks(ctx, peer, manifest, indices, rateLimiterOf(t))
+	}
+	expected := make(map[int]bool, len(indices))
+	for _, i := range indices {
+		if i < 0 || i >= len(manifest.Chunks) {
+			return nil, fmt.Errorf("%w: %d", ErrInvalidChunkIndex, i)
 		}
+		expected[i] = true
+	}
+	if len(indices) == 0 {
+		return map[int][]byte{}, nil
+	}
+
+	conn, err := t.Dial(ctx, peer.addr())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrPeerUnreachable, err)
+	}
+	defer conn.Close()
+	defer context.AfterFunc(ctx, func() { conn.Close() })()
 
-		// Write chunk to output file
-		if _, err := outFile.Write(chunkData); err != nil {
-			return fmt.Errorf("failed to write chunk to file: %v", err)
+	// Pipeline every request. Writing happens concurrently with reading so that a
+	// seeder blocked on sending a response never stalls our requests. The first
+	// batch goes with the handshake, before it is known whether the seeder
+	// serves batches; one that doesn't only serves its first chunk, and the
+	// rest are requested one at a time.
+	writeErr := make(chan error, 1)
+	batched := make(chan bool, 1)
+	go func() {
+		first := indices[:min(len(indices), MaxBatchChunks)]
+		if err := writeMessages(conn, helloFor(manifest), chunkBatch(manifest, first)); err != nil {
+			writeErr <- fmt.Errorf("failed to send chunk request: %v", err)
+			return
 		}
+		batch, ok := <-batched
+		if !ok {
+			writeErr <- nil
+			return
+		}
+		rest := indices[len(first):]
+		if !batch {
+			rest = indices[1:]
+		}
+		for len(rest) > 0 {
+			n := 1
+			if batch {
+				n = min(len(rest), MaxBatchChunks)
+			}
+			if err := writeMessage(conn, chunkBatch(manifest, rest[:n])); err != nil {
+				writeErr <- fmt.Errorf("failed to send chunk request: %v", err)
+				return
+			}
+			rest = rest[n:]
+		}
+		writeErr <- nil
+	}()
+
+	// Make sure the peer serves the manifest's chunk layout
+	r := bufio.NewReader(conn)
+	batch, err := readHelloAckBatch(r, manifest)
+	if err != nil {
+		close(batched)
+		return nil, err
+	}
+	batched <- batch
+
+	// Read responses, matching each to an outstanding request
+	chunks := make(map[int][]byte, len(indices))
+	for len(expected) > 0 {
+		resp, err := readChunkHeader(r)
+		if err != nil {
+			return chunks, err
+		}
+		if !expected[resp.ChunkIndex] {
+			return chunks, fmt.Errorf("peer %s sent unrequested chunk %d", peer.addr(), resp.ChunkIndex)
+		}
+		if err := checkChunkResponse(peer, manifest, resp); err != nil {
+			return chunks, err
+		}
+
+		data, err := readChunkData(r, resp.Size)
+		if err != nil {
+			return chunks, err
+		}
+		if !manifest.VerifyChunk(manifest.Chunks[resp.ChunkIndex], data) {
+			return chunks, &ChunkError{Index: resp.ChunkIndex, Peer: &peer, Err: ErrHashMismatch}
+		}
+		chunks[resp.ChunkIndex] = data
+		delete(expected, resp.ChunkIndex)
 	}
 
+	if err := <-writeErr; err != nil {
+		return chunks, err
+	}
+	return chunks, nil
+}
+
+// chunkBatch returns the request for the chunks at indices of manifest's file,
+// as a batch if there are several.
+func chunkBatch(manifest *file.Manifest, indices []int) ChunkRequest {
+	req := ChunkRequest{Type: TypeChunk, FileHash: manifest.FileHash, ChunkIndex: indices[0]}
+	if len(indices) > 1 {
+		req.ChunkIndices = indices
+	}
+	return req
+}
+
+// helloFor returns the handshake announcing manifest's file and chunk layout,
+// with its access token for seeders of private files.
+func helloFor(manifest *file.Manifest) HelloRequest {
+	return HelloRequest{
+		Type:      TypeHello,
+		FileHash:  manifest.FileHash,
+		ChunkSize: manifest.ChunkSize,
+		Chunking:  manifest.Chunking,
+		Token:     manifest.AccessToken,
+	}
+}
+
+// checkChunkResponse makes sure a chunk response header matches manifest before
+// any chunk data is read: the peer must serve the same file with the same chunk
+// layout, and the chunk's hash and size must be those the manifest expects.
+func checkChunkResponse(peer Peer, manifest *file.Manifest, resp ChunkResponse) error {
+	if resp.FileHash != manifest.FileHash {
+		return fmt.Errorf("%w: %s has file hash %s, expected %s", ErrPeerMismatch, peer.addr(), resp.FileHash, manifest.FileHash)
+	}
+	if resp.ChunkSize != manifest.ChunkSize {
+		return fmt.Errorf("%w: %s uses chunk size %d, expected %d", ErrPeerMismatch, peer.addr(), resp.ChunkSize, manifest.ChunkSize)
+	}
+	if resp.ChunkIndex < 0 || resp.ChunkIndex >= len(manifest.Chunks) {
+		return fmt.Errorf("%w: peer %s sent chunk %d", ErrInvalidChunkIndex, peer.addr(), resp.ChunkIndex)
+	}
+
+	chunk := manifest.Chunks[resp.ChunkIndex]
+	if resp.Hash != chunk.Hash {
+		return &ChunkError{Index: resp.ChunkIndex, Peer: &peer, Err: ErrHashMismatch}
+	}
+	if resp.Size != chunk.Size {
+		return fmt.Errorf("peer sent %d bytes for chunk %d, expected %d", resp.Size, resp.ChunkIndex, chunk.Size)
+	}
 	return nil
 }
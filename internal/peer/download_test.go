@@ -0,0 +1,462 @@
+package peer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+func TestDownloadFilePreallocatesPart(t *testing.T) {
+	tr := NewMemoryTransport()
+	path, data, manifest := testManifest(t, 6*testChunkSize+99)
+	peer := serveFile(t, tr, 9000, path, manifest, ServerOptions{})
+
+	// Every chunk lands at its offset in a .part file that has the full size
+	// from the start, whatever order the chunks arrive in
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	var mu sync.Mutex
+	var sizes []int64
+	opts := DownloadOptions{
+		Transport:   tr,
+		MaxParallel: 4,
+		OnChunk: func(int, Peer, int64) {
+			info, err := os.Stat(PartPath(outputPath))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			sizes = append(sizes, info.Size())
+			mu.Unlock()
+		},
+	}
+	if _, err := DownloadFile(context.Background(), manifest, []Peer{peer}, outputPath, opts); err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range sizes {
+		if size != manifest.FileSize {
+			t.Fatalf(".part file had %d bytes during the download, want %d", size, manifest.FileSize)
+		}
+	}
+	if got := readOutput(t, outputPath); !bytes.Equal(got, data) {
+		t.Fatal("downloaded file doesn't match")
+	}
+	if _, err := os.Stat(PartPath(outputPath)); !os.IsNotExist(err) {
+		t.Fatalf(".part file left after the download: %v", err)
+	}
+}
+
+func TestDownloadFileAppearsOnlyWhenComplete(t *testing.T) {
+	tr := NewMemoryTransport()
+	path, data, manifest := testManifest(t, 5*testChunkSize+7)
+	peer := serveFile(t, tr, 9000, path, manifest, ServerOptions{})
+
+	// Progress runs after each chunk is written, including the last, so
+	// nothing may be at the final path yet
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	calls := 0
+	opts := DownloadOptions{
+		Transport:   tr,
+		VerifyAfter: true,
+		Progress: func(done, total int64) {
+			calls++
+			if _, err := os.Stat(outputPath); !os.IsNotExist(err) {
+				t.Errorf("output file exists with %d of %d bytes downloaded: %v", done, total, err)
+			}
+		},
+	}
+	if _, err := DownloadFile(context.Background(), manifest, []Peer{peer}, outputPath, opts); err != nil {
+		t.Fatal(err)
+	}
+	if calls != len(manifest.Chunks) {
+		t.Fatalf("Progress called %d times for %d chunks", calls, len(manifest.Chunks))
+	}
+	if got := readOutput(t, outputPath); !bytes.Equal(got, data) {
+		t.Fatal("downloaded file doesn't match")
+	}
+
+	// A download that fails leaves its .part file, and nothing at the final path
+	outputPath = filepath.Join(t.TempDir(), "failed.bin")
+	opts = DownloadOptions{Transport: corruptTransport{tr}}
+	if _, err := DownloadFile(context.Background(), manifest, []Peer{peer}, outputPath, opts); err == nil {
+		t.Fatal("download from a corrupt peer succeeded")
+	}
+	if _, err := os.Stat(outputPath); !os.IsNotExist(err) {
+		t.Fatalf("failed download left a file at the final path: %v", err)
+	}
+	if _, err := os.Stat(PartPath(outputPath)); err != nil {
+		t.Fatalf("failed download left no .part file: %v", err)
+	}
+}
+
+func TestMoveIntoPlaceAcrossFilesystems(t *testing.T) {
+	// /dev/shm is usually a tmpfs, apart from the test's temporary directory
+	shm, err := os.MkdirTemp("/dev/shm", "goshare-test")
+	if err != nil {
+		t.Skip("no /dev/shm:", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(shm) })
+	partPath := filepath.Join(shm, "out.bin.part")
+	if err := os.WriteFile(partPath, []byte("complete"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	if err := os.Link(partPath, outputPath); !errors.Is(err, syscall.EXDEV) {
+		t.Skipf("%s and %s are on the same filesystem: %v", shm, outputPath, err)
+	}
+
+	if err := moveIntoPlace(partPath, outputPath); err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutput(t, outputPath); string(got) != "complete" {
+		t.Fatalf("moved file holds %q", got)
+	}
+	info, err := os.Stat(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Fatalf("moved file has mode %v, want the .part file's 0640", info.Mode().Perm())
+	}
+	if _, err := os.Stat(partPath); !os.IsNotExist(err) {
+		t.Fatalf(".part file left after moving: %v", err)
+	}
+	entries, err := os.ReadDir(filepath.Dir(outputPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("output directory holds %d entries, want only the moved file", len(entries))
+	}
+}
+
+func TestDownloadFileMaxParallel(t *testing.T) {
+	mem := NewMemoryTransport()
+	path, data, manifest := testManifest(t, 12*testChunkSize)
+	peer := serveFile(t, mem, 9000, path, manifest, ServerOptions{})
+	// Slow responses make requests overlap
+	slow := delayTransport{Transport: mem, slow: map[string]time.Duration{"9000": 5 * time.Millisecond}}
+
+	for _, maxParallel := range []int{1, 3} {
+		tr := &countingTransport{Transport: slow}
+		outputPath := filepath.Join(t.TempDir(), "out.bin")
+		opts := DownloadOptions{Transport: tr, MaxParallel: maxParallel}
+		if _, err := DownloadFile(context.Background(), manifest, []Peer{peer}, outputPath, opts); err != nil {
+			t.Fatal(err)
+		}
+		if got := readOutput(t, outputPath); !bytes.Equal(got, data) {
+			t.Fatalf("MaxParallel %d: downloaded file doesn't match", maxParallel)
+		}
+		if _, peak := tr.stats(); peak != maxParallel {
+			t.Errorf("MaxParallel %d: %d requests were in flight at once", maxParallel, peak)
+		}
+	}
+}
+
+func TestDefaultMaxParallel(t *testing.T) {
+	for _, tc := range []struct{ peers, want int }{{0, 1}, {1, 2}, {3, 6}, {4, 8}, {50, 8}} {
+		if got := DefaultMaxParallel(tc.peers); got != tc.want {
+			t.Errorf("DefaultMaxParallel(%d) = %d, want %d", tc.peers, got, tc.want)
+		}
+	}
+}
+
+func TestDownloadFileRejectsMismatchedPeers(t *testing.T) {
+	tr := NewMemoryTransport()
+	path, data, manifest := testManifest(t, 4*testChunkSize)
+	// The same file chunked differently, and a different file
+	coarse, err := file.CreateManifest(path, 2*testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPath, _, other := testManifest(t, 4*testChunkSize+1)
+	wrongLayout := serveFile(t, tr, 9001, path, coarse, ServerOptions{})
+	wrongFile := serveFile(t, tr, 9002, otherPath, other, ServerOptions{})
+	good := serveFile(t, tr, 9003, path, manifest, ServerOptions{})
+
+	for _, bad := range []Peer{wrongLayout, wrongFile} {
+		_, err := DownloadFile(context.Background(), manifest, []Peer{bad}, filepath.Join(t.TempDir(), "out.bin"), DownloadOptions{Transport: tr})
+		if !errors.Is(err, ErrPeerMismatch) {
+			t.Fatalf("download from %v returned %v, want ErrPeerMismatch", bad, err)
+		}
+	}
+
+	// Mismatched peers are dropped in favour of one serving the manifest's file
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	result, err := DownloadFile(context.Background(), manifest, []Peer{wrongLayout, wrongFile, good}, outputPath, DownloadOptions{Transport: tr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutput(t, outputPath); !bytes.Equal(got, data) {
+		t.Fatal("downloaded file doesn't match")
+	}
+	if result.PeerChunks[good.addr()] != len(manifest.Chunks) {
+		t.Errorf("chunks by peer %v, want all from %s", result.PeerChunks, good.addr())
+	}
+}
+
+func TestCheckChunkResponse(t *testing.T) {
+	_, _, manifest := testManifest(t, 2*testChunkSize+10)
+	peer := Peer{Address: "localhost", Port: 9000}
+	good := ChunkResponse{
+		FileHash:   manifest.FileHash,
+		ChunkSize:  manifest.ChunkSize,
+		ChunkIndex: 2,
+		Hash:       manifest.Chunks[2].Hash,
+		Size:       manifest.Chunks[2].Size,
+	}
+	if err := checkChunkResponse(peer, manifest, good); err != nil {
+		t.Fatalf("matching response rejected: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		modify func(*ChunkResponse)
+		want   error
+	}{
+		{"file hash", func(r *ChunkResponse) { r.FileHash = "other" }, ErrPeerMismatch},
+		{"chunk size", func(r *ChunkResponse) { r.ChunkSize *= 2 }, ErrPeerMismatch},
+		{"index", func(r *ChunkResponse) { r.ChunkIndex = 3 }, ErrInvalidChunkIndex},
+		{"chunk hash", func(r *ChunkResponse) { r.Hash = manifest.Chunks[0].Hash }, ErrHashMismatch},
+		{"size", func(r *ChunkResponse) { r.Size = testChunkSize }, nil},
+	} {
+		resp := good
+		tc.modify(&resp)
+		err := checkChunkResponse(peer, manifest, resp)
+		if err == nil || (tc.want != nil && !errors.Is(err, tc.want)) {
+			t.Errorf("wrong %s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestDownloadEmptyFile(t *testing.T) {
+	path, _ := writeTestFile(t, "empty", 0)
+	manifest, err := file.CreateManifest(path, testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An empty file needs no peers at all
+	outputPath := filepath.Join(t.TempDir(), "empty")
+	if _, err := DownloadFile(context.Background(), manifest, nil, outputPath, DownloadOptions{VerifyAfter: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutput(t, outputPath); len(got) != 0 {
+		t.Fatalf("downloaded empty file has %d bytes", len(got))
+	}
+
+	// Seeding one works too, though there is no chunk to ask for
+	tr := NewMemoryTransport()
+	peer := serveFile(t, tr, 9000, path, manifest, ServerOptions{})
+	if _, err := Ping(context.Background(), tr, peer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DownloadChunk(context.Background(), tr, peer, 0); err == nil {
+		t.Fatal("seeder of an empty file served chunk 0")
+	}
+}
+
+// benchmarkDownload downloads a 16 MB file of 256 KB chunks from a seeder on
+// the in-memory transport b.N times with opts, reporting throughput. Each read
+// from the seeder takes at least latency, to mimic a network link.
+func benchmarkDownload(b *testing.B, opts DownloadOptions, latency time.Duration) {
+	path, data := writeTestFile(b, "shared.bin", 16<<20)
+	manifest, err := file.CreateManifest(path, 256<<10)
+	if err != nil {
+		b.Fatal(err)
+	}
+	mem := NewMemoryTransport()
+	peer := serveFile(b, mem, 9000, path, manifest, ServerOptions{})
+	opts.Transport = mem
+	if latency > 0 {
+		opts.Transport = delayTransport{Transport: mem, slow: map[string]time.Duration{"9000": latency}}
+	}
+	outputPath := filepath.Join(b.TempDir(), "out.bin")
+
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := DownloadFile(context.Background(), manifest, []Peer{peer}, outputPath, opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDownloadChunkVerification compares hashing every chunk as it
+// arrives with SkipChunkVerify, which only checks the whole file at the end.
+func BenchmarkDownloadChunkVerification(b *testing.B) {
+	b.Run("verify", func(b *testing.B) {
+		benchmarkDownload(b, DownloadOptions{}, 0)
+	})
+	b.Run("skip", func(b *testing.B) {
+		benchmarkDownload(b, DownloadOptions{SkipChunkVerify: true}, 0)
+	})
+}
+
+func TestDownloadFilePrefetch(t *testing.T) {
+	mem := NewMemoryTransport()
+	path, data, manifest := testManifest(t, 12*testChunkSize+5)
+	peer := serveFile(t, mem, 9000, path, manifest, ServerOptions{})
+
+	for _, depth := range []int{0, 1, 4} {
+		tr := &countingTransport{Transport: delayTransport{Transport: mem, slow: map[string]time.Duration{"9000": time.Millisecond}}}
+		outputPath := filepath.Join(t.TempDir(), "out.bin")
+		if _, err := DownloadFile(context.Background(), manifest, []Peer{peer}, outputPath, DownloadOptions{Transport: tr, Prefetch: depth}); err != nil {
+			t.Fatalf("prefetch %d: %v", depth, err)
+		}
+		if got := readOutput(t, outputPath); !bytes.Equal(got, data) {
+			t.Fatalf("prefetch %d: downloaded file doesn't match", depth)
+		}
+
+		// Read-ahead fetches several chunks at once, but never more than its depth
+		_, peak := tr.stats()
+		if want := max(depth, 1); peak > want || (depth > 1 && peak < 2) {
+			t.Errorf("prefetch %d: %d fetches in flight at once, want up to %d", depth, peak, want)
+		}
+	}
+}
+
+// BenchmarkDownloadPrefetch compares fetching one chunk at a time with reading
+// four chunks ahead, over a link where each read takes a millisecond.
+func BenchmarkDownloadPrefetch(b *testing.B) {
+	for _, depth := range []int{1, 4} {
+		b.Run(fmt.Sprintf("depth-%d", depth), func(b *testing.B) {
+			benchmarkDownload(b, DownloadOptions{Prefetch: depth}, time.Millisecond)
+		})
+	}
+}
+
+func TestDownloadRefreshesPeersWhenAllFail(t *testing.T) {
+	tr := NewMemoryTransport()
+	path, data, manifest := testManifest(t, 4*testChunkSize+3)
+	// The peers the download starts with have gone away; the tracker now
+	// knows another one
+	gone := []Peer{{Address: "localhost", Port: 9001}, {Address: "localhost", Port: 9002}}
+	fresh := serveFile(t, tr, 9003, path, manifest, ServerOptions{})
+
+	var mu sync.Mutex
+	refreshes := 0
+	opts := DownloadOptions{
+		Transport:   tr,
+		MaxParallel: 4,
+		RefreshPeers: func(ctx context.Context) ([]Peer, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			refreshes++
+			return []Peer{fresh}, nil
+		},
+	}
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	if _, err := DownloadFile(context.Background(), manifest, gone, outputPath, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutput(t, outputPath); !bytes.Equal(got, data) {
+		t.Fatal("download from refreshed peers doesn't match")
+	}
+	// Workers that run out of peers at once share one lookup
+	if refreshes != 1 {
+		t.Fatalf("peers were looked up %d times, want once", refreshes)
+	}
+
+	// Without a way to find new peers the download fails
+	opts.RefreshPeers = nil
+	if _, err := DownloadFile(context.Background(), manifest, gone, filepath.Join(t.TempDir(), "out.bin"), opts); err == nil {
+		t.Fatal("download from peers that are all gone succeeded")
+	}
+}
+
+func TestDownloadUnavailableChunks(t *testing.T) {
+	tr := NewMemoryTransport()
+	path, data, manifest := testManifest(t, 5*testChunkSize+3)
+	// The seeder's copy is still growing: it only serves the first 3 chunks
+	growing := *manifest
+	growing.Chunks = manifest.Chunks[:3]
+	partial := serveFile(t, tr, 9001, path, &growing, ServerOptions{})
+
+	// The chunks the seeder has are downloaded, and the others listed
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	_, err := DownloadFile(context.Background(), manifest, []Peer{partial}, outputPath, DownloadOptions{Transport: tr})
+	var unavailable *UnavailableError
+	if !errors.Is(err, ErrChunkUnavailable) || !errors.As(err, &unavailable) || !slices.Equal(unavailable.Chunks, []int{3, 4, 5}) {
+		t.Fatalf("download returned %v, want an UnavailableError for chunks 3 to 5", err)
+	}
+	part, err := os.ReadFile(PartPath(outputPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(part[:3*testChunkSize], data[:3*testChunkSize]) {
+		t.Fatal("chunks the seeder has weren't downloaded")
+	}
+
+	// Waiting for the chunks lets a seeder that has them turn up; another
+	// that can't be reached yet doesn't count as lacking them
+	later := Peer{Address: "localhost", Port: 9002}
+	failed := make(chan struct{})
+	var once sync.Once
+	opts := DownloadOptions{
+		Transport:       tr,
+		UnavailableWait: time.Second,
+		OnChunkError: func(i int, p Peer, err error) {
+			if errors.Is(err, ErrInvalidChunkIndex) {
+				once.Do(func() { close(failed) })
+			}
+		},
+	}
+	outputPath = filepath.Join(t.TempDir(), "out.bin")
+	done := make(chan error, 1)
+	go func() {
+		_, err := DownloadFile(context.Background(), manifest, []Peer{partial, later}, outputPath, opts)
+		done <- err
+	}()
+	<-failed
+	serveFile(t, tr, later.Port, path, manifest, ServerOptions{})
+	if err := <-done; err != nil {
+		t.Fatalf("download waiting for a seeder with every chunk: %v", err)
+	}
+	if got := readOutput(t, outputPath); !bytes.Equal(got, data) {
+		t.Fatal("download that waited for missing chunks doesn't match")
+	}
+}
+
+func TestDownloadChunkRejectsOversizedHeader(t *testing.T) {
+	tr := NewMemoryTransport()
+	ln, err := tr.Listen(":9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// The peer announces chunks far larger than any it could send
+	sizes := []int64{1 << 62, MaxChunkSize + 1}
+	go func() {
+		for _, size := range sizes {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			var req ChunkRequest
+			if err := readMessage(bufio.NewReader(conn), &req); err == nil {
+				writeMessage(conn, ChunkResponse{ChunkIndex: req.ChunkIndex, Size: size})
+			}
+			conn.Close()
+		}
+	}()
+
+	for _, size := range sizes {
+		_, err := DownloadChunk(context.Background(), tr, Peer{Address: "localhost", Port: 9000}, 0)
+		if err == nil || !strings.Contains(err.Error(), "more than the") {
+			t.Fatalf("chunk announced as %d bytes returned %v, want it refused", size, err)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+// Package peer implements the peer-to-peer file sharing functionality.
+// It provides both client and server capabilities for sharing files between peers.
+package peer
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+// Errors returned by the peer package. They are wrapped with additional context,
+// so callers should test for them with errors.Is.
+var (
+	// ErrPeerUnreachable means a connection to a peer could not be established.
+	ErrPeerUnreachable = errors.New("peer unreachable")
+
+	// ErrPeerMismatch means a peer is serving a different file or chunk layout
+	// than the manifest being downloaded.
+	ErrPeerMismatch = errors.New("peer serving different file")
+
+	// ErrHashMismatch means chunk data did not match the hash in the manifest.
+	ErrHashMismatch = file.ErrHashMismatch
+
+	// ErrChunkRejected means chunk data matched its hash but was rejected by
+	// DownloadOptions.VerifyFunc.
+	ErrChunkRejected = errors.New("chunk rejected by verification hook")
+
+	// ErrInvalidChunkIndex means a requested chunk index is outside the file.
+	ErrInvalidChunkIndex = errors.New("invalid chunk index")
+
+	// ErrNoPeers means there are no usable peers left to download from.
+	ErrNoPeers = errors.New("no peers available")
+
+	// ErrChunkUnavailable means no peer that could be reached has a chunk
+	// of the file, e.g. because every seeder's copy is still growing. The
+	// download fails with an UnavailableError listing the chunks.
+	ErrChunkUnavailable = errors.New("chunk not available from any peer")
+
+	// ErrVerificationFailed means the assembled download did not match its manifest.
+	ErrVerificationFailed = errors.New("download verification failed")
+
+	// ErrManifestNotServed means a peer doesn't answer manifest requests.
+	ErrManifestNotServed = errors.New("peer doesn't serve manifests")
+
+	// ErrAccessDenied means a peer requires an access token for a file and
+	// none, or the wrong one, was given.
+	ErrAccessDenied = errors.New("access denied")
+
+	// ErrFileGone means a seeder's copy of a file was deleted or truncated
+	// while it was being served, so it no longer serves the file.
+	ErrFileGone = errors.New("shared file is gone")
+
+	// ErrDiskFull is returned when a download cannot be written because the
+	// destination disk is out of space. The partial download is kept for resuming.
+	ErrDiskFull = errors.New("disk full")
+)
+
+// ChunkError records which chunk, and which peer if any, a download failure
+// relates to. Use errors.As to extract it and errors.Is to inspect its cause.
+type ChunkError struct {
+	Index int   // Index of the chunk in the manifest
+	Peer  *Peer // Peer the last attempt was made against, or nil
+	Err   error // Underlying cause
+}
+
+func (e *ChunkError) Error() string {
+	if e.Peer != nil {
+		return fmt.Sprintf("chunk %d from %s: %v", e.Index, e.Peer.addr(), e.Err)
+	}
+	return fmt.Sprintf("chunk %d: %v", e.Index, e.Err)
+}
+
+func (e *ChunkError) Unwrap() error {
+	return e.Err
+}
+
+// UnavailableError lists the chunks a download couldn't get because no peer
+// had them. The other chunks were downloaded, so resuming the download later
+// only fetches these. It wraps ErrChunkUnavailable.
+type UnavailableError struct {
+	Chunks []int // Indices of the missing chunks, in ascending order
+}
+
+// maxListedChunks is the most chunk indices an UnavailableError's message lists.
+const maxListedChunks = 20
+
+func (e *UnavailableError) Error() string {
+	listed := e.Chunks
+	if len(listed) > maxListedChunks {
+		listed = listed[:maxListedChunks]
+	}
+	s := make([]string, len(listed))
+	for i, index := range listed {
+		s[i] = strconv.Itoa(index)
+	}
+	more := ""
+	if len(e.Chunks) > len(listed) {
+		more = fmt.Sprintf(" and %d more", len(e.Chunks)-len(listed))
+	}
+	return fmt.Sprintf("%d chunks not available from any peer: %s%s", len(e.Chunks), strings.Join(s, ", "), more)
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return ErrChunkUnavailable
+}
+
+// Error codes sent in ChunkResponse.Code so that clients can map a seeder's
+// refusal back to the matching sentinel error.
+const (
+	codeInvalidChunkIndex = "invalid_chunk_index"
+	codeFileNotShared     = "file_not_shared"
+	codeLayoutMismatch    = "layout_mismatch"
+	codeManifestNotServed = "manifest_not_served"
+	codeAccessDenied      = "access_denied"
+	codeBatchTooLarge     = "batch_too_large"
+	codeFileGone          = "file_gone"
+)
+
+// errorForCode returns the sentinel error for a ChunkResponse code, or nil.
+func errorForCode(code string) error {
+	switch code {
+	case codeInvalidChunkIndex:
+		return ErrInvalidChunkIndex
+	case codeFileNotShared, codeLayoutMismatch:
+		// The seeder can't serve any chunk of the file as the client expects
+		return ErrPeerMismatch
+	case codeManifestNotServed:
+		return ErrManifestNotServed
+	case codeAccessDenied:
+		return ErrAccessDenied
+	case codeFileGone:
+		return ErrFileGone
+	default:
+		return nil
+	}
+}
+
+// classifyWriteError wraps err with ErrDiskFull when it was caused by the disk
+// running out of space, so callers can detect the condition with errors.Is.
+func classifyWriteError(err error) error {
+	if errors.Is(err, syscall.ENOSPC) {
+		return fmt.Errorf("%w: %v", ErrDiskFull, err)
+	}
+	return err
+}
@@ -0,0 +1,86 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestClassifyWriteError(t *testing.T) {
+	enospc := &fs.PathError{Op: "write", Path: "out.bin.part", Err: syscall.ENOSPC}
+	if err := classifyWriteError(enospc); !errors.Is(err, ErrDiskFull) {
+		t.Fatalf("classifyWriteError(ENOSPC) = %v, want ErrDiskFull", err)
+	}
+	other := &fs.PathError{Op: "write", Path: "out.bin.part", Err: syscall.EIO}
+	if err := classifyWriteError(other); errors.Is(err, ErrDiskFull) || err != other {
+		t.Fatalf("classifyWriteError(EIO) = %v, want it unchanged", err)
+	}
+}
+
+func TestDownloadToFullDisk(t *testing.T) {
+	// Writes to /dev/full fail with ENOSPC, as on a full disk
+	full, err := os.OpenFile("/dev/full", os.O_WRONLY, 0)
+	if err != nil {
+		t.Skip("no /dev/full:", err)
+	}
+	defer full.Close()
+
+	tr := NewMemoryTransport()
+	path, _, manifest := testManifest(t, 2*testChunkSize)
+	peer := serveFile(t, tr, 9000, path, manifest, ServerOptions{})
+	_, err = DownloadToSink(context.Background(), manifest, []Peer{peer}, NewFileSink(full, manifest), DownloadOptions{Transport: tr})
+	if !errors.Is(err, ErrDiskFull) {
+		t.Fatalf("download returned %v, want ErrDiskFull", err)
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	mem := NewMemoryTransport()
+	path, _, manifest := testManifest(t, 3*testChunkSize)
+	good := serveFile(t, mem, 9000, path, manifest, ServerOptions{})
+	corrupt := portTransport{base: mem, byPort: map[int]Transport{good.Port: corruptTransport{mem}}}
+	missing := Peer{Address: "localhost", Port: 9999}
+	ctx := context.Background()
+
+	if _, err := DownloadChunk(ctx, mem, missing, 0); !errors.Is(err, ErrPeerUnreachable) {
+		t.Errorf("DownloadChunk from a peer that isn't listening returned %v, want ErrPeerUnreachable", err)
+	}
+	if _, err := DownloadChunk(ctx, mem, good, len(manifest.Chunks)); !errors.Is(err, ErrInvalidChunkIndex) {
+		t.Errorf("DownloadChunk past the last chunk returned %v, want ErrInvalidChunkIndex", err)
+	}
+	if _, err := DownloadChunks(ctx, mem, good, manifest, []int{-1}); !errors.Is(err, ErrInvalidChunkIndex) {
+		t.Errorf("DownloadChunks of chunk -1 returned %v, want ErrInvalidChunkIndex", err)
+	}
+
+	_, err := DownloadChunks(ctx, corrupt, good, manifest, []int{1})
+	var chunkErr *ChunkError
+	if !errors.Is(err, ErrHashMismatch) || !errors.As(err, &chunkErr) || chunkErr.Index != 1 {
+		t.Errorf("DownloadChunks of a corrupt chunk returned %v, want a ChunkError for chunk 1 wrapping ErrHashMismatch", err)
+	}
+
+	// A download whose only peer is unreachable reports the peer and chunk
+	out := filepath.Join(t.TempDir(), "out.bin")
+	_, err = DownloadFile(ctx, manifest, []Peer{missing}, out, DownloadOptions{Transport: mem})
+	if !errors.Is(err, ErrPeerUnreachable) || !errors.As(err, &chunkErr) || chunkErr.Peer == nil || *chunkErr.Peer != missing {
+		t.Errorf("DownloadFile from an unreachable peer returned %v, want a ChunkError naming %v and wrapping ErrPeerUnreachable", err, missing)
+	}
+}
+
+func TestUnavailableError(t *testing.T) {
+	var chunks []int
+	for i := 0; i < maxListedChunks+5; i++ {
+		chunks = append(chunks, i)
+	}
+	var err error = &UnavailableError{Chunks: chunks}
+	if !errors.Is(err, ErrChunkUnavailable) {
+		t.Fatalf("UnavailableError doesn't wrap ErrChunkUnavailable")
+	}
+	if msg := err.Error(); !strings.HasSuffix(msg, "19 and 5 more") {
+		t.Fatalf("message %q doesn't list the first %d chunks and count the rest", msg, maxListedChunks)
+	}
+}
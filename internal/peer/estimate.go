@@ -0,0 +1,141 @@
+// Package peer implements the peer-to-peer file sharing functionality.
+// It provides both client and server capabilities for sharing files between peers.
+package peer
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+// DefaultEstimateSample is how many chunks MeasurePeers times from each peer
+// unless asked for a different number.
+const DefaultEstimateSample = 2
+
+// PeerSpeed is the result of timing a peer with MeasurePeers.
+type PeerSpeed struct {
+	Peer    Peer
+	RTT     time.Duration // Round-trip time of a ping
+	Bytes   int64         // Chunk data fetched and verified
+	Elapsed time.Duration // Time spent fetching it, including connection setup
+	Err     error         // Why the peer couldn't be timed, if it couldn't
+}
+
+// Throughput returns the rate at which the peer served chunks, in bytes per
+// second, or 0 if no chunk was fetched from it.
+func (s *PeerSpeed) Throughput() float64 {
+	if s.Err != nil || s.Bytes == 0 || s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) / s.Elapsed.Seconds()
+}
+
+// MeasurePeers pings each peer and times fetching a random sample of up to
+// sample chunks of manifest's file from it, one at a time as a download does,
+// so that each chunk's time includes connecting to the peer. Chunks are
+// checked against the manifest, and a peer serving a bad one gets an error
+// wrapping ErrHashMismatch rather than a speed. Every peer is timed
+// concurrently, so fast peers on a shared link may appear slower than they
+// are alone. Nothing is written to disk. The results are returned in the
+// order of peers.
+func MeasurePeers(ctx context.Context, t Transport, peers []Peer, manifest *file.Manifest, sample int) ([]*PeerSpeed, error) {
+	if err := manifest.CheckHashKey(); err != nil {
+		return nil, err
+	}
+	if sample <= 0 {
+		sample = DefaultEstimateSample
+	}
+
+	speeds := make([]*PeerSpeed, len(peers))
+	var wg sync.WaitGroup
+	for i, p := range peers {
+		wg.Add(1)
+		go func(i int, p Peer) {
+			defer wg.Done()
+			speeds[i] = measurePeer(ctx, t, p, manifest, sampleChunks(len(manifest.Chunks), sample))
+		}(i, p)
+	}
+	wg.Wait()
+	return speeds, nil
+}
+
+// measurePeer pings p and times fetching each chunk in indices from it.
+func measurePeer(ctx context.Context, t Transport, p Peer, manifest *file.Manifest, indices []int) *PeerSpeed {
+	speed := &PeerSpeed{Peer: p}
+	rtt, err := Ping(ctx, t, p)
+	if err != nil {
+		speed.Err = err
+		return speed
+	}
+	speed.RTT = rtt
+
+	for _, i := range indices {
+		start := time.Now()
+		data, err := fetchChunk(ctx, t, p, manifest, i)
+		if err == nil && !manifest.VerifyChunk(manifest.Chunks[i], data) {
+			err = ErrHashMismatch
+		}
+		if err != nil {
+			speed.Err = err
+			return speed
+		}
+		speed.Elapsed += time.Since(start)
+		speed.Bytes += int64(len(data))
+	}
+	return speed
+}
+
+// Estimate is the expected duration of a download, worked out by
+// EstimateDownload.
+type Estimate struct {
+	Duration time.Duration // Expected time to fetch every chunk
+	Rate     float64       // Expected combined rate, in bytes per second
+	Peers    int           // Peers the estimate counts on
+	Limited  bool          // Whether the rate is capped by the bandwidth limit
+}
+
+// ErrNoSpeeds is returned by EstimateDownload when none of the peers could be
+// timed.
+var ErrNoSpeeds = errors.New("no peer could be timed")
+
+// EstimateDownload estimates how long downloading size bytes takes from the
+// peers timed in speeds, with up to maxParallel chunks in flight. Each
+// request in flight is assumed to go to a different peer, the fastest first,
+// at the rate that peer was measured at, so the combined rate is that of the
+// fastest maxParallel peers, capped by bandwidth if it is positive. Extra
+// requests to the same peer aren't counted on to speed it up. The estimate
+// is only as good as the sample it is based on: peers that get busier, or a
+// download sharing the link with other traffic, take longer.
+func EstimateDownload(speeds []*PeerSpeed, size int64, maxParallel int, bandwidth int64) (*Estimate, error) {
+	var rates []float64
+	for _, s := range speeds {
+		if rate := s.Throughput(); rate > 0 {
+			rates = append(rates, rate)
+		}
+	}
+	if len(rates) == 0 {
+		return nil, ErrNoSpeeds
+	}
+	sort.Sort(sort.Reverse(sort.Float64Slice(rates)))
+	if maxParallel < 1 {
+		maxParallel = 1
+	}
+	if len(rates) > maxParallel {
+		rates = rates[:maxParallel]
+	}
+
+	estimate := &Estimate{Peers: len(rates)}
+	for _, rate := range rates {
+		estimate.Rate += rate
+	}
+	if bandwidth > 0 && estimate.Rate > float64(bandwidth) {
+		estimate.Rate = float64(bandwidth)
+		estimate.Limited = true
+	}
+	estimate.Duration = time.Duration(float64(size) / estimate.Rate * float64(time.Second))
+	return estimate, nil
+}
@@ -0,0 +1,111 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+// slowTransport is a Transport whose connections take delay to set up.
+type slowTransport struct {
+	Transport
+	delay time.Duration
+}
+
+func (t slowTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	time.Sleep(t.delay)
+	return t.Transport.Dial(ctx, addr)
+}
+
+func TestMeasurePeers(t *testing.T) {
+	mem := NewMemoryTransport()
+	path, _, manifest := testManifest(t, 6*testChunkSize)
+	fast := serveFile(t, mem, 9001, path, manifest, ServerOptions{})
+	slow := serveFile(t, mem, 9002, path, manifest, ServerOptions{})
+	lying := serveFile(t, mem, 9003, path, manifest, ServerOptions{})
+	gone := Peer{Address: "localhost", Port: 9004}
+	tr := portTransport{base: mem, byPort: map[int]Transport{
+		9002: slowTransport{mem, 50 * time.Millisecond},
+		9003: corruptTransport{mem},
+	}}
+
+	peers := []Peer{fast, slow, lying, gone}
+	speeds, err := MeasurePeers(context.Background(), tr, peers, manifest, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(speeds) != len(peers) {
+		t.Fatalf("got %d speeds for %d peers", len(speeds), len(peers))
+	}
+	for i, s := range speeds {
+		if s.Peer != peers[i] {
+			t.Fatalf("speed %d is for %v, want %v", i, s.Peer, peers[i])
+		}
+	}
+
+	for _, s := range speeds[:2] {
+		if s.Err != nil || s.Bytes != 2*testChunkSize || s.Elapsed <= 0 || s.RTT <= 0 {
+			t.Fatalf("peer %d timed as %+v, want 2 chunks with a ping", s.Peer.Port, s)
+		}
+	}
+	// Every chunk from the slow peer waits for its connection
+	if s := speeds[1]; s.Elapsed < 2*50*time.Millisecond || s.Throughput() >= speeds[0].Throughput() {
+		t.Fatalf("slow peer took %v at %.0f bytes/s, fast peer %.0f bytes/s", s.Elapsed, s.Throughput(), speeds[0].Throughput())
+	}
+	if s := speeds[2]; !errors.Is(s.Err, ErrHashMismatch) || s.Throughput() != 0 {
+		t.Fatalf("peer serving bad chunks timed as %+v, want ErrHashMismatch", s)
+	}
+	if s := speeds[3]; s.Err == nil || s.Throughput() != 0 {
+		t.Fatalf("unreachable peer timed as %+v", s)
+	}
+
+	estimate, err := EstimateDownload(speeds, manifest.FileSize, 4, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if estimate.Peers != 2 {
+		t.Fatalf("estimate counts on %d peers, want the 2 that were timed", estimate.Peers)
+	}
+}
+
+func TestEstimateDownload(t *testing.T) {
+	const mb = 1 << 20
+	speeds := []*PeerSpeed{
+		{Bytes: mb, Elapsed: time.Second},     // 1 MB/s
+		{Bytes: 4 * mb, Elapsed: time.Second}, // 4 MB/s
+		{Bytes: 2 * mb, Elapsed: time.Second}, // 2 MB/s
+		{Bytes: 8 * mb, Elapsed: time.Second, Err: errors.New("bad chunk")},
+		{}, // Never served a chunk
+	}
+	for _, tc := range []struct {
+		maxParallel int
+		bandwidth   int64
+		rate        float64
+		peers       int
+		limited     bool
+	}{
+		{1, 0, 4 * mb, 1, false},
+		{0, 0, 4 * mb, 1, false},
+		{2, 0, 6 * mb, 2, false}, // The fastest peers are counted on first
+		{10, 0, 7 * mb, 3, false},
+		{10, 5 * mb, 5 * mb, 3, true},
+		{10, 8 * mb, 7 * mb, 3, false},
+	} {
+		e, err := EstimateDownload(speeds, 70*mb, tc.maxParallel, tc.bandwidth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := time.Duration(70 * mb / tc.rate * float64(time.Second))
+		if math.Abs(e.Rate-tc.rate) > 1 || e.Peers != tc.peers || e.Limited != tc.limited || e.Duration != want {
+			t.Errorf("MaxParallel %d, bandwidth %d: estimate %+v, want %.0f bytes/s from %d peers (limited %v) taking %v",
+				tc.maxParallel, tc.bandwidth, e, tc.rate, tc.peers, tc.limited, want)
+		}
+	}
+
+	if _, err := EstimateDownload(speeds[3:], mb, 4, 0); !errors.Is(err, ErrNoSpeeds) {
+		t.Fatalf("estimate without a timed peer returned %v, want ErrNoSpeeds", err)
+	}
+}
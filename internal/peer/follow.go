@@ -0,0 +1,167 @@
+// Package peer implements the peer-to-peer file sharing functionality.
+// It provides both client and server capabilities for sharing files between peers.
+package peer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+// Refresh asks a peer which chunks it has of manifest's file, and returns
+// manifest extended with the chunks appended to the file since manifest was
+// made. If the peer has nothing new, manifest itself is returned. Only the
+// chunks that may have changed are asked for, so the request stays small
+// however large the file has become.
+func Refresh(ctx context.Context, t Transport, peer Peer, manifest *file.Manifest) (*file.Manifest, error) {
+	if peer.URL != "" {
+		return nil, fmt.Errorf("web seed %s can't report new chunks", peer.URL)
+	}
+	conn, err := t.Dial(ctx, peer.addr())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrPeerUnreachable, err)
+	}
+	defer conn.Close()
+	defer context.AfterFunc(ctx, func() { conn.Close() })()
+
+	// Ask for the chunks from the first unsealed one, a batch at a time
+	from := manifest.SealedChunks()
+	var chunks []file.Chunk
+	r := bufio.NewReader(conn)
+	for {
+		req := HaveRequest{Type: TypeHave, FileHash: manifest.FileHash, From: from + len(chunks), Token: manifest.AccessToken}
+		if err := writeMessage(conn, req); err != nil {
+			return nil, fmt.Errorf("failed to send have request: %v", err)
+		}
+		var ack HaveAck
+		if err := readMessage(r, &ack); err != nil {
+			return nil, fmt.Errorf("failed to read have reply: %v", err)
+		}
+		if ack.Type != TypeHaveAck {
+			return nil, fmt.Errorf("unexpected have reply type %q", ack.Type)
+		}
+		if ack.Error != "" {
+			if sentinel := errorForCode(ack.Code); sentinel != nil {
+				return nil, fmt.Errorf("%w: %s", sentinel, ack.Error)
+			}
+			return nil, fmt.Errorf("peer rejected have request: %s", ack.Error)
+		}
+		chunks = append(chunks, ack.Chunks...)
+		if len(ack.Chunks) == 0 || from+len(chunks) >= ack.Total {
+			break
+		}
+	}
+
+	// A peer that is behind has nothing new to offer
+	size := manifest.ChunkOffset(from)
+	for _, chunk := range chunks {
+		size += chunk.Size
+	}
+	if size <= manifest.FileSize {
+		return manifest, nil
+	}
+	grown, err := manifest.Extend(from, chunks)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s reported invalid chunks: %v", ErrPeerMismatch, peer.addr(), err)
+	}
+	return grown, nil
+}
+
+// Follow keeps a downloaded copy of a growing file up to date, like tail -f
+// over the network. outputPath must hold the content described by manifest, as
+// left by DownloadFile. Every interval the peers are asked in turn with Refresh
+// for chunks appended to the file, and new chunks are downloaded and written
+// to outputPath in place, so that readers see it grow. Web seeds can't report
+// new chunks, but are still used to fetch them. Peers that can't be reached are
+// asked again at the next interval. opts.Progress isn't called for appended
+// chunks; onGrow, if set, is called with the extended manifest after each
+// update instead. Follow runs until ctx is done and then returns ctx's error.
+func Follow(ctx context.Context, manifest *file.Manifest, peers []Peer, outputPath string, interval time.Duration, opts DownloadOptions, onGrow func(*file.Manifest)) error {
+	if err := manifest.CheckGrowable(); err != nil {
+		return err
+	}
+	if opts.SkipChunkVerify {
+		return errors.New("SkipChunkVerify can't be used when following a file, since appended chunks are only verified as they arrive")
+	}
+	opts = opts.withDefaults()
+	opts.Progress = nil
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		grown := refreshAny(ctx, opts.Transport, peers, manifest)
+		if grown == manifest {
+			continue
+		}
+		if err := appendChunks(ctx, manifest, grown, peers, outputPath, opts); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			// The last chunk may have grown again since it was listed
+			if errors.Is(err, ErrHashMismatch) {
+				continue
+			}
+			return err
+		}
+		manifest = grown
+		if onGrow != nil {
+			onGrow(manifest)
+		}
+	}
+}
+
+// refreshAny asks each peer in turn for new chunks of manifest's file and
+// returns the extended manifest from the first one that has any, or manifest
+// if none does.
+func refreshAny(ctx context.Context, t Transport, peers []Peer, manifest *file.Manifest) *file.Manifest {
+	for _, p := range peers {
+		if p.URL != "" {
+			continue
+		}
+		grown, err := Refresh(ctx, t, p, manifest)
+		if err == nil && grown != manifest {
+			return grown
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return manifest
+}
+
+// appendChunks downloads the chunks of grown that manifest doesn't have yet,
+// or only has in part, into the file at outputPath.
+func appendChunks(ctx context.Context, manifest, grown *file.Manifest, peers []Peer, outputPath string, opts DownloadOptions) error {
+	out, err := os.OpenFile(outputPath, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open followed file: %v", err)
+	}
+	defer out.Close()
+
+	var pending []int
+	for i := manifest.SealedChunks(); i < len(grown.Chunks); i++ {
+		pending = append(pending, i)
+	}
+	d := newDownloader(grown, peers, NewFileSink(out, grown), opts)
+	if err := d.run(ctx, pending); err != nil {
+		return err
+	}
+	if err := out.Truncate(grown.FileSize); err != nil {
+		return fmt.Errorf("failed to resize followed file: %w", classifyWriteError(err))
+	}
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("failed to flush followed file: %w", classifyWriteError(err))
+	}
+	return out.Close()
+}
@@ -0,0 +1,90 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+func TestFollowPicksUpAppendedChunks(t *testing.T) {
+	path, data, manifest := testManifest(t, 2*testChunkSize+100)
+	src, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	store := NewFileStore()
+	if err := store.AddReader(src, manifest.FileSize, manifest); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	tr := NewMemoryTransport()
+	peer := serveStore(t, tr, 9000, store, ServerOptions{})
+
+	outputPath := filepath.Join(t.TempDir(), "log.txt")
+	opts := DownloadOptions{Transport: tr}
+	if _, err := DownloadFile(context.Background(), manifest, []Peer{peer}, outputPath, opts); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing was appended yet, so the peer has nothing new
+	if same, err := Refresh(context.Background(), tr, peer, manifest); err != nil || same != manifest {
+		t.Fatalf("Refresh of an unchanged file returned a new manifest, %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	grew := make(chan *file.Manifest, 1)
+	followed := make(chan error, 1)
+	go func() {
+		followed <- Follow(ctx, manifest, []Peer{peer}, outputPath, 10*time.Millisecond, opts, func(m *file.Manifest) {
+			select {
+			case grew <- m:
+			default:
+			}
+		})
+	}()
+
+	// The seeder's file grows by a chunk and a half, completing its last chunk
+	appended := bytes.Repeat([]byte("new log line\n"), testChunkSize*3/2/13)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(appended); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	data = append(data, appended...)
+	grown, err := manifest.Grow(src, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Grow(src, grown.FileSize, grown); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-grew:
+		if m.FileSize != int64(len(data)) || len(m.Chunks) != len(grown.Chunks) {
+			t.Fatalf("follower grew to %d bytes in %d chunks, want %d in %d", m.FileSize, len(m.Chunks), len(data), len(grown.Chunks))
+		}
+	case err := <-followed:
+		t.Fatalf("Follow returned %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("follower didn't pick up the appended chunks")
+	}
+	if got := readOutput(t, outputPath); !bytes.Equal(got, data) {
+		t.Fatalf("followed file holds %d bytes, want the %d of the grown file", len(got), len(data))
+	}
+
+	cancel()
+	if err := <-followed; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Follow returned %v after cancel, want context.Canceled", err)
+	}
+}
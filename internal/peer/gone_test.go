@@ -0,0 +1,140 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// goneCall is a call of ServerOptions.OnFileGone.
+type goneCall struct {
+	fileHash string
+	err      error
+}
+
+// recordGone returns options calling OnFileGone into the returned channel.
+func recordGone() (ServerOptions, chan goneCall) {
+	calls := make(chan goneCall, 8)
+	return ServerOptions{OnFileGone: func(fileHash string, err error) { calls <- goneCall{fileHash, err} }}, calls
+}
+
+// nextGone waits for the next call of OnFileGone.
+func nextGone(t *testing.T, calls chan goneCall) goneCall {
+	t.Helper()
+	select {
+	case call := <-calls:
+		return call
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnFileGone wasn't called")
+		return goneCall{}
+	}
+}
+
+func TestServeTruncatedFile(t *testing.T) {
+	tr := NewMemoryTransport()
+	path, data, manifest := testManifest(t, 4*testChunkSize)
+	opts, calls := recordGone()
+	opts.ServeManifest = true
+	seeder := serveFile(t, tr, 9001, path, manifest, opts)
+	copyPath := filepath.Join(t.TempDir(), "copy.bin")
+	if err := os.WriteFile(copyPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	good := serveFile(t, tr, 9002, copyPath, manifest, ServerOptions{})
+
+	if resp, _ := requestChunk(t, tr, seeder, manifest, 3); resp.Error != "" {
+		t.Fatalf("intact file refused chunk 3: %s", resp.Error)
+	}
+
+	// A chunk cut short by truncation is refused rather than sent short
+	if err := os.Truncate(path, 2*testChunkSize+10); err != nil {
+		t.Fatal(err)
+	}
+	resp, _ := requestChunk(t, tr, seeder, manifest, 3)
+	if resp.Code != codeFileGone || resp.Size != 0 {
+		t.Fatalf("truncated chunk answered %+v", resp)
+	}
+	if call := nextGone(t, calls); call.fileHash != manifest.FileHash || !errors.Is(call.err, ErrFileGone) {
+		t.Fatalf("OnFileGone called with %s, %v", call.fileHash, call.err)
+	}
+
+	// From then on the file isn't served at all, even its intact chunks
+	if _, err := DownloadChunks(context.Background(), tr, seeder, manifest, []int{0}); !errors.Is(err, ErrFileGone) {
+		t.Fatalf("download of an intact chunk of a gone file returned %v, want ErrFileGone", err)
+	}
+	if _, err := FetchManifest(context.Background(), tr, seeder, manifest.FileHash, "", 0); !errors.Is(err, ErrFileGone) {
+		t.Fatalf("manifest fetch of a gone file returned %v, want ErrFileGone", err)
+	}
+
+	// Downloads move on to other peers
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	if _, err := DownloadFile(context.Background(), manifest, []Peer{seeder, good}, outputPath, DownloadOptions{Transport: tr}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutput(t, outputPath); !bytes.Equal(got, data) {
+		t.Fatal("download doesn't match the file")
+	}
+	select {
+	case call := <-calls:
+		t.Fatalf("OnFileGone called again with %v", call.err)
+	default:
+	}
+}
+
+func TestServeDeletedFileZeroCopy(t *testing.T) {
+	path, _, manifest := testManifest(t, 3*testChunkSize)
+	store := NewFileStore()
+	if err := store.Add(path, manifest); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	opts, calls := recordGone()
+	opts.ZeroCopy = true
+	seeder := serveTCP(t, store, opts)
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if resp, _ := requestChunk(t, TCPTransport{}, seeder, manifest, 0); resp.Code != codeFileGone {
+		t.Fatalf("chunk of a deleted file answered %+v", resp)
+	}
+	if call := nextGone(t, calls); !errors.Is(call.err, ErrFileGone) {
+		t.Fatalf("OnFileGone called with %v", call.err)
+	}
+}
+
+func TestWithdraw(t *testing.T) {
+	path, _, manifest := testManifest(t, 2*testChunkSize)
+	store := NewFileStore()
+	if err := store.Add(path, manifest); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if err := store.Withdraw(manifest.FileHash, errors.New("replaced")); err != nil {
+		t.Fatal(err)
+	}
+	shared, err := store.Get(manifest.FileHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The content is kept in the store but no longer read
+	if _, err := shared.ReadAt(make([]byte, 10), 0); !errors.Is(err, ErrFileGone) {
+		t.Fatalf("read of a withdrawn file returned %v, want ErrFileGone", err)
+	}
+	if err := shared.goneErr(); err == nil || !strings.Contains(err.Error(), "replaced") {
+		t.Fatalf("withdrawn file gone because of %v, want the reason given", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("withdrawing removed the file: %v", err)
+	}
+
+	if err := store.Withdraw("unknown", errors.New("replaced")); !errors.Is(err, ErrFileNotShared) {
+		t.Fatalf("withdrawing an unknown file returned %v, want ErrFileNotShared", err)
+	}
+}
@@ -0,0 +1,192 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+// testChunkSize keeps test files small while still splitting them into
+// several chunks.
+const testChunkSize = 4 << 10
+
+// writeTestFile writes size bytes of random data to a file named name in a
+// temporary directory, and returns its path and content.
+func writeTestFile(t testing.TB, name string, size int) (string, []byte) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+// testManifest writes a file of size random bytes, as writeTestFile does, and
+// creates its manifest with testChunkSize chunks.
+func testManifest(t testing.TB, size int) (string, []byte, *file.Manifest) {
+	t.Helper()
+	path, data := writeTestFile(t, "shared.bin", size)
+	manifest, err := file.CreateManifest(path, testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, data, manifest
+}
+
+// serveStore listens on port of tr and serves store until the test ends, and
+// returns the peer to download from.
+func serveStore(t testing.TB, tr Transport, port int, store *FileStore, opts ServerOptions) Peer {
+	t.Helper()
+	ln, err := tr.Listen(":" + strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- ServeStore(ln, store, opts) }()
+	t.Cleanup(func() {
+		ln.Close()
+		if err := <-done; !errors.Is(err, net.ErrClosed) {
+			t.Errorf("ServeStore returned %v", err)
+		}
+	})
+	return Peer{Address: "localhost", Port: port}
+}
+
+// serveFile serves the file at path, described by manifest, on port of tr
+// until the test ends, and returns the peer to download from.
+func serveFile(t testing.TB, tr Transport, port int, path string, manifest *file.Manifest, opts ServerOptions) Peer {
+	t.Helper()
+	store := NewFileStore()
+	if err := store.Add(path, manifest); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return serveStore(t, tr, port, store, opts)
+}
+
+// readOutput returns the content of a downloaded file, failing the test if
+// it can't be read.
+func readOutput(t testing.TB, path string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// countingTransport wraps a Transport to count the connections it dials and
+// track the most that were open at once.
+type countingTransport struct {
+	Transport
+
+	mu    sync.Mutex
+	open  int
+	peak  int
+	dials int
+}
+
+func (t *countingTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := t.Transport.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	t.open++
+	t.dials++
+	t.peak = max(t.peak, t.open)
+	t.mu.Unlock()
+	return &countedConn{Conn: conn, t: t}, nil
+}
+
+// stats returns the connections dialed and the most open at once.
+func (t *countingTransport) stats() (dials, peak int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.dials, t.peak
+}
+
+// countedConn is a connection dialed by countingTransport.
+type countedConn struct {
+	net.Conn
+	t    *countingTransport
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() {
+		c.t.mu.Lock()
+		c.t.open--
+		c.t.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// corruptTransport wraps a Transport so that the data of every chunk fetched
+// over it arrives with its first byte flipped, as if a seeder served a corrupt
+// copy. It relies on fetches reading a handshake answer and a chunk header, a
+// line each, before the chunk data.
+type corruptTransport struct {
+	Transport
+}
+
+func (t corruptTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := t.Transport.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &corruptConn{Conn: conn}, nil
+}
+
+// corruptConn flips the first byte after the second line it reads.
+type corruptConn struct {
+	net.Conn
+	lines int
+	done  bool
+}
+
+func (c *corruptConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	for i := 0; i < n && !c.done; i++ {
+		if c.lines == 2 {
+			p[i] ^= 0xff
+			c.done = true
+		} else if p[i] == '\n' {
+			c.lines++
+		}
+	}
+	return n, err
+}
+
+// portTransport dials each port through its own Transport, so that tests can
+// make some peers misbehave.
+type portTransport struct {
+	base   Transport
+	byPort map[int]Transport
+}
+
+func (t portTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(port)
+	if tr, ok := t.byPort[n]; ok {
+		return tr.Dial(ctx, addr)
+	}
+	return t.base.Dial(ctx, addr)
+}
+
+func (t portTransport) Listen(addr string) (net.Listener, error) {
+	return t.base.Listen(addr)
+}
@@ -0,0 +1,114 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+// rejectChunk returns a VerifyFunc rejecting the chunk at offset the first
+// times it is checked, and the number of times each chunk was checked.
+func rejectChunk(offset int64, times int) (func(file.Chunk, []byte) error, func(int64) int) {
+	var mu sync.Mutex
+	checked := make(map[int64]int)
+	verify := func(chunk file.Chunk, data []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		checked[chunk.Offset]++
+		if int64(len(data)) != chunk.Size {
+			return errors.New("wrong chunk size")
+		}
+		if chunk.Offset == offset && checked[chunk.Offset] <= times {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+	count := func(offset int64) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return checked[offset]
+	}
+	return verify, count
+}
+
+func TestVerifyFunc(t *testing.T) {
+	tr := NewMemoryTransport()
+	path, data, manifest := testManifest(t, 4*testChunkSize+70)
+	peers := []Peer{
+		serveFile(t, tr, 9001, path, manifest, ServerOptions{}),
+		serveFile(t, tr, 9002, path, manifest, ServerOptions{}),
+	}
+	offset := manifest.Chunks[2].Offset
+
+	// A chunk rejected once is fetched again from the other peer
+	verify, checked := rejectChunk(offset, 1)
+	var failed []error
+	var mu sync.Mutex
+	opts := DownloadOptions{Transport: tr, VerifyFunc: verify, OnChunkError: func(_ int, _ Peer, err error) {
+		mu.Lock()
+		failed = append(failed, err)
+		mu.Unlock()
+	}}
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	if _, err := DownloadFile(context.Background(), manifest, peers, outputPath, opts); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readOutput(t, outputPath), data) {
+		t.Fatal("download doesn't match the file")
+	}
+	if n := checked(offset); n != 2 {
+		t.Fatalf("rejected chunk checked %d times, want 2", n)
+	}
+	if n := checked(0); n != 1 {
+		t.Fatalf("accepted chunk checked %d times, want once", n)
+	}
+	if len(failed) != 1 || !errors.Is(failed[0], ErrChunkRejected) {
+		t.Fatalf("chunk errors %v, want one rejection", failed)
+	}
+
+	// A chunk every peer's copy of is rejected fails the download
+	verify, _ = rejectChunk(offset, len(peers)*10)
+	opts = DownloadOptions{Transport: tr, VerifyFunc: verify}
+	_, err := DownloadFile(context.Background(), manifest, peers, filepath.Join(t.TempDir(), "out.bin"), opts)
+	var chunkErr *ChunkError
+	if !errors.Is(err, ErrChunkRejected) || !errors.As(err, &chunkErr) || chunkErr.Index != 2 {
+		t.Fatalf("download with chunk 2 always rejected returned %v, want a ChunkError for chunk 2 wrapping ErrChunkRejected", err)
+	}
+	if !strings.Contains(err.Error(), "bad signature") {
+		t.Fatalf("download error %v doesn't give the hook's reason", err)
+	}
+}
+
+func TestVerifyFuncOnResume(t *testing.T) {
+	tr := NewMemoryTransport()
+	path, data, manifest := testManifest(t, 4*testChunkSize)
+	peer := serveFile(t, tr, 9000, path, manifest, ServerOptions{})
+
+	// The .part file holds the whole file, whose chunk 1 the hook rejects once
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	if err := os.WriteFile(PartPath(outputPath), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	offset := manifest.Chunks[1].Offset
+	verify, checked := rejectChunk(offset, 1)
+	result, err := ResumeFile(context.Background(), manifest, []Peer{peer}, outputPath, DownloadOptions{Transport: tr, VerifyFunc: verify})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Reused != len(manifest.Chunks)-1 {
+		t.Fatalf("resume kept %d chunks, want all but the rejected one", result.Reused)
+	}
+	if n := checked(offset); n != 2 {
+		t.Fatalf("rejected chunk checked %d times, want on resuming and once fetched", n)
+	}
+	if !bytes.Equal(readOutput(t, outputPath), data) {
+		t.Fatal("resumed download doesn't match the file")
+	}
+}
@@ -0,0 +1,89 @@
+package peer
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDownloadRandomOrder(t *testing.T) {
+	tr := NewMemoryTransport()
+	path, _, manifest := testManifest(t, 64*testChunkSize)
+	store := NewFileStore()
+	if err := store.Add(path, manifest); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	var mu sync.Mutex
+	var served []int
+	peer := serveStore(t, tr, 9000, store, ServerOptions{OnChunkServed: func(_ string, i int, _ int64) {
+		mu.Lock()
+		served = append(served, i)
+		mu.Unlock()
+	}})
+
+	// displacement downloads the file and returns the farthest any chunk was
+	// served from its place in manifest order
+	displacement := func(randomOrder bool) int {
+		t.Helper()
+		mu.Lock()
+		served = nil
+		mu.Unlock()
+		opts := DownloadOptions{Transport: tr, MaxParallel: 2, RandomOrder: randomOrder}
+		if _, err := DownloadFile(context.Background(), manifest, []Peer{peer}, filepath.Join(t.TempDir(), "out.bin"), opts); err != nil {
+			t.Fatal(err)
+		}
+		// The last chunk may be counted just after the download returns
+		deadline := time.Now().Add(time.Second)
+		for {
+			mu.Lock()
+			n := len(served)
+			mu.Unlock()
+			if n == len(manifest.Chunks) || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		worst := 0
+		for pos, i := range served {
+			worst = max(worst, pos-i, i-pos)
+		}
+		return worst
+	}
+
+	// Two workers take chunks in order, so each is served near its place
+	if d := displacement(false); d > 8 {
+		t.Fatalf("chunks served up to %d places out of order without RandomOrder", d)
+	}
+	if d := displacement(true); d <= 8 {
+		t.Fatalf("chunks served at most %d places out of order with RandomOrder, want a shuffled order", d)
+	}
+}
+
+func TestStartDelay(t *testing.T) {
+	start := time.Now()
+	if err := startDelay(context.Background(), 0); err != nil || time.Since(start) > 10*time.Millisecond {
+		t.Fatalf("startDelay without jitter returned %v after %v", err, time.Since(start))
+	}
+
+	const jitter = 30 * time.Millisecond
+	for i := 0; i < 5; i++ {
+		start = time.Now()
+		if err := startDelay(context.Background(), jitter); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed > jitter+50*time.Millisecond {
+			t.Fatalf("startDelay waited %v, want at most %v", elapsed, jitter)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := startDelay(ctx, time.Hour); err != context.Canceled {
+		t.Fatalf("startDelay with a canceled context returned %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+// Package peer implements the peer-to-peer file sharing functionality.
+// It provides both client and server capabilities for sharing files between peers.
+package peer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+// FetchManifest asks a peer for the manifest of the file with the given hash,
+// for downloaders who only know the hash. Seeders only answer if they serve
+// manifests (see ServerOptions.ServeManifest); otherwise the error wraps
+// ErrManifestNotServed. Manifests larger than maxSize bytes
+// (file.DefaultMaxManifestSize if maxSize isn't positive) are rejected with
+// file.ErrManifestTooLarge. Seeders of private files also require their
+// access token, and refuse with ErrAccessDenied without it; the manifest
+// returned doesn't carry the token. The manifest must describe the file with
+// the requested hash, but like one from a tracker it comes from an untrusted
+// source: its chunks are what the download verifies against, so only the
+// final check of the whole file against fileHash proves it genuine.
+func FetchManifest(ctx context.Context, t Transport, peer Peer, fileHash, token string, maxSize int64) (*file.Manifest, error) {
+	if peer.URL != "" {
+		return nil, fmt.Errorf("%w: web seed %s", ErrManifestNotServed, peer.URL)
+	}
+	if maxSize <= 0 {
+		maxSize = file.DefaultMaxManifestSize
+	}
+
+	conn, err := t.Dial(ctx, peer.addr())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrPeerUnreachable, err)
+	}
+	defer conn.Close()
+	defer context.AfterFunc(ctx, func() { conn.Close() })()
+
+	if err := writeMessage(conn, ManifestRequest{Type: TypeManifest, FileHash: fileHash, Token: token}); err != nil {
+		return nil, fmt.Errorf("failed to send manifest request: %v", err)
+	}
+
+	// Read the header, then the manifest that follows it
+	r := bufio.NewReader(conn)
+	var resp ManifestResponse
+	if err := readMessage(r, &resp); err != nil {
+		return nil, fmt.Errorf("failed to read manifest header: %v", err)
+	}
+	if resp.Type != TypeManifestData {
+		return nil, fmt.Errorf("unexpected response type %q", resp.Type)
+	}
+	if resp.Error != "" {
+		if sentinel := errorForCode(resp.Code); sentinel != nil {
+			return nil, fmt.Errorf("peer refused manifest: %w", sentinel)
+		}
+		return nil, fmt.Errorf("peer refused manifest: %s", resp.Error)
+	}
+	if resp.Size < 0 {
+		return nil, fmt.Errorf("invalid manifest size %d", resp.Size)
+	}
+	if resp.Size > maxSize {
+		return nil, fmt.Errorf("%w: %d bytes", file.ErrManifestTooLarge, resp.Size)
+	}
+	manifest, err := file.ReadManifest(io.LimitReader(r, resp.Size), maxSize)
+	if err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("truncated manifest from %s: %w", peer.addr(), err)
+		}
+		return nil, fmt.Errorf("invalid manifest from %s: %w", peer.addr(), err)
+	}
+	if manifest.FileHash != fileHash {
+		return nil, fmt.Errorf("%w: %s sent the manifest of %s, expected %s: %w", ErrPeerMismatch, peer.addr(), manifest.FileHash, fileHash, file.ErrManifestMismatch)
+	}
+	return manifest, nil
+}
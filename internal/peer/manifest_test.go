@@ -0,0 +1,75 @@
+package peer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+func TestFetchManifest(t *testing.T) {
+	tr := NewMemoryTransport()
+	path, _, manifest := testManifest(t, 5*testChunkSize+11)
+	serving := serveFile(t, tr, 9001, path, manifest, ServerOptions{ServeManifest: true})
+	private := serveFile(t, tr, 9002, path, manifest, ServerOptions{})
+	ctx := context.Background()
+
+	got, err := FetchManifest(ctx, tr, serving, manifest.FileHash, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.FileHash != manifest.FileHash || got.FileSize != manifest.FileSize || !slices.Equal(got.Chunks, manifest.Chunks) {
+		t.Fatalf("fetched manifest %+v doesn't match the shared one", got)
+	}
+
+	if _, err := FetchManifest(ctx, tr, private, manifest.FileHash, "", 0); !errors.Is(err, ErrManifestNotServed) {
+		t.Errorf("seeder not serving manifests returned %v, want ErrManifestNotServed", err)
+	}
+	if _, err := FetchManifest(ctx, tr, serving, "0123abcd", "", 0); !errors.Is(err, ErrPeerMismatch) {
+		t.Errorf("manifest of a file the seeder doesn't share returned %v, want ErrPeerMismatch", err)
+	}
+	if _, err := FetchManifest(ctx, tr, serving, manifest.FileHash, "", 64); !errors.Is(err, file.ErrManifestTooLarge) {
+		t.Errorf("manifest over the size limit returned %v, want ErrManifestTooLarge", err)
+	}
+	if _, err := FetchManifest(ctx, tr, Peer{URL: "http://example.com/file"}, manifest.FileHash, "", 0); !errors.Is(err, ErrManifestNotServed) {
+		t.Errorf("web seed returned %v, want ErrManifestNotServed", err)
+	}
+	if _, err := FetchManifest(ctx, tr, Peer{Address: "localhost", Port: 9003}, manifest.FileHash, "", 0); !errors.Is(err, ErrPeerUnreachable) {
+		t.Errorf("unreachable peer returned %v, want ErrPeerUnreachable", err)
+	}
+}
+
+func TestFetchManifestOfAnotherFile(t *testing.T) {
+	tr := NewMemoryTransport()
+	_, _, manifest := testManifest(t, 2*testChunkSize)
+	_, _, other := testManifest(t, 3*testChunkSize)
+
+	// A lying peer answers every request with the manifest of another file
+	ln, err := tr.Listen(":9001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var req ManifestRequest
+		if err := readMessage(bufio.NewReader(conn), &req); err != nil {
+			return
+		}
+		data, _ := file.EncodeManifest(other)
+		writeMessage(conn, ManifestResponse{Type: TypeManifestData, FileHash: req.FileHash, Size: int64(len(data))})
+		conn.Write(data)
+	}()
+
+	_, err = FetchManifest(context.Background(), tr, Peer{Address: "localhost", Port: 9001}, manifest.FileHash, "", 0)
+	if !errors.Is(err, ErrPeerMismatch) || !errors.Is(err, file.ErrManifestMismatch) {
+		t.Fatalf("manifest of another file returned %v, want ErrPeerMismatch", err)
+	}
+}
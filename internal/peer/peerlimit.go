@@ -0,0 +1,88 @@
+// Package peer implements the peer-to-peer file sharing functionality.
+// It provides both client and server capabilities for sharing files between peers.
+package peer
+
+import (
+	"context"
+	"sync"
+)
+
+// peerLimit caps the number of chunk requests in flight to each peer during a
+// download. It is safe for concurrent use by download workers.
+type peerLimit struct {
+	max int // Requests allowed in flight per peer; 0 means no limit
+
+	mu       sync.Mutex
+	inFlight map[Peer]int
+	released chan struct{} // Closed and replaced whenever a request finishes
+}
+
+// newPeerLimit creates a peerLimit allowing max requests in flight per peer.
+func newPeerLimit(max int) *peerLimit {
+	return &peerLimit{
+		max:      max,
+		inFlight: make(map[Peer]int),
+		released: make(chan struct{}),
+	}
+}
+
+// acquire chooses a peer among candidates with sel, skipping peers that are at
+// their limit, and reserves a request slot on it. If every candidate is busy it
+// waits for a slot to be released, or returns ctx's error once ctx is done.
+// candidates must not be empty.
+func (l *peerLimit) acquire(ctx context.Context, candidates []Peer, sel PeerSelector, chunkIndex int) (Peer, error) {
+	for {
+		// Choose among peers with a free slot; the selector runs unlocked since
+		// it may probe peers
+		l.mu.Lock()
+		free := l.free(candidates)
+		released := l.released
+		l.mu.Unlock()
+
+		if len(free) > 0 {
+			peer := sel.Select(free, chunkIndex)
+			l.mu.Lock()
+			if l.max <= 0 || l.inFlight[peer] < l.max {
+				l.inFlight[peer]++
+				l.mu.Unlock()
+				return peer, nil
+			}
+			l.mu.Unlock()
+			// Another worker took the last slot in the meantime; choose again
+			continue
+		}
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return Peer{}, ctx.Err()
+		}
+	}
+}
+
+// release frees the slot reserved on peer by acquire.
+func (l *peerLimit) release(peer Peer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inFlight[peer]--
+	if l.inFlight[peer] == 0 {
+		delete(l.inFlight, peer)
+	}
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+// free returns the candidates below their limit. l.mu must be held.
+func (l *peerLimit) free(candidates []Peer) []Peer {
+	if l.max <= 0 {
+		return candidates
+	}
+	var out []Peer
+	for _, p := range candidates {
+		if l.inFlight[p] < l.max {
+			out = append(out, p)
+		}
+	}
+	return out
+}
@@ -0,0 +1,87 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDownloadPerPeerParallel(t *testing.T) {
+	mem := NewMemoryTransport()
+	path, data, manifest := testManifest(t, 24*testChunkSize)
+
+	// Each peer is dialed through its own countingTransport, and serves slowly
+	// enough for requests to pile up
+	tr := portTransport{base: mem, byPort: make(map[int]Transport)}
+	counters := make(map[int]*countingTransport)
+	var peers []Peer
+	for _, port := range []int{9000, 9001} {
+		peers = append(peers, serveFile(t, mem, port, path, manifest, ServerOptions{}))
+		slow := delayTransport{Transport: mem, slow: map[string]time.Duration{
+			strconv.Itoa(port): time.Millisecond,
+		}}
+		counters[port] = &countingTransport{Transport: slow}
+		tr.byPort[port] = counters[port]
+	}
+
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	opts := DownloadOptions{Transport: tr, MaxParallel: 8, PerPeerParallel: 2}
+	if _, err := DownloadFile(context.Background(), manifest, peers, outputPath, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutput(t, outputPath); !bytes.Equal(got, data) {
+		t.Fatal("downloaded file doesn't match")
+	}
+	total := 0
+	for port, c := range counters {
+		dials, peak := c.stats()
+		if peak > 2 {
+			t.Errorf("peer on port %d had %d requests in flight, want at most 2", port, peak)
+		}
+		total += dials
+	}
+	if total != len(manifest.Chunks) {
+		t.Errorf("%d requests for %d chunks", total, len(manifest.Chunks))
+	}
+}
+
+func TestPeerLimitWaitsForSlot(t *testing.T) {
+	l := newPeerLimit(1)
+	peers := []Peer{{Address: "localhost", Port: 9000}}
+	ctx := context.Background()
+	first, err := l.acquire(ctx, peers, FirstAvailable{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The only peer is busy, so a second request waits until the first is
+	// released, or gives up with its context
+	timeout, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := l.acquire(timeout, peers, FirstAvailable{}, 1); err != context.DeadlineExceeded {
+		t.Fatalf("acquire on a busy peer returned %v, want context.DeadlineExceeded", err)
+	}
+
+	acquired := make(chan error, 1)
+	go func() {
+		_, err := l.acquire(ctx, peers, FirstAvailable{}, 1)
+		acquired <- err
+	}()
+	select {
+	case err := <-acquired:
+		t.Fatalf("acquire on a busy peer returned %v before a slot was released", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	l.release(first)
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("acquire still waiting after a slot was released")
+	}
+}
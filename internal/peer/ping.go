@@ -0,0 +1,40 @@
+// Package peer implements the peer-to-peer file sharing functionality.
+// It provides both client and server capabilities for sharing files between peers.
+package peer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"time"
+)
+
+// Ping measures the round-trip time to a peer by sending a PingRequest and
+// waiting for the PongResponse. Connection setup is not included in the result.
+// Web seeds are timed with an HTTP HEAD request instead, including connection setup.
+func Ping(ctx context.Context, t Transport, peer Peer) (time.Duration, error) {
+	if peer.URL != "" {
+		return pingWebSeed(ctx, peer)
+	}
+	conn, err := t.Dial(ctx, peer.addr())
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrPeerUnreachable, err)
+	}
+	defer conn.Close()
+	defer context.AfterFunc(ctx, func() { conn.Close() })()
+
+	start := time.Now()
+	if err := writeMessage(conn, PingRequest{Type: TypePing}); err != nil {
+		return 0, fmt.Errorf("failed to send ping: %v", err)
+	}
+
+	var resp PongResponse
+	if err := readMessage(bufio.NewReader(conn), &resp); err != nil {
+		return 0, fmt.Errorf("failed to read pong: %v", err)
+	}
+	if resp.Type != TypePong {
+		return 0, fmt.Errorf("unexpected response type %q", resp.Type)
+	}
+
+	return time.Since(start), nil
+}
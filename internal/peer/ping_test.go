@@ -0,0 +1,57 @@
+package peer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPing(t *testing.T) {
+	mem := NewMemoryTransport()
+	path, _, manifest := testManifest(t, testChunkSize)
+	peer := serveFile(t, mem, 9000, path, manifest, ServerOptions{})
+
+	// The round trip includes the time the seeder takes to answer
+	const delay = 20 * time.Millisecond
+	tr := delayTransport{Transport: mem, slow: map[string]time.Duration{"9000": delay}}
+	rtt, err := Ping(context.Background(), tr, peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt < delay {
+		t.Fatalf("Ping measured %v, want at least %v", rtt, delay)
+	}
+
+	if _, err := Ping(context.Background(), mem, Peer{Address: "localhost", Port: 9999}); !errors.Is(err, ErrPeerUnreachable) {
+		t.Fatalf("Ping of a missing peer returned %v, want ErrPeerUnreachable", err)
+	}
+}
+
+func TestPingThenChunkOnOneConnection(t *testing.T) {
+	tr := NewMemoryTransport()
+	path, _, manifest := testManifest(t, 2*testChunkSize)
+	peer := serveFile(t, tr, 9000, path, manifest, ServerOptions{})
+
+	conn, err := tr.Dial(context.Background(), peer.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go writeMessages(conn, PingRequest{Type: TypePing}, ChunkRequest{Type: TypeChunk, ChunkIndex: 1})
+
+	// Pings are answered in order with other requests on the connection
+	r := bufio.NewReader(conn)
+	var pong PongResponse
+	if err := readMessage(r, &pong); err != nil || pong.Type != TypePong {
+		t.Fatalf("read %+v, %v; want a pong", pong, err)
+	}
+	resp, err := readChunkHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ChunkIndex != 1 || resp.Size != manifest.Chunks[1].Size {
+		t.Fatalf("chunk header %+v doesn't describe chunk 1", resp)
+	}
+}
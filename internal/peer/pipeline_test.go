@@ -0,0 +1,105 @@
+package peer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+// reverseSeeder serves data, described by manifest, to one connection on port
+// of tr. It answers the first batch of chunk requests in reverse order, after
+// sending the chunks in extra, whether requested or not.
+func reverseSeeder(t *testing.T, tr Transport, port int, manifest *file.Manifest, data []byte, extra ...int) {
+	t.Helper()
+	ln, err := tr.Listen(":" + strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		var hello HelloRequest
+		if err := readMessage(r, &hello); err != nil {
+			return
+		}
+		writeMessage(conn, HelloAck{Type: TypeHelloAck, FileHash: manifest.FileHash, ChunkSize: manifest.ChunkSize, Batch: true})
+		var req ChunkRequest
+		if err := readMessage(r, &req); err != nil {
+			return
+		}
+		indices := slices.Clone(req.indices())
+		slices.Reverse(indices)
+		for _, i := range append(extra, indices...) {
+			chunk := manifest.Chunks[i]
+			writeMessage(conn, ChunkResponse{
+				FileHash:   manifest.FileHash,
+				ChunkSize:  manifest.ChunkSize,
+				ChunkIndex: i,
+				Hash:       chunk.Hash,
+				Size:       chunk.Size,
+			})
+			conn.Write(data[chunk.Offset : chunk.Offset+chunk.Size])
+		}
+	}()
+}
+
+func TestDownloadChunksPipelined(t *testing.T) {
+	mem := NewMemoryTransport()
+	path, data, manifest := testManifest(t, 5*testChunkSize+100)
+	peer := serveFile(t, mem, 9000, path, manifest, ServerOptions{})
+	tr := &countingTransport{Transport: mem}
+
+	indices := []int{4, 0, 5, 2}
+	chunks, err := DownloadChunks(context.Background(), tr, peer, manifest, indices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != len(indices) {
+		t.Fatalf("got %d chunks, want %d", len(chunks), len(indices))
+	}
+	for _, i := range indices {
+		c := manifest.Chunks[i]
+		if !bytes.Equal(chunks[i], data[c.Offset:c.Offset+c.Size]) {
+			t.Errorf("chunk %d doesn't match the file", i)
+		}
+	}
+	if dials, _ := tr.stats(); dials != 1 {
+		t.Errorf("pipelined requests dialed %d connections, want 1", dials)
+	}
+}
+
+func TestDownloadChunksMatchesOutOfOrderResponses(t *testing.T) {
+	tr := NewMemoryTransport()
+	_, data, manifest := testManifest(t, 4*testChunkSize)
+	reverseSeeder(t, tr, 9000, manifest, data)
+
+	chunks, err := DownloadChunks(context.Background(), tr, Peer{Address: "localhost", Port: 9000}, manifest, []int{0, 1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range manifest.Chunks {
+		if !bytes.Equal(chunks[i], data[c.Offset:c.Offset+c.Size]) {
+			t.Errorf("chunk %d doesn't match the file", i)
+		}
+	}
+}
+
+func TestDownloadChunksRejectsUnrequestedChunk(t *testing.T) {
+	tr := NewMemoryTransport()
+	_, data, manifest := testManifest(t, 4*testChunkSize)
+	reverseSeeder(t, tr, 9000, manifest, data, 3)
+
+	if _, err := DownloadChunks(context.Background(), tr, Peer{Address: "localhost", Port: 9000}, manifest, []int{0, 1}); err == nil {
+		t.Fatal("DownloadChunks accepted a chunk that wasn't requested")
+	}
+}
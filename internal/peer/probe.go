@@ -0,0 +1,95 @@
+// Package peer implements the peer-to-peer file sharing functionality.
+// It provides both client and server capabilities for sharing files between peers.
+package peer
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+// DefaultProbeSample is how many chunks ProbePeers fetches from each peer
+// unless asked for a different number.
+const DefaultProbeSample = 4
+
+// ProbeReport is the result of checking a sample of the chunks a peer serves
+// against a manifest.
+type ProbeReport struct {
+	Peer      Peer
+	Good      []int // Sampled chunks whose data matched the manifest
+	BadChunks []int // Sampled chunks whose data didn't match the manifest
+	Err       error // Why the peer couldn't be checked in full, if it couldn't
+}
+
+// OK reports whether the peer served every sampled chunk and all of them matched.
+func (r *ProbeReport) OK() bool {
+	return r.Err == nil && len(r.BadChunks) == 0
+}
+
+// Unreachable reports whether the peer couldn't be connected to at all, as
+// opposed to serving data that doesn't match.
+func (r *ProbeReport) Unreachable() bool {
+	return errors.Is(r.Err, ErrPeerUnreachable)
+}
+
+// ProbePeers fetches a random sample of up to sample chunks of manifest's file
+// from each peer and checks them against the manifest, to find seeders serving
+// corrupt or forged data before downloading from them. Every peer is checked
+// concurrently with its own sample. Nothing is written to disk. The reports are
+// returned in the order of peers.
+func ProbePeers(ctx context.Context, t Transport, peers []Peer, manifest *file.Manifest, sample int) ([]*ProbeReport, error) {
+	if err := manifest.CheckHashKey(); err != nil {
+		return nil, err
+	}
+	if sample <= 0 {
+		sample = DefaultProbeSample
+	}
+
+	reports := make([]*ProbeReport, len(peers))
+	var wg sync.WaitGroup
+	for i, p := range peers {
+		wg.Add(1)
+		go func(i int, p Peer) {
+			defer wg.Done()
+			reports[i] = probePeer(ctx, t, p, manifest, sampleChunks(len(manifest.Chunks), sample))
+		}(i, p)
+	}
+	wg.Wait()
+	return reports, nil
+}
+
+// probePeer fetches each chunk in indices from p and checks it against the
+// manifest. A chunk with the wrong content counts against the peer and the
+// next one is tried; any other failure, such as the peer being unreachable or
+// serving a different file, ends the check.
+func probePeer(ctx context.Context, t Transport, p Peer, manifest *file.Manifest, indices []int) *ProbeReport {
+	report := &ProbeReport{Peer: p}
+	for _, i := range indices {
+		data, err := fetchChunk(ctx, t, p, manifest, i)
+		if errors.Is(err, ErrHashMismatch) || (err == nil && !manifest.VerifyChunk(manifest.Chunks[i], data)) {
+			report.BadChunks = append(report.BadChunks, i)
+			continue
+		}
+		if err != nil {
+			report.Err = err
+			break
+		}
+		report.Good = append(report.Good, i)
+	}
+	return report
+}
+
+// sampleChunks picks up to sample distinct chunk indices out of n at random,
+// in ascending order.
+func sampleChunks(n, sample int) []int {
+	indices := rand.Perm(n)
+	if len(indices) > sample {
+		indices = indices[:sample]
+	}
+	sort.Ints(indices)
+	return indices
+}
@@ -0,0 +1,59 @@
+package peer
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"testing"
+)
+
+func TestProbePeers(t *testing.T) {
+	mem := NewMemoryTransport()
+	path, _, manifest := testManifest(t, 10*testChunkSize+7)
+	honest := serveFile(t, mem, 9001, path, manifest, ServerOptions{})
+	// Chunks from port 9002 arrive corrupted, as from a poisoned seeder
+	lying := serveFile(t, mem, 9002, path, manifest, ServerOptions{})
+	gone := Peer{Address: "localhost", Port: 9003}
+	tr := portTransport{base: mem, byPort: map[int]Transport{9002: corruptTransport{mem}}}
+
+	peers := []Peer{honest, lying, gone}
+	reports, err := ProbePeers(context.Background(), tr, peers, manifest, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != len(peers) {
+		t.Fatalf("got %d reports for %d peers", len(reports), len(peers))
+	}
+	for i, r := range reports {
+		if r.Peer != peers[i] {
+			t.Fatalf("report %d is for %v, want %v", i, r.Peer, peers[i])
+		}
+	}
+
+	if r := reports[0]; !r.OK() || len(r.Good) != 3 || len(r.BadChunks) != 0 {
+		t.Errorf("honest peer: good %v, bad %v, err %v; want 3 good chunks", r.Good, r.BadChunks, r.Err)
+	}
+	if r := reports[1]; r.OK() || r.Unreachable() || len(r.BadChunks) != 3 || len(r.Good) != 0 {
+		t.Errorf("lying peer: good %v, bad %v, err %v; want 3 bad chunks", r.Good, r.BadChunks, r.Err)
+	}
+	if r := reports[2]; r.OK() || !r.Unreachable() || len(r.BadChunks) != 0 {
+		t.Errorf("unreachable peer: bad %v, err %v; want unreachable with no bad chunks", r.BadChunks, r.Err)
+	}
+}
+
+func TestSampleChunks(t *testing.T) {
+	for _, tc := range []struct{ n, sample, want int }{{10, 4, 4}, {3, 4, 3}, {0, 4, 0}} {
+		indices := sampleChunks(tc.n, tc.sample)
+		if len(indices) != tc.want {
+			t.Fatalf("sampling %d of %d chunks picked %v", tc.sample, tc.n, indices)
+		}
+		if !sort.IntsAreSorted(indices) || len(slices.Compact(slices.Clone(indices))) != len(indices) {
+			t.Fatalf("sample %v isn't ascending and distinct", indices)
+		}
+		for _, i := range indices {
+			if i < 0 || i >= tc.n {
+				t.Fatalf("sample %v has an index outside %d chunks", indices, tc.n)
+			}
+		}
+	}
+}
@@ -0,0 +1,285 @@
+// Package peer implements the peer-to-peer file sharing functionality.
+// It provides both client and server capabilities for sharing files between peers.
+package peer
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+// maxMessageSize bounds the length of a single JSON message line, so that a peer
+// sending endless data without a newline can't exhaust memory.
+const maxMessageSize = 64 << 10
+
+// errMessageTooLarge is returned when a message line exceeds maxMessageSize.
+var errMessageTooLarge = errors.New("message too large")
+
+// Message types understood by the file server. Every request is a single line of
+// JSON carrying one of these types; requests without a type are chunk requests,
+// which keeps older clients working.
+const (
+	TypeChunk    = "chunk"     // ChunkRequest
+	TypePing     = "ping"      // PingRequest
+	TypePong     = "pong"      // PongResponse
+	TypeHello    = "hello"     // HelloRequest
+	TypeHelloAck = "hello_ack" // HelloAck
+	TypeHave     = "have"      // HaveRequest
+	TypeHaveAck  = "have_ack"  // HaveAck
+
+	TypeManifest     = "manifest"      // ManifestRequest
+	TypeManifestData = "manifest_data" // ManifestResponse
+)
+
+// maxHaveChunks is the most chunks listed in a single HaveAck, which keeps it
+// well below maxMessageSize.
+const maxHaveChunks = 256
+
+// MaxChunkSize is the largest chunk DownloadChunk accepts. Without a manifest
+// the size in a peer's ChunkResponse header can't be checked against the
+// chunk's own, so it only bounds the buffer a peer can make us allocate.
+const MaxChunkSize = 256 << 20
+
+// MaxBatchChunks is the most chunks a single ChunkRequest may ask for with
+// ChunkIndices. Seeders serve the chunks of a batch one at a time, so it
+// bounds how long one request ties up a connection rather than memory, and
+// refuse larger batches.
+const MaxBatchChunks = 64
+
+// PingRequest asks a seeder to answer immediately with a PongResponse.
+// It is used to measure round-trip time without transferring chunk data.
+type PingRequest struct {
+	Type string `json:"type"` // Always TypePing
+}
+
+// PongResponse is the seeder's reply to a PingRequest.
+type PongResponse struct {
+	Type string `json:"type"` // Always TypePong
+}
+
+// HelloRequest opens a connection by naming the file the client wants and the
+// chunk layout of its manifest. The seeder answers with a HelloAck, and chunk
+// requests on the connection that don't name a file refer to this one.
+type HelloRequest struct {
+	Type      string `json:"type"`               // Always TypeHello
+	FileHash  string `json:"fileHash"`           // Hash of the file to download
+	ChunkSize int64  `json:"chunkSize"`          // Chunk size of the client's manifest
+	Chunking  string `json:"chunking,omitempty"` // Chunking strategy of the client's manifest
+	Token     string `json:"token,omitempty"`    // Access token of the file, if the seeder requires one
+}
+
+// HelloAck is the seeder's reply to a HelloRequest. If the seeder can't serve
+// the requested file with the requested layout, Error is set, and ChunkSize and
+// Chunking describe the layout it does serve, if it has the file at all.
+// Batch tells clients that the seeder serves every chunk of a ChunkRequest's
+// ChunkIndices; seeders that predate batches leave it unset and only serve
+// its ChunkIndex.
+type HelloAck struct {
+	Type      string `json:"type"`               // Always TypeHelloAck
+	FileHash  string `json:"fileHash"`           // Hash of the requested file
+	ChunkSize int64  `json:"chunkSize"`          // Chunk size the seeder serves the file with
+	Chunking  string `json:"chunking,omitempty"` // Chunking strategy the seeder serves the file with
+	Batch     bool   `json:"batch,omitempty"`    // Whether batched chunk requests are served
+	Error     string `json:"error,omitempty"`    // Reason the file can't be served as requested
+	Code      string `json:"code,omitempty"`     // Machine-readable reason, see errorForCode
+}
+
+// HaveRequest asks a seeder how many chunks of a file it has now, for files
+// that grow while they are shared. The seeder answers with a HaveAck listing
+// its chunks from index From on.
+type HaveRequest struct {
+	Type     string `json:"type"`            // Always TypeHave
+	FileHash string `json:"fileHash"`        // Hash the file was first shared under
+	From     int    `json:"from"`            // Index of the first chunk to list
+	Token    string `json:"token,omitempty"` // Access token of the file, if the seeder requires one
+}
+
+// HaveAck is the seeder's reply to a HaveRequest. Total is the number of chunks
+// the seeder has, and Chunks lists at most maxHaveChunks of them starting at
+// the requested index; if there are more, the client asks again from the
+// first one missing.
+type HaveAck struct {
+	Type     string       `json:"type"`             // Always TypeHaveAck
+	FileHash string       `json:"fileHash"`         // Hash of the requested file
+	Total    int          `json:"total"`            // Number of chunks the seeder has
+	Chunks   []file.Chunk `json:"chunks,omitempty"` // The seeder's chunks from the requested index on
+	Error    string       `json:"error,omitempty"`  // Reason the request can't be answered
+	Code     string       `json:"code,omitempty"`   // Machine-readable reason, see errorForCode
+}
+
+// ChunkResponse is the header a seeder sends in reply to a ChunkRequest, once
+// for each chunk of a batch, in the order they were requested.
+// It is followed by exactly Size bytes of chunk data, unless Error is set.
+// FileHash and ChunkSize describe the seeder's copy of the file so that clients can
+// detect a peer serving a different file or chunk layout. ChunkIndex and Hash
+// identify the chunk that follows, so pipelined responses can be matched to their
+// requests and checked against the manifest before the data is accepted.
+type ChunkResponse struct {
+	FileHash   string `json:"fileHash"`        // Hash of the file the seeder is serving
+	ChunkSize  int64  `json:"chunkSize"`       // Chunk size of the seeder's manifest
+	ChunkIndex int    `json:"chunkIndex"`      // Index of the chunk this response carries
+	Hash       string `json:"hash,omitempty"`  // Hash of the chunk, per the seeder's manifest
+	Size       int64  `json:"size"`            // Number of chunk data bytes that follow
+	Error      string `json:"error,omitempty"` // Reason the chunk could not be served
+	Code       string `json:"code,omitempty"`  // Machine-readable reason, see errorForCode
+}
+
+// ManifestRequest asks a seeder for the manifest of a file it shares, so that
+// a downloader who only knows the file hash can get it from peers. The seeder
+// answers with a ManifestResponse.
+type ManifestRequest struct {
+	Type     string `json:"type"`            // Always TypeManifest
+	FileHash string `json:"fileHash"`        // Hash of the file whose manifest is wanted
+	Token    string `json:"token,omitempty"` // Access token of the file, if the seeder requires one
+}
+
+// ManifestResponse is the header a seeder sends in reply to a ManifestRequest.
+// It is followed by exactly Size bytes of the manifest as gzip-compressed
+// JSON, unless Error is set. Manifests can be much larger than maxMessageSize,
+// so they aren't sent as a message line.
+type ManifestResponse struct {
+	Type     string `json:"type"`            // Always TypeManifestData
+	FileHash string `json:"fileHash"`        // Hash of the requested file
+	Size     int64  `json:"size"`            // Number of manifest bytes that follow
+	Error    string `json:"error,omitempty"` // Reason the manifest can't be served
+	Code     string `json:"code,omitempty"`  // Machine-readable reason, see errorForCode
+}
+
+// messageHeader is decoded first from every request to find its type.
+type messageHeader struct {
+	Type string `json:"type"`
+}
+
+// writeMessage writes v as a single newline-terminated line of JSON.
+func writeMessage(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// writeMessages writes each of msgs as a line of JSON with a single Write, so that
+// a handshake and the first request can be sent together without waiting for the
+// handshake's reply.
+func writeMessages(w io.Writer, msgs ...interface{}) error {
+	var buf []byte
+	for _, v := range msgs {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, data...), '\n')
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// readMessage reads one newline-terminated JSON message from r into v.
+// The reader is left positioned just after the message, so any payload that
+// follows can be read from the same reader.
+func readMessage(r *bufio.Reader, v interface{}) error {
+	line, err := readLine(r)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(line, v)
+}
+
+// readLine reads up to and including the next newline, like r.ReadBytes('\n'),
+// but fails with errMessageTooLarge once more than maxMessageSize bytes have been
+// read without finding one.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		frag, err := r.ReadSlice('\n')
+		if len(line)+len(frag) > maxMessageSize {
+			return nil, errMessageTooLarge
+		}
+		line = append(line, frag...)
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+// readHelloAck reads the seeder's HelloAck and makes sure it agreed to serve
+// manifest's file with manifest's chunk layout.
+func readHelloAck(r *bufio.Reader, manifest *file.Manifest) error {
+	_, err := readHelloAckBatch(r, manifest)
+	return err
+}
+
+// readHelloAckBatch is readHelloAck, also reporting whether the seeder serves
+// batched chunk requests.
+func readHelloAckBatch(r *bufio.Reader, manifest *file.Manifest) (bool, error) {
+	var ack HelloAck
+	if err := readMessage(r, &ack); err != nil {
+		return false, fmt.Errorf("failed to read handshake: %v", err)
+	}
+	if ack.Type != TypeHelloAck {
+		return false, fmt.Errorf("unexpected handshake reply type %q", ack.Type)
+	}
+	if ack.Error != "" {
+		if ack.Code == codeLayoutMismatch {
+			return false, fmt.Errorf("%w: seeder serves chunk size %d (%s chunking), manifest uses %d (%s chunking)",
+				ErrPeerMismatch, ack.ChunkSize, chunkingName(ack.Chunking), manifest.ChunkSize, chunkingName(manifest.Chunking))
+		}
+		if sentinel := errorForCode(ack.Code); sentinel != nil {
+			return false, fmt.Errorf("%w: %s", sentinel, ack.Error)
+		}
+		return false, fmt.Errorf("peer rejected handshake: %s", ack.Error)
+	}
+	return ack.Batch, nil
+}
+
+// chunkingName returns the chunking strategy recorded in a manifest, treating
+// an empty value as fixed-size chunking.
+func chunkingName(chunking string) string {
+	if chunking == "" {
+		return file.ChunkingFixed
+	}
+	return chunking
+}
+
+// readChunkHeader reads a ChunkResponse header, turning a refusal into an error.
+// The chunk data that follows is read separately with readChunkData, so callers can
+// validate the header before allocating space for the payload.
+func readChunkHeader(r *bufio.Reader) (ChunkResponse, error) {
+	var resp ChunkResponse
+	if err := readMessage(r, &resp); err != nil {
+		return resp, fmt.Errorf("failed to read chunk header: %v", err)
+	}
+	if resp.Error != "" {
+		if sentinel := errorForCode(resp.Code); sentinel != nil {
+			return resp, fmt.Errorf("peer refused chunk: %w", sentinel)
+		}
+		return resp, fmt.Errorf("peer refused chunk: %s", resp.Error)
+	}
+	if resp.Size < 0 {
+		return resp, fmt.Errorf("invalid chunk size %d", resp.Size)
+	}
+	return resp, nil
+}
+
+// readChunkData reads exactly size bytes of chunk data. The last chunk of a
+// file is usually shorter than the manifest's ChunkSize, so size must be the
+// chunk's own size from the response header, never the nominal chunk size.
+// A connection that ends before size bytes arrive is reported as a truncated
+// chunk wrapping io.ErrUnexpectedEOF.
+func readChunkData(r io.Reader, size int64) ([]byte, error) {
+	data := make([]byte, size)
+	n, err := io.ReadFull(r, data)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("truncated chunk data: got %d of %d bytes: %w", n, size, io.ErrUnexpectedEOF)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk data: %v", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,91 @@
+package peer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+// handshake sends hello to peer over tr and returns the seeder's answer.
+func handshake(t *testing.T, tr Transport, peer Peer, hello HelloRequest) HelloAck {
+	t.Helper()
+	conn, err := tr.Dial(context.Background(), peer.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := writeMessage(conn, hello); err != nil {
+		t.Fatal(err)
+	}
+	var ack HelloAck
+	if err := readMessage(bufio.NewReader(conn), &ack); err != nil {
+		t.Fatal(err)
+	}
+	return ack
+}
+
+func TestHelloAgreement(t *testing.T) {
+	tr := NewMemoryTransport()
+	path, _, manifest := testManifest(t, 3*testChunkSize)
+	peer := serveFile(t, tr, 9000, path, manifest, ServerOptions{})
+
+	ack := handshake(t, tr, peer, helloFor(manifest))
+	if ack.Type != TypeHelloAck || ack.Error != "" || ack.FileHash != manifest.FileHash || ack.ChunkSize != manifest.ChunkSize {
+		t.Fatalf("seeder answered %+v, want it to accept the manifest's layout", ack)
+	}
+
+	// After the handshake, chunks are served for the agreed file
+	data, err := fetchChunk(context.Background(), tr, peer, manifest, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !manifest.VerifyChunk(manifest.Chunks[2], data) {
+		t.Fatal("chunk fetched after the handshake doesn't match the manifest")
+	}
+}
+
+func TestHelloLayoutMismatch(t *testing.T) {
+	tr := NewMemoryTransport()
+	path, _, manifest := testManifest(t, 3*testChunkSize)
+	peer := serveFile(t, tr, 9000, path, manifest, ServerOptions{})
+
+	// The same file, chunked twice as coarsely
+	other, err := file.CreateManifest(path, 2*testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack := handshake(t, tr, peer, helloFor(other))
+	if ack.Error == "" || ack.Code != codeLayoutMismatch || ack.ChunkSize != manifest.ChunkSize {
+		t.Fatalf("seeder answered %+v, want a layout mismatch reporting chunk size %d", ack, manifest.ChunkSize)
+	}
+	if _, err := fetchChunk(context.Background(), tr, peer, other, 0); !errors.Is(err, ErrPeerMismatch) {
+		t.Fatalf("fetching with the other layout returned %v, want ErrPeerMismatch", err)
+	}
+
+	// A file the seeder doesn't have is refused without a layout
+	unknown := helloFor(manifest)
+	unknown.FileHash = "not-shared"
+	if ack := handshake(t, tr, peer, unknown); ack.Code != codeFileNotShared || ack.ChunkSize != 0 {
+		t.Fatalf("seeder answered %+v for an unknown file, want file not shared", ack)
+	}
+}
+
+func TestReadChunkData(t *testing.T) {
+	data, err := readChunkData(bytes.NewReader([]byte("short chunk and more")), 11)
+	if err != nil || string(data) != "short chunk" {
+		t.Fatalf("readChunkData returned %q, %v; want exactly the 11 bytes asked for", data, err)
+	}
+
+	// A connection ending early is a truncated chunk, not a short one
+	if _, err := readChunkData(bytes.NewReader([]byte("short")), 11); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("reading past the end returned %v, want io.ErrUnexpectedEOF", err)
+	}
+	if _, err := readChunkData(bytes.NewReader(nil), 11); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("reading from an empty stream returned %v, want io.ErrUnexpectedEOF", err)
+	}
+}
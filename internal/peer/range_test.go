@@ -0,0 +1,38 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+func TestDownloadRange(t *testing.T) {
+	path, data := writeTestFile(t, "movie.mp4", 12*testChunkSize+5)
+	const start, end = 3*testChunkSize + 17, 8 * testChunkSize
+	manifest, err := file.CreateRangeManifest(path, testChunkSize, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The seeder shares the whole file under the range's manifest, and the
+	// download holds just the range
+	tr := NewMemoryTransport()
+	peer := serveFile(t, tr, 9000, path, manifest, ServerOptions{})
+	outputPath := filepath.Join(t.TempDir(), manifest.FileName)
+	opts := DownloadOptions{Transport: tr, MaxParallel: 3, VerifyAfter: true}
+	if _, err := DownloadFile(context.Background(), manifest, []Peer{peer}, outputPath, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutput(t, outputPath); !bytes.Equal(got, data[start:end]) {
+		t.Fatalf("downloaded %d bytes, want bytes %d-%d of the file", len(got), start, end)
+	}
+
+	// A file of another size can't be served under the range's manifest
+	short, _ := writeTestFile(t, "short.mp4", end)
+	if err := NewFileStore().Add(short, manifest); err == nil {
+		t.Fatal("FileStore shared a range of a file of the wrong size")
+	}
+}
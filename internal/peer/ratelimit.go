@@ -0,0 +1,134 @@
+// Package peer implements the peer-to-peer file sharing functionality.
+// It provides both client and server capabilities for sharing files between peers.
+package peer
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxRateBurst bounds how many bytes a RateLimiter lets through at once, so
+// that the rate stays smooth even at high limits.
+const maxRateBurst = 64 << 10
+
+// RateLimiter caps the combined rate of reads through it with a token bucket.
+// A single RateLimiter is shared by every connection of a download, so the
+// limit holds for the download as a whole however many peers it uses.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // Bytes per second
+	burst  int     // Largest read let through at once, and the most tokens saved up
+	tokens float64 // Bytes that may be read now; negative while reads are owed for
+	last   time.Time
+}
+
+// NewRateLimiter creates a RateLimiter allowing bytesPerSecond bytes per
+// second, which must be positive.
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	burst := int(min(bytesPerSecond, maxRateBurst))
+	return &RateLimiter{
+		rate:   float64(bytesPerSecond),
+		burst:  burst,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// wait takes n bytes' worth of tokens, blocking until the bucket is no longer
+// in debt or ctx is done. The bytes have usually been read already, so a read
+// is paid for after the fact; over time the rate still converges on the limit.
+func (l *RateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(float64(l.burst), l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// read reads at most one burst from r into p and waits for the bytes read.
+func (l *RateLimiter) read(ctx context.Context, r io.Reader, p []byte) (int, error) {
+	if len(p) > l.burst {
+		p = p[:l.burst]
+	}
+	n, err := r.Read(p)
+	if n > 0 {
+		if waitErr := l.wait(ctx, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+// limitedReader is an io.Reader whose reads are throttled by a RateLimiter.
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *RateLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	return r.limiter.read(r.ctx, r.r, p)
+}
+
+// limitReader returns r throttled by limiter, or r itself if limiter is nil.
+// Waiting for the limiter stops when ctx is done.
+func limitReader(ctx context.Context, r io.Reader, limiter *RateLimiter) io.Reader {
+	if limiter == nil {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, limiter: limiter}
+}
+
+// limitedConn is a connection whose reads are throttled by a RateLimiter.
+type limitedConn struct {
+	net.Conn
+	ctx     context.Context
+	limiter *RateLimiter
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	return c.limiter.read(c.ctx, c.Conn, p)
+}
+
+// limitedTransport is a Transport whose outgoing connections share a RateLimiter
+// for everything they read. Listening is not limited.
+type limitedTransport struct {
+	Transport
+	limiter *RateLimiter
+}
+
+// Dial connects to addr and throttles reads from the connection. Waiting for
+// the limiter stops when ctx is done.
+func (t limitedTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := t.Transport.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &limitedConn{Conn: conn, ctx: ctx, limiter: t.limiter}, nil
+}
+
+// rateLimiterOf returns the RateLimiter of a transport set up by
+// DownloadOptions.RateLimit, or nil if t isn't limited.
+func rateLimiterOf(t Transport) *RateLimiter {
+	if lt, ok := t.(limitedTransport); ok {
+		return lt.limiter
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRateLimitedDownload(t *testing.T) {
+	tr := NewMemoryTransport()
+	path, data, manifest := testManifest(t, 8*testChunkSize)
+	peers := []Peer{
+		serveFile(t, tr, 9001, path, manifest, ServerOptions{}),
+		serveFile(t, tr, 9002, path, manifest, ServerOptions{}),
+	}
+
+	// The limiter starts with one burst of tokens; the rest of the file is
+	// paid for at the limit, however many peers it comes from
+	const limit = 16 << 10
+	want := time.Duration(float64(len(data)-limit) / limit * float64(time.Second))
+	opts := DownloadOptions{Transport: tr, MaxParallel: 4, RateLimit: NewRateLimiter(limit)}
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	start := time.Now()
+	if _, err := DownloadFile(context.Background(), manifest, peers, outputPath, opts); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < want*9/10 {
+		t.Fatalf("download of %d bytes at %d bytes/s took %v, want at least %v", len(data), limit, elapsed, want)
+	}
+	if got := readOutput(t, outputPath); !bytes.Equal(got, data) {
+		t.Fatal("rate limited download doesn't match")
+	}
+}
+
+func TestRateLimiterWaitStopsWithContext(t *testing.T) {
+	l := NewRateLimiter(1 << 10)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// Reading far more than the limit allows owes seconds of waiting
+	start := time.Now()
+	if err := l.wait(ctx, 10<<10); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("wait returned %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("wait returned after %v, not when the context was done", elapsed)
+	}
+}
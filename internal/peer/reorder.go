@@ -0,0 +1,176 @@
+// Package peer implements the peer-to-peer file sharing functionality.
+// It provides both client and server capabilities for sharing files between peers.
+package peer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+// DefaultReorderBuffer is how many bytes of chunks DownloadTo holds in memory
+// while waiting for an earlier chunk, unless DownloadOptions.ReorderBuffer
+// says otherwise.
+const DefaultReorderBuffer = 64 << 20
+
+// reorderBuffer is a ChunkSink writing chunks to w in file order. Chunks that
+// arrive before those ahead of them are held in memory until they can be
+// written. To bound that memory, a chunk is only fetched once it has been
+// admitted with reserve, which waits while the chunks being fetched or held
+// would exceed the limit. The next chunk to write is always admitted, so a
+// download can't stall on a limit smaller than a chunk.
+type reorderBuffer struct {
+	w        io.Writer
+	manifest *file.Manifest
+	limit    int64
+
+	mu       sync.Mutex
+	next     int            // Index of the next chunk to write to w
+	held     map[int][]byte // Chunks received ahead of next
+	reserved int64          // Bytes of the chunks admitted but not yet written
+	hasher   *file.FileHasher
+	err      error         // Why writing to w failed, if it did
+	changed  chan struct{} // Closed when a chunk is written or writing fails
+}
+
+// newReorderBuffer returns a reorderBuffer writing manifest's file to w,
+// holding at most limit bytes of chunks beyond the next one.
+func newReorderBuffer(w io.Writer, manifest *file.Manifest, limit int64) *reorderBuffer {
+	return &reorderBuffer{
+		w:        w,
+		manifest: manifest,
+		limit:    limit,
+		held:     make(map[int][]byte),
+		hasher:   manifest.NewFileHasher(),
+		changed:  make(chan struct{}),
+	}
+}
+
+// reserve waits until the chunk at index i fits in the buffer and admits it,
+// or returns early when writing has failed, stop is closed, or ctx is done.
+// Chunks must be admitted in file order.
+func (b *reorderBuffer) reserve(ctx context.Context, stop <-chan struct{}, i int) error {
+	size := b.manifest.Chunks[i].Size
+	for {
+		b.mu.Lock()
+		if b.err != nil {
+			b.mu.Unlock()
+			return b.err
+		}
+		if i == b.next || b.reserved+size <= b.limit {
+			b.reserved += size
+			b.mu.Unlock()
+			return nil
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-stop:
+			return errors.New("download stopped")
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// WriteChunkAt holds the chunk at index until every chunk before it has been
+// written, then writes it and any held chunks that follow it to w.
+func (b *reorderBuffer) WriteChunkAt(index int, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return b.err
+	}
+
+	b.held[index] = data
+	written := false
+	for {
+		data, ok := b.held[b.next]
+		if !ok {
+			break
+		}
+		if _, err := b.w.Write(data); err != nil {
+			b.err = fmt.Errorf("failed to write chunk %d: %w", b.next, err)
+			b.held = nil
+			close(b.changed)
+			return b.err
+		}
+		b.hasher.WriteChunk(b.next, data)
+		delete(b.held, b.next)
+		b.reserved -= b.manifest.Chunks[b.next].Size
+		b.next++
+		written = true
+	}
+	if written {
+		// Wake reserve calls waiting for room
+		close(b.changed)
+		b.changed = make(chan struct{})
+	}
+	return nil
+}
+
+// Finalize checks that every chunk was written and that together they match
+// the manifest's file hash.
+func (b *reorderBuffer) Finalize() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.next != len(b.manifest.Chunks) {
+		return fmt.Errorf("only %d of %d chunks were written", b.next, len(b.manifest.Chunks))
+	}
+	if !b.hasher.Verify() {
+		return fmt.Errorf("%w: file hash mismatch", ErrVerificationFailed)
+	}
+	return nil
+}
+
+// DownloadTo downloads manifest's file from peers and writes its content to w
+// in order, as a stream, e.g. to pipe it to another program without storing
+// it. Chunks are still fetched from several peers at once, up to
+// opts.MaxParallel, always in file order; those that arrive before the
+// chunks ahead of them are held in memory until they can be written. While
+// opts.ReorderBuffer bytes (DefaultReorderBuffer if not positive) of chunks
+// are held or being fetched, no further chunks are requested, so a single
+// slow chunk holds back the download rather than filling memory; only the
+// next chunk to write may exceed the limit. Every chunk is verified before it
+// is written, so SkipChunkVerify can't be used, and the whole-file hash is
+// checked at the end, failing with ErrVerificationFailed after the content
+// was written if it doesn't match. Chunks can't be skipped, so a chunk no
+// peer has fails the download. A directory manifest's content is written as
+// the single stream it is shared as. On success it returns a summary like
+// DownloadFile.
+func DownloadTo(ctx context.Context, manifest *file.Manifest, peers []Peer, w io.Writer, opts DownloadOptions) (*DownloadResult, error) {
+	start := time.Now()
+	if opts.SkipChunkVerify {
+		return nil, errors.New("SkipChunkVerify can't be used when streaming a download, which can't be verified afterwards")
+	}
+	if err := manifest.CheckHashKey(); err != nil {
+		return nil, err
+	}
+	opts = opts.withDefaults()
+	opts.RandomOrder = false
+	if opts.ReorderBuffer <= 0 {
+		opts.ReorderBuffer = DefaultReorderBuffer
+	}
+
+	pending := make([]int, len(manifest.Chunks))
+	for i := range pending {
+		pending[i] = i
+	}
+	buf := newReorderBuffer(w, manifest, opts.ReorderBuffer)
+	result, err := fetchInto(ctx, manifest, peers, buf, pending, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := buf.Finalize(); err != nil {
+		return nil, err
+	}
+	result.Duration = time.Since(start)
+	return result, nil
+}
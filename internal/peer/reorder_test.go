@@ -0,0 +1,144 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// failingWriter is an io.Writer whose writes fail.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("pipe closed")
+}
+
+func TestReorderBuffer(t *testing.T) {
+	_, data, manifest := testManifest(t, 4*testChunkSize+10)
+	chunk := func(i int) []byte {
+		c := manifest.Chunks[i]
+		return data[c.Offset : c.Offset+c.Size]
+	}
+	ctx := context.Background()
+
+	var out bytes.Buffer
+	b := newReorderBuffer(&out, manifest, 2*testChunkSize)
+	for _, i := range []int{0, 1} {
+		if err := b.reserve(ctx, nil, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A third chunk doesn't fit until the first ones are written
+	admitted := make(chan error, 1)
+	go func() { admitted <- b.reserve(ctx, nil, 2) }()
+	if err := b.WriteChunkAt(1, chunk(1)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-admitted:
+		t.Fatal("chunk admitted past the limit while the chunks ahead of it were held")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if out.Len() != 0 {
+		t.Fatal("chunk written before the one ahead of it")
+	}
+	if err := b.WriteChunkAt(0, chunk(0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-admitted; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), data[:2*testChunkSize]) {
+		t.Fatal("held chunk wasn't written once the one ahead of it arrived")
+	}
+
+	if err := b.Finalize(); err == nil {
+		t.Fatal("Finalize succeeded with chunks missing")
+	}
+	for _, i := range []int{2, 4, 3} {
+		b.WriteChunkAt(i, chunk(i))
+	}
+	if err := b.Finalize(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatal("chunks written out of order")
+	}
+}
+
+func TestReorderBufferLimits(t *testing.T) {
+	_, data, manifest := testManifest(t, 2*testChunkSize)
+	ctx := context.Background()
+
+	// The next chunk is admitted even if it is larger than the limit
+	b := newReorderBuffer(&bytes.Buffer{}, manifest, 1)
+	if err := b.reserve(ctx, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	close(stop)
+	if err := b.reserve(ctx, stop, 1); err == nil {
+		t.Fatal("reserve waiting for room returned nil after the download stopped")
+	}
+
+	// Content that doesn't match the file hash fails at the end
+	b = newReorderBuffer(&bytes.Buffer{}, manifest, DefaultReorderBuffer)
+	b.WriteChunkAt(0, data[:testChunkSize])
+	b.WriteChunkAt(1, make([]byte, testChunkSize))
+	if err := b.Finalize(); !errors.Is(err, ErrVerificationFailed) {
+		t.Fatalf("Finalize of the wrong content returned %v, want ErrVerificationFailed", err)
+	}
+
+	// Once writing fails, so does everything after it
+	b = newReorderBuffer(failingWriter{}, manifest, testChunkSize)
+	b.reserve(ctx, nil, 0)
+	if err := b.WriteChunkAt(0, data[:testChunkSize]); err == nil {
+		t.Fatal("failed write not reported")
+	}
+	if err := b.reserve(ctx, nil, 1); err == nil {
+		t.Fatal("chunk admitted after writing failed")
+	}
+}
+
+func TestDownloadTo(t *testing.T) {
+	mem := NewMemoryTransport()
+	path, data, manifest := testManifest(t, 12*testChunkSize+7)
+	// Chunks from port 9001 are slow to arrive, so the others get ahead
+	slow := serveFile(t, mem, 9001, path, manifest, ServerOptions{})
+	fast := serveFile(t, mem, 9002, path, manifest, ServerOptions{})
+	tr := portTransport{base: mem, byPort: map[int]Transport{9001: slowTransport{mem, 20 * time.Millisecond}}}
+
+	for _, maxParallel := range []int{1, 4} {
+		var out bytes.Buffer
+		opts := DownloadOptions{Transport: tr, MaxParallel: maxParallel, ReorderBuffer: 2 * testChunkSize}
+		result, err := DownloadTo(context.Background(), manifest, []Peer{slow, fast}, &out, opts)
+		if err != nil {
+			t.Fatalf("MaxParallel %d: %v", maxParallel, err)
+		}
+		if !bytes.Equal(out.Bytes(), data) {
+			t.Fatalf("MaxParallel %d: streamed content doesn't match", maxParallel)
+		}
+		if result.Bytes != manifest.FileSize {
+			t.Fatalf("MaxParallel %d: result counts %d bytes, want %d", maxParallel, result.Bytes, manifest.FileSize)
+		}
+	}
+
+	if _, err := DownloadTo(context.Background(), manifest, []Peer{fast}, &bytes.Buffer{}, DownloadOptions{Transport: mem, SkipChunkVerify: true}); err == nil {
+		t.Fatal("stream without chunk verification started")
+	}
+
+	// A stream can't skip a chunk no peer has
+	growing := *manifest
+	growing.Chunks = manifest.Chunks[:3]
+	partial := serveFile(t, mem, 9003, path, &growing, ServerOptions{})
+	var out bytes.Buffer
+	_, err := DownloadTo(context.Background(), manifest, []Peer{partial}, &out, DownloadOptions{Transport: mem})
+	if err == nil {
+		t.Fatal("stream of a file missing chunks succeeded")
+	}
+	if !bytes.Equal(out.Bytes(), data[:out.Len()]) || out.Len() > 3*testChunkSize {
+		t.Fatalf("stream wrote %d bytes past the chunks the peer has, or wrong ones", out.Len())
+	}
+}
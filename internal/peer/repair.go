@@ -0,0 +1,65 @@
+// Package peer implements the peer-to-peer file sharing functionality.
+// It provides both client and server capabilities for sharing files between peers.
+package peer
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+// Repair scans a downloaded file chunk by chunk and re-downloads only the chunks
+// that fail hash verification. Each bad chunk is requested from the given peers in
+// order until one returns valid data, which is then written in place.
+// It returns the indices of the chunks that were repaired.
+// It stops early if ctx is cancelled.
+func Repair(ctx context.Context, t Transport, manifest *file.Manifest, filePath string, peers []Peer) ([]int, error) {
+	f, err := os.OpenFile(filePath, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file for repair: %v", err)
+	}
+	defer f.Close()
+
+	report, err := file.VerifyFile(manifest, filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify file: %v", err)
+	}
+	badChunks := report.BadChunks
+	if len(badChunks) == 0 {
+		return nil, nil
+	}
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("%w: %d chunks need repair", ErrNoPeers, len(badChunks))
+	}
+
+	var repaired []int
+	for _, i := range badChunks {
+		// Try each peer until one serves a valid copy of the chunk
+		var lastErr error
+		fixed := false
+		for _, p := range peers {
+			if err := ctx.Err(); err != nil {
+				return repaired, err
+			}
+			data, err := fetchChunk(ctx, t, p, manifest, i)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if err := file.WriteChunkAt(f, manifest, i, data); err != nil {
+				lastErr = err
+				continue
+			}
+			fixed = true
+			break
+		}
+		if !fixed {
+			return repaired, fmt.Errorf("failed to repair chunk %d: %w", i, lastErr)
+		}
+		repaired = append(repaired, i)
+	}
+
+	return repaired, nil
+}
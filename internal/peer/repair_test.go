@@ -0,0 +1,56 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestRepairRefetchesOnlyBadChunks(t *testing.T) {
+	tr := NewMemoryTransport()
+	path, data, manifest := testManifest(t, 4*testChunkSize+100)
+	peer := serveFile(t, tr, 9000, path, manifest, ServerOptions{})
+
+	// A local copy with chunks 1 and 4 (the short last one) corrupted
+	corrupt := bytes.Clone(data)
+	corrupt[manifest.Chunks[1].Offset+7] ^= 0xff
+	corrupt[manifest.Chunks[4].Offset] ^= 0xff
+	local := filepath.Join(t.TempDir(), "local.bin")
+	if err := os.WriteFile(local, corrupt, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	repaired, err := Repair(context.Background(), tr, manifest, local, []Peer{peer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(repaired, []int{1, 4}) {
+		t.Errorf("repaired chunks %v, want [1 4]", repaired)
+	}
+	if got := readOutput(t, local); !bytes.Equal(got, data) {
+		t.Fatal("repaired file doesn't match the original")
+	}
+
+	// An intact file needs no peer at all
+	repaired, err = Repair(context.Background(), tr, manifest, local, nil)
+	if err != nil || len(repaired) != 0 {
+		t.Fatalf("Repair of an intact file returned %v, %v", repaired, err)
+	}
+}
+
+func TestRepairWithoutPeers(t *testing.T) {
+	_, data, manifest := testManifest(t, 2*testChunkSize)
+	data[0] ^= 0xff
+	local := filepath.Join(t.TempDir(), "local.bin")
+	if err := os.WriteFile(local, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Repair(context.Background(), NewMemoryTransport(), manifest, local, nil); !errors.Is(err, ErrNoPeers) {
+		t.Fatalf("Repair returned %v, want ErrNoPeers", err)
+	}
+}
@@ -0,0 +1,81 @@
+// Package peer implements the peer-to-peer file sharing functionality.
+// It provides both client and server capabilities for sharing files between peers.
+package peer
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// DownloadResult summarizes a finished download, e.g. to judge the health of
+// a swarm after retries and failovers.
+type DownloadResult struct {
+	Bytes    int64         // Bytes downloaded from peers, not counting reused chunks
+	Duration time.Duration // How long the download took, including verification
+	Chunks   int           // Chunks downloaded from peers
+	Reused   int           // Chunks already available locally, which weren't downloaded
+
+	// Retries counts the chunk requests that failed, because a peer couldn't
+	// be reached or served bad data, so that the chunk had to be requested
+	// again.
+	Retries int
+
+	// PeerChunks maps each peer that served chunks, by host:port or web seed
+	// URL, to the number of chunks it served. The counts add up to Chunks.
+	PeerChunks map[string]int
+
+	// FailedPeers lists the peers, in sorted order, that failed at least one
+	// request. They may also have served other chunks.
+	FailedPeers []string
+}
+
+// downloadStats accumulates a DownloadResult as chunks arrive and requests
+// fail. It is safe for concurrent use.
+type downloadStats struct {
+	mu     sync.Mutex
+	result DownloadResult
+	failed map[string]bool
+}
+
+func newDownloadStats() *downloadStats {
+	return &downloadStats{
+		result: DownloadResult{PeerChunks: make(map[string]int)},
+		failed: make(map[string]bool),
+	}
+}
+
+// chunkDone records that from served a chunk of size bytes.
+func (s *downloadStats) chunkDone(from Peer, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.result.Chunks++
+	s.result.Bytes += size
+	s.result.PeerChunks[from.addr()]++
+}
+
+// requestFailed records that a chunk request to peer failed.
+func (s *downloadStats) requestFailed(peer Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.result.Retries++
+	s.failed[peer.addr()] = true
+}
+
+// snapshot returns the result accumulated so far.
+func (s *downloadStats) snapshot() *DownloadResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := s.result
+	result.PeerChunks = make(map[string]int, len(s.result.PeerChunks))
+	for addr, n := range s.result.PeerChunks {
+		result.PeerChunks[addr] = n
+	}
+	result.FailedPeers = make([]string, 0, len(s.failed))
+	for addr := range s.failed {
+		result.FailedPeers = append(result.FailedPeers, addr)
+	}
+	sort.Strings(result.FailedPeers)
+	return &result
+}
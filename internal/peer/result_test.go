@@ -0,0 +1,71 @@
+package peer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestDownloadResult(t *testing.T) {
+	mem := NewMemoryTransport()
+	path, data, manifest := testManifest(t, 6*testChunkSize+10)
+	// Port 9001 has no server and chunks from 9002 arrive corrupted, so
+	// every chunk ends up coming from 9003
+	dead := Peer{Address: "localhost", Port: 9001}
+	corrupt := serveFile(t, mem, 9002, path, manifest, ServerOptions{})
+	good := serveFile(t, mem, 9003, path, manifest, ServerOptions{})
+	tr := portTransport{base: mem, byPort: map[int]Transport{9002: corruptTransport{mem}}}
+
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	result, err := DownloadFile(context.Background(), manifest, []Peer{dead, corrupt, good}, outputPath, DownloadOptions{Transport: tr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Chunks != len(manifest.Chunks) || result.Bytes != int64(len(data)) || result.Reused != 0 {
+		t.Fatalf("result counts %d chunks of %d bytes and %d reused, want %d chunks of %d bytes",
+			result.Chunks, result.Bytes, result.Reused, len(manifest.Chunks), len(data))
+	}
+	if want := map[string]int{"localhost:9003": len(manifest.Chunks)}; !reflect.DeepEqual(result.PeerChunks, want) {
+		t.Fatalf("chunks per peer %v, want %v", result.PeerChunks, want)
+	}
+	if want := []string{"localhost:9001", "localhost:9002"}; !slices.Equal(result.FailedPeers, want) {
+		t.Fatalf("failed peers %v, want %v", result.FailedPeers, want)
+	}
+	// Each failed peer failed at least once before being passed over
+	if result.Retries < 2 {
+		t.Fatalf("result counts %d retries, want at least one per failed peer", result.Retries)
+	}
+	if result.Duration <= 0 {
+		t.Fatal("result has no duration")
+	}
+}
+
+func TestResumeResultCountsReusedChunks(t *testing.T) {
+	tr := NewMemoryTransport()
+	path, data, manifest := testManifest(t, 5*testChunkSize)
+	peer := serveFile(t, tr, 9000, path, manifest, ServerOptions{})
+
+	// A .part file missing chunks 1 and 3
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	part := slices.Clone(data)
+	clear(part[1*testChunkSize : 2*testChunkSize])
+	clear(part[3*testChunkSize : 4*testChunkSize])
+	if err := os.WriteFile(PartPath(outputPath), part, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := ResumeFile(context.Background(), manifest, []Peer{peer}, outputPath, DownloadOptions{Transport: tr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Chunks != 2 || result.Reused != 3 || result.Bytes != 2*testChunkSize {
+		t.Fatalf("resume fetched %d chunks of %d bytes and reused %d, want 2 of %d bytes and 3 reused",
+			result.Chunks, result.Bytes, result.Reused, 2*testChunkSize)
+	}
+	if result.Retries != 0 || len(result.FailedPeers) != 0 {
+		t.Fatalf("resume from a working peer had %d retries and failed peers %v", result.Retries, result.FailedPeers)
+	}
+}
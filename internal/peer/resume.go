@@ -0,0 +1,37 @@
+// Package peer implements the peer-to-peer file sharing functionality.
+// It provides both client and server capabilities for sharing files between peers.
+package peer
+
+import (
+	"context"
+	"os"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+// ResumeFile continues an interrupted DownloadFile. Chunks already present in
+// the .part file for outputPath are checked against the manifest and kept if
+// they match; only the rest are downloaded. Without a .part file it downloads
+// the whole file. Kept chunks must also pass opts.VerifyFunc, if set. The
+// result's Reused counts the chunks kept from the .part file.
+func ResumeFile(ctx context.Context, manifest *file.Manifest, peers []Peer, outputPath string, opts DownloadOptions) (*DownloadResult, error) {
+	prefill := func(out *os.File) ([]int, error) {
+		var pending []int
+		for i, chunk := range manifest.Chunks {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+
+			// Keep the chunk if the .part file already holds its data
+			data := make([]byte, chunk.Size)
+			n, _ := out.ReadAt(data, chunk.Offset)
+			if n != len(data) || !manifest.VerifyChunk(chunk, data) ||
+				(opts.VerifyFunc != nil && opts.VerifyFunc(chunk, data) != nil) {
+				pending = append(pending, i)
+			}
+		}
+		return pending, nil
+	}
+
+	return downloadFile(ctx, manifest, peers, outputPath, opts, true, prefill)
+}
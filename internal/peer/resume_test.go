@@ -0,0 +1,77 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestResumeFileFetchesOnlyMissingChunks(t *testing.T) {
+	tr := NewMemoryTransport()
+	path, data, manifest := testManifest(t, 5*testChunkSize+300)
+	store := NewFileStore()
+	if err := store.Add(path, manifest); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	var mu sync.Mutex
+	var served []int
+	peer := serveStore(t, tr, 9000, store, ServerOptions{OnChunkServed: func(_ string, i int, _ int64) {
+		mu.Lock()
+		served = append(served, i)
+		mu.Unlock()
+	}})
+	// takeServed returns the chunks served since it was last called, once
+	// there are want of them. Chunks are counted once they have been sent,
+	// so the last may be counted just after the download finishes.
+	takeServed := func(want int) []int {
+		deadline := time.Now().Add(time.Second)
+		for {
+			mu.Lock()
+			got := served
+			if len(got) >= want || time.Now().After(deadline) {
+				served = nil
+				mu.Unlock()
+				slices.Sort(got)
+				return got
+			}
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// A .part file with chunks 1 and 5 (the short last one) damaged, and
+	// stray bytes past the end of the file
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	part := append(bytes.Clone(data), "trailing garbage"...)
+	part[manifest.Chunks[1].Offset] ^= 0xff
+	clear(part[manifest.Chunks[5].Offset:len(data)])
+	if err := os.WriteFile(PartPath(outputPath), part, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := ResumeFile(context.Background(), manifest, []Peer{peer}, outputPath, DownloadOptions{Transport: tr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutput(t, outputPath); !bytes.Equal(got, data) {
+		t.Fatal("resumed file doesn't match the original")
+	}
+	if served := takeServed(2); !slices.Equal(served, []int{1, 5}) || result.Reused != 4 || result.Chunks != 2 {
+		t.Fatalf("fetched chunks %v and reused %d, want [1 5] fetched and 4 reused", served, result.Reused)
+	}
+
+	// Without a .part file, everything is fetched
+	outputPath = filepath.Join(t.TempDir(), "fresh.bin")
+	if result, err = ResumeFile(context.Background(), manifest, []Peer{peer}, outputPath, DownloadOptions{Transport: tr}); err != nil {
+		t.Fatal(err)
+	}
+	if served := takeServed(len(manifest.Chunks)); len(served) != len(manifest.Chunks) || result.Reused != 0 {
+		t.Fatalf("fetched %d chunks and reused %d without a .part file, want all %d fetched", len(served), result.Reused, len(manifest.Chunks))
+	}
+}
@@ -0,0 +1,146 @@
+// Package peer implements the peer-to-peer file sharing functionality.
+// It provides both client and server capabilities for sharing files between peers.
+package peer
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// PeerSelector decides which peer should serve each chunk of a download.
+// Implementations must be safe for concurrent use.
+type PeerSelector interface {
+	// Select returns the peer to request chunkIndex from.
+	// It is never called with an empty peers slice.
+	Select(peers []Peer, chunkIndex int) Peer
+}
+
+// FirstAvailable always selects the first peer in the list.
+// This matches the original behavior of downloading everything from one peer.
+type FirstAvailable struct{}
+
+// Select returns the first peer.
+func (FirstAvailable) Select(peers []Peer, chunkIndex int) Peer {
+	return peers[0]
+}
+
+// RoundRobin cycles through the peers in order, spreading chunks evenly.
+type RoundRobin struct {
+	mu   sync.Mutex
+	next int
+}
+
+// Select returns the next peer in rotation.
+func (r *RoundRobin) Select(peers []Peer, chunkIndex int) Peer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p := peers[r.next%len(peers)]
+	r.next++
+	return p
+}
+
+// LowestLatency selects the peer with the lowest measured round-trip time.
+// Peers are timed with Ping, a ping/pong exchange over a fresh connection that
+// leaves out connection setup, rather than by how long the TCP connect takes,
+// so that the time a seeder takes to answer a request counts too. The first
+// Select for a list of peers probes all of them at once, and later calls reuse
+// the results for the lifetime of the selector, so a download waits for at
+// most one probe timeout however many peers are unreachable. Unreachable peers
+// are only chosen if no peer could be reached.
+type LowestLatency struct {
+	Transport Transport
+
+	mu      sync.Mutex
+	latency map[Peer]*latencyProbe
+}
+
+// latencyProbe is the round-trip time measured for a peer, which is set once
+// done is closed.
+type latencyProbe struct {
+	done chan struct{}
+	rtt  time.Duration
+}
+
+// probeTimeout bounds how long LowestLatency waits for a single peer to answer.
+const probeTimeout = 5 * time.Second
+
+// NewLowestLatency creates a LowestLatency selector that probes peers over t.
+func NewLowestLatency(t Transport) *LowestLatency {
+	return &LowestLatency{
+		Transport: t,
+		latency:   make(map[Peer]*latencyProbe),
+	}
+}
+
+// Select returns the peer with the lowest round-trip time, waiting for the
+// probes of peers not timed yet.
+func (l *LowestLatency) Select(peers []Peer, chunkIndex int) Peer {
+	probes := l.probes(peers)
+
+	best := peers[0]
+	bestRTT := time.Duration(math.MaxInt64)
+	for i, p := range probes {
+		<-p.done
+		if p.rtt < bestRTT {
+			best, bestRTT = peers[i], p.rtt
+		}
+	}
+	return best
+}
+
+// probes returns the probes of peers, starting concurrent ones for the peers
+// not probed before. The lock is only held to look them up, so that callers
+// wait for the probes without blocking each other.
+func (l *LowestLatency) probes(peers []Peer) []*latencyProbe {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.latency == nil {
+		l.latency = make(map[Peer]*latencyProbe)
+	}
+	probes := make([]*latencyProbe, len(peers))
+	for i, p := range peers {
+		lp, ok := l.latency[p]
+		if !ok {
+			lp = &latencyProbe{done: make(chan struct{})}
+			l.latency[p] = lp
+			go l.probe(p, lp)
+		}
+		probes[i] = lp
+	}
+	return probes
+}
+
+// probe measures the round-trip time to p into lp and closes lp.done.
+// Unreachable peers get the maximum possible duration.
+func (l *LowestLatency) probe(p Peer, lp *latencyProbe) {
+	defer close(lp.done)
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	rtt, err := Ping(ctx, l.Transport, p)
+	if err != nil {
+		lp.rtt = time.Duration(math.MaxInt64)
+		return
+	}
+	lp.rtt = rtt
+}
+
+// NewSelector returns the PeerSelector registered under name.
+// Valid names are "first", "round-robin", and "lowest-latency".
+func NewSelector(name string, t Transport) (PeerSelector, error) {
+	switch name {
+	case "", "first":
+		return FirstAvailable{}, nil
+	case "round-robin":
+		return &RoundRobin{}, nil
+	case "lowest-latency":
+		return NewLowestLatency(t), nil
+	default:
+		return nil, fmt.Errorf("unknown peer selector %q", name)
+	}
+}
@@ -0,0 +1,164 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// delayTransport wraps a Transport to simulate slow and unreachable peers:
+// connections to a port in slow answer each read after a delay, and dials to a
+// port in dead fail after a delay.
+type delayTransport struct {
+	Transport
+	slow map[string]time.Duration
+	dead map[string]time.Duration
+}
+
+func (t delayTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	_, port, _ := net.SplitHostPort(addr)
+	if d, ok := t.dead[port]; ok {
+		if err := sleepContext(ctx, d); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("connection refused")
+	}
+	conn, err := t.Transport.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	if d, ok := t.slow[port]; ok {
+		return slowConn{Conn: conn, delay: d}, nil
+	}
+	return conn, nil
+}
+
+// slowConn delays every read by delay.
+type slowConn struct {
+	net.Conn
+	delay time.Duration
+}
+
+func (c slowConn) Read(p []byte) (int, error) {
+	time.Sleep(c.delay)
+	return c.Conn.Read(p)
+}
+
+func TestFirstAvailable(t *testing.T) {
+	peers := []Peer{{Address: "a", Port: 1}, {Address: "b", Port: 2}}
+	for i := 0; i < 3; i++ {
+		if p := (FirstAvailable{}).Select(peers, i); p != peers[0] {
+			t.Fatalf("chunk %d: selected %v, want %v", i, p, peers[0])
+		}
+	}
+}
+
+func TestRoundRobinFairness(t *testing.T) {
+	peers := []Peer{{Address: "a", Port: 1}, {Address: "b", Port: 2}, {Address: "c", Port: 3}}
+	var rr RoundRobin
+
+	// Concurrent callers still get an even share of chunks per peer
+	const perPeer = 100
+	var mu sync.Mutex
+	counts := make(map[Peer]int)
+	var wg sync.WaitGroup
+	for w := 0; w < 6; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perPeer*len(peers)/6; i++ {
+				p := rr.Select(peers, i)
+				mu.Lock()
+				counts[p]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	for _, p := range peers {
+		if counts[p] != perPeer {
+			t.Errorf("peer %v selected %d times, want %d", p, counts[p], perPeer)
+		}
+	}
+
+	// Sequential calls cycle through the peers in order
+	var ordered RoundRobin
+	for i := 0; i < 2*len(peers); i++ {
+		if p := ordered.Select(peers, i); p != peers[i%len(peers)] {
+			t.Fatalf("call %d selected %v, want %v", i, p, peers[i%len(peers)])
+		}
+	}
+}
+
+func TestLowestLatencyPrefersFasterPeer(t *testing.T) {
+	mem := NewMemoryTransport()
+	path, _, manifest := testManifest(t, testChunkSize)
+	slow := serveFile(t, mem, 9001, path, manifest, ServerOptions{})
+	fast := serveFile(t, mem, 9002, path, manifest, ServerOptions{})
+	tr := delayTransport{Transport: mem, slow: map[string]time.Duration{"9001": 50 * time.Millisecond}}
+
+	selector := NewLowestLatency(tr)
+	for i := 0; i < 3; i++ {
+		if p := selector.Select([]Peer{slow, fast}, i); p != fast {
+			t.Fatalf("chunk %d: selected %v, want the faster %v", i, p, fast)
+		}
+	}
+}
+
+func TestLowestLatencyProbesConcurrently(t *testing.T) {
+	mem := NewMemoryTransport()
+	path, _, manifest := testManifest(t, testChunkSize)
+	live := serveFile(t, mem, 9000, path, manifest, ServerOptions{})
+
+	// Five peers that each take 200ms to fail to connect
+	const dialDelay = 200 * time.Millisecond
+	tr := delayTransport{Transport: mem, dead: make(map[string]time.Duration)}
+	var peers []Peer
+	for port := 9101; port <= 9105; port++ {
+		p := Peer{Address: "localhost", Port: port}
+		tr.dead[strconv.Itoa(port)] = dialDelay
+		peers = append(peers, p)
+	}
+	peers = append(peers, live)
+
+	// Several workers selecting at once wait for one round of probes,
+	// rather than for each dead peer in turn
+	selector := NewLowestLatency(tr)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			if p := selector.Select(peers, w); p != live {
+				t.Errorf("worker %d selected %v, want the reachable %v", w, p, live)
+			}
+		}(w)
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed > 3*dialDelay {
+		t.Fatalf("selecting took %v, want about %v for concurrent probes", elapsed, dialDelay)
+	}
+
+	// Results are cached, so later calls don't probe again
+	start = time.Now()
+	selector.Select(peers, 10)
+	if elapsed := time.Since(start); elapsed > dialDelay/2 {
+		t.Fatalf("cached select took %v", elapsed)
+	}
+}
+
+func TestNewSelector(t *testing.T) {
+	for _, name := range []string{"", "first", "round-robin", "lowest-latency"} {
+		if _, err := NewSelector(name, NewMemoryTransport()); err != nil {
+			t.Errorf("NewSelector(%q): %v", name, err)
+		}
+	}
+	if _, err := NewSelector("fastest", nil); err == nil {
+		t.Error("NewSelector accepted an unknown name")
+	}
+}
@@ -0,0 +1,125 @@
+// Package peer implements the peer-to-peer file sharing functionality.
+// It provides both client and server capabilities for sharing files between peers.
+package peer
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// sendBlockSize bounds each write of chunk data to a connection, so that
+	// a slow client is detected by the write deadline within one block rather
+	// than only after a whole chunk.
+	sendBlockSize = 64 << 10
+
+	// DefaultWriteTimeout is how long a seeder waits for a client to accept
+	// each block of chunk data unless ServerOptions.WriteTimeout is set.
+	DefaultWriteTimeout = 30 * time.Second
+)
+
+// chunkBuffers holds buffers for reading the chunks being served, so that a
+// busy seeder doesn't allocate a chunk-sized slice for every request.
+var chunkBuffers sync.Pool
+
+// getChunkBuffer returns a pooled buffer, or a new one of size bytes if the
+// pool has none that large.
+func getChunkBuffer(size int64) *[]byte {
+	if buf, ok := chunkBuffers.Get().(*[]byte); ok && int64(cap(*buf)) >= size {
+		return buf
+	}
+	buf := make([]byte, size)
+	return &buf
+}
+
+// putChunkBuffer returns a buffer obtained from getChunkBuffer to the pool.
+// The buffer must no longer be used.
+func putChunkBuffer(buf *[]byte) {
+	chunkBuffers.Put(buf)
+}
+
+// writeBlocks writes data to conn in blocks of at most sendBlockSize bytes,
+// giving the client timeout to accept each block. A client that stops reading
+// makes the write fail instead of blocking the handler indefinitely. It
+// returns the number of bytes written. The deadline is cleared afterwards.
+func writeBlocks(conn net.Conn, data []byte, timeout time.Duration) (int64, error) {
+	defer conn.SetWriteDeadline(time.Time{})
+
+	var written int64
+	for len(data) > 0 {
+		block := data
+		if len(block) > sendBlockSize {
+			block = block[:sendBlockSize]
+		}
+		if err := conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+			return written, err
+		}
+		n, err := conn.Write(block)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		data = data[n:]
+	}
+	return written, nil
+}
+
+// sendFiles holds the files a connection sends chunks from with sendfile,
+// keyed by path. Each is opened once per connection, since sendfile reads
+// from and advances the file offset, which handles shared between
+// connections would race on.
+type sendFiles map[string]*os.File
+
+// open returns the connection's handle to the file at path, opening it on
+// first use.
+func (s sendFiles) open(path string) (*os.File, error) {
+	if f, ok := s[path]; ok {
+		return f, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	s[path] = f
+	return f, nil
+}
+
+// close closes every file opened by open.
+func (s sendFiles) close() {
+	for path, f := range s {
+		f.Close()
+		delete(s, path)
+	}
+}
+
+// sendFileBlocks writes size bytes of f starting at offset to conn, like
+// writeBlocks. TCP connections copy the data from f with sendfile where the
+// platform supports it, without it passing through userspace. It returns
+// the number of bytes written.
+func sendFileBlocks(conn *net.TCPConn, f *os.File, offset, size int64, timeout time.Duration) (int64, error) {
+	defer conn.SetWriteDeadline(time.Time{})
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	var written int64
+	for written < size {
+		if err := conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+			return written, err
+		}
+		// ReadFrom only uses sendfile for a file or a LimitedReader of one
+		n, err := conn.ReadFrom(&io.LimitedReader{R: f, N: min(size-written, sendBlockSize)})
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, fmt.Errorf("%s ended after %d of %d bytes: %w", f.Name(), written, size, io.ErrUnexpectedEOF)
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,228 @@
+package peer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+// discardConn is a connection that accepts and drops everything written to
+// it, recording the size of each write.
+type discardConn struct {
+	fuzzConn
+	writes []int
+}
+
+func (c *discardConn) Write(p []byte) (int, error) {
+	if c.writes != nil {
+		c.writes = append(c.writes, len(p))
+	}
+	return len(p), nil
+}
+
+func TestWriteBlocks(t *testing.T) {
+	data := make([]byte, 2*sendBlockSize+10)
+	conn := &discardConn{writes: []int{}}
+	n, err := writeBlocks(conn, data, time.Second)
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("writeBlocks wrote %d of %d bytes, %v", n, len(data), err)
+	}
+	if len(conn.writes) != 3 || conn.writes[0] != sendBlockSize || conn.writes[2] != 10 {
+		t.Fatalf("writeBlocks made writes of %v bytes, want at most %d each", conn.writes, sendBlockSize)
+	}
+
+	// A client that stops reading fails the write once the timeout passes
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	start := time.Now()
+	n, err = writeBlocks(server, data, 20*time.Millisecond)
+	if !errors.Is(err, os.ErrDeadlineExceeded) || n != 0 {
+		t.Fatalf("writing to a stalled client returned %d, %v; want os.ErrDeadlineExceeded", n, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("writing to a stalled client took %v", elapsed)
+	}
+}
+
+// BenchmarkServeChunk serves 256 KB chunks to a connection that discards
+// them, reporting allocations per chunk served. "pooled" is serveChunk, which
+// reads chunks into pooled buffers; "unpooled" allocates a buffer for each
+// chunk with file.GetChunkAt, as seeders did before.
+func BenchmarkServeChunk(b *testing.B) {
+	const chunkSize = 256 << 10
+	data := make([]byte, 16*chunkSize)
+	manifest, err := file.CreateManifestFromReader(bytes.NewReader(data), "bench.bin", int64(len(data)), chunkSize)
+	if err != nil {
+		b.Fatal(err)
+	}
+	store := NewFileStore()
+	if err := store.AddReader(bytes.NewReader(data), manifest.FileSize, manifest); err != nil {
+		b.Fatal(err)
+	}
+	defer store.Close()
+	shared, err := store.Get(manifest.FileHash)
+	if err != nil {
+		b.Fatal(err)
+	}
+	conn := &discardConn{}
+
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(chunkSize)
+		for i := 0; i < b.N; i++ {
+			req := ChunkRequest{Type: TypeChunk, FileHash: manifest.FileHash, ChunkIndex: i % len(manifest.Chunks)}
+			if _, err := serveChunk(conn, shared, req, nil, ServerOptions{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(chunkSize)
+		for i := 0; i < b.N; i++ {
+			index := i % len(manifest.Chunks)
+			chunkData, err := file.GetChunkAt(shared, manifest, index)
+			if err != nil {
+				b.Fatal(err)
+			}
+			resp := ChunkResponse{
+				FileHash:   manifest.FileHash,
+				ChunkSize:  manifest.ChunkSize,
+				ChunkIndex: index,
+				Hash:       manifest.Chunks[index].Hash,
+				Size:       int64(len(chunkData)),
+			}
+			if err := writeMessage(conn, resp); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := conn.Write(chunkData); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// serveTCP serves store on a loopback TCP port until the test ends, and
+// returns the peer to download from.
+func serveTCP(tb testing.TB, store *FileStore, opts ServerOptions) Peer {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- ServeStore(ln, store, opts) }()
+	tb.Cleanup(func() {
+		ln.Close()
+		<-done
+	})
+	return Peer{Address: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port}
+}
+
+func TestZeroCopy(t *testing.T) {
+	path, data, manifest := testManifest(t, 5*testChunkSize+321)
+	store := NewFileStore()
+	if err := store.Add(path, manifest); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	zeroCopy := serveTCP(t, store, ServerOptions{ZeroCopy: true})
+	buffered := serveTCP(t, store, ServerOptions{})
+	tr := TCPTransport{}
+
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	if _, err := DownloadFile(context.Background(), manifest, []Peer{zeroCopy}, outputPath, DownloadOptions{Transport: tr, MaxParallel: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutput(t, outputPath); !bytes.Equal(got, data) {
+		t.Fatal("download from a zero-copy seeder doesn't match")
+	}
+
+	// Chunks sent with sendfile skip verification, so a file damaged on disk
+	// is sent as it is, where the buffered path refuses the chunk
+	damaged := bytes.Clone(data)
+	damaged[10] ^= 0xff
+	if err := os.WriteFile(path, damaged, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if resp, got := requestChunk(t, tr, zeroCopy, manifest, 0); resp.Error != "" || !bytes.Equal(got, damaged[:testChunkSize]) {
+		t.Fatalf("zero-copy seeder answered %+v for chunk 0, want the bytes on disk", resp)
+	}
+	if resp, _ := requestChunk(t, tr, buffered, manifest, 1); resp.Error != "" {
+		t.Fatalf("buffered seeder refused intact chunk 1: %s", resp.Error)
+	}
+
+	// A chunk the file no longer holds in full isn't promised
+	if err := os.Truncate(path, int64(len(data)-100)); err != nil {
+		t.Fatal(err)
+	}
+	last := len(manifest.Chunks) - 1
+	if resp, _ := requestChunk(t, tr, zeroCopy, manifest, last); resp.Error == "" || resp.Size != 0 {
+		t.Fatalf("zero-copy seeder answered %+v for the truncated last chunk, want an error", resp)
+	}
+}
+
+// BenchmarkServeChunkTCP fetches 1 MB chunks of a file on disk over loopback
+// TCP, one connection per run. "zero-copy" sends them with sendfile;
+// "buffered" reads and verifies each chunk in memory first.
+func BenchmarkServeChunkTCP(b *testing.B) {
+	const chunkSize = 1 << 20
+	path, _ := writeTestFile(b, "bench.bin", 16*chunkSize)
+	manifest, err := file.CreateManifest(path, chunkSize)
+	if err != nil {
+		b.Fatal(err)
+	}
+	store := NewFileStore()
+	if err := store.Add(path, manifest); err != nil {
+		b.Fatal(err)
+	}
+	defer store.Close()
+
+	for _, bc := range []struct {
+		name string
+		opts ServerOptions
+	}{{"buffered", ServerOptions{}}, {"zero-copy", ServerOptions{ZeroCopy: true}}} {
+		peer := serveTCP(b, store, bc.opts)
+		b.Run(bc.name, func(b *testing.B) {
+			conn, err := TCPTransport{}.Dial(context.Background(), peer.addr())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+			r := bufio.NewReaderSize(conn, 64<<10)
+			if err := writeMessage(conn, helloFor(manifest)); err != nil {
+				b.Fatal(err)
+			}
+			var ack HelloAck
+			if err := readMessage(r, &ack); err != nil || ack.Error != "" {
+				b.Fatalf("handshake answered %+v, %v", ack, err)
+			}
+
+			b.SetBytes(chunkSize)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				req := ChunkRequest{Type: TypeChunk, FileHash: manifest.FileHash, ChunkIndex: i % len(manifest.Chunks)}
+				if err := writeMessage(conn, req); err != nil {
+					b.Fatal(err)
+				}
+				var resp ChunkResponse
+				if err := readMessage(r, &resp); err != nil || resp.Error != "" {
+					b.Fatalf("chunk request answered %+v, %v", resp, err)
+				}
+				if _, err := io.CopyN(io.Discard, r, resp.Size); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
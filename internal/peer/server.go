@@ -3,75 +3,695 @@
 package peer
 
 import (
+	"bufio"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/timskillet/go-share/internal/file"
 )
 
-// StartFileServer starts a TCP server that listens for incoming chunk requests.
-// It accepts connections on port 9000 and handles them in separate goroutines.
-// The server will continue running until an error occurs or the process is terminated.
-func StartFileServer(filePath string) error {
-	ln, err := net.Listen("tcp", ":9000")
+// DefaultPort is the port StartFileServer listens on unless ServerOptions.Port is set.
+const DefaultPort = 9000
+
+// StartFileServer starts a server that listens for incoming chunk requests.
+// It accepts connections on opts.Port of the given Transport and handles them in
+// separate goroutines. Chunks are served using the layout described by manifest,
+// which must have been created from filePath. Connections from clients that
+// opts doesn't allow are closed before any request is read. The server runs
+// until ctx is cancelled; it then stops listening, closes open connections,
+// waits for their handlers to return, and returns ctx's error.
+func StartFileServer(ctx context.Context, t Transport, filePath string, manifest *file.Manifest, opts ServerOptions) error {
+	store := NewFileStore()
+	if err := store.Add(filePath, manifest); err != nil {
+		return err
+	}
+	defer store.Close()
+
+	return startStoreServer(ctx, t, store, opts)
+}
+
+// StartReaderServer is like StartFileServer, but serves chunks read from src
+// instead of a file on disk. This allows seeding content such as a section of a
+// larger archive or an in-memory buffer. src must hold size bytes matching
+// manifest, and must be safe for concurrent ReadAt calls.
+func StartReaderServer(ctx context.Context, t Transport, src io.ReaderAt, size int64, manifest *file.Manifest, opts ServerOptions) error {
+	store := NewFileStore()
+	if err := store.AddReader(io.NewSectionReader(src, 0, size), size, manifest); err != nil {
+		return err
+	}
+	defer store.Close()
+
+	return startStoreServer(ctx, t, store, opts)
+}
+
+// startStoreServer listens on opts.Port of t and serves the files in store
+// until ctx is done.
+func startStoreServer(ctx context.Context, t Transport, store *FileStore, opts ServerOptions) error {
+	port := opts.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+	ln, err := t.Listen(":" + strconv.Itoa(port))
 	if err != nil {
 		return err
 	}
 	defer ln.Close()
+	defer context.AfterFunc(ctx, func() { ln.Close() })()
 
-	fmt.Printf("Peer server started, serving file: %s\n", filePath)
+	err = ServeStore(ln, store, opts)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Serve accepts connections on ln and serves chunks of manifest's content read
+// from src, handling each connection in its own goroutine. It returns an error
+// wrapping net.ErrClosed once ln is closed, which lets callers stop the server;
+// open connections are then closed, and Serve waits for their handlers to return.
+func Serve(ln net.Listener, src io.ReaderAt, manifest *file.Manifest, opts ServerOptions) error {
+	store := NewFileStore()
+	if err := store.AddReader(io.NewSectionReader(src, 0, manifest.FileSize), manifest.FileSize, manifest); err != nil {
+		return err
+	}
+	defer store.Close()
+	fmt.Printf("Peer server started, serving file: %s\n", manifest.FileName)
+	return ServeStore(ln, store, opts)
+}
+
+// ServeStore is like Serve, but serves every file in store. Each chunk request
+// names the file it wants by hash; requests that don't are answered from the
+// store's only file, if it holds exactly one. Files may be added to and removed
+// from the store while it is being served. Like Serve, it closes open
+// connections and waits for their handlers once ln is closed.
+func ServeStore(ln net.Listener, store *FileStore, opts ServerOptions) error {
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		conns = make(map[net.Conn]struct{}) // Connections being handled
+	)
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				// Interrupt the open connections and let their handlers finish
+				mu.Lock()
+				for c := range conns {
+					c.Close()
+				}
+				mu.Unlock()
+				wg.Wait()
+				return err
+			}
+			continue
+		}
+		if !opts.allowed(conn.RemoteAddr().String()) {
+			fmt.Printf("Rejected connection from %s\n", conn.RemoteAddr())
+			conn.Close()
 			continue
 		}
-		go handleConnection(conn, filePath)
+
+		if opts.OnConnect != nil {
+			opts.OnConnect(conn.RemoteAddr().String())
+		}
+
+		mu.Lock()
+		conns[conn] = struct{}{}
+		mu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handleConnection(conn, store, opts)
+			mu.Lock()
+			delete(conns, conn)
+			mu.Unlock()
+		}()
+	}
+}
+
+// ServerOptions configures how StartFileServer serves a file.
+// The zero value serves every client.
+type ServerOptions struct {
+	// Port is the port StartFileServer and StartReaderServer listen on
+	// (default: DefaultPort). Serve uses the listener it is given instead.
+	Port int
+
+	// Allow, if non-empty, restricts downloads to clients whose IP address is in
+	// one of these networks.
+	Allow []*net.IPNet
+	// Deny rejects clients whose IP address is in one of these networks, even if
+	// they are also allowed.
+	Deny []*net.IPNet
+
+	// OnChunkServed, if set, is called after each chunk has been sent in full,
+	// with the hash of its file, its index, and its size. It is called from the
+	// connection's goroutine, so it must be safe for concurrent use.
+	OnChunkServed func(fileHash string, chunkIndex int, size int64)
+
+	// OnConnect, if set, is called with the client's address for each
+	// connection accepted, before any of its requests are handled. It must be
+	// safe for concurrent use.
+	OnConnect func(remoteAddr string)
+
+	// Stats, if set, is updated with every connection and chunk served.
+	Stats *ServerStats
+
+	// WriteTimeout is how long a client may take to accept each block of chunk
+	// data before its connection is dropped (default: DefaultWriteTimeout).
+	WriteTimeout time.Duration
+
+	// ZeroCopy sends chunks of files added with FileStore.Add straight from
+	// the file to TCP connections with sendfile, so that busy seeders don't
+	// copy every chunk through memory. Chunks sent this way aren't verified
+	// against the manifest first, so a file corrupted on disk is only caught
+	// by downloaders. Other sources and transports are served as usual.
+	ZeroCopy bool
+
+	// ServeManifest answers ManifestRequests with the manifests of the shared
+	// files, so that downloaders who only know a file hash can get its
+	// manifest from peers instead of a tracker. Requests for files the store
+	// doesn't share are refused.
+	ServeManifest bool
+
+	// AccessTokens maps the hashes of private files to the tokens clients
+	// must present, in the handshake or with each request, before the file
+	// is served. Clients without the right token are refused with
+	// ErrAccessDenied and disconnected. Files not listed are served to
+	// every client.
+	AccessTokens map[string]string
+
+	// OnFileGone, if set, is called with a file's hash and the reason when a
+	// chunk read finds that the file was truncated or deleted since it was
+	// shared. The file is no longer served from then on: requests for it are
+	// refused with ErrFileGone rather than answered with bad data. It is
+	// called once per file, from a connection's goroutine.
+	OnFileGone func(fileHash string, err error)
+}
+
+// authorized reports whether token grants access to shared under
+// AccessTokens.
+func (o ServerOptions) authorized(shared *SharedFile, token string) bool {
+	want, ok := o.AccessTokens[shared.hash]
+	return !ok || subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1
+}
+
+// writeTimeout returns the configured WriteTimeout or its default.
+func (o ServerOptions) writeTimeout() time.Duration {
+	if o.WriteTimeout > 0 {
+		return o.WriteTimeout
 	}
+	return DefaultWriteTimeout
 }
 
 // ChunkRequest represents a request from a peer to download a specific chunk of a file.
 // The ChunkIndex field specifies which chunk of the file is being requested.
+// A batch of up to MaxBatchChunks chunks can be requested at once with
+// ChunkIndices, saving a message per chunk on high-latency links; the seeder
+// answers with each of them in turn. ChunkIndex is then the first of them,
+// which is all that seeders predating batches serve (see HelloAck.Batch).
 type ChunkRequest struct {
-	ChunkIndex int `json:"chunkIndex"` // Index of the chunk being requested
+	Type         string `json:"type,omitempty"`         // TypeChunk, or empty for older clients
+	FileHash     string `json:"fileHash,omitempty"`     // File the chunk belongs to, or empty for a single-file seeder
+	ChunkIndex   int    `json:"chunkIndex"`             // Index of the chunk being requested
+	ChunkIndices []int  `json:"chunkIndices,omitempty"` // Indices of a batch of chunks, overriding ChunkIndex
+	Token        string `json:"token,omitempty"`        // Access token of the file, if not given in the handshake
 }
 
-// handleConnection processes an incoming connection from a peer requesting a file chunk.
-// It reads the chunk request, validates it, and sends the requested chunk data.
+// indices returns the chunks req asks for, in the order to serve them.
+func (req ChunkRequest) indices() []int {
+	if len(req.ChunkIndices) > 0 {
+		return req.ChunkIndices
+	}
+	return []int{req.ChunkIndex}
+}
+
+// handleConnection processes an incoming connection from a peer.
+// It reads requests one line at a time, dispatching each by type and writing its
+// response, until the peer closes the connection. Responses are written in request
+// order, so clients may pipeline several requests before reading any responses,
+// and the chunks of a batched request are served one at a time.
+// Each chunk served and a summary of the connection are logged at debug level.
 // The connection is automatically closed when the function returns.
-func handleConnection(conn net.Conn, filePath string) {
+func handleConnection(conn net.Conn, store *FileStore, opts ServerOptions) {
 	defer conn.Close()
 
-	// Read and decode the chunk request
-	var req ChunkRequest
-	if err := json.NewDecoder(conn).Decode(&req); err != nil {
-		fmt.Printf("Error reading chunk request: %v\n", err)
-		return
+	stats := connStats{remote: conn.RemoteAddr().String(), start: time.Now(), server: opts.Stats}
+	stats.opened()
+	defer stats.closed()
+
+	// File named by the connection's handshake, if any
+	var bound *SharedFile
+
+	// Files opened to send chunks from with ZeroCopy
+	var files sendFiles
+	if opts.ZeroCopy {
+		files = make(sendFiles)
+		defer files.close()
+	}
+
+	r := bufio.NewReader(conn)
+	for {
+		// Read the next request, bounded by maxMessageSize
+		line, err := readLine(r)
+		// The peer hung up, or the server is shutting down; connections of
+		// a MemoryTransport report the latter as a closed pipe
+		if err == io.EOF || errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe) {
+			return
+		}
+		if err != nil {
+			fmt.Printf("Error reading request: %v\n", err)
+			return
+		}
+		req, err := decodeRequest(line)
+		if err != nil {
+			fmt.Printf("Error decoding request: %v\n", err)
+			return
+		}
+
+		switch req := req.(type) {
+		case PingRequest:
+			err = writeMessage(conn, PongResponse{Type: TypePong})
+		case HelloRequest:
+			var ack HelloAck
+			bound, ack = hello(store, req, opts)
+			err = writeMessage(conn, ack)
+			if err == nil && ack.Code == codeAccessDenied {
+				fmt.Printf("Refused %s: missing or wrong access token for %s\n", stats.remote, req.FileHash)
+				return
+			}
+		case HaveRequest:
+			ack := have(store, req, opts)
+			err = writeMessage(conn, ack)
+			if err == nil && ack.Code == codeAccessDenied {
+				fmt.Printf("Refused %s: missing or wrong access token for %s\n", stats.remote, req.FileHash)
+				return
+			}
+		case ManifestRequest:
+			err = serveManifest(conn, store, req, opts)
+		case ChunkRequest:
+			shared := bound
+			var lookupErr error
+			if req.FileHash != "" || shared == nil {
+				shared, lookupErr = store.lookup(req.FileHash)
+			}
+			if lookupErr != nil {
+				fmt.Printf("Error finding file: %v\n", lookupErr)
+				shared = nil
+			}
+			// Files not bound by a handshake need the token with the request
+			if shared != nil && shared != bound && !opts.authorized(shared, req.Token) {
+				if err := writeMessage(conn, ChunkResponse{ChunkIndex: req.ChunkIndex, Error: "missing or wrong access token", Code: codeAccessDenied}); err != nil {
+					fmt.Printf("Error sending response: %v\n", err)
+				}
+				fmt.Printf("Refused %s: missing or wrong access token for %s\n", stats.remote, shared.hash)
+				return
+			}
+			indices := req.indices()
+			if len(indices) > MaxBatchChunks {
+				resp := ChunkResponse{
+					ChunkIndex: indices[0],
+					Error:      fmt.Sprintf("too many chunks in batch: %d, at most %d", len(indices), MaxBatchChunks),
+					Code:       codeBatchTooLarge,
+				}
+				if err := writeMessage(conn, resp); err != nil {
+					fmt.Printf("Error sending response: %v\n", err)
+				}
+				return
+			}
+			// Legacy requests leave the hash out, so log the file actually served
+			served := req.FileHash
+			if shared != nil {
+				served = shared.Manifest().FileHash
+			}
+			for _, index := range indices {
+				one := req
+				one.ChunkIndex, one.ChunkIndices = index, nil
+				start := time.Now()
+				var n int64
+				n, err = serveChunk(conn, shared, one, files, opts)
+				stats.logChunk(served, index, n, time.Since(start))
+				if err != nil {
+					break
+				}
+				if n > 0 {
+					manifest := shared.Manifest()
+					stats.record(manifest, n)
+					if opts.OnChunkServed != nil {
+						opts.OnChunkServed(manifest.FileHash, index, n)
+					}
+				}
+			}
+		}
+		if err != nil {
+			fmt.Printf("Error sending response: %v\n", err)
+			return
+		}
+	}
+}
+
+// decodeRequest parses a single request line received from a peer, returning a
+// PingRequest, HelloRequest, HaveRequest, ManifestRequest, or ChunkRequest. Lines come from untrusted peers, so anything other
+// than a well-formed request of a known type is rejected with an error.
+func decodeRequest(line []byte) (interface{}, error) {
+	var header messageHeader
+	if err := json.Unmarshal(line, &header); err != nil {
+		return nil, err
+	}
+
+	switch header.Type {
+	case TypePing:
+		return PingRequest{Type: TypePing}, nil
+	case TypeHello:
+		var req HelloRequest
+		if err := json.Unmarshal(line, &req); err != nil {
+			return nil, fmt.Errorf("invalid hello: %v", err)
+		}
+		return req, nil
+	case TypeHave:
+		var req HaveRequest
+		if err := json.Unmarshal(line, &req); err != nil {
+			return nil, fmt.Errorf("invalid have request: %v", err)
+		}
+		return req, nil
+	case TypeManifest:
+		var req ManifestRequest
+		if err := json.Unmarshal(line, &req); err != nil {
+			return nil, fmt.Errorf("invalid manifest request: %v", err)
+		}
+		return req, nil
+	case "", TypeChunk:
+		var req ChunkRequest
+		if err := json.Unmarshal(line, &req); err != nil {
+			return nil, fmt.Errorf("invalid chunk request: %v", err)
+		}
+		return req, nil
+	default:
+		return nil, fmt.Errorf("unknown request type %q", header.Type)
+	}
+}
+
+// serveManifest answers a ManifestRequest with the manifest of the requested
+// file, if the server serves manifests and shares the file under that hash.
+func serveManifest(conn net.Conn, store *FileStore, req ManifestRequest, opts ServerOptions) error {
+	resp := ManifestResponse{Type: TypeManifestData, FileHash: req.FileHash}
+	if !opts.ServeManifest {
+		resp.Error = "manifests not served"
+		resp.Code = codeManifestNotServed
+		return writeMessage(conn, resp)
 	}
 
-	// Create manifest to get chunk information
-	manifest, err := file.CreateManifest(filePath, file.DefaultChunkSize)
+	// A file that grew since it was shared has a manifest with a new hash,
+	// which isn't the one asked for
+	shared, err := store.Get(req.FileHash)
+	if err != nil || shared.Manifest().FileHash != req.FileHash {
+		resp.Error = "file not shared"
+		resp.Code = codeFileNotShared
+		return writeMessage(conn, resp)
+	}
+	if !opts.authorized(shared, req.Token) {
+		resp.Error = "missing or wrong access token"
+		resp.Code = codeAccessDenied
+		return writeMessage(conn, resp)
+	}
+	if shared.goneErr() != nil {
+		resp.Error = "file is no longer available"
+		resp.Code = codeFileGone
+		return writeMessage(conn, resp)
+	}
+
+	data, err := file.EncodeManifest(shared.Manifest().WithoutAccessToken())
 	if err != nil {
-		fmt.Printf("Error creating manifest: %v\n", err)
-		return
+		fmt.Printf("Error encoding manifest: %v\n", err)
+		resp.Error = "failed to encode manifest"
+		return writeMessage(conn, resp)
+	}
+	resp.Size = int64(len(data))
+	if err := writeMessage(conn, resp); err != nil {
+		return err
+	}
+	_, err = writeBlocks(conn, data, opts.writeTimeout())
+	return err
+}
+
+// hello answers a connection's handshake. It returns the requested file if the
+// store has it with the requested chunk layout and the client may have it, or
+// nil and a rejection otherwise.
+func hello(store *FileStore, req HelloRequest, opts ServerOptions) (*SharedFile, HelloAck) {
+	ack := HelloAck{Type: TypeHelloAck, FileHash: req.FileHash}
+
+	shared, err := store.Get(req.FileHash)
+	if err != nil {
+		ack.Error = "file not shared"
+		ack.Code = codeFileNotShared
+		return nil, ack
+	}
+	if !opts.authorized(shared, req.Token) {
+		ack.Error = "missing or wrong access token"
+		ack.Code = codeAccessDenied
+		return nil, ack
+	}
+	if shared.goneErr() != nil {
+		ack.Error = "file is no longer available"
+		ack.Code = codeFileGone
+		return nil, ack
+	}
+
+	manifest := shared.Manifest()
+	ack.ChunkSize = manifest.ChunkSize
+	ack.Chunking = manifest.Chunking
+	if manifest.ChunkSize != req.ChunkSize || chunkingName(manifest.Chunking) != chunkingName(req.Chunking) {
+		ack.Error = "chunk layout mismatch"
+		ack.Code = codeLayoutMismatch
+		return nil, ack
+	}
+	ack.Batch = true
+	return shared, ack
+}
+
+// have answers a HaveRequest with the chunks the store currently has of the
+// requested file, starting at the requested index.
+func have(store *FileStore, req HaveRequest, opts ServerOptions) HaveAck {
+	ack := HaveAck{Type: TypeHaveAck, FileHash: req.FileHash}
+
+	shared, err := store.lookup(req.FileHash)
+	if err != nil {
+		ack.Error = "file not shared"
+		ack.Code = codeFileNotShared
+		return ack
+	}
+	if !opts.authorized(shared, req.Token) {
+		ack.Error = "missing or wrong access token"
+		ack.Code = codeAccessDenied
+		return ack
+	}
+
+	manifest := shared.Manifest()
+	ack.Total = len(manifest.Chunks)
+	if req.From < 0 || req.From > ack.Total {
+		ack.Error = fmt.Sprintf("invalid chunk index: %d", req.From)
+		ack.Code = codeInvalidChunkIndex
+		return ack
+	}
+	end := req.From + maxHaveChunks
+	if end > ack.Total {
+		end = ack.Total
+	}
+	ack.Chunks = manifest.Chunks[req.From:end]
+	return ack
+}
+
+// serveChunk reads the requested chunk of shared and writes it to conn,
+// preceded by a ChunkResponse header describing the chunk and the file being
+// served. A nil shared means the requested file isn't served. Chunks that can't
+// be served are reported in the header's Error field; the returned error is only
+// set if writing to conn failed. It returns the number of chunk data bytes written.
+// The chunk is read into a pooled buffer and written in bounded blocks, each of
+// which the client must accept within opts.WriteTimeout. With files, chunks of
+// a file on disk are sent to TCP connections with sendfile instead, unverified.
+// Content that ends before the chunk does was truncated since it was shared,
+// so the file stops being served, as described for ServerOptions.OnFileGone.
+func serveChunk(conn net.Conn, shared *SharedFile, req ChunkRequest, files sendFiles, opts ServerOptions) (int64, error) {
+	if shared == nil {
+		return 0, writeMessage(conn, ChunkResponse{
+			FileHash:   req.FileHash,
+			ChunkIndex: req.ChunkIndex,
+			Error:      "file not shared",
+			Code:       codeFileNotShared,
+		})
+	}
+
+	manifest := shared.Manifest()
+	resp := ChunkResponse{
+		FileHash:   manifest.FileHash,
+		ChunkSize:  manifest.ChunkSize,
+		ChunkIndex: req.ChunkIndex,
+	}
+
+	if shared.goneErr() != nil {
+		resp.Error = "file is no longer available"
+		resp.Code = codeFileGone
+		return 0, writeMessage(conn, resp)
 	}
 
 	// Find the requested chunk
 	if req.ChunkIndex < 0 || req.ChunkIndex >= len(manifest.Chunks) {
 		fmt.Printf("Invalid chunk index: %d\n", req.ChunkIndex)
-		return
+		resp.Error = fmt.Sprintf("invalid chunk index: %d", req.ChunkIndex)
+		resp.Code = codeInvalidChunkIndex
+		return 0, writeMessage(conn, resp)
 	}
 
-	// Read the chunk data
-	chunkData, err := file.GetChunk(filePath, manifest, req.ChunkIndex)
+	if tcp, ok := conn.(*net.TCPConn); ok && files != nil {
+		if path, base, ok := shared.diskFile(); ok {
+			return sendChunkFile(tcp, files, shared, path, base, manifest.Chunks[req.ChunkIndex], resp, opts)
+		}
+	}
+
+	// Read the chunk data into a reusable buffer
+	buf := getChunkBuffer(manifest.Chunks[req.ChunkIndex].Size)
+	defer putChunkBuffer(buf)
+	chunkData, err := file.ReadChunkAt(shared, manifest, req.ChunkIndex, *buf)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		fileGone(shared, fmt.Errorf("%w: content ends before chunk %d: %v", ErrFileGone, req.ChunkIndex, err), opts)
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, ErrFileGone) {
+		resp.Error = "file is no longer available"
+		resp.Code = codeFileGone
+		return 0, writeMessage(conn, resp)
+	}
 	if err != nil {
 		fmt.Printf("Error reading chunk: %v\n", err)
-		return
+		resp.Error = "failed to read chunk"
+		return 0, writeMessage(conn, resp)
+	}
+
+	// Send the header followed by the chunk data. The header describes the
+	// chunk exactly as the manifest records it, which is what clients check it
+	// against; GetChunkAt returned exactly that many bytes.
+	chunk := manifest.Chunks[req.ChunkIndex]
+	resp.Hash = chunk.Hash
+	resp.Size = chunk.Size
+	if int64(len(chunkData)) != chunk.Size {
+		fmt.Printf("Error reading chunk %d: got %d bytes, expected %d\n", req.ChunkIndex, len(chunkData), chunk.Size)
+		return 0, writeMessage(conn, ChunkResponse{
+			FileHash:   resp.FileHash,
+			ChunkSize:  resp.ChunkSize,
+			ChunkIndex: resp.ChunkIndex,
+			Error:      "failed to read chunk",
+		})
+	}
+	if err := writeMessage(conn, resp); err != nil {
+		return 0, err
+	}
+	return writeBlocks(conn, chunkData, opts.writeTimeout())
+}
+
+// sendChunkFile is serveChunk's zero-copy path: it sends chunk of shared's
+// content, stored in the file at path from offset base, with sendfile.
+func sendChunkFile(conn *net.TCPConn, files sendFiles, shared *SharedFile, path string, base int64, chunk file.Chunk, resp ChunkResponse, opts ServerOptions) (int64, error) {
+	// Only promise the chunk if the file still holds all of it
+	f, err := files.open(path)
+	var info os.FileInfo
+	if err == nil {
+		info, err = f.Stat()
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		err = fmt.Errorf("%w: %s was deleted", ErrFileGone, path)
+	} else if err == nil && info.Size() < base+chunk.Offset+chunk.Size {
+		err = fmt.Errorf("%w: %s has %d bytes, too few for chunk %d", ErrFileGone, path, info.Size(), resp.ChunkIndex)
+	}
+	if errors.Is(err, ErrFileGone) {
+		fileGone(shared, err, opts)
+		resp.Error = "file is no longer available"
+		resp.Code = codeFileGone
+		return 0, writeMessage(conn, resp)
+	}
+	if err != nil {
+		fmt.Printf("Error reading chunk: %v\n", err)
+		resp.Error = "failed to read chunk"
+		return 0, writeMessage(conn, resp)
+	}
+
+	resp.Hash = chunk.Hash
+	resp.Size = chunk.Size
+	if err := writeMessage(conn, resp); err != nil {
+		return 0, err
 	}
+	return sendFileBlocks(conn, f, base+chunk.Offset, chunk.Size, opts.writeTimeout())
+}
 
-	// Send the chunk data
-	if _, err := conn.Write(chunkData); err != nil {
-		fmt.Printf("Error sending chunk: %v\n", err)
+// fileGone stops serving shared for reason, wrapping ErrFileGone, and
+// notifies opts.OnFileGone the first time.
+func fileGone(shared *SharedFile, reason error, opts ServerOptions) {
+	if !shared.markGone(reason) {
 		return
 	}
+	fmt.Printf("Stopped serving %s: %v\n", shared.Manifest().FileName, reason)
+	if opts.OnFileGone != nil {
+		opts.OnFileGone(shared.hash, reason)
+	}
+}
+
+// connStats accumulates what was served over one connection for debug logging,
+// and feeds the server-wide ServerStats if there is one.
+type connStats struct {
+	remote   string
+	start    time.Time
+	requests int
+	bytes    int64
+	server   *ServerStats // Server-wide totals to update, or nil
+}
+
+// opened records the connection in the server-wide totals.
+func (s *connStats) opened() {
+	if s.server != nil {
+		s.server.connOpened()
+	}
+}
+
+// closed logs the connection's totals and removes it from the server-wide ones.
+func (s *connStats) closed() {
+	s.logSummary()
+	if s.server != nil {
+		s.server.connClosed()
+	}
+}
+
+// record adds n bytes sent in full from manifest's file to the server-wide totals.
+func (s *connStats) record(manifest *file.Manifest, n int64) {
+	if s.server != nil {
+		s.server.chunkServed(manifest.FileHash, manifest.FileName, n)
+	}
+}
+
+// logChunk records a request for chunk index of the file with hash fileHash
+// and logs it at debug level.
+func (s *connStats) logChunk(fileHash string, index int, n int64, elapsed time.Duration) {
+	s.requests++
+	s.bytes += n
+	slog.Debug("served chunk",
+		"peer", s.remote,
+		"file", fileHash,
+		"chunk", index,
+		"bytes", n,
+		"duration", elapsed)
+}
+
+// logSummary logs the totals for the connection at debug level.
+func (s *connStats) logSummary() {
+	slog.Debug("connection closed",
+		"peer", s.remote,
+		"requests", s.requests,
+		"bytes", s.bytes,
+		"duration", time.Since(s.start))
 }
@@ -0,0 +1,473 @@
+package peer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use, for capturing logs
+// written by server goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// records decodes the JSON log records written so far.
+func (b *syncBuffer) records(t *testing.T) []map[string]any {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var records []map[string]any
+	dec := json.NewDecoder(bytes.NewReader(b.buf.Bytes()))
+	for dec.More() {
+		var r map[string]any
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+// captureLogs sends the default logger's records at level and above to the
+// returned buffer as JSON until the test ends.
+func captureLogs(t *testing.T, level slog.Level) *syncBuffer {
+	buf := &syncBuffer{}
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: level})))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return buf
+}
+
+func TestServerLogsChunksAtDebugLevel(t *testing.T) {
+	logs := captureLogs(t, slog.LevelDebug)
+	tr := NewMemoryTransport()
+	path, _, manifest := testManifest(t, 2*testChunkSize+10)
+	peer := serveFile(t, tr, 9000, path, manifest, ServerOptions{})
+
+	if _, err := DownloadChunks(context.Background(), tr, peer, manifest, []int{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The summary is logged once the server sees the connection close
+	var served, closed map[string]any
+	for deadline := time.Now().Add(time.Second); closed == nil && time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		for _, r := range logs.records(t) {
+			switch r["msg"] {
+			case "served chunk":
+				served = r
+			case "connection closed":
+				closed = r
+			}
+		}
+	}
+	if served == nil || closed == nil {
+		t.Fatalf("logged %v, want a served chunk and a connection summary", logs.records(t))
+	}
+	if served["chunk"] != 2.0 || served["bytes"] != 10.0 || served["peer"] == "" || served["duration"] == nil {
+		t.Errorf("served chunk record %v, want chunk 2 of 10 bytes with its peer and duration", served)
+	}
+	if closed["requests"] != 1.0 || closed["bytes"] != 10.0 {
+		t.Errorf("connection summary %v, want 1 request of 10 bytes", closed)
+	}
+}
+
+func TestServerLogsServedFileForLegacyRequest(t *testing.T) {
+	logs := captureLogs(t, slog.LevelDebug)
+	tr := NewMemoryTransport()
+	path, _, manifest := testManifest(t, testChunkSize)
+	peer := serveFile(t, tr, 9000, path, manifest, ServerOptions{})
+
+	// A request without a handshake or a hash is for the seeder's only file
+	conn, err := tr.Dial(context.Background(), peer.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := writeMessages(conn, ChunkRequest{Type: TypeChunk, ChunkIndex: 0}); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	var resp ChunkResponse
+	if err := readMessage(r, &resp); err != nil || resp.Error != "" {
+		t.Fatalf("legacy request answered %+v, %v", resp, err)
+	}
+	if _, err := io.CopyN(io.Discard, r, resp.Size); err != nil {
+		t.Fatal(err)
+	}
+
+	var served map[string]any
+	for deadline := time.Now().Add(time.Second); served == nil && time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		for _, r := range logs.records(t) {
+			if r["msg"] == "served chunk" {
+				served = r
+			}
+		}
+	}
+	if served == nil || served["file"] != manifest.FileHash {
+		t.Fatalf("served chunk record %v, want the hash of the file served", served)
+	}
+}
+
+func TestServerDoesNotLogChunksAtInfoLevel(t *testing.T) {
+	logs := captureLogs(t, slog.LevelInfo)
+	tr := NewMemoryTransport()
+	path, _, manifest := testManifest(t, testChunkSize)
+	peer := serveFile(t, tr, 9000, path, manifest, ServerOptions{})
+
+	if _, err := DownloadChunks(context.Background(), tr, peer, manifest, []int{0}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if records := logs.records(t); len(records) != 0 {
+		t.Fatalf("logged %v at info level", records)
+	}
+}
+
+// requestChunk sends a handshake and a request for chunk index of manifest's
+// file to peer over tr, and returns the seeder's response header and the data
+// following it.
+func requestChunk(t *testing.T, tr Transport, peer Peer, manifest *file.Manifest, index int) (ChunkResponse, []byte) {
+	t.Helper()
+	conn, err := tr.Dial(context.Background(), peer.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req := ChunkRequest{Type: TypeChunk, FileHash: manifest.FileHash, ChunkIndex: index}
+	if err := writeMessages(conn, helloFor(manifest), req); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	var ack HelloAck
+	if err := readMessage(r, &ack); err != nil || ack.Error != "" {
+		t.Fatalf("handshake answered %+v, %v", ack, err)
+	}
+	var resp ChunkResponse
+	if err := readMessage(r, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error != "" {
+		return resp, nil
+	}
+	data, err := readChunkData(r, resp.Size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, data
+}
+
+func TestServeLastChunkExactSize(t *testing.T) {
+	tr := NewMemoryTransport()
+	path, data, manifest := testManifest(t, 3*testChunkSize+123)
+	peer := serveFile(t, tr, 9000, path, manifest, ServerOptions{})
+
+	// The short last chunk comes with exactly the size and hash the
+	// client's manifest records for it
+	last := len(manifest.Chunks) - 1
+	resp, got := requestChunk(t, tr, peer, manifest, last)
+	if resp.Error != "" || resp.ChunkIndex != last || resp.Size != 123 || resp.Hash != manifest.Chunks[last].Hash {
+		t.Fatalf("seeder answered %+v for the last chunk, want 123 bytes with its hash", resp)
+	}
+	if !bytes.Equal(got, data[3*testChunkSize:]) {
+		t.Fatal("last chunk doesn't hold the file's tail")
+	}
+	if resp, _ := requestChunk(t, tr, peer, manifest, last+1); resp.Error == "" {
+		t.Fatalf("seeder answered %+v for a chunk past the end", resp)
+	}
+
+	// A source that ends early fails the chunk instead of serving it short,
+	// and is withdrawn as gone
+	store := NewFileStore()
+	if err := store.AddReader(bytes.NewReader(data[:len(data)-10]), manifest.FileSize, manifest); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	truncated := serveStore(t, tr, 9001, store, ServerOptions{})
+	if resp, got := requestChunk(t, tr, truncated, manifest, 0); resp.Error != "" || !bytes.Equal(got, data[:testChunkSize]) {
+		t.Fatalf("seeder of a truncated source answered %+v for a whole chunk", resp)
+	}
+	if resp, got := requestChunk(t, tr, truncated, manifest, last); resp.Error == "" {
+		t.Fatalf("seeder of a truncated source served %d bytes of the last chunk", len(got))
+	}
+	if ack := handshake(t, tr, truncated, helloFor(manifest)); ack.Code != codeFileGone {
+		t.Fatalf("seeder answered %+v after its source ended early, want the file gone", ack)
+	}
+}
+
+func TestStartFileServerStopsOnCancel(t *testing.T) {
+	path, _, manifest := testManifest(t, 2*testChunkSize)
+	// Find a free TCP port
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	var tr TCPTransport
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- StartFileServer(ctx, tr, path, manifest, ServerOptions{Port: port}) }()
+	peer := Peer{Address: "127.0.0.1", Port: port}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(5 * time.Millisecond) {
+		if _, err := Ping(context.Background(), tr, peer); err == nil {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("file server didn't start: %v", err)
+		}
+	}
+
+	// A client that connected and went quiet doesn't keep the server running
+	idle, err := net.Dial("tcp", peer.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("StartFileServer returned %v after cancel, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("StartFileServer still running after cancel")
+	}
+	idle.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := idle.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("idle connection read %v after the server stopped, want io.EOF", err)
+	}
+
+	// The port is free again
+	ln, err = net.Listen("tcp", peer.addr())
+	if err != nil {
+		t.Fatalf("port still in use after the server stopped: %v", err)
+	}
+	ln.Close()
+}
+
+func TestStartReaderServerFromBuffer(t *testing.T) {
+	// Seed the middle of a larger in-memory buffer, as for a file inside an archive
+	archive := make([]byte, 5*testChunkSize)
+	rand.New(rand.NewSource(1)).Read(archive)
+	data := archive[testChunkSize : 4*testChunkSize-100]
+	manifest, err := file.CreateManifestFromReader(bytes.NewReader(data), "section.bin", int64(len(data)), testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := io.NewSectionReader(bytes.NewReader(archive), testChunkSize, int64(len(data)))
+
+	tr := NewMemoryTransport()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- StartReaderServer(ctx, tr, src, int64(len(data)), manifest, ServerOptions{Port: 9000}) }()
+	peer := Peer{Address: "localhost", Port: 9000}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(5 * time.Millisecond) {
+		if _, err := Ping(context.Background(), tr, peer); err == nil {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("reader server didn't start: %v", err)
+		}
+	}
+
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	if _, err := DownloadFile(context.Background(), manifest, []Peer{peer}, outputPath, DownloadOptions{Transport: tr}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutput(t, outputPath); !bytes.Equal(got, data) {
+		t.Fatal("file downloaded from a reader doesn't match its content")
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("StartReaderServer returned %v after cancel, want context.Canceled", err)
+	}
+	if _, err := Ping(context.Background(), tr, peer); err == nil {
+		t.Fatal("reader server still answers after it stopped")
+	}
+}
+
+func TestStartReaderServerRejectsWrongSize(t *testing.T) {
+	data := make([]byte, testChunkSize)
+	manifest, err := file.CreateManifestFromReader(bytes.NewReader(data), "zeros.bin", int64(len(data)), testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = StartReaderServer(context.Background(), NewMemoryTransport(), bytes.NewReader(data), int64(len(data))-1, manifest, ServerOptions{Port: 9000})
+	if err == nil {
+		t.Fatal("StartReaderServer accepted a source shorter than the manifest")
+	}
+}
+
+// fuzzConn is a connection whose peer sent in and then hung up. Everything
+// written to it is kept in out.
+type fuzzConn struct {
+	in  *bytes.Reader
+	out bytes.Buffer
+}
+
+func (c *fuzzConn) Read(p []byte) (int, error)  { return c.in.Read(p) }
+func (c *fuzzConn) Write(p []byte) (int, error) { return c.out.Write(p) }
+func (c *fuzzConn) Close() error                { return nil }
+func (c *fuzzConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: DefaultPort}
+}
+func (c *fuzzConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+}
+func (c *fuzzConn) SetDeadline(t time.Time) error      { return nil }
+func (c *fuzzConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *fuzzConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// FuzzHandleRequest feeds arbitrary request bytes from a peer to a seeder's
+// connection handler. Whatever arrives, the handler must neither panic nor
+// hang, and it must only answer well-formed requests.
+func FuzzHandleRequest(f *testing.F) {
+	path, _, manifest := testManifest(f, 2*testChunkSize+10)
+	store := NewFileStore()
+	if err := store.Add(path, manifest); err != nil {
+		f.Fatal(err)
+	}
+	f.Cleanup(func() { store.Close() })
+	opts := ServerOptions{ServeManifest: true}
+
+	f.Fuzz(func(t *testing.T, in []byte) {
+		conn := &fuzzConn{in: bytes.NewReader(in)}
+		handleConnection(conn, store, opts)
+
+		if conn.out.Len() == 0 {
+			return
+		}
+		// Only a complete request line of up to maxMessageSize bytes that
+		// decodes as a request may be answered
+		first, _, found := bytes.Cut(in, []byte("\n"))
+		if !found || len(first) >= maxMessageSize {
+			t.Fatalf("answered an incomplete or %d byte request line", len(first))
+		}
+		if _, err := decodeRequest(first); err != nil {
+			t.Fatalf("answered %q, which doesn't decode: %v", first, err)
+		}
+	})
+}
+
+func TestAccessTokens(t *testing.T) {
+	tr := NewMemoryTransport()
+	privatePath, private, privateManifest := testManifest(t, 3*testChunkSize+5)
+	publicPath, _ := writeTestFile(t, "public.bin", 2*testChunkSize)
+	publicManifest, err := file.CreateManifest(publicPath, testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewFileStore()
+	defer store.Close()
+	for path, manifest := range map[string]*file.Manifest{privatePath: privateManifest, publicPath: publicManifest} {
+		if err := store.Add(path, manifest); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := ServerOptions{ServeManifest: true, AccessTokens: map[string]string{privateManifest.FileHash: "secret"}}
+	seeder := serveStore(t, tr, 9000, store, opts)
+	ctx := context.Background()
+
+	// Anyone holding the manifest with its token can download the file
+	withToken := *privateManifest
+	withToken.AccessToken = "secret"
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	if _, err := DownloadFile(ctx, &withToken, []Peer{seeder}, outputPath, DownloadOptions{Transport: tr}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutput(t, outputPath); !bytes.Equal(got, private) {
+		t.Fatal("download with the access token doesn't match")
+	}
+	if _, err := DownloadFile(ctx, publicManifest, []Peer{seeder}, filepath.Join(t.TempDir(), "public.bin"), DownloadOptions{Transport: tr}); err != nil {
+		t.Fatalf("file without a token wasn't served to everyone: %v", err)
+	}
+
+	// Without the token, or with the wrong one, every request is refused
+	for _, token := range []string{"", "wrong"} {
+		m := *privateManifest
+		m.AccessToken = token
+		_, err := DownloadFile(ctx, &m, []Peer{seeder}, filepath.Join(t.TempDir(), "out.bin"), DownloadOptions{Transport: tr})
+		if !errors.Is(err, ErrAccessDenied) {
+			t.Errorf("download with token %q returned %v, want ErrAccessDenied", token, err)
+		}
+		if _, err := Refresh(ctx, tr, seeder, &m); !errors.Is(err, ErrAccessDenied) {
+			t.Errorf("have request with token %q returned %v, want ErrAccessDenied", token, err)
+		}
+		if _, err := FetchManifest(ctx, tr, seeder, m.FileHash, token, 0); !errors.Is(err, ErrAccessDenied) {
+			t.Errorf("manifest request with token %q returned %v, want ErrAccessDenied", token, err)
+		}
+	}
+
+	// The manifest is handed out without the token
+	fetched, err := FetchManifest(ctx, tr, seeder, privateManifest.FileHash, "secret", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetched.AccessToken != "" || fetched.FileHash != privateManifest.FileHash {
+		t.Fatalf("manifest served with token %q for %s", fetched.AccessToken, fetched.FileHash)
+	}
+}
+
+func TestAccessTokenWithoutHandshake(t *testing.T) {
+	tr := NewMemoryTransport()
+	path, data, manifest := testManifest(t, 2*testChunkSize)
+	seeder := serveFile(t, tr, 9000, path, manifest, ServerOptions{AccessTokens: map[string]string{manifest.FileHash: "secret"}})
+
+	// request sends a chunk request naming the file without a handshake
+	request := func(token string) (ChunkResponse, *bufio.Reader) {
+		t.Helper()
+		conn, err := tr.Dial(context.Background(), seeder.addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		if err := writeMessage(conn, ChunkRequest{Type: TypeChunk, FileHash: manifest.FileHash, ChunkIndex: 1, Token: token}); err != nil {
+			t.Fatal(err)
+		}
+		r := bufio.NewReader(conn)
+		var resp ChunkResponse
+		if err := readMessage(r, &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp, r
+	}
+
+	resp, r := request("secret")
+	if resp.Error != "" {
+		t.Fatalf("request with the token refused: %s", resp.Error)
+	}
+	if got, err := readChunkData(r, resp.Size); err != nil || !bytes.Equal(got, data[testChunkSize:]) {
+		t.Fatalf("request with the token got %d bytes, %v", len(got), err)
+	}
+
+	// A client without the token is refused and disconnected
+	resp, r = request("wrong")
+	if resp.Code != codeAccessDenied || !errors.Is(errorForCode(resp.Code), ErrAccessDenied) {
+		t.Fatalf("request with the wrong token answered %+v", resp)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("connection still open after a refused request: %v", err)
+	}
+}
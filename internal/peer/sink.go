@@ -0,0 +1,113 @@
+// Package peer implements the peer-to-peer file sharing functionality.
+// It provides both client and server capabilities for sharing files between peers.
+package peer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+// ChunkSink is where a download stores the chunks it receives. DownloadFile
+// writes to a file through a sink returned by NewFileSink; DownloadToSink
+// accepts any sink, so that downloads can feed other storage such as an
+// object store, a database, or memory.
+type ChunkSink interface {
+	// WriteChunkAt stores the data of the chunk at index in the manifest.
+	// Chunks arrive verified, in any order, and concurrently when several are
+	// downloaded at once; each chunk is written once.
+	WriteChunkAt(index int, data []byte) error
+	// Finalize is called once after every chunk has been written, to make
+	// the data durable. It is not called if the download fails.
+	Finalize() error
+}
+
+// fileSink is a ChunkSink writing each chunk at its offset in a file.
+type fileSink struct {
+	f        *os.File
+	manifest *file.Manifest
+}
+
+// NewFileSink returns a ChunkSink that writes each chunk of manifest at its
+// offset in f, and flushes f to disk on Finalize. Write failures caused by a
+// full disk wrap ErrDiskFull. f is not closed.
+func NewFileSink(f *os.File, manifest *file.Manifest) ChunkSink {
+	return fileSink{f: f, manifest: manifest}
+}
+
+func (s fileSink) WriteChunkAt(index int, data []byte) error {
+	if _, err := s.f.WriteAt(data, s.manifest.Chunks[index].Offset); err != nil {
+		return fmt.Errorf("failed to write chunk to file: %w", classifyWriteError(err))
+	}
+	return nil
+}
+
+// hashingSink passes chunks on to a ChunkSink, computing the whole-file hash
+// as long as they are written in file order; see file.FileHasher.
+type hashingSink struct {
+	ChunkSink
+	mu     sync.Mutex
+	hasher *file.FileHasher
+}
+
+func (s *hashingSink) WriteChunkAt(index int, data []byte) error {
+	if err := s.ChunkSink.WriteChunkAt(index, data); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hasher.WriteChunk(index, data)
+	return nil
+}
+
+// verified reports whether every chunk was written in order and the chunks
+// match the manifest's file hash.
+func (s *hashingSink) verified() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hasher.Verify()
+}
+
+func (s fileSink) Finalize() error {
+	if err := s.f.Sync(); err != nil {
+		return fmt.Errorf("failed to flush output file: %w", classifyWriteError(err))
+	}
+	return nil
+}
+
+// DownloadToSink downloads every chunk of manifest's file from peers and
+// stores it in sink, then calls sink.Finalize. Every chunk is verified before
+// it is handed to the sink, so SkipChunkVerify can't be used; VerifyAfter and
+// RepairOnFailure don't apply, since the sink can't be read back. A directory
+// manifest's content is stored as the single stream it is shared as. If the
+// download fails or ctx is done, Finalize isn't called and the sink may hold
+// some of the chunks. On success it returns a summary like DownloadFile.
+func DownloadToSink(ctx context.Context, manifest *file.Manifest, peers []Peer, sink ChunkSink, opts DownloadOptions) (*DownloadResult, error) {
+	start := time.Now()
+	if opts.SkipChunkVerify {
+		return nil, errors.New("SkipChunkVerify can't be used when downloading to a sink, which can't be verified afterwards")
+	}
+	if err := manifest.CheckHashKey(); err != nil {
+		return nil, err
+	}
+	opts = opts.withDefaults()
+
+	pending := make([]int, len(manifest.Chunks))
+	for i := range pending {
+		pending[i] = i
+	}
+	result, err := fetchInto(ctx, manifest, peers, sink, pending, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := sink.Finalize(); err != nil {
+		return nil, err
+	}
+	result.Duration = time.Since(start)
+	return result, nil
+}
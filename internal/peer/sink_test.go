@@ -0,0 +1,155 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// memSink is a ChunkSink keeping chunks in memory.
+type memSink struct {
+	mu        sync.Mutex
+	chunks    map[int][]byte
+	writes    int
+	finalized int
+}
+
+func newMemSink() *memSink {
+	return &memSink{chunks: make(map[int][]byte)}
+}
+
+func (s *memSink) WriteChunkAt(index int, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.chunks[index] = bytes.Clone(data)
+	s.writes++
+	return nil
+}
+
+func (s *memSink) Finalize() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.finalized++
+	return nil
+}
+
+// content joins the chunks in index order.
+func (s *memSink) content() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var buf bytes.Buffer
+	for i := 0; i < len(s.chunks); i++ {
+		buf.Write(s.chunks[i])
+	}
+	return buf.Bytes()
+}
+
+func TestDownloadToSink(t *testing.T) {
+	mem := NewMemoryTransport()
+	path, data, manifest := testManifest(t, 5*testChunkSize+9)
+	// Chunks from port 9001 arrive corrupted and must never reach the sink
+	corruptPeer := serveFile(t, mem, 9001, path, manifest, ServerOptions{})
+	goodPeer := serveFile(t, mem, 9002, path, manifest, ServerOptions{})
+	tr := portTransport{base: mem, byPort: map[int]Transport{9001: corruptTransport{mem}}}
+
+	sink := newMemSink()
+	opts := DownloadOptions{Transport: tr, MaxParallel: 3}
+	result, err := DownloadToSink(context.Background(), manifest, []Peer{corruptPeer, goodPeer}, sink, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sink.writes != len(manifest.Chunks) || sink.finalized != 1 {
+		t.Fatalf("sink got %d writes and %d finalizations, want %d and 1", sink.writes, sink.finalized, len(manifest.Chunks))
+	}
+	if !bytes.Equal(sink.content(), data) {
+		t.Fatal("sink content doesn't match the file")
+	}
+	if result.Bytes != manifest.FileSize {
+		t.Fatalf("result counts %d bytes, want %d", result.Bytes, manifest.FileSize)
+	}
+}
+
+func TestDownloadToSinkFailure(t *testing.T) {
+	_, _, manifest := testManifest(t, 2*testChunkSize)
+	tr := NewMemoryTransport()
+
+	sink := newMemSink()
+	if _, err := DownloadToSink(context.Background(), manifest, []Peer{{Address: "localhost", Port: 9000}}, sink, DownloadOptions{Transport: tr}); err == nil {
+		t.Fatal("download from an unreachable peer succeeded")
+	}
+	if sink.finalized != 0 {
+		t.Fatal("sink finalized after a failed download")
+	}
+
+	_, err := DownloadToSink(context.Background(), manifest, nil, sink, DownloadOptions{Transport: tr, SkipChunkVerify: true})
+	if err == nil {
+		t.Fatal("download to a sink without chunk verification started")
+	}
+}
+
+// failingSink is a ChunkSink whose writes fail.
+type failingSink struct{ *memSink }
+
+func (failingSink) WriteChunkAt(index int, data []byte) error {
+	return errors.New("storage unavailable")
+}
+
+func TestDownloadToSinkWriteError(t *testing.T) {
+	tr := NewMemoryTransport()
+	path, _, manifest := testManifest(t, 2*testChunkSize)
+	peer := serveFile(t, tr, 9000, path, manifest, ServerOptions{})
+
+	sink := failingSink{newMemSink()}
+	if _, err := DownloadToSink(context.Background(), manifest, []Peer{peer}, sink, DownloadOptions{Transport: tr}); err == nil {
+		t.Fatal("download succeeded though the sink couldn't store any chunk")
+	}
+	if sink.finalized != 0 {
+		t.Fatal("sink finalized after its writes failed")
+	}
+}
+
+func TestHashingSink(t *testing.T) {
+	_, data, manifest := testManifest(t, 3*testChunkSize+50)
+	chunk := func(i int) []byte {
+		c := manifest.Chunks[i]
+		return data[c.Offset : c.Offset+c.Size]
+	}
+
+	for _, tc := range []struct {
+		name  string
+		order []int
+		want  bool
+	}{
+		{"in order", []int{0, 1, 2, 3}, true},
+		{"out of order", []int{1, 0, 2, 3}, false},
+		{"incomplete", []int{0, 1, 2}, false},
+	} {
+		mem := newMemSink()
+		sink := &hashingSink{ChunkSink: mem, hasher: manifest.NewFileHasher()}
+		for _, i := range tc.order {
+			if err := sink.WriteChunkAt(i, chunk(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := sink.verified(); got != tc.want {
+			t.Errorf("%s: verified() = %v, want %v", tc.name, got, tc.want)
+		}
+		// Every chunk reaches the sink underneath, whatever the order
+		if mem.writes != len(tc.order) {
+			t.Errorf("%s: %d chunks reached the sink, want %d", tc.name, mem.writes, len(tc.order))
+		}
+	}
+
+	// Chunks the sink underneath refuses aren't hashed
+	sink := &hashingSink{ChunkSink: failingSink{newMemSink()}, hasher: manifest.NewFileHasher()}
+	for i := range manifest.Chunks {
+		if err := sink.WriteChunkAt(i, chunk(i)); err == nil {
+			t.Fatal("hashing sink hid the write error")
+		}
+	}
+	if sink.verified() {
+		t.Fatal("hashing sink verified chunks that weren't stored")
+	}
+}
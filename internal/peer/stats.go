@@ -0,0 +1,102 @@
+// Package peer implements the peer-to-peer file sharing functionality.
+// It provides both client and server capabilities for sharing files between peers.
+package peer
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ServerStats counts what a server has served. Pass it in ServerOptions.Stats
+// to have a server update it; it is safe for concurrent use, and can be served
+// over HTTP as a JSON StatsSnapshot.
+type ServerStats struct {
+	mu      sync.Mutex
+	started time.Time
+	chunks  int64
+	bytes   int64
+	active  int
+	files   map[string]*FileStats
+}
+
+// FileStats is the part of a StatsSnapshot about a single file.
+type FileStats struct {
+	FileName     string `json:"fileName"`
+	ChunksServed int64  `json:"chunksServed"`
+	BytesServed  int64  `json:"bytesServed"`
+}
+
+// StatsSnapshot is the state of a ServerStats at one point in time.
+type StatsSnapshot struct {
+	Uptime            string               `json:"uptime"`
+	ChunksServed      int64                `json:"chunksServed"`
+	BytesServed       int64                `json:"bytesServed"`
+	ActiveConnections int                  `json:"activeConnections"`
+	Files             map[string]FileStats `json:"files"` // Keyed by file hash
+}
+
+// NewServerStats creates an empty ServerStats.
+func NewServerStats() *ServerStats {
+	return &ServerStats{started: time.Now(), files: make(map[string]*FileStats)}
+}
+
+// connOpened records a newly accepted connection.
+func (s *ServerStats) connOpened() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active++
+}
+
+// connClosed records that a connection has ended.
+func (s *ServerStats) connClosed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active--
+}
+
+// chunkServed records n bytes of a chunk of the named file having been sent.
+func (s *ServerStats) chunkServed(fileHash, fileName string, n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.chunks++
+	s.bytes += n
+	f, ok := s.files[fileHash]
+	if !ok {
+		f = &FileStats{FileName: fileName}
+		s.files[fileHash] = f
+	}
+	f.ChunksServed++
+	f.BytesServed += n
+}
+
+// Snapshot returns the current counts.
+func (s *ServerStats) Snapshot() StatsSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap := StatsSnapshot{
+		Uptime:            time.Since(s.started).Round(time.Second).String(),
+		ChunksServed:      s.chunks,
+		BytesServed:       s.bytes,
+		ActiveConnections: s.active,
+		Files:             make(map[string]FileStats, len(s.files)),
+	}
+	for hash, f := range s.files {
+		snap.Files[hash] = *f
+	}
+	return snap
+}
+
+// ServeHTTP responds to GET requests with the current Snapshot as JSON.
+func (s *ServerStats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Snapshot())
+}
@@ -0,0 +1,87 @@
+package peer
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// scrapeStats fetches the stats endpoint at url until check accepts the
+// snapshot or a second has passed, and returns the last snapshot. Chunks are
+// counted once sent, so the count may lag behind the client for a moment.
+func scrapeStats(t *testing.T, url string, check func(StatsSnapshot) bool) StatsSnapshot {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var snap StatsSnapshot
+		err = json.NewDecoder(resp.Body).Decode(&snap)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if check(snap) || time.Now().After(deadline) {
+			return snap
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestStatsEndpoint(t *testing.T) {
+	tr := NewMemoryTransport()
+	path, _, manifest := testManifest(t, 2*testChunkSize+500)
+	stats := NewServerStats()
+	peer := serveFile(t, tr, 9000, path, manifest, ServerOptions{Stats: stats})
+	srv := httptest.NewServer(stats)
+	defer srv.Close()
+
+	for _, i := range []int{0, 2} {
+		if _, err := fetchChunk(context.Background(), tr, peer, manifest, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantBytes := manifest.Chunks[0].Size + manifest.Chunks[2].Size
+
+	// Hold a connection open to see it counted as active
+	conn, err := tr.Dial(context.Background(), peer.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeMessage(conn, PingRequest{Type: TypePing}); err != nil {
+		t.Fatal(err)
+	}
+	if err := readMessage(bufio.NewReader(conn), &PongResponse{}); err != nil {
+		t.Fatal(err)
+	}
+
+	snap := scrapeStats(t, srv.URL, func(s StatsSnapshot) bool { return s.ChunksServed == 2 && s.ActiveConnections == 1 })
+	if snap.ChunksServed != 2 || snap.BytesServed != wantBytes || snap.ActiveConnections != 1 {
+		t.Fatalf("stats report %d chunks, %d bytes, %d connections; want 2, %d, 1",
+			snap.ChunksServed, snap.BytesServed, snap.ActiveConnections, wantBytes)
+	}
+	file := snap.Files[manifest.FileHash]
+	if len(snap.Files) != 1 || file.FileName != manifest.FileName || file.ChunksServed != 2 || file.BytesServed != wantBytes {
+		t.Fatalf("per-file stats %+v, want 2 chunks and %d bytes of %s", snap.Files, wantBytes, manifest.FileName)
+	}
+
+	conn.Close()
+	if snap := scrapeStats(t, srv.URL, func(s StatsSnapshot) bool { return s.ActiveConnections == 0 }); snap.ActiveConnections != 0 {
+		t.Fatalf("stats report %d active connections after the client left", snap.ActiveConnections)
+	}
+
+	resp, err := http.Post(srv.URL, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("POST answered %s, want 405", resp.Status)
+	}
+}
@@ -0,0 +1,280 @@
+// Package peer implements the peer-to-peer file sharing functionality.
+// It provides both client and server capabilities for sharing files between peers.
+package peer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+// ErrFileNotShared is returned by FileStore lookups for files that aren't in the store.
+var ErrFileNotShared = errors.New("file not shared")
+
+// FileStore holds the files a seeder shares, keyed by file hash. Each file is
+// opened once when it is added and closed when it is removed, and its manifest is
+// kept alongside it, so every connection serves from the same handle.
+// It is safe for concurrent use.
+type FileStore struct {
+	mu    sync.RWMutex
+	files map[string]*SharedFile
+}
+
+// NewFileStore creates an empty store.
+func NewFileStore() *FileStore {
+	return &FileStore{files: make(map[string]*SharedFile)}
+}
+
+// SharedFile is a file in a FileStore. Its ReadAt method reads the file's
+// content, and fails with os.ErrClosed once the file has been removed, or with
+// an error wrapping ErrFileGone once it was found deleted or truncated.
+type SharedFile struct {
+	mu       sync.RWMutex // Held for reading during ReadAt, for writing on close and growth
+	hash     string       // Hash the file was shared under, kept as it grows
+	manifest *file.Manifest
+	src      io.ReaderAt
+	closer   io.Closer // Closes src on removal, may be nil
+	closed   bool
+	gone     error // Why the content can no longer be served, wrapping ErrFileGone
+
+	// path is the file on disk src reads, from offset base, if it was added
+	// with FileStore.Add; chunks can then be sent from it with sendfile.
+	path string
+	base int64
+}
+
+// Manifest returns the manifest the file is currently served with. It changes
+// when the file grows; see FileStore.Grow.
+func (f *SharedFile) Manifest() *file.Manifest {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.manifest
+}
+
+// ReadAt reads from the shared file's content.
+func (f *SharedFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.gone != nil {
+		return 0, f.gone
+	}
+	return f.src.ReadAt(p, off)
+}
+
+// goneErr returns why the file's content can no longer be served, or nil.
+func (f *SharedFile) goneErr() error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.gone
+}
+
+// markGone records that the file's content can no longer be served because
+// of reason, which must wrap ErrFileGone. It reports whether the file was
+// marked just now rather than before.
+func (f *SharedFile) markGone(reason error) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.gone != nil {
+		return false
+	}
+	f.gone = reason
+	return true
+}
+
+// diskFile returns the file on disk the content is read from and the offset
+// of the content in it, or ok false if it doesn't come from a file on disk or
+// the file has been removed.
+func (f *SharedFile) diskFile() (path string, base int64, ok bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.path, f.base, f.path != "" && !f.closed
+}
+
+// close waits for in-progress reads, then closes the underlying source.
+func (f *SharedFile) close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	if f.closer != nil {
+		return f.closer.Close()
+	}
+	return nil
+}
+
+// Add opens the file at filePath and shares it under manifest's file hash.
+// manifest must have been created from filePath, either for the whole file or,
+// with CreateRangeManifest, for a range of it.
+func (s *FileStore) Add(filePath string, manifest *file.Manifest) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	// Range manifests are served from their part of the file
+	section, err := manifest.Section(f, info.Size())
+	if err != nil {
+		f.Close()
+		return err
+	}
+	shared := &SharedFile{manifest: manifest, src: section, closer: f, path: filePath, base: manifest.RangeStart}
+	if err := s.add(shared, section.Size()); err != nil {
+		f.Close()
+		return err
+	}
+	return nil
+}
+
+// AddReader shares content read from src under manifest's file hash. src must
+// hold size bytes matching manifest and be safe for concurrent ReadAt calls.
+// If src implements io.Closer, it is closed when the file is removed.
+func (s *FileStore) AddReader(src io.ReaderAt, size int64, manifest *file.Manifest) error {
+	closer, _ := src.(io.Closer)
+	return s.add(&SharedFile{manifest: manifest, src: src, closer: closer}, size)
+}
+
+// add registers shared, whose source holds size bytes, in the store.
+func (s *FileStore) add(shared *SharedFile, size int64) error {
+	manifest := shared.manifest
+	if size != manifest.FileSize {
+		return fmt.Errorf("source has %d bytes but the manifest describes %d", size, manifest.FileSize)
+	}
+	// Chunks are verified before they are served
+	if err := manifest.CheckHashKey(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.files[manifest.FileHash]; ok {
+		return fmt.Errorf("file %s is already shared", manifest.FileHash)
+	}
+	shared.hash = manifest.FileHash
+	s.files[manifest.FileHash] = shared
+	return nil
+}
+
+// Grow updates a shared file that has been appended to. manifest must be the
+// file's manifest extended with file.Manifest.Grow, keeping its file hash, and
+// src must hold its size bytes. The file's source is not closed or replaced as
+// a resource; src should read from the same handle. Connections are served the
+// new chunks from their next request.
+func (s *FileStore) Grow(src io.ReaderAt, size int64, manifest *file.Manifest) error {
+	if size != manifest.FileSize {
+		return fmt.Errorf("source has %d bytes but the manifest describes %d", size, manifest.FileSize)
+	}
+	f, err := s.Get(manifest.FileHash)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	if manifest.FileSize < f.manifest.FileSize {
+		return fmt.Errorf("file %s can't shrink from %d to %d bytes", manifest.FileHash, f.manifest.FileSize, manifest.FileSize)
+	}
+	f.src, f.manifest = src, manifest
+	return nil
+}
+
+// Withdraw stops serving the content of the file with the given hash, e.g.
+// because it was deleted or truncated, without removing it from the store:
+// requests for it are refused with ErrFileGone and reason. reason is wrapped
+// with ErrFileGone if it doesn't wrap it already.
+func (s *FileStore) Withdraw(fileHash string, reason error) error {
+	f, err := s.Get(fileHash)
+	if err != nil {
+		return err
+	}
+	if !errors.Is(reason, ErrFileGone) {
+		reason = fmt.Errorf("%w: %v", ErrFileGone, reason)
+	}
+	f.markGone(reason)
+	return nil
+}
+
+// Get returns the shared file with the given hash.
+func (s *FileStore) Get(fileHash string) (*SharedFile, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	f, ok := s.files[fileHash]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrFileNotShared, fileHash)
+	}
+	return f, nil
+}
+
+// lookup returns the shared file with the given hash, or the store's only file
+// if fileHash is empty.
+func (s *FileStore) lookup(fileHash string) (*SharedFile, error) {
+	if fileHash == "" {
+		return s.only()
+	}
+	return s.Get(fileHash)
+}
+
+// only returns the store's file if it holds exactly one. It lets requests from
+// older clients, which don't name a file, be served by single-file seeders.
+func (s *FileStore) only() (*SharedFile, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.files) != 1 {
+		return nil, fmt.Errorf("%w: request must name one of %d files", ErrFileNotShared, len(s.files))
+	}
+	for _, f := range s.files {
+		return f, nil
+	}
+	return nil, nil
+}
+
+// Remove stops sharing the file with the given hash. It waits for reads in
+// progress to finish, then closes the file.
+func (s *FileStore) Remove(fileHash string) error {
+	s.mu.Lock()
+	f, ok := s.files[fileHash]
+	delete(s.files, fileHash)
+	s.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrFileNotShared, fileHash)
+	}
+	return f.close()
+}
+
+// Close removes every file from the store.
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	files := s.files
+	s.files = make(map[string]*SharedFile)
+	s.mu.Unlock()
+
+	var firstErr error
+	for _, f := range files {
+		if err := f.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
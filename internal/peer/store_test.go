@@ -0,0 +1,159 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+// closeTracker is an in-memory source that records whether it was closed.
+type closeTracker struct {
+	*bytes.Reader
+	closed bool
+}
+
+func (c *closeTracker) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestFileStoreAddGetRemove(t *testing.T) {
+	data := []byte("content shared from memory")
+	manifest, err := file.CreateManifestFromReader(bytes.NewReader(data), "mem.txt", int64(len(data)), 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := &closeTracker{Reader: bytes.NewReader(data)}
+	store := NewFileStore()
+
+	if err := store.AddReader(src, int64(len(data))-1, manifest); err == nil {
+		t.Fatal("AddReader accepted a source of the wrong size")
+	}
+	if err := store.AddReader(src, int64(len(data)), manifest); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddReader(src, int64(len(data)), manifest); err == nil {
+		t.Fatal("the same file was added twice")
+	}
+
+	shared, err := store.Get(manifest.FileHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 7)
+	if _, err := shared.ReadAt(buf, 8); err != nil || string(buf) != "shared " {
+		t.Fatalf("ReadAt returned %q, %v", buf, err)
+	}
+	if only, err := store.lookup(""); err != nil || only != shared {
+		t.Fatalf("the only file wasn't found without a hash: %v", err)
+	}
+
+	if err := store.Remove(manifest.FileHash); err != nil {
+		t.Fatal(err)
+	}
+	if !src.closed {
+		t.Error("removing a file didn't close its source")
+	}
+	if _, err := shared.ReadAt(buf, 0); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("ReadAt after removal returned %v, want os.ErrClosed", err)
+	}
+	if _, err := store.Get(manifest.FileHash); !errors.Is(err, ErrFileNotShared) {
+		t.Errorf("Get after removal returned %v, want ErrFileNotShared", err)
+	}
+	if err := store.Remove(manifest.FileHash); !errors.Is(err, ErrFileNotShared) {
+		t.Errorf("removing a file twice returned %v, want ErrFileNotShared", err)
+	}
+}
+
+func TestFileStoreConcurrentAddServeRemove(t *testing.T) {
+	tr := NewMemoryTransport()
+	store := NewFileStore()
+	t.Cleanup(func() { store.Close() })
+	peer := serveStore(t, tr, 9000, store, ServerOptions{})
+
+	// Three files are always shared, and a fourth comes and goes
+	type shared struct {
+		path     string
+		data     []byte
+		manifest *file.Manifest
+	}
+	var files []shared
+	for i := 0; i < 4; i++ {
+		path, data := writeTestFile(t, "file"+strconv.Itoa(i), (i+2)*testChunkSize+i)
+		manifest, err := file.CreateManifest(path, testChunkSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, shared{path, data, manifest})
+		if i < 3 {
+			if err := store.Add(path, manifest); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	churn := files[3]
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := store.Add(churn.path, churn.manifest); err != nil {
+				t.Errorf("re-adding the file: %v", err)
+				return
+			}
+			if err := store.Remove(churn.manifest.FileHash); err != nil {
+				t.Errorf("removing the file: %v", err)
+				return
+			}
+		}
+	}()
+
+	errs := make(chan error, 16)
+	var downloads sync.WaitGroup
+	for w := 0; w < 16; w++ {
+		downloads.Add(1)
+		go func(w int) {
+			defer downloads.Done()
+			f := files[w%len(files)]
+			outputPath := filepath.Join(t.TempDir(), "out.bin")
+			_, err := DownloadFile(context.Background(), f.manifest, []Peer{peer}, outputPath, DownloadOptions{Transport: tr, MaxParallel: 2})
+			if f.manifest == churn.manifest {
+				// Removed mid-download: either complete or cleanly refused
+				if err != nil && !errors.Is(err, ErrPeerMismatch) && !errors.Is(err, ErrNoPeers) {
+					errs <- fmt.Errorf("download of the file being removed failed with %w", err)
+				}
+				if err != nil {
+					return
+				}
+			} else if err != nil {
+				errs <- fmt.Errorf("download of %s: %w", f.manifest.FileName, err)
+				return
+			}
+			if got := readOutput(t, outputPath); !bytes.Equal(got, f.data) {
+				errs <- fmt.Errorf("downloaded %s doesn't match", f.manifest.FileName)
+			}
+		}(w)
+	}
+	downloads.Wait()
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,180 @@
+// Package peer implements the peer-to-peer file sharing functionality.
+// It provides both client and server capabilities for sharing files between peers.
+package peer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Defaults for TCPTransport. The dial timeout is short so that a download
+// fails over quickly from a peer whose host has gone away, rather than waiting
+// for the operating system to give up, which can take over a minute.
+const (
+	DefaultDialTimeout = 5 * time.Second
+	DefaultKeepAlive   = 30 * time.Second
+)
+
+// Transport abstracts the network used for peer-to-peer transfers.
+// Production code uses TCPTransport, while tests can use a MemoryTransport
+// to exercise the protocol without binding real ports.
+type Transport interface {
+	// Dial connects to the peer listening on addr (host:port).
+	// It gives up when ctx is done.
+	Dial(ctx context.Context, addr string) (net.Conn, error)
+	// Listen starts accepting connections on addr (host:port).
+	Listen(addr string) (net.Listener, error)
+}
+
+// TCPTransport is the default Transport backed by TCP sockets. Its zero value
+// uses DefaultDialTimeout and DefaultKeepAlive.
+type TCPTransport struct {
+	// DialTimeout bounds how long connecting to a peer may take, on top of
+	// the context's deadline (default: DefaultDialTimeout; negative for no
+	// limit but the context's).
+	DialTimeout time.Duration
+	// KeepAlive is how often idle connections are probed with TCP keepalives,
+	// so that a peer that vanished mid-transfer is noticed (default:
+	// DefaultKeepAlive; negative to disable them).
+	KeepAlive time.Duration
+}
+
+// keepAlive returns the keepalive period to use, in net.Dialer's terms.
+func (t TCPTransport) keepAlive() time.Duration {
+	if t.KeepAlive == 0 {
+		return DefaultKeepAlive
+	}
+	return t.KeepAlive
+}
+
+// Dial connects to addr over TCP, giving up after the dial timeout.
+func (t TCPTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	d := net.Dialer{Timeout: t.DialTimeout, KeepAlive: t.keepAlive()}
+	if d.Timeout == 0 {
+		d.Timeout = DefaultDialTimeout
+	} else if d.Timeout < 0 {
+		d.Timeout = 0
+	}
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// Listen listens for TCP connections on addr. Accepted connections get the
+// same keepalives as dialed ones.
+func (t TCPTransport) Listen(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{KeepAlive: t.keepAlive()}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// MemoryTransport is an in-memory Transport built on net.Pipe.
+// Listeners are keyed by port only, so any host name dials the same listener,
+// which mirrors how a single machine's loopback interface behaves.
+type MemoryTransport struct {
+	mu        sync.Mutex
+	listeners map[string]*memoryListener
+}
+
+// NewMemoryTransport creates an empty in-memory network.
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{
+		listeners: make(map[string]*memoryListener),
+	}
+}
+
+// Dial connects to the in-memory listener registered for addr's port.
+func (t *MemoryTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	ln, ok := t.listeners[port]
+	t.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("dial %s: connection refused", addr)
+	}
+
+	client, server := net.Pipe()
+	select {
+	case ln.conns <- server:
+		return client, nil
+	case <-ln.done:
+		client.Close()
+		server.Close()
+		return nil, fmt.Errorf("dial %s: connection refused", addr)
+	case <-ctx.Done():
+		client.Close()
+		server.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// Listen registers an in-memory listener for addr's port.
+func (t *MemoryTransport) Listen(addr string) (net.Listener, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.listeners[port]; ok {
+		return nil, fmt.Errorf("listen %s: address already in use", addr)
+	}
+	ln := &memoryListener{
+		transport: t,
+		port:      port,
+		conns:     make(chan net.Conn),
+		done:      make(chan struct{}),
+	}
+	t.listeners[port] = ln
+	return ln, nil
+}
+
+// memoryListener is the net.Listener returned by MemoryTransport.Listen.
+type memoryListener struct {
+	transport *MemoryTransport
+	port      string
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Accept waits for the next in-memory connection.
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close unregisters the listener and unblocks any pending Accept calls.
+func (l *memoryListener) Close() error {
+	err := errors.New("listener already closed")
+	l.closeOnce.Do(func() {
+		l.transport.mu.Lock()
+		delete(l.transport.listeners, l.port)
+		l.transport.mu.Unlock()
+		close(l.done)
+		err = nil
+	})
+	return err
+}
+
+// Addr returns the listener's in-memory address.
+func (l *memoryListener) Addr() net.Addr {
+	return memoryAddr(net.JoinHostPort("memory", l.port))
+}
+
+// memoryAddr is the net.Addr of an in-memory listener.
+type memoryAddr string
+
+func (a memoryAddr) Network() string { return "memory" }
+func (a memoryAddr) String() string  { return string(a) }
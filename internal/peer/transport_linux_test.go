@@ -0,0 +1,128 @@
+//go:build linux
+
+package peer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fullListener returns the address of a loopback socket listening with no
+// backlog and never accepting, so that connecting to it soon hangs.
+func fullListener(t *testing.T) string {
+	t.Helper()
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { syscall.Close(fd) })
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Listen(fd, 0); err != nil {
+		t.Fatal(err)
+	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return (&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: sa.(*syscall.SockaddrInet4).Port}).String()
+}
+
+func TestTCPTransportDialTimeout(t *testing.T) {
+	addr := fullListener(t)
+	tr := TCPTransport{DialTimeout: 300 * time.Millisecond}
+
+	// The first connections fill the backlog; the next one can't complete
+	for i := 0; i < 10; i++ {
+		start := time.Now()
+		conn, err := tr.Dial(context.Background(), addr)
+		if err == nil {
+			defer conn.Close()
+			continue
+		}
+		elapsed := time.Since(start)
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				t.Fatalf("dial failed with %v, want a timeout", err)
+			}
+		}
+		if elapsed < 250*time.Millisecond || elapsed > 3*time.Second {
+			t.Fatalf("dial gave up after %v, want about 300ms", elapsed)
+		}
+		return
+	}
+	t.Fatal("every dial to a listener with a full backlog succeeded")
+}
+
+// keepAliveOf returns whether conn has TCP keepalives enabled, and how many
+// seconds it may idle before the first probe.
+func keepAliveOf(t *testing.T, conn net.Conn) (bool, int) {
+	t.Helper()
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var on, idle int
+	var sockErr error
+	raw.Control(func(fd uintptr) {
+		if on, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); sockErr == nil {
+			idle, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+		}
+	})
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+	return on != 0, idle
+}
+
+func TestTCPTransportKeepAlive(t *testing.T) {
+	for _, tc := range []struct {
+		tr   TCPTransport
+		on   bool
+		idle int
+	}{
+		{TCPTransport{}, true, int(DefaultKeepAlive / time.Second)},
+		{TCPTransport{KeepAlive: 7 * time.Second}, true, 7},
+		{TCPTransport{KeepAlive: -1}, false, 0},
+	} {
+		ln, err := tc.tr.Listen("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- conn
+		}()
+		dialed, err := tc.tr.Dial(context.Background(), ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dialed.Close()
+		server, ok := <-accepted
+		if !ok {
+			t.Fatal("listener didn't accept the connection")
+		}
+		defer server.Close()
+
+		for side, conn := range map[string]net.Conn{"dialed": dialed, "accepted": server} {
+			on, idle := keepAliveOf(t, conn)
+			if on != tc.on || (tc.on && idle != tc.idle) {
+				t.Errorf("KeepAlive %v: %s connection has keepalive %v after %ds idle, want %v after %ds",
+					tc.tr.KeepAlive, side, on, idle, tc.on, tc.idle)
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemoryTransportDialListen(t *testing.T) {
+	tr := NewMemoryTransport()
+	ctx := context.Background()
+
+	if _, err := tr.Dial(ctx, "localhost:9000"); err == nil {
+		t.Fatal("Dial succeeded without a listener")
+	}
+
+	ln, err := tr.Listen(":9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tr.Listen(":9000"); err == nil {
+		t.Fatal("second Listen on the same port succeeded")
+	}
+
+	// Any host name reaches the listener registered for the port
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+	client, err := tr.Dial(ctx, "192.0.2.1:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-accepted
+	go client.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := server.Read(buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("server read %q, %v", buf, err)
+	}
+	client.Close()
+	server.Close()
+
+	// Closing the listener unblocks Accept and frees the port
+	acceptErr := make(chan error, 1)
+	go func() {
+		_, err := ln.Accept()
+		acceptErr <- err
+	}()
+	ln.Close()
+	if err := <-acceptErr; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Accept after Close returned %v, want net.ErrClosed", err)
+	}
+	if _, err := tr.Dial(ctx, "localhost:9000"); err == nil {
+		t.Fatal("Dial succeeded after the listener was closed")
+	}
+	if ln, err := tr.Listen(":9000"); err != nil {
+		t.Fatalf("Listen after Close: %v", err)
+	} else {
+		ln.Close()
+	}
+}
+
+func TestMemoryTransportDialContext(t *testing.T) {
+	tr := NewMemoryTransport()
+	ln, err := tr.Listen(":9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// Nothing accepts, so Dial waits until ctx is done
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := tr.Dial(ctx, "localhost:9000"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Dial returned %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestDownloadFileMemoryTransport(t *testing.T) {
+	tr := NewMemoryTransport()
+	// Several chunks and a short last one
+	path, data, manifest := testManifest(t, 5*testChunkSize+123)
+	peer := serveFile(t, tr, 9000, path, manifest, ServerOptions{})
+
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	result, err := DownloadFile(context.Background(), manifest, []Peer{peer}, outputPath, DownloadOptions{Transport: tr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutput(t, outputPath); !bytes.Equal(got, data) {
+		t.Fatalf("downloaded %d bytes differing from the %d shared", len(got), len(data))
+	}
+	if result.Chunks != len(manifest.Chunks) || result.Bytes != int64(len(data)) {
+		t.Errorf("result reports %d chunks, %d bytes; want %d, %d", result.Chunks, result.Bytes, len(manifest.Chunks), len(data))
+	}
+}
+
+func TestDownloadChunkMemoryTransport(t *testing.T) {
+	tr := NewMemoryTransport()
+	path, data, manifest := testManifest(t, 2*testChunkSize+10)
+	peer := serveFile(t, tr, 9000, path, manifest, ServerOptions{})
+
+	for i, chunk := range manifest.Chunks {
+		got, err := DownloadChunk(context.Background(), tr, peer, i)
+		if err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+		if want := data[chunk.Offset : chunk.Offset+chunk.Size]; !bytes.Equal(got, want) {
+			t.Errorf("chunk %d: got %d bytes, want %d matching the file", i, len(got), len(want))
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Package peer implements the peer-to-peer file sharing functionality.
+// It provides both client and server capabilities for sharing files between peers.
+package peer
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+// UpdateFile builds the file described by manifest from an older local version at
+// oldPath, downloading only the chunks whose content the old file doesn't have.
+// The old file is chunked with the same strategy as manifest, and every new chunk
+// whose hash matches one of the old chunks is copied from the old file instead of
+// being fetched. outputPath may be the same as oldPath, in which case the old file
+// is replaced once the update succeeds. It returns the number of reused chunks.
+func UpdateFile(ctx context.Context, oldPath string, manifest *file.Manifest, peers []Peer, outputPath string, opts DownloadOptions) (int, error) {
+	oldManifest, err := file.CreateManifestLike(oldPath, manifest)
+	if err != nil {
+		return 0, fmt.Errorf("failed to index old file: %v", err)
+	}
+
+	// Map each old chunk hash to where its data lives in the old file
+	type location struct {
+		offset int64
+		size   int64
+	}
+	oldChunks := make(map[string]location)
+	for _, chunk := range oldManifest.Chunks {
+		if _, ok := oldChunks[chunk.Hash]; !ok {
+			oldChunks[chunk.Hash] = location{offset: chunk.Offset, size: chunk.Size}
+		}
+	}
+
+	oldFile, err := os.Open(oldPath)
+	if err != nil {
+		return 0, err
+	}
+	defer oldFile.Close()
+
+	reused := 0
+	prefill := func(out *os.File) ([]int, error) {
+		var pending []int
+		for i, chunk := range manifest.Chunks {
+			loc, ok := oldChunks[chunk.Hash]
+			if ok && loc.size == chunk.Size {
+				data := make([]byte, chunk.Size)
+				if _, err := oldFile.ReadAt(data, loc.offset); err != nil {
+					return nil, fmt.Errorf("failed to read chunk from old file: %v", err)
+				}
+				if err := file.WriteChunkAt(out, manifest, i, data); err != nil {
+					return nil, fmt.Errorf("failed to copy chunk %d: %w", i, classifyWriteError(err))
+				}
+				reused++
+			} else {
+				pending = append(pending, i)
+			}
+		}
+		return pending, nil
+	}
+
+	if _, err := downloadFile(ctx, manifest, peers, outputPath, opts, false, prefill); err != nil {
+		return reused, err
+	}
+	return reused, nil
+}
@@ -0,0 +1,90 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+func TestUpdateFileFetchesOnlyChangedChunks(t *testing.T) {
+	tr := NewMemoryTransport()
+	oldPath, oldData := writeTestFile(t, "old.bin", 5*testChunkSize+100)
+
+	// The new version differs from the old one only in chunk 2
+	newData := bytes.Clone(oldData)
+	for i := 2 * testChunkSize; i < 3*testChunkSize; i++ {
+		newData[i]++
+	}
+	newPath := filepath.Join(t.TempDir(), "new.bin")
+	if err := os.WriteFile(newPath, newData, 0644); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := file.CreateManifest(newPath, testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := serveFile(t, tr, 9000, newPath, manifest, ServerOptions{})
+
+	var mu sync.Mutex
+	var fetched []int
+	opts := DownloadOptions{
+		Transport: tr,
+		OnChunk: func(index int, from Peer, size int64) {
+			mu.Lock()
+			fetched = append(fetched, index)
+			mu.Unlock()
+		},
+	}
+
+	// Updating the old file in place replaces it with the new version
+	reused, err := UpdateFile(context.Background(), oldPath, manifest, []Peer{peer}, oldPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(fetched, []int{2}) {
+		t.Errorf("fetched chunks %v, want only [2]", fetched)
+	}
+	if reused != len(manifest.Chunks)-1 {
+		t.Errorf("reused %d chunks, want %d", reused, len(manifest.Chunks)-1)
+	}
+	if got := readOutput(t, oldPath); !bytes.Equal(got, newData) {
+		t.Fatal("updated file doesn't match the new version")
+	}
+}
+
+func TestUpdateFileReusesMovedChunks(t *testing.T) {
+	tr := NewMemoryTransport()
+	oldPath, oldData := writeTestFile(t, "old.bin", 4*testChunkSize)
+
+	// The new version swaps the first two chunks, so all of its data is
+	// already in the old file, just at other offsets
+	newData := append(bytes.Clone(oldData[testChunkSize:2*testChunkSize]), oldData[:testChunkSize]...)
+	newData = append(newData, oldData[2*testChunkSize:]...)
+	newPath := filepath.Join(t.TempDir(), "new.bin")
+	if err := os.WriteFile(newPath, newData, 0644); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := file.CreateManifest(newPath, testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// No peer is reachable, so every chunk has to come from the old file
+	out := filepath.Join(t.TempDir(), "out.bin")
+	reused, err := UpdateFile(context.Background(), oldPath, manifest, []Peer{{Address: "localhost", Port: 9000}}, out, DownloadOptions{Transport: tr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reused != len(manifest.Chunks) {
+		t.Errorf("reused %d chunks, want all %d", reused, len(manifest.Chunks))
+	}
+	if got := readOutput(t, out); !bytes.Equal(got, newData) {
+		t.Fatal("updated file doesn't match the new version")
+	}
+}
@@ -0,0 +1,80 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyAfterRepairsFromOtherPeers(t *testing.T) {
+	mem := NewMemoryTransport()
+	path, data, manifest := testManifest(t, 3*testChunkSize+7)
+	// Chunks from port 9001 arrive corrupted; port 9002 serves them intact
+	corruptPeer := serveFile(t, mem, 9001, path, manifest, ServerOptions{})
+	goodPeer := serveFile(t, mem, 9002, path, manifest, ServerOptions{})
+	tr := portTransport{base: mem, byPort: map[int]Transport{9001: corruptTransport{mem}}}
+
+	// Without per-chunk checks the corruption is only found by the final
+	// verification, which fails the download and keeps the .part file
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	opts := DownloadOptions{Transport: tr, SkipChunkVerify: true}
+	_, err := DownloadFile(context.Background(), manifest, []Peer{corruptPeer, goodPeer}, outputPath, opts)
+	if !errors.Is(err, ErrVerificationFailed) {
+		t.Fatalf("download returned %v, want ErrVerificationFailed", err)
+	}
+	if _, err := os.Stat(outputPath); !os.IsNotExist(err) {
+		t.Fatal("unverified download was moved into place")
+	}
+	if _, err := os.Stat(PartPath(outputPath)); err != nil {
+		t.Fatalf(".part file not kept for inspection: %v", err)
+	}
+
+	// With repair the bad chunks are fetched again from a peer serving them intact
+	opts.RepairOnFailure = true
+	if _, err := DownloadFile(context.Background(), manifest, []Peer{corruptPeer, goodPeer}, outputPath, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutput(t, outputPath); !bytes.Equal(got, data) {
+		t.Fatal("repaired download doesn't match")
+	}
+}
+
+func TestSequentialVerifyFindsCorruption(t *testing.T) {
+	mem := NewMemoryTransport()
+	path, _, manifest := testManifest(t, 3*testChunkSize+7)
+	peer := serveFile(t, mem, 9001, path, manifest, ServerOptions{})
+	tr := portTransport{base: mem, byPort: map[int]Transport{9001: corruptTransport{mem}}}
+
+	// Chunks arriving in order are hashed as they are written; when that hash
+	// doesn't match, the file is read again to find the bad chunks
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	opts := DownloadOptions{Transport: tr, SkipChunkVerify: true, MaxParallel: 1}
+	_, err := DownloadFile(context.Background(), manifest, []Peer{peer}, outputPath, opts)
+	if !errors.Is(err, ErrVerificationFailed) || !strings.Contains(err.Error(), "bad chunks") {
+		t.Fatalf("sequential download of corrupt chunks returned %v, want ErrVerificationFailed with the bad chunks", err)
+	}
+	if _, err := os.Stat(outputPath); !os.IsNotExist(err) {
+		t.Fatal("unverified download was moved into place")
+	}
+}
+
+func TestVerifyAfter(t *testing.T) {
+	tr := NewMemoryTransport()
+	path, data, manifest := testManifest(t, 3*testChunkSize+7)
+	peer := serveFile(t, tr, 9000, path, manifest, ServerOptions{})
+
+	for _, maxParallel := range []int{1, 4} {
+		outputPath := filepath.Join(t.TempDir(), "out.bin")
+		opts := DownloadOptions{Transport: tr, VerifyAfter: true, MaxParallel: maxParallel}
+		if _, err := DownloadFile(context.Background(), manifest, []Peer{peer}, outputPath, opts); err != nil {
+			t.Fatalf("MaxParallel %d: %v", maxParallel, err)
+		}
+		if got := readOutput(t, outputPath); !bytes.Equal(got, data) {
+			t.Fatalf("MaxParallel %d: downloaded file doesn't match", maxParallel)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Package peer implements the peer-to-peer file sharing functionality.
+// It provides both client and server capabilities for sharing files between peers.
+package peer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+// webSeedClient is the HTTP client used to fetch chunks from web seeds.
+// Requests are bounded by their context rather than a client timeout.
+var webSeedClient = &http.Client{}
+
+// WebSeed returns a Peer that serves the file from a plain HTTP server, such as
+// a mirror or CDN, at rawURL. Chunks are fetched with HTTP Range requests using
+// the chunk boundaries in the manifest, and verified like chunks from any peer.
+// The server must support Range requests.
+func WebSeed(rawURL string) Peer {
+	return Peer{URL: rawURL}
+}
+
+// fetchWebSeedChunk fetches chunk chunkIndex of manifest's file from a web seed
+// with an HTTP Range request. It checks that the server answered with exactly
+// the requested byte range; the caller verifies the chunk hash. The response
+// is read through limiter, unless it is nil.
+func fetchWebSeedChunk(ctx context.Context, seed Peer, manifest *file.Manifest, chunkIndex int, limiter *RateLimiter) ([]byte, error) {
+	if chunkIndex < 0 || chunkIndex >= len(manifest.Chunks) {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidChunkIndex, chunkIndex)
+	}
+	// Web seeds hold the whole file, of which a range manifest covers a part
+	offset := manifest.RangeStart + manifest.ChunkOffset(chunkIndex)
+	size := manifest.Chunks[chunkIndex].Size
+	if size == 0 {
+		return []byte{}, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, seed.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrPeerMismatch, err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+size-1))
+
+	resp, err := webSeedClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrPeerUnreachable, err)
+	}
+	defer resp.Body.Close()
+
+	// A server that ignores the range, or doesn't have the file, can't serve any chunk
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		return nil, fmt.Errorf("%w: web seed %s does not support range requests", ErrPeerMismatch, seed.URL)
+	case http.StatusNotFound, http.StatusRequestedRangeNotSatisfiable:
+		return nil, fmt.Errorf("%w: web seed %s answered %s", ErrPeerMismatch, seed.URL, resp.Status)
+	default:
+		return nil, fmt.Errorf("web seed %s answered %s", seed.URL, resp.Status)
+	}
+
+	var start, end int64
+	if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/", &start, &end); err != nil ||
+		start != offset || end != offset+size-1 {
+		return nil, fmt.Errorf("web seed %s sent range %q, expected bytes %d-%d",
+			seed.URL, resp.Header.Get("Content-Range"), offset, offset+size-1)
+	}
+
+	// Read the range, making sure no more than the chunk arrives
+	data, err := io.ReadAll(io.LimitReader(limitReader(ctx, resp.Body, limiter), size+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk data: %v", err)
+	}
+	if int64(len(data)) != size {
+		return nil, fmt.Errorf("web seed %s sent %d bytes for chunk %d, expected %d", seed.URL, len(data), chunkIndex, size)
+	}
+	return data, nil
+}
+
+// downloadWebSeedChunks is DownloadChunks for a web seed. Each chunk is fetched
+// with its own Range request and verified against the manifest.
+func downloadWebSeedChunks(ctx context.Context, seed Peer, manifest *file.Manifest, indices []int, limiter *RateLimiter) (map[int][]byte, error) {
+	chunks := make(map[int][]byte, len(indices))
+	for _, i := range indices {
+		data, err := fetchWebSeedChunk(ctx, seed, manifest, i, limiter)
+		if err != nil {
+			return chunks, err
+		}
+		if !manifest.VerifyChunk(manifest.Chunks[i], data) {
+			return chunks, &ChunkError{Index: i, Peer: &seed, Err: ErrHashMismatch}
+		}
+		chunks[i] = data
+	}
+	return chunks, nil
+}
+
+// pingWebSeed measures the round-trip time of a HEAD request to a web seed.
+func pingWebSeed(ctx context.Context, seed Peer) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, seed.URL, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	resp, err := webSeedClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrPeerUnreachable, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("web seed %s answered %s", seed.URL, resp.Status)
+	}
+	return time.Since(start), nil
+}
@@ -0,0 +1,77 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serveWebSeed serves content as a plain HTTP file server supporting Range
+// requests, and returns its URL and a count of the ranges requested.
+func serveWebSeed(t *testing.T, content []byte) (string, *atomic.Int32) {
+	t.Helper()
+	var ranges atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			ranges.Add(1)
+		}
+		http.ServeContent(w, r, "shared.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL + "/shared.bin", &ranges
+}
+
+func TestDownloadFromWebSeed(t *testing.T) {
+	_, data, manifest := testManifest(t, 4*testChunkSize+77)
+	url, ranges := serveWebSeed(t, data)
+
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	result, err := DownloadFile(context.Background(), manifest, []Peer{WebSeed(url)}, outputPath, DownloadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutput(t, outputPath); !bytes.Equal(got, data) {
+		t.Fatal("file downloaded from the web seed doesn't match the original")
+	}
+	if result.Chunks != len(manifest.Chunks) || int(ranges.Load()) != len(manifest.Chunks) {
+		t.Fatalf("downloaded %d chunks with %d range requests, want one per each of %d chunks",
+			result.Chunks, ranges.Load(), len(manifest.Chunks))
+	}
+}
+
+func TestWebSeedRejectsBadResponses(t *testing.T) {
+	_, data, manifest := testManifest(t, 2*testChunkSize)
+	ctx := context.Background()
+
+	// A server ignoring Range would send the whole file for every chunk
+	whole := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer whole.Close()
+	if _, err := fetchWebSeedChunk(ctx, WebSeed(whole.URL), manifest, 1, nil); !errors.Is(err, ErrPeerMismatch) {
+		t.Fatalf("fetching from a server without range support returned %v, want ErrPeerMismatch", err)
+	}
+
+	// A server with other content of the same size fails verification
+	other := bytes.Clone(data)
+	other[manifest.Chunks[1].Offset] ^= 0xff
+	url, _ := serveWebSeed(t, other)
+	chunks, err := downloadWebSeedChunks(ctx, WebSeed(url), manifest, []int{0, 1}, nil)
+	var chunkErr *ChunkError
+	if !errors.As(err, &chunkErr) || chunkErr.Index != 1 || !errors.Is(err, ErrHashMismatch) {
+		t.Fatalf("fetching a corrupt chunk returned %v, want a hash mismatch for chunk 1", err)
+	}
+	if len(chunks) != 1 || !bytes.Equal(chunks[0], data[:testChunkSize]) {
+		t.Fatalf("got %d chunks before the corrupt one, want chunk 0 intact", len(chunks))
+	}
+
+	if _, err := fetchWebSeedChunk(ctx, WebSeed(url), manifest, 2, nil); !errors.Is(err, ErrInvalidChunkIndex) {
+		t.Fatalf("fetching an out-of-range chunk returned %v, want ErrInvalidChunkIndex", err)
+	}
+}
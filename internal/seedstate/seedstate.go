@@ -0,0 +1,130 @@
+// Package seedstate records which files a client is seeding and where they are
+// announced, so that every seeding session can be re-established at once after
+// a restart. The state is a small JSON file in the user's configuration directory.
+package seedstate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Entry describes one seeding session.
+type Entry struct {
+	FileHash     string   `json:"fileHash"`          // Hash the file is announced under
+	FilePath     string   `json:"filePath"`          // Absolute path of the file or directory served
+	ManifestPath string   `json:"manifestPath"`      // Absolute path of its saved manifest
+	Trackers     []string `json:"trackers"`          // Trackers the file was announced to
+	Address      string   `json:"address"`           // Address the file was announced at
+	Port         int      `json:"port"`              // Port the file was served on
+	HashKey      string   `json:"hashKey,omitempty"` // Name or path of the key of a keyed manifest, never the key itself
+}
+
+// State is the set of recorded seeding sessions, at most one per file hash.
+type State struct {
+	Seeds []Entry `json:"seeds"`
+}
+
+// DefaultPath returns the default location of the state file, go-share/seeds.json
+// inside the user's configuration directory (e.g. ~/.config/go-share/seeds.json on Linux).
+func DefaultPath() (string, error) {
+	config, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(config, "go-share", "seeds.json"), nil
+}
+
+// Load reads the state file at path. A missing file is an empty state.
+func Load(path string) (*State, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &State{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid seed state %s: %v", path, err)
+	}
+	return &state, nil
+}
+
+// Save writes the state to path, creating its directory if needed. The file is
+// replaced atomically, so a crash never leaves a truncated state behind.
+func (s *State) Save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// Put records entry, replacing any entry for the same file hash.
+func (s *State) Put(entry Entry) {
+	for i := range s.Seeds {
+		if s.Seeds[i].FileHash == entry.FileHash {
+			s.Seeds[i] = entry
+			return
+		}
+	}
+	s.Seeds = append(s.Seeds, entry)
+}
+
+// Remove deletes the entry for fileHash, reporting whether there was one.
+func (s *State) Remove(fileHash string) bool {
+	n := len(s.Seeds)
+	s.Seeds = slices.DeleteFunc(s.Seeds, func(e Entry) bool { return e.FileHash == fileHash })
+	return len(s.Seeds) < n
+}
+
+// Record adds entry to the state file at path, replacing any entry for the
+// same file hash. Concurrent Record and Forget calls from several processes
+// may overwrite each other's changes.
+func Record(path string, entry Entry) error {
+	state, err := Load(path)
+	if err != nil {
+		return err
+	}
+	state.Put(entry)
+	return state.Save(path)
+}
+
+// Forget removes the entry for fileHash from the state file at path, reporting
+// whether there was one.
+func Forget(path, fileHash string) (bool, error) {
+	state, err := Load(path)
+	if err != nil {
+		return false, err
+	}
+	if !state.Remove(fileHash) {
+		return false, nil
+	}
+	return true, state.Save(path)
+}
@@ -0,0 +1,72 @@
+package seedstate
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRecordAndForget(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "go-share", "seeds.json")
+	state, err := Load(path)
+	if err != nil || len(state.Seeds) != 0 {
+		t.Fatalf("loading a missing state file returned %+v, %v; want an empty state", state, err)
+	}
+
+	first := Entry{FileHash: "abc", FilePath: "/srv/a.bin", ManifestPath: "/srv/a.bin.manifest", Trackers: []string{"http://tracker.example:8080"}, Address: "10.0.0.1", Port: 9000}
+	second := Entry{FileHash: "def", FilePath: "/srv/b.bin", ManifestPath: "/srv/b.bin.manifest", Address: "10.0.0.1", Port: 9001, HashKey: "group"}
+	for _, e := range []Entry{first, second} {
+		if err := Record(path, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Recording a file again replaces its entry
+	first.Port = 9002
+	if err := Record(path, first); err != nil {
+		t.Fatal(err)
+	}
+	state, err = Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(state.Seeds, []Entry{first, second}) {
+		t.Fatalf("recorded sessions %+v, want %+v", state.Seeds, []Entry{first, second})
+	}
+	if info, err := os.Stat(filepath.Dir(path)); err != nil || info.Mode().Perm() != 0700 {
+		t.Fatalf("state directory created with %v, %v; want mode 0700", info.Mode().Perm(), err)
+	}
+
+	if forgotten, err := Forget(path, "abc"); err != nil || !forgotten {
+		t.Fatalf("Forget of a recorded file returned %v, %v", forgotten, err)
+	}
+	if forgotten, err := Forget(path, "abc"); err != nil || forgotten {
+		t.Fatalf("Forget of a forgotten file returned %v, %v", forgotten, err)
+	}
+	state, err = Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(state.Seeds, []Entry{second}) {
+		t.Fatalf("sessions after Forget %+v, want only %+v", state.Seeds, second)
+	}
+
+	// No temporary files are left next to the state
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("state directory holds %d entries, %v; want only the state file", len(entries), err)
+	}
+}
+
+func TestLoadRejectsInvalidState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seeds.json")
+	if err := os.WriteFile(path, []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Fatal("Load accepted an invalid state file")
+	}
+	if err := Record(path, Entry{FileHash: "abc"}); err == nil {
+		t.Fatal("Record replaced an invalid state file")
+	}
+}
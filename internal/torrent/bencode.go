@@ -0,0 +1,189 @@
+// Package torrent converts between go-share manifests and BitTorrent v2
+// metainfo (.torrent) files, so that files can be shared with standard
+// BitTorrent clients as well as go-share peers.
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Marshal returns the bencoding of v, which may be an int or int64, a string
+// or []byte, a []any or []string list, or a map[string]any dictionary, whose
+// keys are written in sorted order as bencoding requires.
+func Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encode(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encode writes the bencoding of v to buf.
+func encode(buf *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case int:
+		return encode(buf, int64(v))
+	case int64:
+		buf.WriteByte('i')
+		buf.WriteString(strconv.FormatInt(v, 10))
+		buf.WriteByte('e')
+	case string:
+		buf.WriteString(strconv.Itoa(len(v)))
+		buf.WriteByte(':')
+		buf.WriteString(v)
+	case []byte:
+		buf.WriteString(strconv.Itoa(len(v)))
+		buf.WriteByte(':')
+		buf.Write(v)
+	case []string:
+		buf.WriteByte('l')
+		for _, s := range v {
+			encode(buf, s)
+		}
+		buf.WriteByte('e')
+	case []any:
+		buf.WriteByte('l')
+		for _, item := range v {
+			if err := encode(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('d')
+		for _, key := range keys {
+			encode(buf, key)
+			if err := encode(buf, v[key]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return fmt.Errorf("can't bencode %T", v)
+	}
+	return nil
+}
+
+// ErrInvalidBencode is returned by Unmarshal for data that isn't valid bencoding.
+var ErrInvalidBencode = errors.New("invalid bencoding")
+
+// maxBencodeDepth bounds how deeply lists and dictionaries may nest, so that
+// malicious input can't exhaust the stack.
+const maxBencodeDepth = 64
+
+// Unmarshal decodes the single bencoded value that makes up data. Integers are
+// returned as int64, strings as string, lists as []any, and dictionaries as
+// map[string]any.
+func Unmarshal(data []byte) (any, error) {
+	d := &decoder{data: data}
+	v, err := d.value(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(data) {
+		return nil, fmt.Errorf("%w: %d bytes of trailing data", ErrInvalidBencode, len(data)-d.pos)
+	}
+	return v, nil
+}
+
+// decoder decodes bencoded values from data, starting at pos.
+type decoder struct {
+	data []byte
+	pos  int
+}
+
+// value decodes the value at d.pos, nested depth lists or dictionaries deep.
+func (d *decoder) value(depth int) (any, error) {
+	if d.pos >= len(d.data) {
+		return nil, fmt.Errorf("%w: unexpected end of data", ErrInvalidBencode)
+	}
+	if depth > maxBencodeDepth {
+		return nil, fmt.Errorf("%w: nested too deeply", ErrInvalidBencode)
+	}
+
+	switch c := d.data[d.pos]; {
+	case c == 'i':
+		d.pos++
+		end := bytes.IndexByte(d.data[d.pos:], 'e')
+		if end < 0 {
+			return nil, fmt.Errorf("%w: unterminated integer", ErrInvalidBencode)
+		}
+		digits := string(d.data[d.pos : d.pos+end])
+		n, err := strconv.ParseInt(digits, 10, 64)
+		// Leading zeros and negative zero are not allowed
+		if err != nil || digits != strconv.FormatInt(n, 10) {
+			return nil, fmt.Errorf("%w: bad integer %q", ErrInvalidBencode, digits)
+		}
+		d.pos += end + 1
+		return n, nil
+
+	case c == 'l':
+		d.pos++
+		list := []any{}
+		for d.pos < len(d.data) && d.data[d.pos] != 'e' {
+			item, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+		if d.pos >= len(d.data) {
+			return nil, fmt.Errorf("%w: unterminated list", ErrInvalidBencode)
+		}
+		d.pos++
+		return list, nil
+
+	case c == 'd':
+		d.pos++
+		dict := map[string]any{}
+		for d.pos < len(d.data) && d.data[d.pos] != 'e' {
+			key, err := d.string()
+			if err != nil {
+				return nil, err
+			}
+			item, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			dict[key] = item
+		}
+		if d.pos >= len(d.data) {
+			return nil, fmt.Errorf("%w: unterminated dictionary", ErrInvalidBencode)
+		}
+		d.pos++
+		return dict, nil
+
+	case c >= '0' && c <= '9':
+		return d.string()
+
+	default:
+		return nil, fmt.Errorf("%w: unexpected %q at offset %d", ErrInvalidBencode, c, d.pos)
+	}
+}
+
+// string decodes the byte string at d.pos.
+func (d *decoder) string() (string, error) {
+	colon := bytes.IndexByte(d.data[d.pos:], ':')
+	if colon < 0 {
+		return "", fmt.Errorf("%w: unterminated string length", ErrInvalidBencode)
+	}
+	n, err := strconv.Atoi(string(d.data[d.pos : d.pos+colon]))
+	if err != nil || n < 0 {
+		return "", fmt.Errorf("%w: bad string length at offset %d", ErrInvalidBencode, d.pos)
+	}
+	start := d.pos + colon + 1
+	if n > len(d.data)-start {
+		return "", fmt.Errorf("%w: string runs past the end of data", ErrInvalidBencode)
+	}
+	d.pos = start + n
+	return string(d.data[start:d.pos]), nil
+}
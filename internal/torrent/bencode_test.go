@@ -0,0 +1,63 @@
+package torrent
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMarshal(t *testing.T) {
+	for _, tc := range []struct {
+		v    any
+		want string
+	}{
+		{42, "i42e"},
+		{int64(-7), "i-7e"},
+		{"spam", "4:spam"},
+		{[]byte{0, 'x'}, "2:\x00x"},
+		{"", "0:"},
+		{[]string{"a", "bc"}, "l1:a2:bce"},
+		{[]any{1, "x", []any{}}, "li1e1:xlee"},
+		// Dictionary keys are written in sorted order
+		{map[string]any{"zeta": 1, "alpha": "a", "mid": []string{}}, "d5:alpha1:a3:midle4:zetai1ee"},
+	} {
+		got, err := Marshal(tc.v)
+		if err != nil || string(got) != tc.want {
+			t.Errorf("Marshal(%#v) = %q, %v; want %q", tc.v, got, err, tc.want)
+		}
+	}
+
+	for _, v := range []any{3.5, map[string]any{"x": true}, []any{nil}} {
+		if _, err := Marshal(v); err == nil {
+			t.Errorf("Marshal(%#v) succeeded", v)
+		}
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	v := map[string]any{
+		"int":  int64(-12),
+		"str":  "a:b",
+		"list": []any{int64(1), "x", []any{}},
+		"dict": map[string]any{"k": "v"},
+	}
+	data, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, v) {
+		t.Fatalf("Unmarshal(%q) = %#v, want %#v", data, got, v)
+	}
+
+	deep := strings.Repeat("l", maxBencodeDepth+2) + strings.Repeat("e", maxBencodeDepth+2)
+	for _, bad := range []string{"", "i12", "i012e", "i-0e", "ie", "5:abc", "-1:a", "l1:a", "d1:ai1e", "di1ei2ee", "x", "i1ei2e", deep} {
+		if v, err := Unmarshal([]byte(bad)); !errors.Is(err, ErrInvalidBencode) {
+			t.Errorf("Unmarshal(%q) = %#v, %v; want ErrInvalidBencode", bad, v, err)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package torrent
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+// ErrUnsupported is returned for manifests that have no BitTorrent v2
+// equivalent, and for torrents that have no go-share equivalent.
+var ErrUnsupported = errors.New("no equivalent between manifest and torrent")
+
+// ErrInvalidTorrent is returned by Import for data that isn't a well-formed
+// BitTorrent v2 torrent.
+var ErrInvalidTorrent = errors.New("invalid torrent")
+
+// CreatedBy is recorded as the creator of exported torrents.
+const CreatedBy = "go-share"
+
+// ExportOptions configures Export.
+type ExportOptions struct {
+	// Announce lists the URLs of BitTorrent trackers for the torrent; the
+	// first is its main tracker. go-share trackers don't speak the BitTorrent
+	// tracker protocol, so the manifest's trackers aren't used. Without any,
+	// clients find peers through DHT or peer exchange.
+	Announce []string
+}
+
+// Torrent is a .torrent file created by Export.
+type Torrent struct {
+	Data     []byte   // Bencoded metainfo, as saved in a .torrent file
+	InfoHash [32]byte // SHA-256 of the bencoded info dictionary, the torrent's v2 info hash
+}
+
+// Export converts manifest into a BitTorrent v2 torrent (BEP 52) for the same
+// file, whose content is read from r. BitTorrent v2 hashes each piece as a
+// SHA-256 Merkle tree over 16 KiB blocks rather than as a whole, so the piece
+// hashes are computed from the content, which must still match every chunk of
+// the manifest; otherwise the error wraps file.ErrContentChanged. Each chunk
+// becomes one piece, so the manifest must use fixed-size chunks whose size is
+// a power of two of at least 16 KiB. Directories, ranges, and keyed manifests
+// aren't supported and return an error wrapping ErrUnsupported.
+func Export(manifest *file.Manifest, r io.Reader, opts ExportOptions) (*Torrent, error) {
+	if err := checkExportable(manifest); err != nil {
+		return nil, err
+	}
+
+	// Hash each chunk's blocks, building the piece layer as we go and keeping
+	// the leaves for the root of the whole file's tree
+	pieceWidth := int(manifest.ChunkSize / file.MerkleBlockSize)
+	var leaves [][32]byte
+	var layer []byte
+	for i, chunk := range manifest.Chunks {
+		data := make([]byte, chunk.Size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil, fmt.Errorf("%w: content ends within chunk %d", file.ErrContentChanged, i)
+			}
+			return nil, err
+		}
+		if !manifest.VerifyChunk(chunk, data) {
+			return nil, fmt.Errorf("%w: chunk %d doesn't match the manifest", file.ErrContentChanged, i)
+		}
+		chunkLeaves := file.MerkleLeaves(data)
+		pieceHash := file.MerkleRoot(chunkLeaves, pieceWidth)
+		layer = append(layer, pieceHash[:]...)
+		leaves = append(leaves, chunkLeaves...)
+	}
+	if n, _ := r.Read(make([]byte, 1)); n > 0 {
+		return nil, fmt.Errorf("%w: content is longer than %d bytes", file.ErrContentChanged, manifest.FileSize)
+	}
+
+	// Files of at most one piece are verified by their root alone, so only
+	// larger ones have a piece layer
+	fileEntry := map[string]any{"length": manifest.FileSize}
+	pieceLayers := map[string]any{}
+	if manifest.FileSize > 0 {
+		root := file.MerkleRoot(leaves, file.MerkleWidth(len(leaves)))
+		fileEntry["pieces root"] = root[:]
+		if manifest.FileSize > manifest.ChunkSize {
+			pieceLayers[string(root[:])] = layer
+		}
+	}
+	info := map[string]any{
+		"name":         manifest.FileName,
+		"piece length": manifest.ChunkSize,
+		"meta version": 2,
+		"file tree": map[string]any{
+			manifest.FileName: map[string]any{"": fileEntry},
+		},
+	}
+	infoData, err := Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := map[string]any{
+		"created by":   CreatedBy,
+		"info":         info,
+		"piece layers": pieceLayers,
+	}
+	if len(opts.Announce) > 0 {
+		meta["announce"] = opts.Announce[0]
+	}
+	if len(opts.Announce) > 1 {
+		// Each tracker is its own tier, tried in order
+		tiers := make([]any, len(opts.Announce))
+		for i, url := range opts.Announce {
+			tiers[i] = []string{url}
+		}
+		meta["announce-list"] = tiers
+	}
+	data, err := Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	return &Torrent{Data: data, InfoHash: sha256.Sum256(infoData)}, nil
+}
+
+// checkExportable returns an error wrapping ErrUnsupported if manifest can't
+// be exported by Export.
+func checkExportable(manifest *file.Manifest) error {
+	switch {
+	case manifest.IsDir():
+		return fmt.Errorf("%w: %s is a directory; only single files can be exported", ErrUnsupported, manifest.FileName)
+	case manifest.IsRange():
+		return fmt.Errorf("%w: %s is a byte range of a file", ErrUnsupported, manifest.FileName)
+	case manifest.IsKeyed():
+		return fmt.Errorf("%w: %s uses keyed hashing, which plain piece hashes would defeat", ErrUnsupported, manifest.FileName)
+	case manifest.Chunking != "" && manifest.Chunking != file.ChunkingFixed:
+		return fmt.Errorf("%w: %s uses %s chunking; pieces need %s chunking", ErrUnsupported, manifest.FileName, manifest.Chunking, file.ChunkingFixed)
+	}
+	size := manifest.ChunkSize
+	if size < file.MerkleBlockSize || size&(size-1) != 0 {
+		return fmt.Errorf("%w: chunk size %d is not a power of two of at least %d bytes; rechunk it, e.g. with --chunk-size 1M",
+			ErrUnsupported, size, file.MerkleBlockSize)
+	}
+	return nil
+}
+
+// Import converts the BitTorrent v2 torrent (BEP 52) in data into a manifest
+// for the same file, with one chunk per piece. The manifest uses
+// file.HashingMerkle, so its chunks are verified against the torrent's piece
+// hashes, and its file hash is the file's pieces root. Only torrents of a
+// single file are supported; others, and v1-only torrents, return an error
+// wrapping ErrUnsupported. The torrent's trackers speak the BitTorrent
+// protocol, so they aren't recorded as the manifest's trackers.
+func Import(data []byte) (*file.Manifest, error) {
+	v, err := Unmarshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidTorrent, err)
+	}
+	meta, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: not a dictionary", ErrInvalidTorrent)
+	}
+	info, ok := meta["info"].(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: missing info dictionary", ErrInvalidTorrent)
+	}
+	if version, _ := info["meta version"].(int64); version != 2 {
+		return nil, fmt.Errorf("%w: not a BitTorrent v2 torrent", ErrUnsupported)
+	}
+	pieceLength, _ := info["piece length"].(int64)
+	if pieceLength < file.MerkleBlockSize || pieceLength&(pieceLength-1) != 0 {
+		return nil, fmt.Errorf("%w: piece length %d is not a power of two of at least %d bytes", ErrInvalidTorrent, pieceLength, file.MerkleBlockSize)
+	}
+
+	// A single file is a file tree with one entry, whose "" key holds the
+	// file's details; any other key makes it a directory
+	tree, _ := info["file tree"].(map[string]any)
+	if len(tree) != 1 {
+		return nil, fmt.Errorf("%w: torrent has %d top-level entries; only single-file torrents can be imported", ErrUnsupported, len(tree))
+	}
+	var name string
+	var node map[string]any
+	for name, v = range tree {
+		node, _ = v.(map[string]any)
+	}
+	entry, ok := node[""].(map[string]any)
+	if !ok || len(node) != 1 {
+		return nil, fmt.Errorf("%w: %s is a directory; only single-file torrents can be imported", ErrUnsupported, name)
+	}
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return nil, fmt.Errorf("%w: unsafe file name %q", ErrInvalidTorrent, name)
+	}
+	length, ok := entry["length"].(int64)
+	if !ok || length < 0 {
+		return nil, fmt.Errorf("%w: missing or invalid file length", ErrInvalidTorrent)
+	}
+
+	manifest := &file.Manifest{
+		FileName:  name,
+		FileSize:  length,
+		ChunkSize: pieceLength,
+		Chunks:    []file.Chunk{},
+		Hashing:   file.HashingMerkle,
+	}
+	if length == 0 {
+		manifest.FileHash = fmt.Sprintf("%x", file.MerkleRoot(nil, 1))
+		return manifest, nil
+	}
+	root, _ := entry["pieces root"].(string)
+	if len(root) != sha256.Size {
+		return nil, fmt.Errorf("%w: missing or invalid pieces root", ErrInvalidTorrent)
+	}
+	manifest.FileHash = fmt.Sprintf("%x", root)
+
+	// A file of one piece is verified by its root; larger ones have a layer
+	// of piece hashes, which must add up to the root
+	pieces := int((length + pieceLength - 1) / pieceLength)
+	hashes := [][32]byte{[32]byte([]byte(root))}
+	if pieces > 1 {
+		layers, _ := meta["piece layers"].(map[string]any)
+		layer, _ := layers[root].(string)
+		if len(layer) != pieces*sha256.Size {
+			return nil, fmt.Errorf("%w: piece layer of %s has %d bytes, expected %d", ErrInvalidTorrent, name, len(layer), pieces*sha256.Size)
+		}
+		hashes = make([][32]byte, pieces)
+		for i := range hashes {
+			copy(hashes[i][:], layer[i*sha256.Size:])
+		}
+		if file.MerkleLayerRoot(hashes, int(pieceLength/file.MerkleBlockSize)) != [32]byte([]byte(root)) {
+			return nil, fmt.Errorf("%w: piece layer of %s doesn't match its pieces root", ErrInvalidTorrent, name)
+		}
+	}
+	for i, hash := range hashes {
+		offset := int64(i) * pieceLength
+		manifest.Chunks = append(manifest.Chunks, file.Chunk{
+			Hash:   fmt.Sprintf("%x", hash),
+			Size:   min(pieceLength, length-offset),
+			Offset: offset,
+		})
+	}
+	if err := manifest.Validate(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
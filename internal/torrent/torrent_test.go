@@ -0,0 +1,236 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"maps"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+// pieceSize is the chunk size of test manifests, the smallest a piece can be
+// that spans more than one block.
+const pieceSize = 2 * file.MerkleBlockSize
+
+// testContent returns size bytes of random content and its manifest, with
+// pieceSize chunks.
+func testContent(t *testing.T, size int) ([]byte, *file.Manifest) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	manifest, err := file.CreateManifestFromReader(bytes.NewReader(data), "movie.bin", int64(size), pieceSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, manifest
+}
+
+func TestExport(t *testing.T) {
+	data, manifest := testContent(t, 2*pieceSize+100)
+	announce := []string{"http://tracker.example/announce", "udp://backup.example:6969"}
+	tor, err := Export(manifest, bytes.NewReader(data), ExportOptions{Announce: announce})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The file's root covers every block; the piece layer has the root of
+	// each piece's blocks, the last padded to a full piece
+	root := file.MerkleRoot(file.MerkleLeaves(data), 8)
+	var layer []byte
+	for offset := 0; offset < len(data); offset += pieceSize {
+		piece := file.MerkleRoot(file.MerkleLeaves(data[offset:min(offset+pieceSize, len(data))]), 2)
+		layer = append(layer, piece[:]...)
+	}
+	info := map[string]any{
+		"name":         "movie.bin",
+		"piece length": pieceSize,
+		"meta version": 2,
+		"file tree": map[string]any{
+			"movie.bin": map[string]any{"": map[string]any{"length": len(data), "pieces root": root[:]}},
+		},
+	}
+	want, err := Marshal(map[string]any{
+		"announce":      announce[0],
+		"announce-list": []any{[]string{announce[0]}, []string{announce[1]}},
+		"created by":    CreatedBy,
+		"info":          info,
+		"piece layers":  map[string]any{string(root[:]): layer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tor.Data, want) {
+		t.Fatalf("exported torrent:\n%q\nwant:\n%q", tor.Data, want)
+	}
+	infoData, _ := Marshal(info)
+	if tor.InfoHash != sha256.Sum256(infoData) {
+		t.Fatal("info hash isn't the SHA-256 of the info dictionary")
+	}
+}
+
+func TestExportSinglePiece(t *testing.T) {
+	data, manifest := testContent(t, pieceSize-1)
+	tor, err := Export(manifest, bytes.NewReader(data), ExportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A file of one piece has no piece layer, and no trackers are listed
+	if !bytes.Contains(tor.Data, []byte("12:piece layersdee")) {
+		t.Fatalf("single-piece torrent has piece layers: %q", tor.Data)
+	}
+	if bytes.Contains(tor.Data, []byte("announce")) {
+		t.Fatalf("torrent without trackers announces: %q", tor.Data)
+	}
+}
+
+func TestExportRejects(t *testing.T) {
+	data, manifest := testContent(t, 2*pieceSize+100)
+
+	// Content that no longer matches the manifest
+	changed := bytes.Clone(data)
+	changed[pieceSize+1] ^= 0xff
+	for name, content := range map[string][]byte{"changed": changed, "short": data[:len(data)-1], "long": append(bytes.Clone(data), 0)} {
+		if _, err := Export(manifest, bytes.NewReader(content), ExportOptions{}); !errors.Is(err, file.ErrContentChanged) {
+			t.Errorf("%s content: Export returned %v, want ErrContentChanged", name, err)
+		}
+	}
+
+	// Manifests without a BitTorrent v2 equivalent
+	path := filepath.Join(t.TempDir(), "movie.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	oddSize, err := file.CreateManifest(path, pieceSize+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, err := file.CreateManifest(path, file.MerkleBlockSize/2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cdc, err := file.CreateManifestCDC(path, pieceSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyed, err := file.CreateKeyedManifest(path, pieceSize, bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranged, err := file.CreateRangeManifest(path, pieceSize, 0, pieceSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, m := range map[string]*file.Manifest{"odd chunk size": oddSize, "small chunks": small, "CDC": cdc, "keyed": keyed, "range": ranged} {
+		if _, err := Export(m, bytes.NewReader(data), ExportOptions{}); !errors.Is(err, ErrUnsupported) {
+			t.Errorf("%s manifest: Export returned %v, want ErrUnsupported", name, err)
+		}
+	}
+}
+
+func TestImportExported(t *testing.T) {
+	for _, size := range []int{3*pieceSize + 5000, pieceSize - 1, 3 * file.MerkleBlockSize / 2, 0} {
+		data, manifest := testContent(t, size)
+		tor, err := Export(manifest, bytes.NewReader(data), ExportOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		imported, err := Import(tor.Data)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if imported.FileName != manifest.FileName || imported.FileSize != manifest.FileSize || len(imported.Chunks) != len(manifest.Chunks) {
+			t.Fatalf("%d bytes: imported %s of %d bytes in %d chunks, want %s of %d bytes in %d",
+				size, imported.FileName, imported.FileSize, len(imported.Chunks), manifest.FileName, manifest.FileSize, len(manifest.Chunks))
+		}
+
+		// The imported manifest verifies the same content, chunk by chunk
+		// and as a whole
+		for i, chunk := range imported.Chunks {
+			if chunk.Offset != manifest.Chunks[i].Offset || chunk.Size != manifest.Chunks[i].Size {
+				t.Fatalf("%d bytes: chunk %d at %d of %d bytes, want the exported layout", size, i, chunk.Offset, chunk.Size)
+			}
+			piece := data[chunk.Offset : chunk.Offset+chunk.Size]
+			if !imported.VerifyChunk(chunk, piece) {
+				t.Fatalf("%d bytes: chunk %d doesn't verify", size, i)
+			}
+			if len(piece) > 0 && imported.VerifyChunk(chunk, append(bytes.Clone(piece[1:]), piece[0]^1)) {
+				t.Fatalf("%d bytes: altered chunk %d verifies", size, i)
+			}
+		}
+		path := filepath.Join(t.TempDir(), "movie.bin")
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		report, err := file.VerifyFile(imported, path)
+		if err != nil || !report.OK() {
+			t.Fatalf("%d bytes: the file doesn't verify against the imported manifest: %+v, %v", size, report, err)
+		}
+	}
+}
+
+func TestImportRejects(t *testing.T) {
+	data, manifest := testContent(t, 3*pieceSize)
+	tor, err := Export(manifest, bytes.NewReader(data), ExportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := Unmarshal(tor.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := v.(map[string]any)
+	info := meta["info"].(map[string]any)
+
+	// edit returns the torrent with change applied to a copy of its metainfo
+	edit := func(change func(meta, info map[string]any)) []byte {
+		t.Helper()
+		metaCopy := maps.Clone(meta)
+		infoCopy := maps.Clone(info)
+		metaCopy["info"] = infoCopy
+		change(metaCopy, infoCopy)
+		data, err := Marshal(metaCopy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	entry := map[string]any{"": map[string]any{"length": int64(1)}}
+
+	for name, tc := range map[string]struct {
+		data []byte
+		want error
+	}{
+		"garbage":   {[]byte("not bencoded"), ErrInvalidTorrent},
+		"list":      {[]byte("le"), ErrInvalidTorrent},
+		"v1":        {edit(func(_, info map[string]any) { delete(info, "meta version") }), ErrUnsupported},
+		"odd piece": {edit(func(_, info map[string]any) { info["piece length"] = int64(pieceSize + 1) }), ErrInvalidTorrent},
+		"two files": {edit(func(_, info map[string]any) {
+			info["file tree"] = map[string]any{"a": entry, "b": entry}
+		}), ErrUnsupported},
+		"directory": {edit(func(_, info map[string]any) {
+			info["file tree"] = map[string]any{"dir": map[string]any{"a": entry}}
+		}), ErrUnsupported},
+		"unsafe name": {edit(func(_, info map[string]any) {
+			info["file tree"] = map[string]any{"..": entry}
+		}), ErrInvalidTorrent},
+		"no layer": {edit(func(meta, _ map[string]any) { meta["piece layers"] = map[string]any{} }), ErrInvalidTorrent},
+		"tampered layer": {edit(func(meta, _ map[string]any) {
+			layers := map[string]any{}
+			for root, layer := range meta["piece layers"].(map[string]any) {
+				l := []byte(layer.(string))
+				l[0] ^= 1
+				layers[root] = string(l)
+			}
+			meta["piece layers"] = layers
+		}), ErrInvalidTorrent},
+	} {
+		if _, err := Import(tc.data); !errors.Is(err, tc.want) {
+			t.Errorf("%s: Import returned %v, want %v", name, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package tracker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func TestCleanBasePath(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"", ""},
+		{"/", ""},
+		{"goshare", "/goshare"},
+		{"/goshare/", "/goshare"},
+		{"//a//b/", "/a/b"},
+	} {
+		if got := cleanBasePath(tc.in); got != tc.want {
+			t.Errorf("cleanBasePath(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestBasePathBehindProxy(t *testing.T) {
+	tr := NewTracker()
+	tr.BasePath = "goshare/"
+	backend := httptest.NewServer(tr.Handler())
+	t.Cleanup(backend.Close)
+	target, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The proxy passes the path on unchanged
+	proxy := httptest.NewServer(httputil.NewSingleHostReverseProxy(target))
+	t.Cleanup(proxy.Close)
+	ctx := context.Background()
+
+	// Clients reach every endpoint through the tracker URL with the prefix,
+	// with or without a trailing slash
+	seeder := Peer{Address: "10.0.0.1", Port: 9000}
+	for _, base := range []string{proxy.URL + "/goshare", proxy.URL + "/goshare/"} {
+		c := NewTrackerClient(base, 0)
+		if err := c.Announce(ctx, AnnounceRequest{FileHash: "abc", Address: seeder.Address, Port: seeder.Port}); err != nil {
+			t.Fatalf("announce through %s: %v", base, err)
+		}
+		peers, err := c.GetPeers(ctx, "abc")
+		if err != nil || !slices.Equal(peers, []Peer{seeder}) {
+			t.Fatalf("peers through %s: %v, %v", base, peers, err)
+		}
+		if health, err := c.Health(ctx); err != nil || health.Peers != 1 {
+			t.Fatalf("health through %s: %+v, %v", base, health, err)
+		}
+	}
+
+	// The endpoints are no longer served at the root
+	if _, err := NewTrackerClient(proxy.URL, 0).GetPeers(ctx, "abc"); err == nil {
+		t.Fatal("peers listed outside the base path")
+	}
+	resp, err := http.Get(proxy.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("health check outside the base path answered %s", resp.Status)
+	}
+}
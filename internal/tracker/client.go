@@ -0,0 +1,409 @@
+// Package tracker implements the central server that keeps track of which peers have which files.
+// It maintains a registry of peers and their shared files, allowing other peers to discover
+// where they can download specific files from.
+package tracker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+// DefaultTrackerURL is the tracker address used when none is configured.
+const DefaultTrackerURL = "http://localhost:8080"
+
+// DefaultRequestTimeout bounds every tracker request, including reading the
+// response body, so a hung tracker can't block a client forever.
+const DefaultRequestTimeout = 10 * time.Second
+
+// DefaultAnnounceInterval is how often a seeder re-announces itself so that it stays
+// registered if the tracker restarts, unless the tracker's PeerTTL calls for
+// announcing more often; see AnnounceInterval.
+const DefaultAnnounceInterval = 5 * time.Minute
+
+// AnnounceInterval returns how often to re-announce to a tracker that keeps
+// peers listed for peerTTL, given the configured interval. Without a TTL the
+// interval is used as is, or DefaultAnnounceInterval if it isn't positive.
+// With one, an interval that isn't positive, or long enough that a single
+// failed announce would let the registration lapse (over half the TTL), is
+// replaced by a third of the TTL, which leaves room for two failures in a row.
+func AnnounceInterval(interval, peerTTL time.Duration) time.Duration {
+	if peerTTL <= 0 {
+		if interval <= 0 {
+			return DefaultAnnounceInterval
+		}
+		return interval
+	}
+	if interval <= 0 || interval > peerTTL/2 {
+		return peerTTL / 3
+	}
+	return interval
+}
+
+// Announce retries transient failures, network errors and 5xx responses, up to
+// announceAttempts times in total, doubling the wait between attempts from
+// announceBackoff.
+const (
+	announceAttempts = 4
+	announceBackoff  = 500 * time.Millisecond
+)
+
+// sharedTransport is reused by every TrackerClient so that repeated announces and
+// peer queries share a pool of keep-alive connections instead of dialing each time.
+var sharedTransport = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout:   5 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          100,
+	MaxIdleConnsPerHost:   10,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   5 * time.Second,
+	ResponseHeaderTimeout: 10 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+}
+
+// longPollTransport is sharedTransport without its ResponseHeaderTimeout, for
+// long-polls, whose response only starts once the tracker stops waiting.
+var longPollTransport = func() *http.Transport {
+	t := sharedTransport.Clone()
+	t.ResponseHeaderTimeout = 0
+	return t
+}()
+
+// TrackerClient is an HTTP client for a tracker server.
+// It is safe for concurrent use.
+type TrackerClient struct {
+	baseURL string       // Tracker URL without a trailing slash, e.g. http://localhost:8080
+	http    *http.Client // Client with a pooled transport and overall timeout
+
+	attempts int           // Announce attempts before giving up on transient failures
+	backoff  time.Duration // Wait before the first announce retry
+
+	peerTTL atomic.Int64 // PeerTTL reported by the last successful announce, in nanoseconds
+}
+
+// NewTrackerClient creates a client for the tracker at baseURL. The URL may
+// include a path, such as https://host/goshare for a tracker served under a
+// base path behind a reverse proxy; the endpoints are requested under it.
+// Requests that take longer than timeout fail; a zero timeout uses DefaultRequestTimeout.
+func NewTrackerClient(baseURL string, timeout time.Duration) *TrackerClient {
+	if timeout <= 0 {
+		timeout = DefaultRequestTimeout
+	}
+	return &TrackerClient{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		http: &http.Client{
+			Transport: sharedTransport,
+			Timeout:   timeout,
+		},
+		attempts: announceAttempts,
+		backoff:  announceBackoff,
+	}
+}
+
+// statusError is returned when the tracker answers with an unexpected status.
+type statusError struct {
+	op     string // What the request was doing, e.g. "announce file"
+	status string // Status line, e.g. "503 Service Unavailable"
+	code   int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("failed to %s: %s", e.op, e.status)
+}
+
+// retryable reports whether a failed request may succeed if repeated: the tracker
+// couldn't be reached or answered with a server error. Client errors and
+// cancellation are final.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code >= 500
+	}
+	return true
+}
+
+// post sends a JSON POST request to u.
+func (c *TrackerClient) post(ctx context.Context, u string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return c.http.Do(req)
+}
+
+// get sends a GET request to u.
+func (c *TrackerClient) get(ctx context.Context, u string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.http.Do(req)
+}
+
+// Announce tells the tracker that a peer is serving the file in req.
+// Network errors and 5xx responses, such as a 503 while the tracker restarts, are
+// retried with exponential backoff a few times; other failures are returned at once.
+func (c *TrackerClient) Announce(ctx context.Context, req AnnounceRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to marshal announce request: %v", err)
+	}
+
+	backoff := c.backoff
+	for attempt := 1; ; attempt++ {
+		err := c.announceOnce(ctx, data)
+		if err == nil || attempt >= c.attempts || !retryable(ctx, err) {
+			return err
+		}
+
+		// Wait before trying again, unless ctx ends first
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// announceOnce sends a single announce request with the encoded AnnounceRequest,
+// and records the PeerTTL the tracker answers with.
+func (c *TrackerClient) announceOnce(ctx context.Context, data []byte) error {
+	resp, err := c.post(ctx, c.baseURL+"/announce", data)
+	if err != nil {
+		return fmt.Errorf("failed to announce file: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{op: "announce file", status: resp.Status, code: resp.StatusCode}
+	}
+
+	// Older trackers answer without a body, and never expire peers, so a
+	// body that can't be decoded counts as no TTL
+	var announceResp AnnounceResponse
+	json.NewDecoder(io.LimitReader(resp.Body, 1<<10)).Decode(&announceResp)
+	c.peerTTL.Store(int64(time.Duration(announceResp.PeerTTL) * time.Second))
+	return nil
+}
+
+// PeerTTL returns how long the tracker keeps a peer listed without hearing
+// from it, as reported by the last successful announce, or 0 if it never
+// expires peers or hasn't been announced to yet.
+func (c *TrackerClient) PeerTTL() time.Duration {
+	return time.Duration(c.peerTTL.Load())
+}
+
+// Unannounce tells the tracker that a peer has stopped serving the file in req.
+func (c *TrackerClient) Unannounce(ctx context.Context, req AnnounceRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to marshal unannounce request: %v", err)
+	}
+
+	resp, err := c.post(ctx, c.baseURL+"/unannounce", data)
+	if err != nil {
+		return fmt.Errorf("failed to unannounce file: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to unannounce file: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// KeepAnnounced re-announces req periodically until ctx is cancelled, then sends a
+// final unannounce so the tracker stops handing out this peer. The caller is
+// expected to have made the initial announce with c, at once, so that the
+// tracker's PeerTTL is known. Announces are spaced by AnnounceInterval of
+// interval and the TTL reported by the latest announce, so that the
+// registration never lapses. Announce failures are passed to onError (if
+// non-nil) and retried at the next interval. It returns the result of the
+// final unannounce.
+func (c *TrackerClient) KeepAnnounced(ctx context.Context, req AnnounceRequest, interval time.Duration, onError func(error)) error {
+	for {
+		timer := time.NewTimer(AnnounceInterval(interval, c.PeerTTL()))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			// ctx is already done, so the final unannounce gets a fresh one
+			return c.Unannounce(context.Background(), req)
+		case <-timer.C:
+			if err := c.Announce(ctx, req); err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// GetPeers asks the tracker which peers are serving the file with the given hash.
+// The tracker returns a random subset of at most DefaultPeersLimit of them.
+func (c *TrackerClient) GetPeers(ctx context.Context, fileHash string) ([]Peer, error) {
+	return c.GetPeersLimit(ctx, fileHash, 0)
+}
+
+// GetPeersLimit is like GetPeers, but asks for at most limit peers. A limit
+// of 0 leaves the choice to the tracker.
+func (c *TrackerClient) GetPeersLimit(ctx context.Context, fileHash string, limit int) ([]Peer, error) {
+	u := c.baseURL + "/peers?fileHash=" + url.QueryEscape(fileHash)
+	if limit > 0 {
+		u += "&limit=" + strconv.Itoa(limit)
+	}
+	resp, err := c.get(ctx, u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get peers: %w", err)
+	}
+	return decodePeers(resp)
+}
+
+// WaitPeers long-polls the tracker for the peers serving the file with the
+// given hash: the tracker answers once they change, or after wait (at most
+// MaxPeersWait), with the peers as they are then. Trackers without long-polls
+// answer at once, so callers looping over WaitPeers should compare the peers
+// with the previous ones rather than assume they changed.
+func (c *TrackerClient) WaitPeers(ctx context.Context, fileHash string, wait time.Duration) ([]Peer, error) {
+	u := c.baseURL + "/peers?fileHash=" + url.QueryEscape(fileHash) + "&wait=" + url.QueryEscape(wait.String())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// The request timeout applies on top of the wait
+	client := &http.Client{Transport: longPollTransport, Timeout: c.http.Timeout + min(wait, MaxPeersWait)}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get peers: %w", err)
+	}
+	return decodePeers(resp)
+}
+
+// decodePeers reads the peers from a response of the /peers endpoint and
+// closes its body.
+func decodePeers(resp *http.Response) ([]Peer, error) {
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get peers: %s", resp.Status)
+	}
+
+	var peersResp PeersResponse
+	if err := json.NewDecoder(resp.Body).Decode(&peersResp); err != nil {
+		return nil, fmt.Errorf("failed to decode peers response: %v", err)
+	}
+
+	return peersResp.Peers, nil
+}
+
+// CountPeers asks the tracker how many peers are serving the file with the
+// given hash, without fetching the peers themselves.
+func (c *TrackerClient) CountPeers(ctx context.Context, fileHash string) (int, error) {
+	resp, err := c.get(ctx, c.baseURL+"/count?fileHash="+url.QueryEscape(fileHash))
+	if err != nil {
+		return 0, fmt.Errorf("failed to count peers: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("failed to count peers: %s", resp.Status)
+	}
+
+	var countResp CountResponse
+	if err := json.NewDecoder(resp.Body).Decode(&countResp); err != nil {
+		return 0, fmt.Errorf("failed to decode count response: %v", err)
+	}
+
+	return countResp.Peers, nil
+}
+
+// UploadManifest stores a manifest on the tracker, indexed by its file hash.
+// The tracker must be running with manifest storage enabled. The manifest's
+// access token, if any, isn't uploaded.
+func (c *TrackerClient) UploadManifest(ctx context.Context, manifest *file.Manifest) error {
+	data, err := json.Marshal(manifest.WithoutAccessToken())
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %v", err)
+	}
+
+	u := c.baseURL + "/manifest?fileHash=" + url.QueryEscape(manifest.FileHash)
+	resp, err := c.post(ctx, u, data)
+	if err != nil {
+		return fmt.Errorf("failed to upload manifest: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to upload manifest: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// GetManifest fetches the manifest for the file with the given hash from the tracker.
+// The returned manifest is checked to describe the requested file, with a valid
+// chunk layout.
+func (c *TrackerClient) GetManifest(ctx context.Context, fileHash string) (*file.Manifest, error) {
+	resp, err := c.get(ctx, c.baseURL+"/manifest?fileHash="+url.QueryEscape(fileHash))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get manifest: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get manifest: %s", resp.Status)
+	}
+
+	// A hostile tracker can't exhaust memory with a huge manifest
+	manifest, err := file.ReadManifest(resp.Body, file.DefaultMaxManifestSize)
+	if err != nil {
+		return nil, fmt.Errorf("tracker returned a bad manifest: %w", err)
+	}
+	if manifest.FileHash != fileHash {
+		return nil, fmt.Errorf("%w: tracker returned manifest for %s, expected %s", file.ErrManifestMismatch, manifest.FileHash, fileHash)
+	}
+
+	return manifest, nil
+}
+
+// Health asks the tracker whether it is up, as liveness probes do, and returns
+// the size of its registry.
+func (c *TrackerClient) Health(ctx context.Context) (*HealthResponse, error) {
+	resp, err := c.get(ctx, c.baseURL+"/healthz")
+	if err != nil {
+		return nil, fmt.Errorf("failed to check tracker health: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to check tracker health: %s", resp.Status)
+	}
+
+	var health HealthResponse
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		return nil, fmt.Errorf("failed to decode health response: %v", err)
+	}
+	return &health, nil
+}
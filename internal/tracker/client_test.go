@@ -0,0 +1,261 @@
+package tracker
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTrackerClientReusesConnections(t *testing.T) {
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(NewTracker().Handler())
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	c := NewTrackerClient(srv.URL, 0)
+	ctx := context.Background()
+	if err := c.Announce(ctx, AnnounceRequest{FileHash: "abc", Address: "10.0.0.1", Port: 9000}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := c.GetPeers(ctx, "abc"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A second client shares the pool too
+	if _, err := NewTrackerClient(srv.URL, 0).GetPeers(ctx, "abc"); err != nil {
+		t.Fatal(err)
+	}
+	if n := conns.Load(); n != 1 {
+		t.Fatalf("7 requests opened %d connections, want 1 kept alive", n)
+	}
+}
+
+func TestTrackerClientTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	c := NewTrackerClient(srv.URL, 50*time.Millisecond)
+	start := time.Now()
+	if _, err := c.GetPeers(context.Background(), "abc"); err == nil {
+		t.Fatal("GetPeers succeeded against a hung tracker")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("GetPeers gave up after %v, want about 50ms", elapsed)
+	}
+}
+
+func TestKeepAnnouncedReannouncesAndUnannounces(t *testing.T) {
+	tr := NewTracker()
+	var announces atomic.Int32
+	handler := tr.Handler()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/announce" {
+			announces.Add(1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	c := NewTrackerClient(srv.URL, 0)
+	req := AnnounceRequest{FileHash: "abc", Address: "10.0.0.1", Port: 9000}
+	if err := c.Announce(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.KeepAnnounced(ctx, req, 20*time.Millisecond, func(err error) { t.Error(err) }) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for announces.Load() < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := announces.Load(); n < 3 {
+		t.Fatalf("tracker saw %d announces, want repeated ones", n)
+	}
+
+	// Stopping unannounces the peer
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("final unannounce: %v", err)
+	}
+	peers, err := c.GetPeers(context.Background(), "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 0 {
+		t.Fatalf("peers %v still listed after KeepAnnounced stopped", peers)
+	}
+}
+
+func TestUnannounceRemovesOnlyThatPeer(t *testing.T) {
+	_, c := startTracker(t, NewTracker())
+	ctx := context.Background()
+	for _, port := range []int{9000, 9001} {
+		if err := c.Announce(ctx, AnnounceRequest{FileHash: "abc", Address: "10.0.0.1", Port: port}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Unannounce(ctx, AnnounceRequest{FileHash: "abc", Address: "10.0.0.1", Port: 9000}); err != nil {
+		t.Fatal(err)
+	}
+	peers, err := c.GetPeers(ctx, "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0] != (Peer{Address: "10.0.0.1", Port: 9001}) {
+		t.Fatalf("peers after unannounce: %v", peers)
+	}
+}
+
+func TestAnnounceRetriesServerErrors(t *testing.T) {
+	tracker := NewTracker().Handler()
+	var requests, failures, status atomic.Int32
+	failures.Store(2)
+	status.Store(http.StatusServiceUnavailable)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if failures.Add(-1) >= 0 {
+			http.Error(w, "restarting", int(status.Load()))
+			return
+		}
+		tracker.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	c := NewTrackerClient(srv.URL, 0)
+	c.backoff = time.Millisecond
+	ctx := context.Background()
+	req := AnnounceRequest{FileHash: "abc", Address: "10.0.0.1", Port: 9000}
+
+	// Two 503s, then the announce goes through
+	if err := c.Announce(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if n := requests.Load(); n != 3 {
+		t.Fatalf("announce took %d requests, want 3", n)
+	}
+	if peers, err := c.GetPeers(ctx, "abc"); err != nil || len(peers) != 1 {
+		t.Fatalf("tracker lists %v, %v after the retried announce", peers, err)
+	}
+
+	// A tracker that keeps failing is given up on after the allowed attempts
+	requests.Store(0)
+	failures.Store(100)
+	if err := c.Announce(ctx, req); err == nil {
+		t.Fatal("announce succeeded against a failing tracker")
+	}
+	if n := requests.Load(); int(n) != c.attempts {
+		t.Fatalf("announce made %d requests, want %d attempts", n, c.attempts)
+	}
+
+	// Client errors aren't retried
+	requests.Store(0)
+	failures.Store(100)
+	status.Store(http.StatusBadRequest)
+	if err := c.Announce(ctx, req); err == nil {
+		t.Fatal("announce succeeded despite a 400")
+	}
+	if n := requests.Load(); n != 1 {
+		t.Fatalf("a 400 was retried: %d requests", n)
+	}
+}
+
+func TestAnnounceInterval(t *testing.T) {
+	for _, tc := range []struct{ interval, ttl, want time.Duration }{
+		{0, 0, DefaultAnnounceInterval},
+		{time.Minute, 0, time.Minute},
+		{0, 15 * time.Minute, 5 * time.Minute},
+		{time.Minute, 15 * time.Minute, time.Minute},
+		{7 * time.Minute, 15 * time.Minute, 7 * time.Minute},
+		// One failed announce at over half the TTL would let the peer lapse
+		{8 * time.Minute, 15 * time.Minute, 5 * time.Minute},
+		{time.Hour, 30 * time.Second, 10 * time.Second},
+	} {
+		if got := AnnounceInterval(tc.interval, tc.ttl); got != tc.want {
+			t.Errorf("AnnounceInterval(%v, %v) = %v, want %v", tc.interval, tc.ttl, got, tc.want)
+		}
+	}
+}
+
+func TestAnnounceReportsPeerTTL(t *testing.T) {
+	tr := NewTracker()
+	tr.PeerTTL = 90 * time.Second
+	_, c := startTracker(t, tr)
+	if c.PeerTTL() != 0 {
+		t.Fatalf("PeerTTL is %v before any announce", c.PeerTTL())
+	}
+	if err := c.Announce(context.Background(), AnnounceRequest{FileHash: "abc", Address: "10.0.0.1", Port: 9000}); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.PeerTTL(); got != tr.PeerTTL {
+		t.Fatalf("PeerTTL is %v after an announce, want %v", got, tr.PeerTTL)
+	}
+
+	// Older trackers answer announces without a body, and keep peers listed
+	old := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer old.Close()
+	c = NewTrackerClient(old.URL, 0)
+	if err := c.Announce(context.Background(), AnnounceRequest{FileHash: "abc", Address: "10.0.0.1", Port: 9000}); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.PeerTTL(); got != 0 {
+		t.Fatalf("PeerTTL is %v from a tracker without one", got)
+	}
+}
+
+func TestKeepAnnouncedWithinPeerTTL(t *testing.T) {
+	tr := NewTracker()
+	tr.PeerTTL = time.Second
+	var announces atomic.Int32
+	handler := tr.Handler()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/announce" {
+			announces.Add(1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	c := NewTrackerClient(srv.URL, 0)
+	req := AnnounceRequest{FileHash: "abc", Address: "10.0.0.1", Port: 9000}
+	if err := c.Announce(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	// An interval far longer than the TTL is shortened to a third of it
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.KeepAnnounced(ctx, req, time.Hour, nil) }()
+	time.Sleep(1200 * time.Millisecond)
+	peers, err := c.GetPeers(context.Background(), "abc")
+	cancel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 {
+		t.Fatalf("peer lapsed while KeepAnnounced ran: listed %v", peers)
+	}
+	if n := announces.Load(); n < 3 {
+		t.Fatalf("tracker saw %d announces in over its TTL, want one every third of it", n)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,32 @@
+package tracker
+
+import (
+	"bytes"
+	"math/rand"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+// startTracker serves t over HTTP until the test ends, and returns a client
+// for it.
+func startTracker(tb testing.TB, t *Tracker) (*httptest.Server, *TrackerClient) {
+	tb.Helper()
+	srv := httptest.NewServer(t.Handler())
+	tb.Cleanup(srv.Close)
+	return srv, NewTrackerClient(srv.URL, 0)
+}
+
+// testManifest returns the manifest of size bytes of random content, split
+// into 1 KB chunks.
+func testManifest(tb testing.TB, size int) *file.Manifest {
+	tb.Helper()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	manifest, err := file.CreateManifestFromReader(bytes.NewReader(data), "shared.bin", int64(size), 1<<10)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return manifest
+}
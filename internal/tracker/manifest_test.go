@@ -0,0 +1,213 @@
+package tracker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+func TestManifestStorage(t *testing.T) {
+	tr := NewTracker()
+	tr.StoreManifests = true
+	_, c := startTracker(t, tr)
+	ctx := context.Background()
+	manifest := testManifest(t, 10<<10)
+
+	if _, err := c.GetManifest(ctx, manifest.FileHash); err == nil {
+		t.Fatal("GetManifest succeeded before any upload")
+	}
+	if err := c.UploadManifest(ctx, manifest); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.GetManifest(ctx, manifest.FileHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, manifest) {
+		t.Fatalf("GetManifest returned %+v, want the uploaded manifest", got)
+	}
+}
+
+func TestManifestStorageDisabled(t *testing.T) {
+	_, c := startTracker(t, NewTracker())
+	manifest := testManifest(t, 4<<10)
+	if err := c.UploadManifest(context.Background(), manifest); err == nil {
+		t.Fatal("UploadManifest succeeded without StoreManifests")
+	}
+}
+
+func TestManifestUploadRejectsWrongHash(t *testing.T) {
+	tr := NewTracker()
+	tr.StoreManifests = true
+	srv, _ := startTracker(t, tr)
+
+	manifest := testManifest(t, 4<<10)
+	body, _ := json.Marshal(manifest)
+	resp, err := http.Post(srv.URL+"/manifest?fileHash=other", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("upload under another hash answered %s, want 400", resp.Status)
+	}
+
+	// Chunks that don't describe the file are refused too
+	manifest.Chunks = manifest.Chunks[1:]
+	body, _ = json.Marshal(manifest)
+	resp, err = http.Post(srv.URL+"/manifest?fileHash="+manifest.FileHash, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("upload of an invalid manifest answered %s, want 400", resp.Status)
+	}
+}
+
+func TestGetManifestChecksFileHash(t *testing.T) {
+	// A tracker answering with the manifest of another file
+	other := testManifest(t, 4<<10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(other)
+	}))
+	defer srv.Close()
+
+	_, err := NewTrackerClient(srv.URL, 0).GetManifest(context.Background(), "wanted")
+	if !errors.Is(err, file.ErrManifestMismatch) {
+		t.Fatalf("GetManifest returned %v, want ErrManifestMismatch", err)
+	}
+}
+
+func TestManifestStorageDropsAccessToken(t *testing.T) {
+	tr := NewTracker()
+	tr.StoreManifests = true
+	srv, c := startTracker(t, tr)
+	ctx := context.Background()
+	manifest := testManifest(t, 4<<10)
+	manifest.AccessToken = "secret"
+
+	// The client leaves the token out, and the tracker never keeps one
+	if err := c.UploadManifest(ctx, manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.AccessToken != "secret" {
+		t.Fatal("UploadManifest removed the token from the caller's manifest")
+	}
+	body, _ := json.Marshal(manifest)
+	resp, err := http.Post(srv.URL+"/manifest?fileHash="+manifest.FileHash, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload with a token answered %s", resp.Status)
+	}
+
+	got, err := c.GetManifest(ctx, manifest.FileHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.AccessToken != "" {
+		t.Fatalf("tracker handed out the access token %q", got.AccessToken)
+	}
+}
+
+func TestManifestETagAndGzip(t *testing.T) {
+	tr := NewTracker()
+	tr.StoreManifests = true
+	srv, c := startTracker(t, tr)
+	manifest := testManifest(t, 64<<10)
+	if err := c.UploadManifest(context.Background(), manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	// get fetches the manifest with the given request headers, without the
+	// client decompressing it
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	get := func(header http.Header) (*http.Response, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/manifest?fileHash="+manifest.FileHash, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header = header
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, body
+	}
+
+	resp, plain := get(http.Header{})
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || etag != `"`+manifest.FileHash+`"` || resp.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("plain GET answered %s with ETag %q and encoding %q", resp.Status, etag, resp.Header.Get("Content-Encoding"))
+	}
+	var got file.Manifest
+	if err := json.Unmarshal(plain, &got); err != nil || got.FileHash != manifest.FileHash {
+		t.Fatalf("plain body isn't the manifest: %v", err)
+	}
+
+	resp, gzipped := get(http.Header{"Accept-Encoding": {"gzip"}})
+	if resp.Header.Get("Content-Encoding") != "gzip" || len(gzipped) >= len(plain) {
+		t.Fatalf("gzip GET answered encoding %q with %d bytes, plain is %d", resp.Header.Get("Content-Encoding"), len(gzipped), len(plain))
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(gzipped))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unzipped, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromGzip file.Manifest
+	if err := json.Unmarshal(unzipped, &fromGzip); err != nil || !reflect.DeepEqual(fromGzip, got) {
+		t.Fatalf("gzip body doesn't decode to the same manifest: %v", err)
+	}
+
+	for _, inm := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		resp, body := get(http.Header{"If-None-Match": {inm}})
+		if resp.StatusCode != http.StatusNotModified || len(body) != 0 {
+			t.Errorf("If-None-Match %s answered %s with %d bytes, want 304 without a body", inm, resp.Status, len(body))
+		}
+	}
+	if resp, _ := get(http.Header{"If-None-Match": {`"other"`}}); resp.StatusCode != http.StatusOK {
+		t.Errorf("If-None-Match of another ETag answered %s", resp.Status)
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, want := range map[string]bool{
+		"":                      false,
+		"gzip":                  true,
+		"GZIP":                  true,
+		"br, gzip;q=0.5":        true,
+		"gzip;q=0":              false,
+		"gzip; q=0.0":           false,
+		"identity":              false,
+		"*":                     true,
+		"*;q=0":                 false,
+		"gzip;q=0, *":           false,
+		"deflate, *;q=0.1":      true,
+		"br;q=1.0, deflate;q=0": false,
+	} {
+		if got := acceptsGzip(header); got != want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
@@ -4,10 +4,19 @@
 package tracker
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
+	"math/rand"
 	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/timskillet/go-share/internal/file"
 )
 
 // Peer represents a node in the network that can serve files.
@@ -20,17 +29,61 @@ type Peer struct {
 // Tracker is the central server that maintains the peer registry.
 // It uses a thread-safe map to store which peers have which files.
 type Tracker struct {
-	mu    sync.RWMutex      // Mutex to protect concurrent access to the peers map
-	peers map[string][]Peer // Map of file hashes to list of peers that have the file
+	// StoreManifests enables the /manifest endpoint, letting peers upload manifests
+	// so that downloaders who only know a file hash can fetch them centrally.
+	StoreManifests bool
+
+	// AdminToken authorizes admin endpoints such as DELETE /peer. Requests must
+	// send it as "Authorization: Bearer <token>". Admin endpoints are disabled
+	// when it is empty.
+	AdminToken string
+
+	// PeerTTL, if positive, is how long a peer stays listed after it last
+	// announced a file, so that seeders that went away without unannouncing
+	// drop out of the swarm. Seeders learn it from the announce response and
+	// re-announce well within it. Peers are listed until unannounced if it
+	// is zero.
+	PeerTTL time.Duration
+
+	// BasePath, if set, is the path prefix Handler serves the endpoints
+	// under, e.g. "/goshare" for a tracker reached as https://host/goshare
+	// through a reverse proxy that passes the path on unchanged. Clients are
+	// then given the tracker URL with the prefix.
+	BasePath string
+
+	mu        sync.RWMutex                  // Mutex to protect concurrent access to the maps below
+	peers     map[string][]Peer             // Map of file hashes to list of peers that have the file
+	seen      map[string]map[Peer]time.Time // Map of file hashes to when each of their peers last announced
+	swept     time.Time                     // When expired peers were last removed
+	manifests map[string]*storedManifest    // Map of file hashes to uploaded manifests
+	changed   map[string]*peerWait          // Map of file hashes to the clients waiting for their peers to change
+}
+
+// peerWait is the set of long-polling clients waiting for the peers of one
+// file to change.
+type peerWait struct {
+	ch      chan struct{} // Closed when the peers change
+	waiters int           // Number of clients waiting on ch
 }
 
-// NewTracker creates and returns a new Tracker instance with an initialized peers map.
+// NewTracker creates and returns a new Tracker instance with initialized maps.
 func NewTracker() *Tracker {
 	return &Tracker{
-		peers: make(map[string][]Peer),
+		peers:     make(map[string][]Peer),
+		seen:      make(map[string]map[Peer]time.Time),
+		manifests: make(map[string]*storedManifest),
+		changed:   make(map[string]*peerWait),
 	}
 }
 
+// DefaultPeerTTL is the PeerTTL the tracker command runs with unless told
+// otherwise, three times DefaultAnnounceInterval.
+const DefaultPeerTTL = 3 * DefaultAnnounceInterval
+
+// maxManifestUploadSize limits the size of manifests accepted by the tracker,
+// which is the size every manifest the tool creates fits in.
+const maxManifestUploadSize = file.DefaultMaxManifestSize
+
 // AnnounceRequest represents the data sent by peers when they announce they have a file.
 type AnnounceRequest struct {
 	FileHash string `json:"fileHash"` // Hash of the file being announced
@@ -38,13 +91,22 @@ type AnnounceRequest struct {
 	Port     int    `json:"port"`     // Port where the peer is serving the file
 }
 
+// AnnounceResponse is the body the tracker answers an announce with. Older
+// trackers send no body, which is the same as a zero PeerTTL.
+type AnnounceResponse struct {
+	PeerTTL int64 `json:"peerTTL,omitempty"` // Seconds a peer stays listed without re-announcing, 0 for ever
+}
+
 // PeersResponse represents the data sent back to peers requesting information about a file.
 type PeersResponse struct {
 	Peers []Peer `json:"peers"` // List of peers that have the requested file
 }
 
 // Announce handles HTTP POST requests from peers announcing they have a file.
-// It adds the peer to the list of peers that have the specified file.
+// It adds the peer to the list of peers that have the specified file. Peers
+// announce again periodically to stay listed, so announcing a peer that is
+// already listed succeeds without listing it twice, and keeps it listed for
+// another PeerTTL, which the response reports.
 func (t *Tracker) Announce(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -57,28 +119,250 @@ func (t *Tracker) Announce(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	t.AddPeer(req.FileHash, Peer{Address: req.Address, Port: req.Port})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnnounceResponse{PeerTTL: int64(t.PeerTTL / time.Second)})
+}
+
+// AddPeer lists peer as having the file with the given hash, unless it is
+// already listed, and records that it was just seen. It reports whether the
+// peer was added. Checking for the peer and adding it happen under the same
+// lock, so concurrent announces of the same peer list it once. A listed peer
+// that had expired is left out of answers until it announces again, so its
+// return wakes long-polling clients as a new peer does.
+func (t *Tracker) AddPeer(fileHash string, peer Peer) bool {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	peer := Peer{
-		Address: req.Address,
-		Port:    req.Port,
+	now := time.Now()
+	t.expireLocked(now)
+	peers := t.peers[fileHash]
+	listed := slices.Contains(peers, peer)
+	revived := listed && t.expiredLocked(fileHash, peer, now)
+	if t.seen[fileHash] == nil {
+		t.seen[fileHash] = make(map[Peer]time.Time)
+	}
+	t.seen[fileHash][peer] = now
+
+	if listed {
+		if revived {
+			t.notifyLocked(fileHash)
+		}
+		return false
+	}
+	t.peers[fileHash] = append(peers, peer)
+	t.notifyLocked(fileHash)
+	return true
+}
+
+// expiredLocked reports whether peer has gone PeerTTL without announcing the
+// file with the given hash at now. The caller must hold t.mu.
+func (t *Tracker) expiredLocked(fileHash string, peer Peer, now time.Time) bool {
+	return t.PeerTTL > 0 && now.Sub(t.seen[fileHash][peer]) >= t.PeerTTL
+}
+
+// livePeersLocked returns a copy of the peers of the file with the given hash
+// that haven't expired at now. The caller must hold t.mu.
+func (t *Tracker) livePeersLocked(fileHash string, now time.Time) []Peer {
+	peers := slices.Clone(t.peers[fileHash])
+	if t.PeerTTL > 0 {
+		peers = slices.DeleteFunc(peers, func(p Peer) bool { return t.expiredLocked(fileHash, p, now) })
 	}
+	return peers
+}
 
-	// Add peer to the list if not already present
-	peers := t.peers[req.FileHash]
+// countLivePeersLocked returns how many peers of the file with the given hash
+// haven't expired at now, without copying the peer list. The caller must hold
+// t.mu.
+func (t *Tracker) countLivePeersLocked(fileHash string, now time.Time) int {
+	peers := t.peers[fileHash]
+	if t.PeerTTL <= 0 {
+		return len(peers)
+	}
+	n := 0
 	for _, p := range peers {
-		if p.Address == peer.Address && p.Port == peer.Port {
-			return
+		if !t.expiredLocked(fileHash, p, now) {
+			n++
+		}
+	}
+	return n
+}
+
+// expireLocked removes the peers that have expired at now. Expired peers are
+// already left out of every answer, so this only frees their memory, and it
+// runs at most once every quarter of PeerTTL. The caller must hold t.mu for
+// writing.
+func (t *Tracker) expireLocked(now time.Time) {
+	if t.PeerTTL <= 0 || now.Sub(t.swept) < t.PeerTTL/4 {
+		return
+	}
+	t.swept = now
+
+	type registration struct {
+		fileHash string
+		peer     Peer
+	}
+	var expired []registration
+	for fileHash, peers := range t.peers {
+		for _, p := range peers {
+			if t.expiredLocked(fileHash, p, now) {
+				expired = append(expired, registration{fileHash, p})
+			}
 		}
 	}
-	t.peers[req.FileHash] = append(peers, peer)
+	for _, r := range expired {
+		t.removePeerLocked(r.fileHash, r.peer.Address, r.peer.Port)
+	}
+}
+
+// waitLocked registers a client waiting for the peers of the file with the
+// given hash to change. Its channel is closed the next time they do; the
+// client must call doneWaitingLocked when it stops waiting. The caller must
+// hold t.mu for writing.
+func (t *Tracker) waitLocked(fileHash string) *peerWait {
+	w, ok := t.changed[fileHash]
+	if !ok {
+		w = &peerWait{ch: make(chan struct{})}
+		t.changed[fileHash] = w
+	}
+	w.waiters++
+	return w
+}
+
+// doneWaitingLocked unregisters a client that stopped waiting on w, and
+// forgets w once nobody waits on it, so that polls for files whose peers
+// never change don't accumulate. The caller must hold t.mu for writing.
+func (t *Tracker) doneWaitingLocked(fileHash string, w *peerWait) {
+	w.waiters--
+	if w.waiters == 0 && t.changed[fileHash] == w {
+		delete(t.changed, fileHash)
+	}
+}
+
+// notifyLocked wakes everyone waiting for the peers of the file with the
+// given hash to change. The caller must hold t.mu for writing.
+func (t *Tracker) notifyLocked(fileHash string) {
+	if w, ok := t.changed[fileHash]; ok {
+		close(w.ch)
+		delete(t.changed, fileHash)
+	}
+}
 
+// Unannounce handles HTTP POST requests from peers that have stopped serving a file.
+// It removes the peer from the list of peers that have the specified file.
+func (t *Tracker) Unannounce(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req AnnounceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	t.RemovePeer(req.FileHash, req.Address, req.Port)
 	w.WriteHeader(http.StatusOK)
 }
 
+// RemovePeer removes the peer at address:port from the file with the given hash.
+// If fileHash is empty, the peer is removed from every file it is registered under.
+// It returns the number of registrations removed.
+func (t *Tracker) RemovePeer(fileHash, address string, port int) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if fileHash != "" {
+		return t.removePeerLocked(fileHash, address, port)
+	}
+
+	removed := 0
+	for hash := range t.peers {
+		removed += t.removePeerLocked(hash, address, port)
+	}
+	return removed
+}
+
+// removePeerLocked removes address:port from a single file's peer list.
+// The caller must hold t.mu for writing.
+func (t *Tracker) removePeerLocked(fileHash, address string, port int) int {
+	peers := t.peers[fileHash]
+	for i, p := range peers {
+		if p.Address == address && p.Port == port {
+			// Copy so that slices handed out by GetPeers are never modified
+			peers = append(peers[:i:i], peers[i+1:]...)
+			if len(peers) == 0 {
+				delete(t.peers, fileHash)
+				delete(t.seen, fileHash)
+			} else {
+				t.peers[fileHash] = peers
+				delete(t.seen[fileHash], p)
+			}
+			t.notifyLocked(fileHash)
+			return 1
+		}
+	}
+	return 0
+}
+
+// RemovePeerResponse is returned by the admin DELETE /peer endpoint.
+type RemovePeerResponse struct {
+	Removed int `json:"removed"` // Number of registrations removed
+}
+
+// AdminRemovePeer handles admin HTTP DELETE requests to evict a peer.
+// The peer is identified by the address and port query parameters; an optional
+// fileHash parameter limits removal to one file, otherwise the peer is removed
+// from every file. Requests must carry the AdminToken.
+func (t *Tracker) AdminRemovePeer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !t.authorizeAdmin(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	address := query.Get("address")
+	port, err := strconv.Atoi(query.Get("port"))
+	if address == "" || err != nil {
+		http.Error(w, "Missing or invalid address/port parameters", http.StatusBadRequest)
+		return
+	}
+
+	removed := t.RemovePeer(query.Get("fileHash"), address, port)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RemovePeerResponse{Removed: removed})
+}
+
+// authorizeAdmin reports whether r carries the tracker's admin token.
+func (t *Tracker) authorizeAdmin(r *http.Request) bool {
+	if t.AdminToken == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(t.AdminToken)) == 1
+}
+
+// DefaultPeersLimit is how many peers GetPeers returns when the request has no
+// limit parameter. Downloaders only need a handful of peers.
+const DefaultPeersLimit = 50
+
+// MaxPeersWait caps the ?wait= of a GetPeers long-poll, so that a request
+// can't hold its connection open indefinitely.
+const MaxPeersWait = time.Minute
+
 // GetPeers handles HTTP GET requests from peers looking for other peers that have a file.
-// It returns a list of peers that have the requested file.
+// It returns up to ?limit= (default DefaultPeersLimit) of the peers that have the
+// requested file, in random order, so that load spreads across all of them.
+// With ?wait= (a duration such as 30s, at most MaxPeersWait), the request is a
+// long-poll: it blocks until the file's peers change or the wait elapses, and
+// then returns the peers as they are, so that clients watching a swarm don't
+// have to poll it on a timer.
 func (t *Tracker) GetPeers(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -90,11 +374,56 @@ func (t *Tracker) GetPeers(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing fileHash parameter", http.StatusBadRequest)
 		return
 	}
+	limit := DefaultPeersLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	var wait time.Duration
+	if v := r.URL.Query().Get("wait"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			http.Error(w, "Invalid wait parameter", http.StatusBadRequest)
+			return
+		}
+		wait = min(d, MaxPeersWait)
+	}
+
+	// Wait for the next change to the peers, unless the client goes away first
+	if wait > 0 {
+		t.mu.Lock()
+		waiting := t.waitLocked(fileHash)
+		t.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-waiting.ch:
+		case <-timer.C:
+		case <-r.Context().Done():
+		}
+		timer.Stop()
+		t.mu.Lock()
+		t.doneWaitingLocked(fileHash, waiting)
+		t.mu.Unlock()
+		if r.Context().Err() != nil {
+			return
+		}
+	}
 
+	// Copy the peers under the lock, then shuffle and trim the copy without it
 	t.mu.RLock()
-	peers := t.peers[fileHash]
+	peers := t.livePeersLocked(fileHash, time.Now())
 	t.mu.RUnlock()
 
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	if len(peers) > limit {
+		peers = peers[:limit]
+	}
+
 	response := PeersResponse{
 		Peers: peers,
 	}
@@ -103,12 +432,219 @@ func (t *Tracker) GetPeers(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// CountResponse is the body returned by the /count endpoint.
+type CountResponse struct {
+	Peers int `json:"peers"` // Number of peers serving the file
+}
+
+// CountPeers handles HTTP GET requests for the number of peers serving a file.
+// It is much cheaper than GetPeers for clients that only display the count,
+// since no peer list is copied or encoded.
+func (t *Tracker) CountPeers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fileHash := r.URL.Query().Get("fileHash")
+	if fileHash == "" {
+		http.Error(w, "Missing fileHash parameter", http.StatusBadRequest)
+		return
+	}
+
+	t.mu.RLock()
+	response := CountResponse{Peers: t.countLivePeersLocked(fileHash, time.Now())}
+	t.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// storedManifest is a manifest uploaded to the tracker, encoded once as it is
+// served, since popular manifests are fetched over and over.
+type storedManifest struct {
+	json    []byte // The manifest as JSON
+	gzipped []byte // The same, gzip-compressed
+}
+
+// Manifest handles HTTP requests for stored manifests when StoreManifests is enabled.
+// A POST with ?fileHash=... and a JSON manifest body stores the manifest, rejecting
+// it if its file hash doesn't match the claimed hash. A GET with ?fileHash=...
+// returns the stored manifest, gzip-compressed if the client accepts it. Its
+// ETag is the file hash, which any manifest of the file goes on describing
+// even if it is replaced, so a GET with a matching If-None-Match is answered
+// with 304 Not Modified and no body.
+func (t *Tracker) Manifest(w http.ResponseWriter, r *http.Request) {
+	if !t.StoreManifests {
+		http.Error(w, "Manifest storage disabled", http.StatusNotFound)
+		return
+	}
+
+	fileHash := r.URL.Query().Get("fileHash")
+	if fileHash == "" {
+		http.Error(w, "Missing fileHash parameter", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		var manifest file.Manifest
+		body := http.MaxBytesReader(w, r.Body, maxManifestUploadSize)
+		if err := json.NewDecoder(body).Decode(&manifest); err != nil {
+			http.Error(w, "Invalid manifest", http.StatusBadRequest)
+			return
+		}
+		if manifest.FileHash != fileHash {
+			http.Error(w, "Manifest file hash does not match fileHash parameter", http.StatusBadRequest)
+			return
+		}
+		if err := manifest.Validate(); err != nil {
+			http.Error(w, "Invalid manifest: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Never hand out a seeder's secret to whoever asks for the manifest
+		manifest.AccessToken = ""
+
+		stored := &storedManifest{}
+		var err error
+		if stored.json, err = json.Marshal(&manifest); err == nil {
+			stored.gzipped, err = file.EncodeManifest(&manifest)
+		}
+		if err != nil {
+			http.Error(w, "Failed to encode manifest", http.StatusInternalServerError)
+			return
+		}
+
+		t.mu.Lock()
+		t.manifests[fileHash] = stored
+		t.mu.Unlock()
+
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet:
+		t.mu.RLock()
+		stored, ok := t.manifests[fileHash]
+		t.mu.RUnlock()
+
+		if !ok {
+			http.Error(w, "Manifest not found", http.StatusNotFound)
+			return
+		}
+
+		etag := `"` + fileHash + `"`
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Vary", "Accept-Encoding")
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		body := stored.json
+		if acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			w.Header().Set("Content-Encoding", "gzip")
+			body = stored.gzipped
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write(body)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, or is "*".
+// Weak validators match too, as If-None-Match compares them weakly.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows a gzip body:
+// it lists gzip without q=0, or doesn't list gzip but allows "*".
+func acceptsGzip(acceptEncoding string) bool {
+	star := false
+	for _, coding := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(coding, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		allowed := true
+		if q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				allowed = false
+			}
+		}
+		switch name {
+		case "gzip":
+			return allowed
+		case "*":
+			star = allowed
+		}
+	}
+	return star
+}
+
+// HealthResponse is the body returned by the /healthz endpoint.
+type HealthResponse struct {
+	Status string `json:"status"` // Always "ok" while the tracker is serving
+	Files  int    `json:"files"`  // Number of files with at least one peer
+	Peers  int    `json:"peers"`  // Number of peer registrations across all files
+}
+
+// Health handles HTTP GET requests from liveness and readiness probes.
+// It reports the size of the registry and always succeeds while the tracker runs.
+func (t *Tracker) Health(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	response := HealthResponse{Status: "ok"}
+	now := time.Now()
+	t.mu.RLock()
+	for fileHash := range t.peers {
+		if n := t.countLivePeersLocked(fileHash, now); n > 0 {
+			response.Files++
+			response.Peers += n
+		}
+	}
+	t.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Handler returns an http.Handler serving all of the tracker's endpoints,
+// under BasePath if it is set.
+func (t *Tracker) Handler() http.Handler {
+	base := cleanBasePath(t.BasePath)
+	mux := http.NewServeMux()
+	mux.HandleFunc(base+"/announce", t.Announce)
+	mux.HandleFunc(base+"/unannounce", t.Unannounce)
+	mux.HandleFunc(base+"/peers", t.GetPeers)
+	mux.HandleFunc(base+"/count", t.CountPeers)
+	mux.HandleFunc(base+"/manifest", t.Manifest)
+	mux.HandleFunc(base+"/peer", t.AdminRemovePeer)
+	mux.HandleFunc(base+"/healthz", t.Health)
+	return mux
+}
+
+// cleanBasePath returns the route prefix for basePath, with a leading slash
+// and no trailing one, such as "/goshare" for "goshare/", or "" for the root.
+func cleanBasePath(basePath string) string {
+	base := path.Clean("/" + basePath)
+	if base == "/" {
+		return ""
+	}
+	return base
+}
+
 // StartTrackerServer starts the HTTP server that handles peer announcements and queries.
 // It listens on the specified port and sets up the necessary HTTP handlers.
 func StartTrackerServer(port int) error {
 	tracker := NewTracker()
-	http.HandleFunc("/announce", tracker.Announce)
-	http.HandleFunc("/peers", tracker.GetPeers)
 	fmt.Printf("Tracker listening on port %d\n", port)
-	return http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+	return http.ListenAndServe(fmt.Sprintf(":%d", port), tracker.Handler())
 }
@@ -0,0 +1,484 @@
+package tracker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRemovePeer(t *testing.T) {
+	tr := NewTracker()
+	_, c := startTracker(t, tr)
+	evicted := Peer{Address: "10.0.0.1", Port: 9000}
+	other := Peer{Address: "10.0.0.2", Port: 9000}
+	for _, hash := range []string{"abc", "def"} {
+		tr.AddPeer(hash, evicted)
+		tr.AddPeer(hash, other)
+	}
+
+	if n := tr.RemovePeer("abc", evicted.Address, evicted.Port); n != 1 {
+		t.Fatalf("RemovePeer of one file removed %d registrations, want 1", n)
+	}
+	if n := tr.RemovePeer("abc", evicted.Address, evicted.Port); n != 0 {
+		t.Fatalf("removing the peer again removed %d registrations, want 0", n)
+	}
+	tr.AddPeer("abc", evicted)
+	if n := tr.RemovePeer("", evicted.Address, evicted.Port); n != 2 {
+		t.Fatalf("RemovePeer of every file removed %d registrations, want 2", n)
+	}
+	for _, hash := range []string{"abc", "def"} {
+		peers, err := c.GetPeers(context.Background(), hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(peers) != 1 || peers[0] != other {
+			t.Errorf("peers of %s after eviction: %v, want only %v", hash, peers, other)
+		}
+	}
+}
+
+func TestAdminRemovePeer(t *testing.T) {
+	tr := NewTracker()
+	tr.AdminToken = "secret"
+	tr.AddPeer("abc", Peer{Address: "10.0.0.1", Port: 9000})
+	srv, _ := startTracker(t, tr)
+
+	remove := func(method, query, token string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+"/peer?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	for _, tc := range []struct {
+		method, query, token string
+		want                 int
+	}{
+		{http.MethodGet, "address=10.0.0.1&port=9000", "secret", http.StatusMethodNotAllowed},
+		{http.MethodDelete, "address=10.0.0.1&port=9000", "", http.StatusUnauthorized},
+		{http.MethodDelete, "address=10.0.0.1&port=9000", "wrong", http.StatusUnauthorized},
+		{http.MethodDelete, "address=10.0.0.1&port=x", "secret", http.StatusBadRequest},
+	} {
+		if resp := remove(tc.method, tc.query, tc.token); resp.StatusCode != tc.want {
+			t.Errorf("%s %s with token %q answered %d, want %d", tc.method, tc.query, tc.token, resp.StatusCode, tc.want)
+		}
+	}
+
+	resp := remove(http.MethodDelete, "address=10.0.0.1&port=9000", "secret")
+	var body RemovePeerResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || body.Removed != 1 {
+		t.Fatalf("authorized DELETE answered %d removing %d, want 200 removing 1", resp.StatusCode, body.Removed)
+	}
+
+	// Without a token configured the endpoint is disabled
+	tr.AdminToken = ""
+	if resp := remove(http.MethodDelete, "address=10.0.0.1&port=9000", "secret"); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("DELETE without a configured token answered %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	tr := NewTracker()
+	srv, c := startTracker(t, tr)
+	ctx := context.Background()
+
+	health, err := c.Health(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *health != (HealthResponse{Status: "ok"}) {
+		t.Fatalf("empty tracker reported %+v", health)
+	}
+
+	tr.AddPeer("abc", Peer{Address: "10.0.0.1", Port: 9000})
+	tr.AddPeer("abc", Peer{Address: "10.0.0.2", Port: 9000})
+	tr.AddPeer("def", Peer{Address: "10.0.0.1", Port: 9000})
+	health, err = c.Health(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *health != (HealthResponse{Status: "ok", Files: 2, Peers: 3}) {
+		t.Fatalf("tracker with 3 peers of 2 files reported %+v", health)
+	}
+
+	// Probes may use HEAD, but nothing that changes state
+	for method, want := range map[string]int{http.MethodHead: http.StatusOK, http.MethodPost: http.StatusMethodNotAllowed} {
+		req, err := http.NewRequest(method, srv.URL+"/healthz", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%s /healthz answered %d, want %d", method, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestGetPeersLimit(t *testing.T) {
+	tr := NewTracker()
+	srv, c := startTracker(t, tr)
+	announced := make(map[Peer]bool)
+	for i := 0; i < 2*DefaultPeersLimit; i++ {
+		p := Peer{Address: "10.0.0.1", Port: 10000 + i}
+		tr.AddPeer("abc", p)
+		announced[p] = true
+	}
+	ctx := context.Background()
+
+	// get returns the peers listed for limit, checking they are distinct
+	// announced peers
+	get := func(limit int) []Peer {
+		t.Helper()
+		peers, err := c.GetPeersLimit(ctx, "abc", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := make(map[Peer]bool)
+		for _, p := range peers {
+			if !announced[p] || seen[p] {
+				t.Fatalf("tracker listed %v, which is unknown or listed twice", p)
+			}
+			seen[p] = true
+		}
+		return peers
+	}
+
+	if n := len(get(0)); n != DefaultPeersLimit {
+		t.Fatalf("tracker listed %d peers without a limit, want %d", n, DefaultPeersLimit)
+	}
+	if n := len(get(5)); n != 5 {
+		t.Fatalf("tracker listed %d peers with limit 5", n)
+	}
+	if n := len(get(1000)); n != len(announced) {
+		t.Fatalf("tracker listed %d peers with a limit above the %d known", n, len(announced))
+	}
+
+	// The subset varies between calls, spreading load across peers
+	first := get(5)
+	varied := false
+	for i := 0; i < 10 && !varied; i++ {
+		varied = !slices.Equal(get(5), first)
+	}
+	if !varied {
+		t.Fatal("eleven requests with limit 5 all listed the same peers in the same order")
+	}
+
+	for _, limit := range []string{"0", "-1", "many"} {
+		resp, err := http.Get(srv.URL + "/peers?fileHash=abc&limit=" + limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("limit %q answered %s, want 400", limit, resp.Status)
+		}
+	}
+}
+
+func TestCountPeers(t *testing.T) {
+	tr := NewTracker()
+	srv, c := startTracker(t, tr)
+	ctx := context.Background()
+
+	// count checks that /count agrees with the peer list
+	count := func(want int) {
+		t.Helper()
+		n, err := c.CountPeers(ctx, "abc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		peers, err := c.GetPeersLimit(ctx, "abc", 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want || len(peers) != want {
+			t.Fatalf("tracker counted %d peers and listed %d, want %d", n, len(peers), want)
+		}
+	}
+
+	count(0)
+	for i := 0; i < 3; i++ {
+		req := AnnounceRequest{FileHash: "abc", Address: "10.0.0.1", Port: 9000 + i}
+		if err := c.Announce(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Announcing again doesn't count twice, nor does another file
+	if err := c.Announce(ctx, AnnounceRequest{FileHash: "abc", Address: "10.0.0.1", Port: 9000}); err != nil {
+		t.Fatal(err)
+	}
+	tr.AddPeer("def", Peer{Address: "10.0.0.2", Port: 9000})
+	count(3)
+
+	if err := c.Unannounce(ctx, AnnounceRequest{FileHash: "abc", Address: "10.0.0.1", Port: 9001}); err != nil {
+		t.Fatal(err)
+	}
+	count(2)
+	tr.RemovePeer("", "10.0.0.1", 9000)
+	count(1)
+
+	for query, want := range map[string]int{"": http.StatusBadRequest, "?fileHash=abc": http.StatusOK} {
+		resp, err := http.Get(srv.URL + "/count" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("GET /count%s answered %s, want %d", query, resp.Status, want)
+		}
+	}
+}
+
+func TestRepeatedAnnounce(t *testing.T) {
+	tr := NewTracker()
+	srv, c := startTracker(t, tr)
+	peer := Peer{Address: "10.0.0.1", Port: 9000}
+
+	if !tr.AddPeer("abc", peer) {
+		t.Fatal("AddPeer of a new peer reported it was already listed")
+	}
+	if tr.AddPeer("abc", peer) {
+		t.Fatal("AddPeer of a listed peer reported it was added")
+	}
+
+	// Re-announces succeed every time, however many arrive at once
+	body := `{"fileHash":"abc","address":"10.0.0.1","port":9000}`
+	var wg sync.WaitGroup
+	statuses := make(chan int, 20)
+	for i := 0; i < cap(statuses); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Post(srv.URL+"/announce", "application/json", strings.NewReader(body))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+	for status := range statuses {
+		if status != http.StatusOK {
+			t.Fatalf("repeated announce answered %d, want 200", status)
+		}
+	}
+
+	peers, err := c.GetPeers(context.Background(), "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0] != peer {
+		t.Fatalf("peers after repeated announces: %v, want only %v", peers, peer)
+	}
+}
+
+func TestWaitPeers(t *testing.T) {
+	tr := NewTracker()
+	_, c := startTracker(t, tr)
+	ctx := context.Background()
+
+	// waiting returns how many clients wait for the peers of fileHash
+	waiting := func(fileHash string) int {
+		tr.mu.Lock()
+		defer tr.mu.Unlock()
+		if w := tr.changed[fileHash]; w != nil {
+			return w.waiters
+		}
+		return 0
+	}
+
+	// An announce answers the clients waiting for the file's peers at once
+	peer := Peer{Address: "10.0.0.1", Port: 9000}
+	type result struct {
+		peers []Peer
+		err   error
+	}
+	done := make(chan result, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			peers, err := c.WaitPeers(ctx, "abc", MaxPeersWait)
+			done <- result{peers, err}
+		}()
+	}
+	for deadline := time.Now().Add(5 * time.Second); waiting("abc") < 2; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("long-polls never started waiting")
+		}
+	}
+	start := time.Now()
+	tr.AddPeer("abc", peer)
+	for i := 0; i < 2; i++ {
+		r := <-done
+		if r.err != nil || !slices.Equal(r.peers, []Peer{peer}) {
+			t.Fatalf("waiting client got %v, %v; want the announced peer", r.peers, r.err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("waiting clients answered %v after the announce", elapsed)
+	}
+
+	// Without a change the peers as they are come back once the wait is over
+	peers, err := c.WaitPeers(ctx, "abc", 50*time.Millisecond)
+	if err != nil || !slices.Equal(peers, []Peer{peer}) {
+		t.Fatalf("timed out long-poll returned %v, %v", peers, err)
+	}
+
+	// Polls for files nobody announces leave nothing behind, whether they
+	// time out or the client goes away
+	for i := 0; i < 20; i++ {
+		if _, err := c.WaitPeers(ctx, fmt.Sprintf("unknown-%d", i), time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cancelled, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.WaitPeers(cancelled, "gone", MaxPeersWait); err == nil {
+		t.Fatal("long-poll outlived its context")
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		tr.mu.Lock()
+		n := len(tr.changed)
+		tr.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("tracker still tracks waits for %d files after every client stopped waiting", n)
+		}
+	}
+}
+
+func TestWaitPeersWakesOnExpiredPeerReturning(t *testing.T) {
+	tr := NewTracker()
+	tr.PeerTTL = time.Hour
+	_, c := startTracker(t, tr)
+	ctx := context.Background()
+
+	// The peer is still listed but expired, and no sweep is due to remove it
+	peer := Peer{Address: "10.0.0.1", Port: 9000}
+	tr.AddPeer("abc", peer)
+	tr.mu.Lock()
+	tr.seen["abc"][peer] = time.Now().Add(-2 * tr.PeerTTL)
+	tr.swept = time.Now()
+	tr.mu.Unlock()
+
+	done := make(chan []Peer, 1)
+	go func() {
+		peers, err := c.WaitPeers(ctx, "abc", MaxPeersWait)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- peers
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		tr.mu.Lock()
+		w := tr.changed["abc"]
+		tr.mu.Unlock()
+		if w != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("long-poll never started waiting")
+		}
+	}
+
+	// Its return is news to the waiting client, though it was never removed
+	if tr.AddPeer("abc", peer) {
+		t.Fatal("expired peer still listed was added again")
+	}
+	select {
+	case peers := <-done:
+		if !slices.Equal(peers, []Peer{peer}) {
+			t.Fatalf("waiting client got %v, want the returning peer", peers)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting client not answered when an expired peer announced again")
+	}
+}
+
+func TestPeerTTL(t *testing.T) {
+	tr := NewTracker()
+	tr.PeerTTL = time.Minute
+	_, c := startTracker(t, tr)
+	ctx := context.Background()
+	stale := Peer{Address: "10.0.0.1", Port: 9000}
+	fresh := Peer{Address: "10.0.0.2", Port: 9000}
+	for _, p := range []Peer{stale, fresh} {
+		if err := c.Announce(ctx, AnnounceRequest{FileHash: "abc", Address: p.Address, Port: p.Port}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Announce(ctx, AnnounceRequest{FileHash: "def", Address: stale.Address, Port: stale.Port}); err != nil {
+		t.Fatal(err)
+	}
+
+	// age makes peer's last announce of fileHash older than the TTL
+	age := func(fileHash string, p Peer) {
+		tr.mu.Lock()
+		defer tr.mu.Unlock()
+		tr.seen[fileHash][p] = time.Now().Add(-2 * tr.PeerTTL)
+	}
+	age("abc", stale)
+	age("def", stale)
+
+	// An expired peer is left out of every answer at once
+	peers, err := c.GetPeers(ctx, "abc")
+	if err != nil || !slices.Equal(peers, []Peer{fresh}) {
+		t.Fatalf("peers %v, %v; want only the one that announced within the TTL", peers, err)
+	}
+	if n, err := c.CountPeers(ctx, "def"); err != nil || n != 0 {
+		t.Fatalf("count %d, %v for a file whose only peer expired", n, err)
+	}
+	health, err := c.Health(ctx)
+	if err != nil || health.Files != 1 || health.Peers != 1 {
+		t.Fatalf("health %+v, %v; want 1 file with 1 peer", health, err)
+	}
+
+	// Re-announcing lists the peer again
+	if err := c.Announce(ctx, AnnounceRequest{FileHash: "abc", Address: stale.Address, Port: stale.Port}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.CountPeers(ctx, "abc"); err != nil || n != 2 {
+		t.Fatalf("count %d, %v after the expired peer announced again, want 2", n, err)
+	}
+
+	// Announces sweep expired peers from memory
+	tr.mu.Lock()
+	tr.swept = time.Time{}
+	tr.mu.Unlock()
+	tr.AddPeer("ghi", fresh)
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if _, ok := tr.peers["def"]; ok {
+		t.Fatal("expired peers still kept after a sweep")
+	}
+	if _, ok := tr.seen["def"]; ok {
+		t.Fatal("last announce times of expired peers still kept after a sweep")
+	}
+}
@@ -0,0 +1,547 @@
+package goshare
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/timskillet/go-share/internal/file"
+	"github.com/timskillet/go-share/internal/peer"
+	"github.com/timskillet/go-share/internal/tracker"
+)
+
+// DownloadOptions configures Download. The zero value downloads to the
+// manifest's file name in the current directory, asking the trackers listed in
+// the manifest for peers. Manifests without trackers need Peers or TrackerURL.
+type DownloadOptions struct {
+	// OutputPath is where the file is written (default: the manifest's file name).
+	OutputPath string
+	// Sink, if set, receives the downloaded chunks instead of a file at
+	// OutputPath, e.g. to store them in an object store or a database. Chunks
+	// are verified before they reach the sink. VerifyAfter, RepairOnFailure,
+	// SkipChunkVerify, and Follow can't be used with a sink, and Resume
+	// downloads every chunk again.
+	Sink ChunkSink
+	// Writer, if set, receives the file's content in order instead of a file
+	// at OutputPath, as by DownloadTo. ReorderBuffer caps the bytes of chunks
+	// held in memory meanwhile (default: DefaultReorderBuffer). The options
+	// that can't be used with a Sink can't be used with a Writer either.
+	Writer        io.Writer
+	ReorderBuffer int64
+
+	// Peers to download from. If empty, they are looked up at TrackerURL.
+	Peers []Peer
+	// TrackerURL is the tracker asked for peers when Peers is empty. If it is
+	// also empty, the trackers listed in the manifest are asked in turn. Peers
+	// looked up this way are looked up again if all of them fail mid-download.
+	TrackerURL string
+	// RefreshPeers, if set, is asked for the current peers when every peer
+	// has failed, and the download goes on with those it returns. It lets a
+	// download given Peers pick up peers that appeared since, e.g. when
+	// resuming a download whose original peers have gone away.
+	RefreshPeers func(ctx context.Context) ([]Peer, error)
+	// UnavailableWait is how long to wait for a peer to have a chunk that none
+	// of the peers has yet, asking the trackers for new peers meanwhile. The
+	// rest of the file is downloaded either way; chunks still missing at the
+	// end fail the download with an UnavailableError (default: give up on such
+	// chunks at once).
+	UnavailableWait time.Duration
+	// TrackerTimeout bounds each tracker request (default: 10s).
+	TrackerTimeout time.Duration
+	// WebSeeds are URLs of plain HTTP servers holding the whole file, such as
+	// mirrors or CDNs, which are used alongside peers. Chunks are fetched from
+	// them with Range requests and verified against the manifest. With web seeds,
+	// a download goes ahead even if no tracker knows any peers.
+	WebSeeds []string
+
+	Transport Transport // Network used to reach peers (default: TCPTransport)
+	// PeerSelection is the strategy for choosing a peer for each chunk: "first",
+	// "round-robin", or "lowest-latency" (default: "first").
+	PeerSelection string
+	// MaxParallel is the number of chunks downloaded at once
+	// (default: two per peer, at most 8).
+	MaxParallel int
+	// PerPeerParallel caps the chunks requested from any single peer at once,
+	// so that a high MaxParallel doesn't overload one seeder (default: no cap).
+	PerPeerParallel int
+	// Prefetch is how many chunks are fetched ahead of the one being written
+	// when MaxParallel is 1. Values below 2 disable read-ahead.
+	Prefetch int
+	// StartJitter delays the first chunk request by a random duration of up to
+	// this long, and RandomOrder requests chunks in random order when several are
+	// downloaded at once. Both spread out downloads that start simultaneously.
+	StartJitter time.Duration
+	RandomOrder bool
+	// HashKey is the group key of a manifest created with UploadOptions.HashKey,
+	// needed to verify its chunks. It is ignored for other manifests.
+	HashKey []byte
+	// AccessToken is the token seeders of a private file require, if it isn't
+	// recorded in the manifest already. It overrides the manifest's token.
+	AccessToken string
+	// FileHash is the hash of the file asked for, when the manifest wasn't
+	// obtained from a trusted source but fetched by hash from a tracker or a
+	// peer, e.g. with FetchManifest or FetchManifestFromPeers. Chunks are
+	// verified against the manifest, so a hostile source could hand out a
+	// manifest of another file whose chunks all check out; the file hash,
+	// which can only be checked against the whole file, is the one anchor.
+	// With FileHash set, a manifest describing another file fails the download
+	// with ErrManifestMismatch, and the finished file is always checked against
+	// the hash as with VerifyAfter. It can't be used with a Sink, which can't
+	// be read back; a Writer's content is always checked.
+	FileHash string
+	// Events, if set, receives an event for each peer reached and chunk
+	// downloaded, for failures, and once the download is complete.
+	Events *EventBus
+
+	// RateLimit, if positive, caps the combined rate at which chunk data is
+	// received from all peers and web seeds, in bytes per second.
+	RateLimit int64
+	// Budget, if set, is shared by downloads run at once, such as those of
+	// several files, to bound them together; see NewBudget. Its per-peer limit
+	// replaces PerPeerParallel, and its rate limit applies unless RateLimit is
+	// set. MaxParallel still caps this download on its own.
+	Budget *Budget
+	// Overwrite lets a directory download replace files that already exist in
+	// the output directory. Without it, such a download fails with
+	// ErrFileExists before anything is downloaded.
+	Overwrite bool
+	// Follow, if positive, keeps going once the file is downloaded, asking the
+	// peers this often for data appended to it since and writing it to the
+	// output file, like tail -f. The download then only ends when ctx is done,
+	// returning ctx's error. It requires a seeder with SeederOptions.Follow, and
+	// can't be used for directories or with SkipChunkVerify. OnFollow, if set,
+	// is called with the file's size once the download completes and after each
+	// time appended data has been written.
+	Follow   time.Duration
+	OnFollow func(size int64)
+
+	// VerifyAfter, RepairOnFailure, SkipChunkVerify, and BlacklistThreshold
+	// control integrity checking as described for the internal peer downloader:
+	// verify the finished file, re-download bad chunks, skip per-chunk hashing on
+	// trusted links, and stop using peers after this many corrupt chunks.
+	VerifyAfter        bool
+	RepairOnFailure    bool
+	SkipChunkVerify    bool
+	BlacklistThreshold int
+
+	// VerifyFunc, if set, is called with each chunk after its hash is checked,
+	// for checks of the caller's own, e.g. a signature on each chunk. A non-nil
+	// error rejects the chunk as if it were corrupt, with an error wrapping
+	// ErrChunkRejected: it is requested from the next peer, and the peer that
+	// served it counts towards BlacklistThreshold. Resumed downloads pass the
+	// chunks kept from their .part file to it as well. It is called
+	// concurrently by the download's workers. Checks of the whole file, such
+	// as a virus scan, are best run once Download returns, before the file is
+	// used.
+	VerifyFunc func(chunk Chunk, data []byte) error
+
+	// Progress, if set, is called after each chunk with the bytes downloaded so
+	// far and the total file size.
+	Progress func(done, total int64)
+}
+
+// Download fetches the file described by manifest from its peers and writes it
+// to opts.OutputPath. The file is assembled in a .part file that is only moved
+// into place once the download succeeds. A directory manifest is downloaded as
+// one stream and then extracted into a directory at opts.OutputPath. On success
+// it returns a summary of the download; with Follow, it describes the initial
+// download.
+func Download(ctx context.Context, manifest *Manifest, opts DownloadOptions) (*DownloadResult, error) {
+	return download(ctx, manifest, opts, false)
+}
+
+// DownloadTo fetches the file described by manifest from its peers and writes
+// its content to w in order, e.g. to pipe it into another program without
+// storing it. Chunks are fetched from several peers at once, and those that
+// arrive early are held in memory until the chunks before them are written;
+// once opts.ReorderBuffer bytes of them are held or being fetched, no more
+// are requested until the lagging chunk arrives. Every chunk is verified
+// before it is written, and the whole-file hash once all of them are, which
+// fails the download with ErrVerificationFailed after the content was
+// written if it doesn't match. opts.OutputPath is ignored.
+func DownloadTo(ctx context.Context, manifest *Manifest, w io.Writer, opts DownloadOptions) (*DownloadResult, error) {
+	opts.Writer = w
+	return download(ctx, manifest, opts, false)
+}
+
+// Resume is like Download, but continues from the .part file left behind by an
+// interrupted or failed download, if there is one. Chunks in it that match the
+// manifest are kept and only the rest are fetched; the result's Reused counts
+// the chunks kept.
+func Resume(ctx context.Context, manifest *Manifest, opts DownloadOptions) (*DownloadResult, error) {
+	return download(ctx, manifest, opts, true)
+}
+
+// download implements Download and Resume, publishing the outcome to opts.Events.
+func download(ctx context.Context, manifest *Manifest, opts DownloadOptions, resume bool) (*DownloadResult, error) {
+	result, err := runDownload(ctx, manifest, opts, resume)
+	if err != nil {
+		opts.Events.publishError(manifest.FileHash, "", err)
+	} else {
+		opts.Events.Publish(Event{Type: EventComplete, FileHash: manifest.FileHash, Size: manifest.FileSize})
+	}
+	return result, err
+}
+
+// runDownload looks up the peers and downloads the file for download.
+func runDownload(ctx context.Context, manifest *Manifest, opts DownloadOptions, resume bool) (*DownloadResult, error) {
+	outputPath := opts.OutputPath
+	if outputPath == "" {
+		outputPath = manifest.FileName
+	}
+	if manifest.IsKeyed() && opts.HashKey != nil {
+		// Set the key on a copy, leaving the caller's manifest alone
+		keyed := *manifest
+		if err := keyed.SetHashKey(opts.HashKey); err != nil {
+			return nil, err
+		}
+		manifest = &keyed
+	}
+	if opts.AccessToken != "" {
+		private := *manifest
+		private.AccessToken = opts.AccessToken
+		manifest = &private
+	}
+	if opts.Sink != nil && (opts.Follow > 0 || opts.VerifyAfter || opts.RepairOnFailure) {
+		return nil, errors.New("Follow, VerifyAfter, and RepairOnFailure can't be used with a Sink")
+	}
+	if opts.Writer != nil && (opts.Sink != nil || opts.Follow > 0 || opts.VerifyAfter || opts.RepairOnFailure) {
+		return nil, errors.New("Sink, Follow, VerifyAfter, and RepairOnFailure can't be used with a Writer")
+	}
+	if opts.FileHash != "" {
+		// A manifest from an untrusted source is only as good as the file
+		// hash it is checked against
+		if manifest.FileHash != opts.FileHash {
+			return nil, fmt.Errorf("%w: got the manifest of %s, expected %s", ErrManifestMismatch, manifest.FileHash, opts.FileHash)
+		}
+		if opts.Sink != nil {
+			return nil, errors.New("FileHash can't be used with a Sink, which can't be verified as a whole")
+		}
+		if opts.Writer == nil {
+			opts.VerifyAfter = true
+		}
+	}
+	if opts.Follow > 0 {
+		if err := manifest.CheckGrowable(); err != nil {
+			return nil, err
+		}
+		if opts.SkipChunkVerify {
+			return nil, errors.New("SkipChunkVerify can't be used with Follow")
+		}
+	}
+
+	seeds := make([]Peer, len(opts.WebSeeds))
+	for i, rawURL := range opts.WebSeeds {
+		seed, err := WebSeed(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		seeds[i] = seed
+	}
+
+	peers := opts.Peers
+	refreshPeers := opts.RefreshPeers
+	if len(peers) == 0 && len(manifest.Chunks) > 0 {
+		trackers := manifest.Trackers
+		if opts.TrackerURL != "" {
+			trackers = []string{opts.TrackerURL}
+		}
+		found, err := FindPeersAny(ctx, trackers, opts.TrackerTimeout, manifest.FileHash)
+		if err != nil && (len(seeds) == 0 || ctx.Err() != nil) {
+			return nil, err
+		}
+		peers = found
+		if refreshPeers == nil && len(trackers) > 0 {
+			refreshPeers = func(ctx context.Context) ([]Peer, error) {
+				return FindPeersAny(ctx, trackers, opts.TrackerTimeout, manifest.FileHash)
+			}
+		}
+	}
+	peers = append(peers, seeds...)
+
+	transport := opts.Transport
+	if transport == nil {
+		transport = TCPTransport{}
+	}
+	selection := opts.PeerSelection
+	if selection == "" {
+		selection = "first"
+	}
+	selector, err := peer.NewSelector(selection, transport)
+	if err != nil {
+		return nil, err
+	}
+	parallel := opts.MaxParallel
+	if parallel < 1 {
+		parallel = peer.DefaultMaxParallel(len(peers))
+	}
+
+	downloadOpts := peer.DownloadOptions{
+		Transport:          transport,
+		Selector:           selector,
+		VerifyAfter:        opts.VerifyAfter,
+		RepairOnFailure:    opts.RepairOnFailure,
+		SkipChunkVerify:    opts.SkipChunkVerify,
+		VerifyFunc:         opts.VerifyFunc,
+		Progress:           opts.Progress,
+		BlacklistThreshold: opts.BlacklistThreshold,
+		MaxParallel:        parallel,
+		Prefetch:           opts.Prefetch,
+		PerPeerParallel:    opts.PerPeerParallel,
+		StartJitter:        opts.StartJitter,
+		RandomOrder:        opts.RandomOrder,
+		Overwrite:          opts.Overwrite,
+		RefreshPeers:       refreshPeers,
+		UnavailableWait:    opts.UnavailableWait,
+		ReorderBuffer:      opts.ReorderBuffer,
+	}
+	if opts.RateLimit > 0 {
+		downloadOpts.RateLimit = peer.NewRateLimiter(opts.RateLimit)
+	}
+	downloadOpts.Budget = opts.Budget
+	if bus := opts.Events; bus != nil {
+		fileHash := manifest.FileHash
+		downloadOpts.Transport = &eventTransport{Transport: transport, bus: bus, fileHash: fileHash, seen: make(map[string]bool)}
+		downloadOpts.OnChunk = func(i int, from Peer, size int64) {
+			bus.Publish(chunkEvent(EventChunkDownloaded, fileHash, peerName(from), i, size))
+		}
+		downloadOpts.OnChunkError = func(i int, from Peer, err error) {
+			e := chunkEvent(EventError, fileHash, peerName(from), i, 0)
+			e.Error = err.Error()
+			bus.Publish(e)
+		}
+	}
+	if opts.Sink != nil {
+		return peer.DownloadToSink(ctx, manifest, peers, opts.Sink, downloadOpts)
+	}
+	if opts.Writer != nil {
+		return peer.DownloadTo(ctx, manifest, peers, opts.Writer, downloadOpts)
+	}
+	if !manifest.IsDir() {
+		var result *DownloadResult
+		if resume {
+			result, err = peer.ResumeFile(ctx, manifest, peers, outputPath, downloadOpts)
+		} else {
+			result, err = peer.DownloadFile(ctx, manifest, peers, outputPath, downloadOpts)
+		}
+		if err != nil || opts.Follow <= 0 {
+			return result, err
+		}
+		return result, follow(ctx, manifest, peers, outputPath, opts, downloadOpts)
+	}
+
+	// Directories are downloaded as one stream, then split into their files
+	if !resume {
+		return peer.DownloadDir(ctx, manifest, peers, outputPath, downloadOpts)
+	}
+	if !opts.Overwrite {
+		if err := file.CheckDirTarget(manifest, outputPath); err != nil {
+			return nil, err
+		}
+	}
+	result, err := peer.ResumeFile(ctx, manifest, peers, peer.DirDataPath(outputPath), downloadOpts)
+	if err != nil {
+		return nil, err
+	}
+	if err := peer.ExtractDownloadedDir(manifest, outputPath, opts.Overwrite); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// follow keeps the downloaded file at outputPath up to date as described for
+// DownloadOptions.Follow.
+func follow(ctx context.Context, manifest *Manifest, peers []Peer, outputPath string, opts DownloadOptions, downloadOpts peer.DownloadOptions) error {
+	// The download itself is complete; following only ends with ctx
+	opts.Events.Publish(Event{Type: EventComplete, FileHash: manifest.FileHash, Size: manifest.FileSize})
+	var onGrow func(*file.Manifest)
+	if opts.OnFollow != nil {
+		opts.OnFollow(manifest.FileSize)
+		onGrow = func(grown *file.Manifest) { opts.OnFollow(grown.FileSize) }
+	}
+	return peer.Follow(ctx, manifest, peers, outputPath, opts.Follow, downloadOpts, onGrow)
+}
+
+// Budget bounds several downloads running at once together; see
+// DownloadOptions.Budget.
+type Budget = peer.Budget
+
+// NewBudget creates a Budget for downloads run at once, such as those of a
+// folder of manifests: at most maxParallel chunks are fetched at a time across
+// all of them, and at most perPeer from any single peer (0 for no limit beyond
+// maxParallel), so a seeder serving several of the files isn't asked for more
+// than by a single download. rateLimit, if positive, caps their combined rate
+// in bytes per second.
+func NewBudget(maxParallel, perPeer int, rateLimit int64) *Budget {
+	var rate *peer.RateLimiter
+	if rateLimit > 0 {
+		rate = peer.NewRateLimiter(rateLimit)
+	}
+	return peer.NewBudget(maxParallel, perPeer, rate)
+}
+
+// WebSeed returns a Peer for a plain HTTP server holding the whole file at
+// rawURL, which must be an absolute http or https URL. See DownloadOptions.WebSeeds.
+func WebSeed(rawURL string) (Peer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return Peer{}, fmt.Errorf("invalid web seed URL %q: must be an http or https URL", rawURL)
+	}
+	return peer.WebSeed(rawURL), nil
+}
+
+// ParsePeer returns the Peer listening at addr, given as host:port, e.g. to
+// download from a known seeder without asking a tracker. IPv6 addresses must
+// be bracketed, as in "[::1]:9000".
+func ParsePeer(addr string) (Peer, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return Peer{}, fmt.Errorf("invalid peer address %q: must be host:port", addr)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 || host == "" {
+		return Peer{}, fmt.Errorf("invalid peer address %q: must be host:port with a port from 1 to 65535", addr)
+	}
+	return Peer{Address: host, Port: port}, nil
+}
+
+// PartPath returns the path a download to outputPath is assembled in before it
+// is complete. It is left behind if a download fails, so it can be inspected.
+// For directories, use PartPathFor.
+func PartPath(outputPath string) string {
+	return peer.PartPath(outputPath)
+}
+
+// PartPathFor is like PartPath, but also handles directory manifests, whose
+// content is assembled as a single stream before it is split into files.
+func PartPathFor(manifest *Manifest, outputPath string) string {
+	if manifest.IsDir() {
+		return peer.PartPath(peer.DirDataPath(outputPath))
+	}
+	return peer.PartPath(outputPath)
+}
+
+// FindPeers asks the tracker at trackerURL which peers serve the file with the
+// given hash. It returns an error wrapping ErrNoPeers if there are none.
+func FindPeers(ctx context.Context, trackerURL string, timeout time.Duration, fileHash string) ([]Peer, error) {
+	client := tracker.NewTrackerClient(trackerURL, timeout)
+	trackerPeers, err := client.GetPeers(ctx, fileHash)
+	if err != nil {
+		return nil, err
+	}
+	if len(trackerPeers) == 0 {
+		return nil, fmt.Errorf("%w for file %s", ErrNoPeers, fileHash)
+	}
+
+	peers := make([]Peer, len(trackerPeers))
+	for i, p := range trackerPeers {
+		peers[i] = Peer{Address: p.Address, Port: p.Port}
+	}
+	return peers, nil
+}
+
+// CountPeers asks the tracker at trackerURL how many peers serve the file with
+// the given hash. It is cheaper than FindPeers when only the number is needed,
+// e.g. to display it.
+func CountPeers(ctx context.Context, trackerURL string, timeout time.Duration, fileHash string) (int, error) {
+	return tracker.NewTrackerClient(trackerURL, timeout).CountPeers(ctx, fileHash)
+}
+
+// FindPeersAny asks each tracker in trackers in turn which peers serve the file
+// with the given hash, and returns the peers from the first one that knows any.
+// It returns an error wrapping ErrNoPeers if no tracker does.
+func FindPeersAny(ctx context.Context, trackers []string, timeout time.Duration, fileHash string) ([]Peer, error) {
+	switch len(trackers) {
+	case 0:
+		return nil, fmt.Errorf("%w: no tracker to ask", ErrNoPeers)
+	case 1:
+		return FindPeers(ctx, trackers[0], timeout, fileHash)
+	}
+
+	var errs []error
+	for _, trackerURL := range trackers {
+		peers, err := FindPeers(ctx, trackerURL, timeout, fileHash)
+		if err == nil {
+			return peers, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", trackerURL, err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// PeerPollInterval is how often WaitForPeers asks the trackers again.
+const PeerPollInterval = 2 * time.Second
+
+// peerPollInterval is PeerPollInterval, shortened by tests.
+var peerPollInterval = PeerPollInterval
+
+// WaitForPeers asks trackers, as FindPeersAny does, every PeerPollInterval
+// until at least min peers serve the file with the given hash, and returns
+// them. Failed polls are retried. If ctx is done first, it returns the peers
+// from the last successful poll, which may be none, with an error wrapping
+// ctx's error, so that the caller may go ahead with fewer peers.
+func WaitForPeers(ctx context.Context, trackers []string, timeout time.Duration, fileHash string, min int) ([]Peer, error) {
+	var found []Peer
+	for {
+		peers, err := FindPeersAny(ctx, trackers, timeout, fileHash)
+		if err == nil {
+			found = peers
+			if len(found) >= min {
+				return found, nil
+			}
+		}
+
+		// Wait before asking again, unless ctx ends first
+		timer := time.NewTimer(peerPollInterval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return found, fmt.Errorf("found %d of %d peers: %w", len(found), min, ctx.Err())
+		}
+	}
+}
+
+// FetchManifest downloads the manifest of the file with the given hash from a
+// tracker that stores manifests, failing with ErrManifestMismatch if the
+// tracker returns one of another file. The tracker isn't trusted to have
+// checked the manifest's chunks, so download it with DownloadOptions.FileHash.
+func FetchManifest(ctx context.Context, trackerURL string, timeout time.Duration, fileHash string) (*Manifest, error) {
+	return tracker.NewTrackerClient(trackerURL, timeout).GetManifest(ctx, fileHash)
+}
+
+// FetchManifestFromPeers asks each of peers in turn for the manifest of the
+// file with the given hash, as served by seeders with
+// SeederOptions.ServeManifest, and returns the first one it gets. It lets a
+// downloader who only knows the hash start without a tracker that stores
+// manifests. Manifests larger than maxSize bytes (DefaultMaxManifestSize if
+// maxSize isn't positive) are rejected, and so are manifests of another file,
+// with ErrManifestMismatch. As with a tracker's, the manifest is only proven
+// genuine once the downloaded file matches fileHash, so download it with
+// DownloadOptions.FileHash. token is the file's access token, needed if its
+// seeders keep it private, and otherwise empty.
+func FetchManifestFromPeers(ctx context.Context, peers []Peer, fileHash, token string, maxSize int64) (*Manifest, error) {
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("%w to ask for the manifest", ErrNoPeers)
+	}
+	var errs []error
+	for _, p := range peers {
+		manifest, err := peer.FetchManifest(ctx, TCPTransport{}, p, fileHash, token, maxSize)
+		if err == nil {
+			return manifest, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", peerName(p), err))
+	}
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,293 @@
+package goshare
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+// shareFile writes content to a file, uploads it with opts, and serves it over
+// tr until the test ends, announcing it to trackerURL if that isn't empty.
+func shareFile(t *testing.T, tr Transport, content []byte, opts UploadOptions, trackerURL string) (string, *Manifest) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "shared.bin")
+	writeContent(t, path, content)
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = 1 << 10
+	}
+	manifest, err := Upload(context.Background(), path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeder := NewSeeder(path, manifest, SeederOptions{Transport: tr, TrackerURL: trackerURL})
+	if err := seeder.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { seeder.Close() })
+	return path, manifest
+}
+
+// writeContent writes content to a file at path.
+func writeContent(t *testing.T, path string, content []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startTracker serves a tracker over HTTP until the test ends and returns its
+// URL.
+func startTracker(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(NewTracker(TrackerOptions{}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestDownloadUsesManifestTrackers(t *testing.T) {
+	tr := NewMemoryTransport()
+	trackerURL := startTracker(t)
+	content := bytes.Repeat([]byte("tracked content "), 200)
+	_, manifest := shareFile(t, tr, content, UploadOptions{Trackers: []string{trackerURL}}, trackerURL)
+	if len(manifest.Trackers) != 1 || manifest.Trackers[0] != trackerURL {
+		t.Fatalf("manifest lists trackers %v, want [%s]", manifest.Trackers, trackerURL)
+	}
+
+	// With neither peers nor a tracker given, the manifest's tracker is asked
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	if _, err := Download(context.Background(), manifest, DownloadOptions{OutputPath: outputPath, Transport: tr}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(outputPath); err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("downloaded %d bytes, %v; want the %d shared", len(got), err, len(content))
+	}
+
+	// TrackerURL overrides the manifest's trackers
+	_, err := Download(context.Background(), manifest, DownloadOptions{
+		OutputPath: filepath.Join(t.TempDir(), "out.bin"),
+		TrackerURL: startTracker(t),
+		Transport:  tr,
+	})
+	if !errors.Is(err, ErrNoPeers) {
+		t.Fatalf("download asking an empty tracker returned %v, want ErrNoPeers", err)
+	}
+}
+
+func TestTrackerUnderBasePath(t *testing.T) {
+	tr := NewMemoryTransport()
+	srv := httptest.NewServer(NewTracker(TrackerOptions{BasePath: "/goshare"}))
+	t.Cleanup(srv.Close)
+	trackerURL := srv.URL + "/goshare"
+	content := bytes.Repeat([]byte("behind a proxy "), 200)
+	_, manifest := shareFile(t, tr, content, UploadOptions{}, trackerURL)
+
+	if n, err := CountPeers(context.Background(), trackerURL, time.Second, manifest.FileHash); err != nil || n != 1 {
+		t.Fatalf("tracker counts %d peers, %v, want the seeder", n, err)
+	}
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	if _, err := Download(context.Background(), manifest, DownloadOptions{OutputPath: outputPath, TrackerURL: trackerURL, Transport: tr}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(outputPath); err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("downloaded %d bytes, %v; want the %d shared", len(got), err, len(content))
+	}
+}
+
+func TestUploadRejectsInvalidTrackers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shared.txt")
+	if err := os.WriteFile(path, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tracker := range []string{"localhost:8080", "ftp://tracker.example", "http://"} {
+		if _, err := Upload(context.Background(), path, UploadOptions{Trackers: []string{tracker}}); !errors.Is(err, file.ErrInvalidTracker) {
+			t.Errorf("Upload with tracker %q returned %v, want ErrInvalidTracker", tracker, err)
+		}
+	}
+}
+
+func TestWaitForPeers(t *testing.T) {
+	interval := peerPollInterval
+	peerPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { peerPollInterval = interval })
+
+	tr := NewMemoryTransport()
+	trackerURL := startTracker(t)
+	content := bytes.Repeat([]byte("awaited content "), 300)
+	path, manifest := shareFile(t, tr, content, UploadOptions{}, trackerURL)
+	trackers := []string{trackerURL}
+
+	type result struct {
+		peers []Peer
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		peers, err := WaitForPeers(context.Background(), trackers, 0, manifest.FileHash, 2)
+		done <- result{peers, err}
+	}()
+
+	// One peer isn't enough, so the wait goes on over several polls
+	select {
+	case r := <-done:
+		t.Fatalf("WaitForPeers returned %v, %v with one peer known", r.peers, r.err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// A second seeder comes online, announcing another address
+	second := NewSeeder(path, manifest, SeederOptions{Transport: NewMemoryTransport(), TrackerURL: trackerURL, Address: "127.0.0.1"})
+	if err := second.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { second.Close() })
+	var peers []Peer
+	select {
+	case r := <-done:
+		if r.err != nil || len(r.peers) != 2 {
+			t.Fatalf("WaitForPeers returned %v, %v, want 2 peers", r.peers, r.err)
+		}
+		peers = r.peers
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitForPeers still waiting with 2 peers known")
+	}
+
+	// The download then proceeds from the peers found
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	if _, err := Download(context.Background(), manifest, DownloadOptions{OutputPath: outputPath, Peers: peers, Transport: tr}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(outputPath); err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("downloaded %d bytes, %v; want the %d shared", len(got), err, len(content))
+	}
+
+	// Waiting for more peers than there are gives up with those found
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	peers, err := WaitForPeers(ctx, trackers, 0, manifest.FileHash, 3)
+	if !errors.Is(err, context.DeadlineExceeded) || len(peers) != 2 {
+		t.Fatalf("WaitForPeers past its deadline returned %v, %v, want the 2 peers and context.DeadlineExceeded", peers, err)
+	}
+}
+
+func TestDownloadKeyedManifest(t *testing.T) {
+	tr := NewMemoryTransport()
+	key := []byte("private group")
+	content := bytes.Repeat([]byte("group secret "), 400)
+	path, shared := shareFile(t, tr, content, UploadOptions{HashKey: key}, "")
+
+	// Group members load the manifest from disk, which doesn't hold the key
+	manifest, err := LoadManifest(ManifestPath(path, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.FileHash != shared.FileHash || !manifest.IsKeyed() {
+		t.Fatal("saved manifest differs from the uploaded one")
+	}
+	peers := []Peer{{Address: "localhost", Port: DefaultSeederPort}}
+	download := func(key []byte) error {
+		outputPath := filepath.Join(t.TempDir(), "out.bin")
+		_, err := Download(context.Background(), manifest, DownloadOptions{OutputPath: outputPath, Peers: peers, Transport: tr, HashKey: key})
+		if err == nil {
+			if got, err := os.ReadFile(outputPath); err != nil || !bytes.Equal(got, content) {
+				t.Fatalf("downloaded %d bytes, %v; want the %d shared", len(got), err, len(content))
+			}
+		}
+		return err
+	}
+	for _, wrong := range [][]byte{nil, []byte("another group")} {
+		if err := download(wrong); !errors.Is(err, ErrHashKey) {
+			t.Fatalf("download with key %q returned %v, want ErrHashKey", wrong, err)
+		}
+	}
+	if err := download(key); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.CheckHashKey() == nil {
+		t.Fatal("Download set the key on the caller's manifest")
+	}
+}
+
+func TestParsePeer(t *testing.T) {
+	for addr, want := range map[string]Peer{
+		"localhost:9000":     {Address: "localhost", Port: 9000},
+		"192.168.1.20:65535": {Address: "192.168.1.20", Port: 65535},
+		"[::1]:1":            {Address: "::1", Port: 1},
+	} {
+		if p, err := ParsePeer(addr); err != nil || p != want {
+			t.Errorf("ParsePeer(%q) = %+v, %v; want %+v", addr, p, err, want)
+		}
+	}
+	for _, addr := range []string{"localhost", ":9000", "host:0", "host:65536", "host:http", "::1:9000", ""} {
+		if p, err := ParsePeer(addr); err == nil {
+			t.Errorf("ParsePeer(%q) = %+v, want an error", addr, p)
+		}
+	}
+}
+
+func TestDownloadAnchoredToFileHash(t *testing.T) {
+	wanted := []byte("the file that was asked for")
+	trusted := NewMemoryTransport()
+	_, genuine := shareFile(t, trusted, wanted, UploadOptions{}, "")
+
+	// A hostile seeder hands out the manifest of other content under the
+	// wanted hash; every chunk of it checks out
+	hostile := NewMemoryTransport()
+	path := filepath.Join(t.TempDir(), "other.bin")
+	writeContent(t, path, bytes.Repeat([]byte("other content "), 200))
+	forged, err := Upload(context.Background(), path, UploadOptions{ChunkSize: 1 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged.FileHash = genuine.FileHash
+	seeder := NewSeeder(path, forged, SeederOptions{Transport: hostile})
+	if err := seeder.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer seeder.Close()
+	peers := []Peer{{Address: "localhost", Port: DefaultSeederPort}}
+
+	// Without VerifyAfter, the file hash is what catches it
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	_, err = Download(context.Background(), forged, DownloadOptions{OutputPath: outputPath, Peers: peers, Transport: hostile, FileHash: genuine.FileHash})
+	if !errors.Is(err, ErrVerificationFailed) {
+		t.Fatalf("download of a forged manifest returned %v, want ErrVerificationFailed", err)
+	}
+	if _, err := os.Stat(outputPath); !os.IsNotExist(err) {
+		t.Fatal("file that doesn't match the hash asked for was moved into place")
+	}
+	if _, err := os.Stat(PartPath(outputPath)); err != nil {
+		t.Fatalf("download that failed verification left no .part file: %v", err)
+	}
+
+	// A manifest of another file is refused before anything is downloaded
+	_, err = Download(context.Background(), genuine, DownloadOptions{OutputPath: outputPath, Peers: peers, Transport: trusted, FileHash: strings.Repeat("0", 64)})
+	if !errors.Is(err, ErrManifestMismatch) {
+		t.Fatalf("download of another file's manifest returned %v, want ErrManifestMismatch", err)
+	}
+	_, err = Download(context.Background(), genuine, DownloadOptions{Sink: nopSink{}, Peers: peers, Transport: trusted, FileHash: genuine.FileHash})
+	if err == nil {
+		t.Fatal("download anchored to a file hash into a sink started")
+	}
+
+	// The genuine manifest downloads as usual
+	outputPath = filepath.Join(t.TempDir(), "out.bin")
+	if _, err := Download(context.Background(), genuine, DownloadOptions{OutputPath: outputPath, Peers: peers, Transport: trusted, FileHash: genuine.FileHash}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(outputPath); err != nil || !bytes.Equal(got, wanted) {
+		t.Fatalf("downloaded %d bytes, %v; want the %d asked for", len(got), err, len(wanted))
+	}
+}
+
+// nopSink is a ChunkSink discarding every chunk.
+type nopSink struct{}
+
+func (nopSink) WriteChunkAt(index int, data []byte) error { return nil }
+func (nopSink) Finalize() error                           { return nil }
@@ -0,0 +1,73 @@
+package goshare
+
+import (
+	"context"
+
+	"github.com/timskillet/go-share/internal/peer"
+)
+
+// DefaultEstimateSample is how many chunks EstimateDownload times per peer by
+// default.
+const DefaultEstimateSample = peer.DefaultEstimateSample
+
+// ErrNoSpeeds is returned by EstimateDownload when none of the peers could be
+// timed.
+var ErrNoSpeeds = peer.ErrNoSpeeds
+
+// PeerSpeed is the result of timing a peer for EstimateDownload: its ping
+// round-trip time and the chunk data it served in the time measured, or why
+// it couldn't be timed. Throughput returns its rate.
+type PeerSpeed = peer.PeerSpeed
+
+// DownloadEstimate is the expected duration and rate of a download.
+type DownloadEstimate = peer.Estimate
+
+// EstimateOptions configures EstimateDownload. The zero value times
+// DefaultEstimateSample chunks per peer over TCP and assumes as many chunks in
+// flight as Download would use.
+type EstimateOptions struct {
+	Transport Transport // Network used to reach peers (default: TCPTransport)
+	// Sample is how many randomly chosen chunks are fetched from each peer
+	// (default: DefaultEstimateSample). Larger samples give steadier
+	// estimates at the cost of more traffic.
+	Sample int
+	// MaxParallel is the number of chunks the download would fetch
+	// concurrently (default: as for Download).
+	MaxParallel int
+	// Bandwidth, if positive, caps the estimated rate in bytes per second,
+	// e.g. at the speed of the local link or a download rate limit.
+	Bandwidth int64
+	// HashKey is the group key of a keyed manifest, needed to check its chunks.
+	HashKey []byte
+}
+
+// EstimateDownload estimates how long downloading the file described by
+// manifest from peers would take, by pinging each peer and timing a small
+// sample of chunks from it. It returns the estimate along with each peer's
+// measurements, in the order of peers. The estimate is rough: it is based on
+// a few chunks per peer at one moment, and the swarm may be faster or slower
+// by the time the download runs. If no peer could be timed, the measurements
+// are returned with an error wrapping ErrNoSpeeds.
+func EstimateDownload(ctx context.Context, manifest *Manifest, peers []Peer, opts EstimateOptions) (*DownloadEstimate, []*PeerSpeed, error) {
+	if opts.Transport == nil {
+		opts.Transport = TCPTransport{}
+	}
+	if opts.MaxParallel < 1 {
+		opts.MaxParallel = peer.DefaultMaxParallel(len(peers))
+	}
+	if manifest.IsKeyed() && opts.HashKey != nil {
+		// Set the key on a copy, leaving the caller's manifest alone
+		keyed := *manifest
+		if err := keyed.SetHashKey(opts.HashKey); err != nil {
+			return nil, nil, err
+		}
+		manifest = &keyed
+	}
+
+	speeds, err := peer.MeasurePeers(ctx, opts.Transport, peers, manifest, opts.Sample)
+	if err != nil {
+		return nil, nil, err
+	}
+	estimate, err := peer.EstimateDownload(speeds, manifest.FileSize, opts.MaxParallel, opts.Bandwidth)
+	return estimate, speeds, err
+}
@@ -0,0 +1,139 @@
+package goshare
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Event types published on an EventBus.
+const (
+	// EventPeerConnected: a seeder accepted a connection from the peer at
+	// Peer, or a download reached the peer at Peer for the first time.
+	EventPeerConnected = "peer_connected"
+	// EventChunkServed: a seeder sent chunk Chunk, of Size bytes, in full.
+	EventChunkServed = "chunk_served"
+	// EventChunkDownloaded: a download received, verified, and wrote chunk
+	// Chunk, of Size bytes, from the peer at Peer.
+	EventChunkDownloaded = "chunk_downloaded"
+	// EventError: something went wrong, as described by Error. Errors for a
+	// single chunk or peer name them; the operation may still succeed.
+	EventError = "error"
+	// EventComplete: a download finished successfully, with Size bytes, or a
+	// seeder served the number of copies it was limited to.
+	EventComplete = "complete"
+)
+
+// Event is something that happened during a download or while seeding. Fields
+// that don't apply to an event's Type are left empty.
+type Event struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	FileHash string    `json:"fileHash,omitempty"`
+	Peer     string    `json:"peer,omitempty"`  // host:port of the peer, or a web seed's URL
+	Chunk    *int      `json:"chunk,omitempty"` // Chunk index, for chunk events
+	Size     int64     `json:"size,omitempty"`  // Bytes of the chunk or file
+	Error    string    `json:"error,omitempty"`
+}
+
+// EventBus delivers the events of downloads and seeders to subscribers, e.g.
+// to log them or report them to a supervisor. Pass one in
+// DownloadOptions.Events or SeederOptions.Events. Events are delivered one at
+// a time, in the order they are published, so subscribers needn't be safe for
+// concurrent use; they must not block for long, and must not subscribe or
+// unsubscribe from within a delivery.
+type EventBus struct {
+	mu     sync.Mutex
+	nextID int
+	subs   map[int]func(Event)
+}
+
+// NewEventBus creates an EventBus without subscribers.
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[int]func(Event))}
+}
+
+// Subscribe calls fn with every event published from now on, until the
+// returned function is called.
+func (b *EventBus) Subscribe(fn func(Event)) (unsubscribe func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := b.nextID
+	b.nextID++
+	b.subs[id] = fn
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subs, id)
+	}
+}
+
+// Publish delivers e to every subscriber, setting its Time if it is unset.
+// Publishing on a nil EventBus does nothing.
+func (b *EventBus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, fn := range b.subs {
+		fn(e)
+	}
+}
+
+// publishError publishes an EventError for err, if it is non-nil.
+func (b *EventBus) publishError(fileHash, peer string, err error) {
+	if err == nil {
+		return
+	}
+	b.Publish(Event{Type: EventError, FileHash: fileHash, Peer: peer, Error: err.Error()})
+}
+
+// chunkEvent returns an event of the given type about chunk index.
+func chunkEvent(typ, fileHash, peer string, index int, size int64) Event {
+	return Event{Type: typ, FileHash: fileHash, Peer: peer, Chunk: &index, Size: size}
+}
+
+// peerName identifies p in events.
+func peerName(p Peer) string {
+	if p.URL != "" {
+		return p.URL
+	}
+	return net.JoinHostPort(p.Address, strconv.Itoa(p.Port))
+}
+
+// eventTransport is a Transport that publishes EventPeerConnected the first
+// time a connection to each peer succeeds.
+type eventTransport struct {
+	Transport
+	bus      *EventBus
+	fileHash string
+
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+// Dial connects to addr, publishing EventPeerConnected if it is the first
+// connection to it.
+func (t *eventTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := t.Transport.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	first := !t.seen[addr]
+	t.seen[addr] = true
+	t.mu.Unlock()
+	if first {
+		t.bus.Publish(Event{Type: EventPeerConnected, FileHash: t.fileHash, Peer: addr})
+	}
+	return conn, nil
+}
@@ -0,0 +1,163 @@
+package goshare
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// eventLog records the events published on a bus.
+type eventLog struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+// record subscribes the log to bus until the test ends.
+func (l *eventLog) record(t *testing.T, bus *EventBus) {
+	t.Cleanup(bus.Subscribe(func(e Event) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.events = append(l.events, e)
+	}))
+}
+
+// ofType returns the recorded events of type typ.
+func (l *eventLog) ofType(typ string) []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var events []Event
+	for _, e := range l.events {
+		if e.Type == typ {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// all returns every recorded event.
+func (l *eventLog) all() []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]Event(nil), l.events...)
+}
+
+func TestEventBus(t *testing.T) {
+	var nilBus *EventBus
+	nilBus.Publish(Event{Type: EventComplete})
+
+	bus := NewEventBus()
+	var first, second []string
+	unsubscribe := bus.Subscribe(func(e Event) {
+		if e.Time.IsZero() {
+			t.Error("event delivered without a time")
+		}
+		first = append(first, e.Type)
+	})
+	bus.Subscribe(func(e Event) { second = append(second, e.Type) })
+
+	bus.Publish(Event{Type: EventPeerConnected})
+	unsubscribe()
+	bus.Publish(Event{Type: EventComplete})
+	if len(first) != 1 || first[0] != EventPeerConnected {
+		t.Fatalf("unsubscribed subscriber got %v, want only the event before it left", first)
+	}
+	if len(second) != 2 || second[0] != EventPeerConnected || second[1] != EventComplete {
+		t.Fatalf("subscriber got %v, want both events in order", second)
+	}
+}
+
+func TestDownloadAndSeederEvents(t *testing.T) {
+	tr := NewMemoryTransport()
+	content := bytes.Repeat([]byte("observed content "), 300)
+	path := filepath.Join(t.TempDir(), "shared.bin")
+	writeContent(t, path, content)
+	manifest, err := Upload(context.Background(), path, UploadOptions{ChunkSize: 1 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seederBus := NewEventBus()
+	var seeded eventLog
+	seeded.record(t, seederBus)
+	seeder := NewSeeder(path, manifest, SeederOptions{Transport: tr, Events: seederBus})
+	if err := seeder.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer seeder.Close()
+
+	downloadBus := NewEventBus()
+	var downloaded eventLog
+	downloaded.record(t, downloadBus)
+	_, err = Download(context.Background(), manifest, DownloadOptions{
+		OutputPath: filepath.Join(t.TempDir(), "out.bin"),
+		Peers:      []Peer{{Address: "localhost", Port: DefaultSeederPort}},
+		Transport:  tr,
+		Events:     downloadBus,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The download reaches its peer, gets every chunk once, then completes
+	events := downloaded.all()
+	if len(events) == 0 || events[0].Type != EventPeerConnected {
+		t.Fatalf("download events %v don't start with %s", events, EventPeerConnected)
+	}
+	if last := events[len(events)-1]; last.Type != EventComplete || last.Size != manifest.FileSize {
+		t.Fatalf("last download event %+v, want %s of %d bytes", last, EventComplete, manifest.FileSize)
+	}
+	chunks := downloaded.ofType(EventChunkDownloaded)
+	got := make(map[int]bool)
+	for _, e := range chunks {
+		if e.Chunk == nil || e.FileHash != manifest.FileHash || e.Size != manifest.Chunks[*e.Chunk].Size {
+			t.Fatalf("chunk event %+v doesn't describe a chunk of the file", e)
+		}
+		got[*e.Chunk] = true
+	}
+	if len(chunks) != len(manifest.Chunks) || len(got) != len(manifest.Chunks) {
+		t.Fatalf("%d chunk events for %d distinct chunks, want one for each of %d", len(chunks), len(got), len(manifest.Chunks))
+	}
+	if errs := downloaded.ofType(EventError); len(errs) != 0 {
+		t.Fatalf("successful download published errors %v", errs)
+	}
+
+	// The seeder publishes served chunks once they are sent, which may be
+	// after the download has them
+	deadline := time.Now().Add(5 * time.Second)
+	for len(seeded.ofType(EventChunkServed)) < len(manifest.Chunks) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(seeded.ofType(EventChunkServed)); n != len(manifest.Chunks) {
+		t.Fatalf("seeder published %d served chunks, want %d", n, len(manifest.Chunks))
+	}
+	if len(seeded.ofType(EventPeerConnected)) == 0 {
+		t.Fatal("seeder published no connections")
+	}
+}
+
+func TestDownloadErrorEvent(t *testing.T) {
+	bus := NewEventBus()
+	var log eventLog
+	log.record(t, bus)
+	_, manifest := shareFile(t, NewMemoryTransport(), []byte("unreachable content"), UploadOptions{}, "")
+
+	_, err := Download(context.Background(), manifest, DownloadOptions{
+		OutputPath: filepath.Join(t.TempDir(), "out.bin"),
+		TrackerURL: startTracker(t),
+		Transport:  NewMemoryTransport(),
+		Events:     bus,
+	})
+	if !errors.Is(err, ErrNoPeers) {
+		t.Fatalf("download returned %v, want ErrNoPeers", err)
+	}
+	errs := log.ofType(EventError)
+	if len(errs) != 1 || errs[0].Error != err.Error() || errs[0].FileHash != manifest.FileHash {
+		t.Fatalf("failed download published errors %+v, want one for %v", errs, err)
+	}
+	if complete := log.ofType(EventComplete); len(complete) != 0 {
+		t.Fatalf("failed download published %+v", complete)
+	}
+}
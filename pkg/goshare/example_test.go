@@ -0,0 +1,59 @@
+package goshare_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/timskillet/go-share/pkg/goshare"
+)
+
+// This example shares a file and downloads it again within one program. The
+// seeder and the downloader talk over an in-memory transport; a real program
+// would leave Transport unset to use TCP, and give the seeder a TrackerURL
+// for downloaders to find it.
+func Example() {
+	dir, err := os.MkdirTemp("", "goshare-example")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "greeting.txt")
+	if err := os.WriteFile(path, []byte("Hello from go-share!\n"), 0644); err != nil {
+		log.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// Prepare the file for sharing and start serving it
+	manifest, err := goshare.Upload(ctx, path, goshare.UploadOptions{ChunkSize: 8})
+	if err != nil {
+		log.Fatal(err)
+	}
+	transport := goshare.NewMemoryTransport()
+	seeder := goshare.NewSeeder(path, manifest, goshare.SeederOptions{Transport: transport})
+	if err := seeder.Start(ctx); err != nil {
+		log.Fatal(err)
+	}
+	defer seeder.Close()
+
+	// Download it from the seeder
+	outputPath := filepath.Join(dir, "downloaded.txt")
+	result, err := goshare.Download(ctx, manifest, goshare.DownloadOptions{
+		OutputPath: outputPath,
+		Peers:      []goshare.Peer{{Address: "localhost", Port: goshare.DefaultSeederPort}},
+		Transport:  transport,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	data, err := os.ReadFile(outputPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Downloaded %d chunks, %d bytes: %s", result.Chunks, result.Bytes, data)
+
+	// Output:
+	// Downloaded 3 chunks, 21 bytes: Hello from go-share!
+}
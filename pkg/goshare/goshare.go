@@ -0,0 +1,98 @@
+// Package goshare is the public API for embedding go-share in other Go programs.
+// It wraps the internal file, peer, and tracker packages behind a small set of
+// high-level operations: Upload prepares a file for sharing, a Seeder serves it
+// and keeps it registered with a tracker, Download fetches a file from its
+// peers, and a Tracker runs the peer registry itself.
+package goshare
+
+import (
+	"github.com/timskillet/go-share/internal/file"
+	"github.com/timskillet/go-share/internal/peer"
+)
+
+// Manifest describes a shared file and its chunks.
+type Manifest = file.Manifest
+
+// Chunk is one entry of a Manifest.
+type Chunk = file.Chunk
+
+// Peer is the address of a seeder.
+type Peer = peer.Peer
+
+// Transport is the network used for peer-to-peer transfers.
+type Transport = peer.Transport
+
+// TCPTransport is the default Transport backed by TCP sockets. Set its
+// DialTimeout and KeepAlive to tune how quickly unreachable peers are given up.
+type TCPTransport = peer.TCPTransport
+
+// Defaults for TCPTransport's DialTimeout and KeepAlive.
+const (
+	DefaultDialTimeout = peer.DefaultDialTimeout
+	DefaultKeepAlive   = peer.DefaultKeepAlive
+)
+
+// ChunkSink is where a download stores its chunks when DownloadOptions.Sink is
+// set: WriteChunkAt is called with each verified chunk, in any order and
+// possibly concurrently, and Finalize once all of them have been written.
+type ChunkSink = peer.ChunkSink
+
+// DownloadResult summarizes a finished download: how many bytes it fetched in
+// how long, how many chunks each peer served, and which requests failed.
+type DownloadResult = peer.DownloadResult
+
+// NewMemoryTransport creates an in-memory Transport, which lets seeders and
+// downloaders in the same process talk without binding real ports.
+func NewMemoryTransport() *peer.MemoryTransport {
+	return peer.NewMemoryTransport()
+}
+
+// Chunking strategies and defaults, see UploadOptions.
+const (
+	ChunkingFixed    = file.ChunkingFixed
+	ChunkingCDC      = file.ChunkingCDC
+	DefaultChunkSize = file.DefaultChunkSize
+)
+
+// Errors reported by uploads and downloads. Use errors.Is to check for them.
+var (
+	ErrNoPeers            = peer.ErrNoPeers
+	ErrPeerUnreachable    = peer.ErrPeerUnreachable
+	ErrVerificationFailed = peer.ErrVerificationFailed
+	ErrDiskFull           = peer.ErrDiskFull
+	ErrFileExists         = file.ErrFileExists
+	ErrHashKey            = file.ErrHashKey
+	ErrContentChanged     = file.ErrContentChanged
+	ErrManifestTooLarge   = file.ErrManifestTooLarge
+	ErrManifestMismatch   = file.ErrManifestMismatch
+	ErrChunkUnavailable   = peer.ErrChunkUnavailable
+	ErrChunkRejected      = peer.ErrChunkRejected
+	ErrManifestNotServed  = peer.ErrManifestNotServed
+	ErrAccessDenied       = peer.ErrAccessDenied
+	ErrFileGone           = peer.ErrFileGone
+)
+
+// UnavailableError is returned by a download that couldn't get some chunks
+// because no peer had them; Chunks lists them. It wraps ErrChunkUnavailable.
+type UnavailableError = peer.UnavailableError
+
+// DefaultReorderBuffer is the memory DownloadTo holds chunks that arrive early
+// in, unless DownloadOptions.ReorderBuffer says otherwise.
+const DefaultReorderBuffer = peer.DefaultReorderBuffer
+
+// DefaultMaxManifestSize is the largest manifest LoadManifest accepts, in
+// bytes of JSON after decompression.
+const DefaultMaxManifestSize = file.DefaultMaxManifestSize
+
+// LoadManifest reads a manifest saved by Upload, compressed or not. Manifests
+// larger than DefaultMaxManifestSize are rejected with ErrManifestTooLarge
+// before they are read into memory, so hostile manifests can't exhaust it.
+func LoadManifest(path string) (*Manifest, error) {
+	return file.LoadManifest(path)
+}
+
+// LoadManifestLimit is like LoadManifest, but accepts manifests of up to
+// maxSize bytes (DefaultMaxManifestSize if maxSize isn't positive).
+func LoadManifestLimit(path string, maxSize int64) (*Manifest, error) {
+	return file.LoadManifestLimit(path, maxSize)
+}
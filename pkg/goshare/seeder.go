@@ -0,0 +1,565 @@
+package goshare
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/timskillet/go-share/internal/file"
+	"github.com/timskillet/go-share/internal/peer"
+	"github.com/timskillet/go-share/internal/tracker"
+)
+
+// DefaultSeederPort is the port a Seeder listens on.
+const DefaultSeederPort = peer.DefaultPort
+
+// SeederOptions configures a Seeder. The zero value serves every client over TCP
+// without registering with a tracker.
+type SeederOptions struct {
+	Transport Transport // Network to serve on (default: TCPTransport)
+
+	// Allow, if non-empty, restricts downloads to clients in these networks.
+	// Deny rejects clients in its networks even if they are allowed.
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+
+	// TrackerURL is the tracker the file is announced to. If empty, the file is
+	// served without being announced.
+	TrackerURL string
+	// TrackerTimeout bounds each tracker request (default: 10s).
+	TrackerTimeout time.Duration
+	// Address is the host peers should connect to, as announced to the tracker
+	// (default: "localhost").
+	Address string
+	// AnnounceInterval is how often the file is re-announced. The file is
+	// announced as soon as the seeder starts, and the tracker's answer tells
+	// how long it keeps peers listed: by default the file is re-announced
+	// three times in that time, or every DefaultAnnounceInterval if the
+	// tracker never drops peers. Intervals over half the tracker's peer TTL
+	// are shortened likewise, so the registration doesn't lapse.
+	AnnounceInterval time.Duration
+	// PublishManifest uploads the manifest to the tracker, so downloaders only
+	// need the file hash.
+	PublishManifest bool
+	// OnAnnounceError, if set, is called when a periodic re-announce fails.
+	OnAnnounceError func(error)
+
+	// MaxUploads, if positive, closes the channel returned by Done once every
+	// chunk of the file has been served this many times, i.e. once peers have
+	// received that many complete copies between them. Seeding continues until
+	// Close is called.
+	MaxUploads int
+
+	// Follow, if positive, re-scans the file this often and shares any data
+	// appended to it since, for files such as logs that grow while they are
+	// seeded. Downloaders following the file pick up the new chunks. Only whole
+	// files with fixed-size chunks can be followed.
+	Follow time.Duration
+	// OnFollowError, if set, is called when a re-scan fails, e.g. because the
+	// file shrank.
+	OnFollowError func(error)
+
+	// VerifyOnStart makes Start check the file against the manifest before
+	// serving or announcing it, and fail with an error wrapping
+	// ErrContentChanged if any chunk doesn't match, so that a file corrupted
+	// on disk doesn't make the seeder a source of bad chunks. VerifySample, if
+	// positive, checks only that many chunks chosen at random, which is faster
+	// for large files but may miss some damage (default: every chunk).
+	VerifyOnStart bool
+	VerifySample  int
+
+	// ZeroCopy sends chunks from the file straight to TCP connections with
+	// sendfile, so that they aren't copied through memory. Chunks are then
+	// not verified before they are sent; use VerifyOnStart to catch a file
+	// corrupted on disk. Directories, gzip files, followed files, and other
+	// transports are served as usual.
+	ZeroCopy bool
+
+	// Gzipped serves the decompressed content of a gzip file, which the
+	// manifest describes, as created by Upload with UploadOptions.Gzipped.
+	// Chunks are decompressed as they are requested. It can't be used with
+	// Follow.
+	Gzipped bool
+
+	// ServeManifest hands the manifest to peers that ask for it, so that
+	// downloaders who only know the file hash can get it from seeders; see
+	// FetchManifestFromPeers.
+	ServeManifest bool
+
+	// OnFileGone, if set, is called with an error wrapping ErrFileGone when
+	// the file is found deleted, replaced, or truncated while it is seeded,
+	// either by a chunk request or by a check every few seconds. The seeder
+	// then stops serving the file, refusing peers with ErrFileGone rather
+	// than sending them bad data, and unannounces it; Close must still be
+	// called.
+	OnFileGone func(error)
+
+	// Events, if set, receives an event for each connection accepted and chunk
+	// served, for failed re-announces and re-scans, and once MaxUploads
+	// copies have been served.
+	Events *EventBus
+}
+
+// Seeder serves a file to peers and keeps it registered with a tracker.
+type Seeder struct {
+	path     string
+	manifest *Manifest
+	opts     SeederOptions
+
+	src       io.ReaderAt // Content being served
+	closer    io.Closer   // Releases src
+	f         *os.File    // The file being served, unless it is a directory
+	store     *peer.FileStore
+	ln        net.Listener
+	served    chan error // Result of peer.Serve once the listener closes
+	stop      context.CancelFunc
+	announced chan error // Result of the re-announce loop, nil if not announcing
+
+	stopFollow context.CancelFunc
+	followed   chan struct{} // Closed when the re-scan loop returns, nil if not following
+
+	gone      chan error // Receives the reason the file is gone, from a chunk request
+	stopWatch context.CancelFunc
+	watched   chan struct{} // Closed when the file check loop returns
+
+	uploads *uploadCounter
+	done    chan struct{} // Closed once MaxUploads complete copies have been served
+	stats   *peer.ServerStats
+}
+
+// SeederStats is a snapshot of what a Seeder has served: totals, active
+// connections, and a breakdown per file hash.
+type SeederStats = peer.StatsSnapshot
+
+// NewSeeder creates a Seeder for the file or directory at path, described by manifest.
+// If manifest has an access token (see UploadOptions.AccessToken), the file is
+// only served to downloaders presenting it. Nothing is served until Start is called.
+func NewSeeder(path string, manifest *Manifest, opts SeederOptions) *Seeder {
+	if opts.Transport == nil {
+		opts.Transport = TCPTransport{}
+	}
+	if opts.Address == "" {
+		opts.Address = "localhost"
+	}
+	return &Seeder{
+		path:     path,
+		manifest: manifest,
+		opts:     opts,
+		uploads:  newUploadCounter(len(manifest.Chunks)),
+		done:     make(chan struct{}),
+		stats:    peer.NewServerStats(),
+	}
+}
+
+// Stats returns a snapshot of what the seeder has served so far.
+func (s *Seeder) Stats() SeederStats {
+	return s.stats.Snapshot()
+}
+
+// StatsHandler returns an http.Handler that responds to GET requests with the
+// seeder's Stats as JSON.
+func (s *Seeder) StatsHandler() http.Handler {
+	return s.stats
+}
+
+// Done returns a channel that is closed once SeederOptions.MaxUploads complete
+// copies of the file have been served. Without MaxUploads it is never closed.
+func (s *Seeder) Done() <-chan struct{} {
+	return s.done
+}
+
+// Uploads returns how many complete copies of the file have been served: the
+// number of times every one of its chunks has been sent to a peer.
+func (s *Seeder) Uploads() int {
+	return s.uploads.completed()
+}
+
+// chunkServed records that a chunk was sent to a peer and closes done once
+// MaxUploads complete copies have been served.
+func (s *Seeder) chunkServed(fileHash string, chunkIndex int, size int64) {
+	if fileHash != s.manifest.FileHash {
+		return
+	}
+	s.opts.Events.Publish(chunkEvent(EventChunkServed, fileHash, "", chunkIndex, size))
+	if n := s.uploads.add(chunkIndex); n > 0 && n == s.opts.MaxUploads {
+		s.opts.Events.Publish(Event{Type: EventComplete, FileHash: fileHash, Size: s.manifest.FileSize})
+		close(s.done)
+	}
+}
+
+// Start begins serving the file on DefaultSeederPort and, if a tracker is
+// configured, announces it and publishes the manifest if requested. ctx bounds
+// only this setup; seeding continues in the background until Close is called.
+func (s *Seeder) Start(ctx context.Context) error {
+	if s.opts.Follow > 0 {
+		if s.opts.Gzipped {
+			return errors.New("a gzip file can't be followed")
+		}
+		if err := s.manifest.CheckGrowable(); err != nil {
+			return err
+		}
+	}
+	if err := s.open(); err != nil {
+		return err
+	}
+	if s.opts.VerifyOnStart {
+		if err := s.verify(); err != nil {
+			s.closer.Close()
+			return err
+		}
+	}
+	s.store = peer.NewFileStore()
+	var err error
+	if s.opts.ZeroCopy && s.f != nil && s.opts.Follow <= 0 {
+		// The store opens the file by path, which sendfile needs
+		err = s.store.Add(s.path, s.manifest)
+	} else {
+		err = s.store.AddReader(io.NewSectionReader(s.src, 0, s.manifest.FileSize), s.manifest.FileSize, s.manifest)
+	}
+	if err != nil {
+		s.closer.Close()
+		return err
+	}
+
+	ln, err := s.opts.Transport.Listen(":" + strconv.Itoa(DefaultSeederPort))
+	if err != nil {
+		s.store.Close()
+		s.closer.Close()
+		return err
+	}
+	s.ln = ln
+	s.served = make(chan error, 1)
+	s.gone = make(chan error, 1)
+	serverOpts := peer.ServerOptions{
+		Allow:         s.opts.Allow,
+		Deny:          s.opts.Deny,
+		OnChunkServed: s.chunkServed,
+		Stats:         s.stats,
+		ZeroCopy:      s.opts.ZeroCopy,
+		ServeManifest: s.opts.ServeManifest,
+		OnFileGone: func(_ string, err error) {
+			select {
+			case s.gone <- err:
+			default:
+			}
+		},
+	}
+	if s.manifest.AccessToken != "" {
+		serverOpts.AccessTokens = map[string]string{s.manifest.FileHash: s.manifest.AccessToken}
+	}
+	if s.opts.Events != nil {
+		serverOpts.OnConnect = func(remoteAddr string) {
+			s.opts.Events.Publish(Event{Type: EventPeerConnected, FileHash: s.manifest.FileHash, Peer: remoteAddr})
+		}
+	}
+	go func() { s.served <- peer.ServeStore(ln, s.store, serverOpts) }()
+
+	if s.opts.TrackerURL != "" {
+		if err := s.announce(ctx); err != nil {
+			s.ln.Close()
+			<-s.served
+			s.store.Close()
+			s.closer.Close()
+			return err
+		}
+	}
+	if s.opts.Follow > 0 {
+		followCtx, stop := context.WithCancel(context.Background())
+		s.stopFollow = stop
+		s.followed = make(chan struct{})
+		go s.follow(followCtx)
+	}
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	s.stopWatch = stopWatch
+	s.watched = make(chan struct{})
+	go s.watch(watchCtx)
+	return nil
+}
+
+// fileCheckInterval is how often a Seeder checks that its file is still
+// there, as described for SeederOptions.OnFileGone.
+const fileCheckInterval = 5 * time.Second
+
+// watch checks the file every fileCheckInterval until it is found gone, by
+// the check or by a chunk request, or ctx is done. A file that is gone stops
+// being served and is unannounced.
+func (s *Seeder) watch(ctx context.Context) {
+	defer close(s.watched)
+
+	ticker := time.NewTicker(fileCheckInterval)
+	defer ticker.Stop()
+	var reason error
+	for reason == nil {
+		select {
+		case <-ticker.C:
+			reason = s.checkFile()
+		case reason = <-s.gone:
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	s.store.Withdraw(s.manifest.FileHash, reason)
+	if s.stop != nil {
+		// Ends the re-announce loop, which unannounces the file
+		s.stop()
+	}
+	s.opts.Events.publishError(s.manifest.FileHash, "", reason)
+	if s.opts.OnFileGone != nil {
+		s.opts.OnFileGone(reason)
+	}
+}
+
+// checkFile returns an error wrapping ErrFileGone if the file at the seeder's
+// path was deleted, replaced by another file, or truncated below the content
+// being served.
+func (s *Seeder) checkFile() error {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %s was deleted", ErrFileGone, s.path)
+	}
+	if err != nil || s.f == nil {
+		// Directories and gzip files are only checked for existence
+		return nil
+	}
+	opened, err := s.f.Stat()
+	if err != nil {
+		return nil
+	}
+	if !os.SameFile(info, opened) {
+		return fmt.Errorf("%w: %s was replaced by another file", ErrFileGone, s.path)
+	}
+	shared, err := s.store.Get(s.manifest.FileHash)
+	if err != nil {
+		return nil
+	}
+	if need := s.manifest.RangeStart + shared.Manifest().FileSize; info.Size() < need {
+		return fmt.Errorf("%w: %s was truncated to %d bytes, %d are shared", ErrFileGone, s.path, info.Size(), need)
+	}
+	return nil
+}
+
+// follow re-scans the file every SeederOptions.Follow and shares the chunks
+// appended to it, until ctx is done.
+func (s *Seeder) follow(ctx context.Context) {
+	defer close(s.followed)
+
+	onError := func(err error) {
+		s.opts.Events.publishError(s.manifest.FileHash, "", err)
+		if s.opts.OnFollowError != nil {
+			s.opts.OnFollowError(err)
+		}
+	}
+	current := s.manifest
+	ticker := time.NewTicker(s.opts.Follow)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		info, err := s.f.Stat()
+		if err != nil {
+			onError(err)
+			continue
+		}
+		if info.Size() == current.FileSize {
+			continue
+		}
+		grown, err := current.Grow(s.f, info.Size())
+		if err == nil {
+			err = s.store.Grow(io.NewSectionReader(s.f, 0, grown.FileSize), grown.FileSize, grown)
+		}
+		if err != nil {
+			onError(err)
+			continue
+		}
+		current = grown
+	}
+}
+
+// open opens the file or directory to serve, checking that it still matches
+// the manifest's size.
+func (s *Seeder) open() error {
+	if s.manifest.IsDir() {
+		dir, err := file.OpenDir(s.path, s.manifest)
+		if err != nil {
+			return err
+		}
+		s.src, s.closer = dir, dir
+		return nil
+	}
+	if s.opts.Gzipped {
+		gz, err := file.OpenGzip(s.path)
+		if err != nil {
+			return err
+		}
+		if gz.Size() != s.manifest.FileSize {
+			gz.Close()
+			return fmt.Errorf("%s: decompressed content has %d bytes but the manifest describes %d", s.path, gz.Size(), s.manifest.FileSize)
+		}
+		s.src, s.closer = gz, gz
+		return nil
+	}
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	// Range manifests are served from their part of the file. A followed file
+	// may have grown already, which the first re-scan picks up.
+	size := info.Size()
+	if s.opts.Follow > 0 && size > s.manifest.FileSize {
+		size = s.manifest.FileSize
+	}
+	section, err := s.manifest.Section(f, size)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("%s: %v", s.path, err)
+	}
+	s.src, s.closer, s.f = section, f, f
+	return nil
+}
+
+// verify checks the opened file against the manifest as described for
+// SeederOptions.VerifyOnStart.
+func (s *Seeder) verify() error {
+	bad, err := file.VerifySample(s.src, s.manifest, s.opts.VerifySample)
+	if err != nil {
+		return fmt.Errorf("failed to verify %s: %v", s.path, err)
+	}
+	if len(bad) > 0 {
+		checked := len(s.manifest.Chunks)
+		if s.opts.VerifySample > 0 {
+			checked = min(checked, s.opts.VerifySample)
+		}
+		return fmt.Errorf("%w: %d of %d chunks checked in %s don't match the manifest, starting with chunk %d; refusing to serve it",
+			ErrContentChanged, len(bad), checked, s.path, bad[0])
+	}
+	return nil
+}
+
+// announce registers the file with the tracker and starts re-announcing it.
+func (s *Seeder) announce(ctx context.Context) error {
+	client := tracker.NewTrackerClient(s.opts.TrackerURL, s.opts.TrackerTimeout)
+	req := tracker.AnnounceRequest{
+		FileHash: s.manifest.FileHash,
+		Address:  s.opts.Address,
+		Port:     DefaultSeederPort,
+	}
+	if err := client.Announce(ctx, req); err != nil {
+		return err
+	}
+
+	// Publish the manifest so downloaders only need the file hash
+	if s.opts.PublishManifest {
+		if err := client.UploadManifest(ctx, s.manifest); err != nil {
+			client.Unannounce(context.Background(), req)
+			return err
+		}
+	}
+
+	// Keep the registration fresh until Close, which unannounces the file
+	loopCtx, stop := context.WithCancel(context.Background())
+	s.stop = stop
+	s.announced = make(chan error, 1)
+	onError := func(err error) {
+		s.opts.Events.publishError(s.manifest.FileHash, "", err)
+		if s.opts.OnAnnounceError != nil {
+			s.opts.OnAnnounceError(err)
+		}
+	}
+	go func() { s.announced <- client.KeepAnnounced(loopCtx, req, s.opts.AnnounceInterval, onError) }()
+	return nil
+}
+
+// Close stops serving the file and removes it from the tracker. It returns
+// the error from unannouncing, if any.
+func (s *Seeder) Close() error {
+	if s.ln == nil {
+		return errors.New("seeder not started")
+	}
+
+	if s.stopFollow != nil {
+		s.stopFollow()
+		<-s.followed
+		s.stopFollow = nil
+	}
+	if s.stopWatch != nil {
+		s.stopWatch()
+		<-s.watched
+		s.stopWatch = nil
+	}
+	var err error
+	if s.stop != nil {
+		s.stop()
+		err = <-s.announced
+	}
+	s.ln.Close()
+	<-s.served
+	s.store.Close()
+	s.closer.Close()
+	s.ln = nil
+	return err
+}
+
+// uploadCounter counts how many times each chunk of a file has been served, to
+// tell how many complete copies peers have received between them.
+type uploadCounter struct {
+	mu     sync.Mutex
+	served []int // Times each chunk has been served
+	copies int   // Complete copies served: the minimum of served
+	atMin  int   // Chunks served exactly copies times
+}
+
+func newUploadCounter(chunks int) *uploadCounter {
+	return &uploadCounter{served: make([]int, chunks), atMin: chunks}
+}
+
+// add records that chunk index was served. It returns the number of complete
+// copies if this completed one, or 0 otherwise.
+func (c *uploadCounter) add(index int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if index < 0 || index >= len(c.served) {
+		return 0
+	}
+	c.served[index]++
+	if c.served[index]-1 != c.copies {
+		return 0
+	}
+	if c.atMin--; c.atMin > 0 {
+		return 0
+	}
+
+	// Every chunk has now been served more than copies times
+	c.copies++
+	for _, n := range c.served {
+		if n == c.copies {
+			c.atMin++
+		}
+	}
+	return c.copies
+}
+
+// completed returns the number of complete copies served.
+func (c *uploadCounter) completed() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.copies
+}
@@ -0,0 +1,270 @@
+package goshare
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadCounter(t *testing.T) {
+	c := newUploadCounter(3)
+	for i, tc := range []struct {
+		index int
+		want  int // Copies completed by this chunk, or 0
+	}{
+		{0, 0}, {0, 0}, {2, 0}, {1, 1}, // One copy once every chunk is served
+		{2, 0}, {5, 0}, {1, 2}, // Out-of-range chunks don't count
+		{1, 0}, {1, 0}, {0, 0}, {2, 3},
+	} {
+		if got := c.add(tc.index); got != tc.want {
+			t.Fatalf("step %d: add(%d) returned %d, want %d", i, tc.index, got, tc.want)
+		}
+	}
+	if got := c.completed(); got != 3 {
+		t.Fatalf("completed returned %d, want 3", got)
+	}
+}
+
+func TestSeederMaxUploads(t *testing.T) {
+	tr := NewMemoryTransport()
+	content := bytes.Repeat([]byte("seeded twice "), 300)
+	path := filepath.Join(t.TempDir(), "shared.bin")
+	writeContent(t, path, content)
+	manifest, err := Upload(context.Background(), path, UploadOptions{ChunkSize: 1 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeder := NewSeeder(path, manifest, SeederOptions{Transport: tr, MaxUploads: 2})
+	if err := seeder.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer seeder.Close()
+
+	download := func() {
+		t.Helper()
+		_, err := Download(context.Background(), manifest, DownloadOptions{
+			OutputPath: filepath.Join(t.TempDir(), "out.bin"),
+			Peers:      []Peer{{Address: "localhost", Port: DefaultSeederPort}},
+			Transport:  tr,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The seeder counts a copy once it has sent its last chunk, which may be
+	// after the download has it
+	download()
+	deadline := time.Now().Add(5 * time.Second)
+	for seeder.Uploads() < 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := seeder.Uploads(); n != 1 {
+		t.Fatalf("seeder counts %d uploads after one download", n)
+	}
+	select {
+	case <-seeder.Done():
+		t.Fatal("Done closed after one of two uploads")
+	default:
+	}
+
+	download()
+	select {
+	case <-seeder.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Done still open after %d uploads", seeder.Uploads())
+	}
+}
+
+func TestSeederVerifyOnStart(t *testing.T) {
+	tr := NewMemoryTransport()
+	content := bytes.Repeat([]byte("checked before seeding "), 300)
+	path := filepath.Join(t.TempDir(), "shared.bin")
+	writeContent(t, path, content)
+	manifest, err := Upload(context.Background(), path, UploadOptions{ChunkSize: 1 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The file is damaged on disk without its size or manifest changing
+	corrupt := bytes.Clone(content)
+	corrupt[len(corrupt)/2] ^= 0xff
+	writeContent(t, path, corrupt)
+
+	for _, sample := range []int{0, len(manifest.Chunks)} {
+		seeder := NewSeeder(path, manifest, SeederOptions{Transport: tr, VerifyOnStart: true, VerifySample: sample})
+		if err := seeder.Start(context.Background()); !errors.Is(err, ErrContentChanged) {
+			seeder.Close()
+			t.Fatalf("sample %d: starting a seeder of a corrupt file returned %v, want ErrContentChanged", sample, err)
+		}
+		if conn, err := tr.Dial(context.Background(), "localhost:9000"); err == nil {
+			conn.Close()
+			t.Fatalf("sample %d: seeder that failed verification is listening", sample)
+		}
+	}
+
+	writeContent(t, path, content)
+	seeder := NewSeeder(path, manifest, SeederOptions{Transport: tr, VerifyOnStart: true})
+	if err := seeder.Start(context.Background()); err != nil {
+		t.Fatalf("starting a seeder of the intact file: %v", err)
+	}
+	seeder.Close()
+}
+
+func TestSeedGzipped(t *testing.T) {
+	tr := NewMemoryTransport()
+	content := bytes.Repeat([]byte("kept compressed on disk "), 500)
+	path := filepath.Join(t.TempDir(), "log.txt")
+	writeContent(t, path, content)
+	gzPath, err := CompressGzip(context.Background(), path, 1<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CompressGzip(context.Background(), path, 1<<10); !errors.Is(err, ErrFileExists) {
+		t.Fatalf("compressing again returned %v, want ErrFileExists", err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := Upload(context.Background(), gzPath, UploadOptions{ChunkSize: 1 << 10, Gzipped: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.FileName != "log.txt" || manifest.FileSize != int64(len(content)) {
+		t.Fatalf("manifest describes %s of %d bytes, want log.txt of %d", manifest.FileName, manifest.FileSize, len(content))
+	}
+	seeder := NewSeeder(gzPath, manifest, SeederOptions{Transport: tr, Gzipped: true})
+	if err := seeder.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer seeder.Close()
+
+	// Downloaders get the decompressed content
+	outputPath := filepath.Join(t.TempDir(), "log.txt")
+	_, err = Download(context.Background(), manifest, DownloadOptions{
+		OutputPath: outputPath,
+		Peers:      []Peer{{Address: "localhost", Port: DefaultSeederPort}},
+		Transport:  tr,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(outputPath); err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("downloaded %d bytes, %v; want the %d decompressed", len(got), err, len(content))
+	}
+
+	// A gzip file can't grow like a plain one
+	following := NewSeeder(gzPath, manifest, SeederOptions{Transport: NewMemoryTransport(), Gzipped: true, Follow: time.Second})
+	if err := following.Start(context.Background()); err == nil {
+		following.Close()
+		t.Fatal("seeder following a gzip file started")
+	}
+}
+
+func TestSeederStopsWhenFileGone(t *testing.T) {
+	tr := NewMemoryTransport()
+	trackerURL := startTracker(t)
+	content := bytes.Repeat([]byte("soon truncated "), 300)
+	path := filepath.Join(t.TempDir(), "shared.bin")
+	writeContent(t, path, content)
+	manifest, err := Upload(context.Background(), path, UploadOptions{ChunkSize: 1 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone := make(chan error, 1)
+	seeder := NewSeeder(path, manifest, SeederOptions{
+		Transport:  tr,
+		TrackerURL: trackerURL,
+		OnFileGone: func(err error) { gone <- err },
+	})
+	if err := seeder.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer seeder.Close()
+	if n, err := CountPeers(context.Background(), trackerURL, time.Second, manifest.FileHash); err != nil || n != 1 {
+		t.Fatalf("tracker counts %d peers, %v, want the seeder", n, err)
+	}
+
+	// A download finds the file cut short, which stops the seeder serving it
+	if err := os.Truncate(path, int64(len(content)/2)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = Download(context.Background(), manifest, DownloadOptions{
+		OutputPath: filepath.Join(t.TempDir(), "out.bin"),
+		Peers:      []Peer{{Address: "localhost", Port: DefaultSeederPort}},
+		Transport:  tr,
+	})
+	if err == nil {
+		t.Fatal("download of a truncated file succeeded")
+	}
+	select {
+	case err := <-gone:
+		if !errors.Is(err, ErrFileGone) {
+			t.Fatalf("OnFileGone called with %v, want ErrFileGone", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnFileGone wasn't called")
+	}
+
+	// The file is unannounced
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n, err := CountPeers(context.Background(), trackerURL, time.Second, manifest.FileHash)
+		if err == nil && n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("tracker still counts %d peers, %v, after the file was gone", n, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSeederCheckFile(t *testing.T) {
+	content := bytes.Repeat([]byte("checked file "), 300)
+	for _, tc := range []struct {
+		name   string
+		change func(path string) error
+		want   string
+	}{
+		{"unchanged", func(string) error { return nil }, ""},
+		{"grown", func(path string) error { return os.WriteFile(path, append(bytes.Clone(content), "more"...), 0644) }, ""},
+		{"deleted", os.Remove, "deleted"},
+		{"truncated", func(path string) error { return os.Truncate(path, 100) }, "truncated"},
+		{"replaced", func(path string) error {
+			other := path + ".new"
+			if err := os.WriteFile(other, content, 0644); err != nil {
+				return err
+			}
+			return os.Rename(other, path)
+		}, "replaced"},
+	} {
+		path := filepath.Join(t.TempDir(), "shared.bin")
+		writeContent(t, path, content)
+		manifest, err := Upload(context.Background(), path, UploadOptions{ChunkSize: 1 << 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		seeder := NewSeeder(path, manifest, SeederOptions{Transport: NewMemoryTransport()})
+		if err := seeder.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := tc.change(path); err != nil {
+			t.Fatal(err)
+		}
+		err = seeder.checkFile()
+		seeder.Close()
+		if tc.want == "" && err != nil {
+			t.Errorf("%s: check failed: %v", tc.name, err)
+		}
+		if tc.want != "" && (!errors.Is(err, ErrFileGone) || !strings.Contains(err.Error(), tc.want)) {
+			t.Errorf("%s: check returned %v, want ErrFileGone for a file %s", tc.name, err, tc.want)
+		}
+	}
+}
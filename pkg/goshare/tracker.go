@@ -0,0 +1,81 @@
+package goshare
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/timskillet/go-share/internal/tracker"
+)
+
+// TrackerOptions configures a Tracker. The zero value only keeps the peer registry.
+type TrackerOptions struct {
+	// StoreManifests lets seeders publish manifests so downloaders can fetch
+	// them by file hash.
+	StoreManifests bool
+	// AdminToken enables admin endpoints such as DELETE /peer for requests that
+	// send it as a bearer token.
+	AdminToken string
+	// PeerTTL, if positive, drops peers that haven't announced a file for
+	// this long, such as seeders that crashed without unannouncing. Seeders
+	// re-announce within it. DefaultPeerTTL suits seeders using the default
+	// announce interval.
+	PeerTTL time.Duration
+	// BasePath, if set, serves the endpoints under this path prefix, e.g.
+	// "/goshare" for a tracker reached as https://host/goshare through a
+	// reverse proxy that passes the path on unchanged. Seeders and
+	// downloaders are then given the tracker URL including the prefix.
+	BasePath string
+}
+
+// DefaultPeerTTL is a PeerTTL that keeps peers announcing at
+// DefaultAnnounceInterval listed even if two announces in a row fail.
+const DefaultPeerTTL = tracker.DefaultPeerTTL
+
+// DefaultAnnounceInterval is how often seeders re-announce files to trackers
+// that don't expire peers.
+const DefaultAnnounceInterval = tracker.DefaultAnnounceInterval
+
+// Tracker is a peer registry that seeders announce files to and downloaders
+// ask for peers. It is an http.Handler, so it can be mounted in an existing
+// server, or run on its own with ListenAndServe.
+type Tracker struct {
+	t       *tracker.Tracker
+	handler http.Handler
+}
+
+// NewTracker creates an empty tracker.
+func NewTracker(opts TrackerOptions) *Tracker {
+	t := tracker.NewTracker()
+	t.StoreManifests = opts.StoreManifests
+	t.AdminToken = opts.AdminToken
+	t.PeerTTL = opts.PeerTTL
+	t.BasePath = opts.BasePath
+	return &Tracker{t: t, handler: t.Handler()}
+}
+
+// ServeHTTP serves the tracker's HTTP endpoints.
+func (t *Tracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.handler.ServeHTTP(w, r)
+}
+
+// RemovePeer removes a peer from the registry for the file with the given hash,
+// or for every file if fileHash is empty. It returns the number of entries removed.
+func (t *Tracker) RemovePeer(fileHash, address string, port int) int {
+	return t.t.RemovePeer(fileHash, address, port)
+}
+
+// ListenAndServe serves the tracker on addr until ctx is done, then shuts the
+// server down gracefully.
+func (t *Tracker) ListenAndServe(ctx context.Context, addr string) error {
+	srv := &http.Server{Addr: addr, Handler: t}
+	stop := context.AfterFunc(ctx, func() { srv.Shutdown(context.Background()) })
+	defer stop()
+
+	err := srv.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,331 @@
+package goshare
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+// UploadOptions configures how Upload prepares a file.
+// The zero value uses fixed 1MB chunks and saves an uncompressed manifest.
+type UploadOptions struct {
+	// ChunkSize is the chunk size in bytes, or the target average chunk size with
+	// ChunkingCDC (default: DefaultChunkSize).
+	ChunkSize int64
+	// Chunking is the chunking strategy, ChunkingFixed or ChunkingCDC
+	// (default: ChunkingFixed).
+	Chunking string
+	// CompressManifest saves the manifest gzip-compressed as .manifest.gz.
+	CompressManifest bool
+	// Rehash always hashes the file again, even if an up-to-date manifest was
+	// saved by an earlier Upload.
+	Rehash bool
+	// Trackers are recorded in the manifest so that downloaders can find peers
+	// without being told a tracker URL.
+	Trackers []string
+	// AccessToken, if set, makes the file private: it is recorded in the
+	// manifest, and seeders of the manifest only serve the file to
+	// downloaders presenting the token, such as those given the manifest.
+	// It is left out of manifests published to trackers and peers, so share
+	// the token along with the file hash to let others download it.
+	AccessToken string
+	// RangeEnd, if positive, shares only the bytes from RangeStart up to
+	// RangeEnd of a file, e.g. to preview the start of a large video. The
+	// range gets its own manifest, named after the range as described for
+	// RangeManifestPath.
+	RangeStart int64
+	RangeEnd   int64
+	// HashKey, if set, hashes chunks and the file with HMAC-SHA256 under this
+	// group key, so that the file hash doesn't reveal what is shared to anyone
+	// without the key. Downloaders need the same key. Only ChunkingFixed is
+	// supported.
+	HashKey []byte
+	// Exclude lists patterns of entries to leave out when sharing a directory,
+	// such as ".git/", "node_modules/", or "*.tmp", in .gitignore syntax. They
+	// are matched against paths relative to the directory, and take precedence
+	// over the patterns of its IgnoreFile, which are always applied.
+	Exclude []string
+	// Gzipped shares the decompressed content of the gzip file at path, which
+	// stays compressed on disk, to save the seeder disk space. The manifest is
+	// named after the content, path's name without its .gz extension, and
+	// downloaders get the decompressed file. Seed it with
+	// SeederOptions.Gzipped. Only whole files with ChunkingFixed and without
+	// HashKey are supported. Files compressed by CompressGzip with the same
+	// chunk size are served much faster than those compressed by other tools.
+	Gzipped bool
+}
+
+// IgnoreFile is the name of the file in a shared directory listing patterns
+// of entries that Upload leaves out, as in a .gitignore file.
+const IgnoreFile = file.IgnoreFile
+
+// withDefaults returns a copy of the options with unset fields filled in.
+func (o UploadOptions) withDefaults() UploadOptions {
+	if o.ChunkSize <= 0 {
+		o.ChunkSize = DefaultChunkSize
+	}
+	if o.Chunking == "" {
+		o.Chunking = ChunkingFixed
+	}
+	return o
+}
+
+// ManifestPath returns where Upload saves the manifest for the file at path.
+func ManifestPath(path string, compressed bool) string {
+	if compressed {
+		return path + ".manifest.gz"
+	}
+	return path + ".manifest"
+}
+
+// RangeManifestPath returns where Upload saves the manifest for the bytes from
+// start to end of the file at path, e.g. movie.0-1048576.mp4.manifest.
+func RangeManifestPath(path string, start, end int64, compressed bool) string {
+	return ManifestPath(filepath.Join(filepath.Dir(path), file.RangeFileName(filepath.Base(path), start, end)), compressed)
+}
+
+// Upload prepares the file at path for sharing. It splits the file into chunks,
+// creates its manifest, and saves the manifest at ManifestPath next to the file.
+// If path is a directory, the concatenated content of its files is chunked, and
+// the manifest lists each file with its permissions, and each symlink, except
+// for the entries matching opts.Exclude or the directory's IgnoreFile. With
+// opts.RangeEnd, only a byte range of the file is shared.
+// If that manifest already exists, was created with the same chunking, and the
+// file hasn't changed since, it is reused without hashing the file again.
+// To make the file available to peers, start a Seeder with the returned manifest.
+// ctx is checked before hashing starts.
+func Upload(ctx context.Context, path string, opts UploadOptions) (*Manifest, error) {
+	opts = opts.withDefaults()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	path = filepath.Clean(path)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, tracker := range opts.Trackers {
+		if err := file.ValidateTrackerURL(tracker); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.HashKey != nil && opts.Chunking != ChunkingFixed {
+		return nil, fmt.Errorf("keyed hashing can only be used with %s chunking", ChunkingFixed)
+	}
+	if len(opts.Exclude) > 0 && !info.IsDir() {
+		return nil, fmt.Errorf("exclude patterns can only be used when sharing a directory")
+	}
+	if opts.Gzipped && (info.IsDir() || opts.RangeEnd > 0 || opts.HashKey != nil || opts.Chunking != ChunkingFixed) {
+		return nil, fmt.Errorf("only whole files with %s chunking and without a hash key can be shared from gzip files", ChunkingFixed)
+	}
+	if opts.RangeEnd > 0 {
+		if opts.HashKey != nil {
+			return nil, fmt.Errorf("ranges can't be shared with keyed hashing")
+		}
+		return uploadRange(path, info, opts)
+	}
+
+	// A directory's modification time doesn't reflect changes to its files, so
+	// its manifest is always created again
+	manifestPath := ManifestPath(path, opts.CompressManifest)
+	if !opts.Rehash && !info.IsDir() {
+		if manifest := cachedManifest(path, manifestPath, opts); manifest != nil {
+			if slices.Equal(manifest.Trackers, opts.Trackers) && manifest.AccessToken == opts.AccessToken {
+				return manifest, nil
+			}
+			// Only the trackers or token changed, so update them without rehashing
+			manifest.Trackers = opts.Trackers
+			manifest.AccessToken = opts.AccessToken
+			return manifest, saveManifest(manifest, path, opts)
+		}
+	}
+
+	// Create manifest for the file or directory
+	var manifest *Manifest
+	switch {
+	case opts.Gzipped:
+		manifest, err = file.CreateGzipManifest(path, opts.ChunkSize)
+	case opts.HashKey != nil && info.IsDir():
+		manifest, err = file.CreateKeyedDirManifest(path, opts.ChunkSize, opts.HashKey, opts.Exclude)
+	case opts.HashKey != nil:
+		manifest, err = file.CreateKeyedManifest(path, opts.ChunkSize, opts.HashKey)
+	case info.IsDir() && opts.Chunking != ChunkingFixed:
+		err = fmt.Errorf("directories can only be shared with %s chunking", ChunkingFixed)
+	case info.IsDir():
+		manifest, err = file.CreateDirManifestExcluding(path, opts.ChunkSize, opts.Exclude)
+	case opts.Chunking == ChunkingFixed:
+		manifest, err = file.CreateManifest(path, opts.ChunkSize)
+	case opts.Chunking == ChunkingCDC:
+		manifest, err = file.CreateManifestCDC(path, opts.ChunkSize)
+	default:
+		err = fmt.Errorf("unknown chunking strategy %q", opts.Chunking)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create manifest: %w", err)
+	}
+	manifest.Trackers = opts.Trackers
+	manifest.AccessToken = opts.AccessToken
+
+	if err := saveManifest(manifest, path, opts); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// CompressGzip gzip-compresses the file at path into path.gz, to be shared
+// from there with UploadOptions.Gzipped once the original is no longer
+// needed. A gzip member starts at every chunk of chunkSize bytes (default:
+// DefaultChunkSize), which must match the chunk size it is shared with, so
+// that each chunk can be decompressed on its own. It fails with ErrFileExists
+// if path.gz exists, and returns the path of the compressed file.
+func CompressGzip(ctx context.Context, path string, chunkSize int64) (string, error) {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	gzPath := path + file.GzipExt
+	dst, err := os.OpenFile(gzPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if errors.Is(err, os.ErrExist) {
+		return "", fmt.Errorf("%w: %s", ErrFileExists, gzPath)
+	}
+	if err != nil {
+		return "", err
+	}
+	// Don't leave a truncated gzip file behind
+	err = file.CompressGzip(dst, src, chunkSize)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(gzPath)
+		return "", fmt.Errorf("failed to compress %s: %w", path, err)
+	}
+	return gzPath, nil
+}
+
+// Rechunk creates a new manifest for the file or directory at path, which
+// manifest describes, using the chunk size and chunking of opts, e.g. to share
+// the same file in a swarm that uses larger chunks. The new manifest is saved
+// where Upload would save it, replacing any manifest there, so a later Upload
+// with the same options reuses it. The content is hashed again in a single
+// pass, and must still have manifest's file hash; otherwise the error wraps
+// ErrContentChanged. Trackers, access tokens, keyed hashing, and byte ranges are carried over
+// from manifest; keyed manifests need their key in opts.HashKey.
+// ctx is checked before hashing starts.
+func Rechunk(ctx context.Context, path string, manifest *Manifest, opts UploadOptions) (*Manifest, error) {
+	opts = opts.withDefaults()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if manifest.IsKeyed() && opts.HashKey != nil {
+		// Set the key on a copy, leaving the caller's manifest alone
+		keyed := *manifest
+		if err := keyed.SetHashKey(opts.HashKey); err != nil {
+			return nil, err
+		}
+		manifest = &keyed
+	}
+
+	path = filepath.Clean(path)
+	rechunked, err := file.Rechunk(path, manifest, opts.ChunkSize, opts.Chunking)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rechunk: %w", err)
+	}
+
+	// Ranges are saved under their own name, as by Upload
+	savePath := path
+	if rechunked.IsRange() {
+		savePath = filepath.Join(filepath.Dir(path), rechunked.FileName)
+	}
+	if err := saveManifest(rechunked, savePath, opts); err != nil {
+		return nil, err
+	}
+	return rechunked, nil
+}
+
+// uploadRange implements Upload for a byte range of the file at path. Ranges
+// are small, so their manifests are always created again.
+func uploadRange(path string, info os.FileInfo, opts UploadOptions) (*Manifest, error) {
+	if info.IsDir() {
+		return nil, fmt.Errorf("%s is a directory; only ranges of files can be shared", path)
+	}
+	if opts.Chunking != ChunkingFixed {
+		return nil, fmt.Errorf("ranges can only be shared with %s chunking", ChunkingFixed)
+	}
+	manifest, err := file.CreateRangeManifest(path, opts.ChunkSize, opts.RangeStart, opts.RangeEnd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create manifest: %w", err)
+	}
+	manifest.Trackers = opts.Trackers
+	manifest.AccessToken = opts.AccessToken
+
+	if err := saveManifest(manifest, filepath.Join(filepath.Dir(path), manifest.FileName), opts); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// saveManifest saves manifest next to the file at path, compressed if opts asks for it.
+func saveManifest(manifest *Manifest, path string, opts UploadOptions) error {
+	save := file.SaveManifest
+	if opts.CompressManifest {
+		save = file.SaveManifestCompressed
+	}
+	if err := save(manifest, path); err != nil {
+		return fmt.Errorf("failed to save manifest: %w", err)
+	}
+	return nil
+}
+
+// cachedManifest returns the manifest saved at manifestPath if it is still
+// current for the file at path and uses the chunking and hash key requested by opts.
+// It returns nil if the manifest has to be created again.
+func cachedManifest(path, manifestPath string, opts UploadOptions) *Manifest {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	manifest, err := file.LoadManifest(manifestPath)
+	if err != nil {
+		return nil
+	}
+	// The manifest of a gzip file's content must not be mistaken for one of
+	// the file itself, and vice versa
+	if opts.Gzipped && !manifest.IsCurrentGzip(info) || !opts.Gzipped && !manifest.IsCurrent(info) {
+		return nil
+	}
+
+	chunking := manifest.Chunking
+	if chunking == "" {
+		chunking = ChunkingFixed
+	}
+	if chunking != opts.Chunking || manifest.ChunkSize != opts.ChunkSize {
+		return nil
+	}
+
+	// The manifest must be keyed exactly when a key is given, and with that key
+	if opts.HashKey == nil {
+		if manifest.IsKeyed() {
+			return nil
+		}
+		return manifest
+	}
+	if !manifest.IsKeyed() || manifest.SetHashKey(opts.HashKey) != nil {
+		return nil
+	}
+	return manifest
+}
@@ -0,0 +1,69 @@
+package goshare
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/timskillet/go-share/internal/file"
+)
+
+func TestUploadReusesCurrentManifest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shared.txt")
+	if err := os.WriteFile(path, []byte("content to share across restarts"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := UploadOptions{ChunkSize: 8}
+	ctx := context.Background()
+	if _, err := Upload(ctx, path, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// Mark the saved manifest, so that its reuse can be told from rehashing
+	const marker = "application/x-cached"
+	saved, err := file.LoadManifest(ManifestPath(path, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved.ContentType = marker
+	if err := file.SaveManifest(saved, path); err != nil {
+		t.Fatal(err)
+	}
+	upload := func(opts UploadOptions) *Manifest {
+		t.Helper()
+		manifest, err := Upload(ctx, path, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return manifest
+	}
+
+	if m := upload(opts); m.ContentType != marker {
+		t.Fatal("unchanged file was hashed again instead of reusing its manifest")
+	}
+	if m := upload(UploadOptions{ChunkSize: 8, Rehash: true}); m.ContentType == marker {
+		t.Fatal("Rehash reused the saved manifest")
+	}
+
+	// Hashing again saved a fresh manifest; mark it once more
+	if err := file.SaveManifest(saved, path); err != nil {
+		t.Fatal(err)
+	}
+	if m := upload(UploadOptions{ChunkSize: 16}); m.ContentType == marker || m.ChunkSize != 16 {
+		t.Fatal("manifest with another chunk size was reused")
+	}
+
+	// A file modified since its manifest was saved is hashed again
+	if err := file.SaveManifest(saved, path); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if m := upload(opts); m.ContentType == marker || m.SourceModTime != later.UnixNano() {
+		t.Fatal("manifest of a modified file was reused")
+	}
+}
@@ -0,0 +1,47 @@
+package goshare
+
+import (
+	"context"
+
+	"github.com/timskillet/go-share/internal/peer"
+)
+
+// DefaultVerifySample is how many chunks VerifyPeers checks per peer by default.
+const DefaultVerifySample = peer.DefaultProbeSample
+
+// PeerReport is the result of checking a peer with VerifyPeers: the sampled
+// chunks it served correctly, those it got wrong, and why it couldn't be
+// checked in full, if it couldn't. OK reports whether it passed.
+type PeerReport = peer.ProbeReport
+
+// VerifyPeersOptions configures VerifyPeers. The zero value checks
+// DefaultVerifySample chunks per peer over TCP.
+type VerifyPeersOptions struct {
+	Transport Transport // Network used to reach peers (default: TCPTransport)
+	// Sample is how many randomly chosen chunks are fetched from each peer
+	// (default: DefaultVerifySample). Larger samples catch peers that corrupt
+	// only some chunks more reliably, at the cost of more traffic.
+	Sample int
+	// HashKey is the group key of a keyed manifest, needed to check its chunks.
+	HashKey []byte
+}
+
+// VerifyPeers checks that peers serve the file described by manifest
+// correctly, without downloading all of it: a random sample of chunks is
+// fetched from each peer and checked against the manifest's hashes. This
+// finds seeders that serve corrupt or forged data before a download relies on
+// them. The reports are returned in the order of peers.
+func VerifyPeers(ctx context.Context, manifest *Manifest, peers []Peer, opts VerifyPeersOptions) ([]*PeerReport, error) {
+	if opts.Transport == nil {
+		opts.Transport = TCPTransport{}
+	}
+	if manifest.IsKeyed() && opts.HashKey != nil {
+		// Set the key on a copy, leaving the caller's manifest alone
+		keyed := *manifest
+		if err := keyed.SetHashKey(opts.HashKey); err != nil {
+			return nil, err
+		}
+		manifest = &keyed
+	}
+	return peer.ProbePeers(ctx, opts.Transport, peers, manifest, opts.Sample)
+}